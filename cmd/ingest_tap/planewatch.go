@@ -1,7 +1,7 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog"
@@ -10,6 +10,7 @@ import (
 	"plane.watch/lib/nats_io"
 	"plane.watch/lib/randstr"
 	"plane.watch/lib/sink"
+	"plane.watch/lib/ws_client"
 	"plane.watch/lib/ws_protocol"
 	"sync"
 	"time"
@@ -25,7 +26,7 @@ type (
 
 	PlaneWatchTapper struct {
 		natsSvr       *nats_io.Server
-		wsLow, wsHigh *ws_protocol.WsClient
+		wsLow, wsHigh *ws_client.Client
 
 		exitChannels map[string]chan bool
 		taps         []tapHeaders
@@ -91,20 +92,20 @@ func (pw *PlaneWatchTapper) Connect(natsServer, wsServer string) error {
 		return err
 	}
 
-	pw.wsLow = ws_protocol.NewClient(
-		ws_protocol.WithSourceURL(wsServer),
-		ws_protocol.WithResponseHandler(pw.wsHandler(&pw.wsHandlersLow)),
-		ws_protocol.WithLogger(pw.logger.With().Str("ws", "low").Logger()),
+	pw.wsLow = ws_client.NewClient(wsServer,
+		ws_client.WithInsecure(),
+		ws_client.WithLogger(pw.logger.With().Str("ws", "low").Logger()),
 	)
-	if err = pw.wsLow.Connect(); err != nil {
+	pw.wsLow.OnResponse(pw.wsHandler(&pw.wsHandlersLow))
+	if err = pw.wsLow.Connect(context.Background()); err != nil {
 		return err
 	}
-	pw.wsHigh = ws_protocol.NewClient(
-		ws_protocol.WithSourceURL(wsServer),
-		ws_protocol.WithResponseHandler(pw.wsHandler(&pw.wsHandlersHigh)),
-		ws_protocol.WithLogger(pw.logger.With().Str("ws", "high").Logger()),
+	pw.wsHigh = ws_client.NewClient(wsServer,
+		ws_client.WithInsecure(),
+		ws_client.WithLogger(pw.logger.With().Str("ws", "high").Logger()),
 	)
-	return pw.wsHigh.Connect()
+	pw.wsHigh.OnResponse(pw.wsHandler(&pw.wsHandlersHigh))
+	return pw.wsHigh.Connect(context.Background())
 }
 
 func (pw *PlaneWatchTapper) Disconnect() {
@@ -115,10 +116,10 @@ func (pw *PlaneWatchTapper) Disconnect() {
 
 	// drains the incoming queues before closing all the things
 	pw.natsSvr.Close()
-	if err := pw.wsLow.Disconnect(); err != nil {
+	if err := pw.wsLow.Close(); err != nil {
 		pw.logger.Error().Err(err).Msg("Did not disconnect from websocket, low")
 	}
-	if err := pw.wsHigh.Disconnect(); err != nil {
+	if err := pw.wsHigh.Close(); err != nil {
 		pw.logger.Error().Err(err).Msg("Did not disconnect from websocket, high")
 	}
 
@@ -189,7 +190,7 @@ func (pw *PlaneWatchTapper) natsTap(icao, feederKey string, subject string, call
 			select {
 			case msg := <-ch:
 				var planeLocation export.PlaneLocation
-				err = json.Unmarshal(msg.Data, &planeLocation)
+				err = export.DecodePlaneLocation(msg.Header.Get(export.HeaderContentType), msg.Data, &planeLocation)
 				if nil != err {
 					pw.logger.Error().Err(err)
 					continue
@@ -228,11 +229,11 @@ func (pw *PlaneWatchTapper) AfterRouterHighTap(icao, feederKey string, callback
 
 func (pw *PlaneWatchTapper) WebSocketTapLow(icao, feederKey string, callback func(*export.PlaneLocation)) error {
 	pw.addWsFilterFunc(icao, feederKey, "low", callback)
-	return pw.wsLow.SubscribeAllLow()
+	return pw.wsLow.Subscribe(context.Background(), ws_protocol.GridTileAllLow)
 }
 func (pw *PlaneWatchTapper) WebSocketTapHigh(icao, feederKey string, callback func(*export.PlaneLocation)) error {
 	pw.addWsFilterFunc(icao, feederKey, "high", callback)
-	return pw.wsHigh.SubscribeAllHigh()
+	return pw.wsHigh.Subscribe(context.Background(), ws_protocol.GridTileAllHigh)
 }
 
 func (pw *PlaneWatchTapper) addWsFilterFunc(icao, feederKey, speed string, filter wsHandler) {
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nats-io/nats.go"
+	"plane.watch/lib/export"
+)
+
+type (
+	AirportApiHandler struct {
+		ApiHandler
+	}
+)
+
+func newAirportApi(idx int) *AirportApiHandler {
+	api := AirportApiHandler{
+		ApiHandler: ApiHandler{
+			idx:     idx,
+			name:    "airport",
+			subject: "v1.airport.*",
+		},
+	}
+	api.handler = api.airportHandler
+
+	return &api
+}
+
+func (aa *AirportApiHandler) airportHandler(msg *nats.Msg) {
+	tStart := time.Now()
+	defer func() {
+		d := time.Since(tStart)
+		prometheusCounterAirportSummary.Observe(float64(d.Microseconds()))
+	}()
+	prometheusCounterAirport.Inc()
+	aa.log.Info().
+		Str("subject", msg.Subject).
+		Msg("Airport Request")
+
+	var respondErr error
+
+	switch msg.Subject {
+	case export.NatsApiAirportListV1:
+		airports := make([]export.Airport, 0)
+		if respondErr = db.Select(&airports, "SELECT * FROM airports WHERE icao_code <> ''"); nil != respondErr {
+			break
+		}
+
+		var json = jsoniter.ConfigFastest
+		var response []byte
+		if response, respondErr = json.Marshal(&airports); nil != respondErr {
+			break
+		}
+		respondErr = msg.Respond(response)
+	default:
+		respondErr = msg.Respond([]byte(fmt.Sprintf(ErrUnsupportedResponse, msg.Subject)))
+	}
+
+	if nil != respondErr {
+		aa.log.Error().Err(respondErr).Msg("Failed sending reply")
+		_ = msg.Respond([]byte(fmt.Sprintf(ErrRequestFailed, respondErr)))
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/coverage"
+	"plane.watch/lib/export"
+	"plane.watch/lib/geo"
+	"plane.watch/lib/nats_io"
+)
+
+type (
+	CoverageApiHandler struct {
+		ApiHandler
+	}
+
+	dbFeederLocation struct {
+		ApiKey    string  `db:"api_key"`
+		Latitude  float64 `db:"latitude"`
+		Longitude float64 `db:"longitude"`
+	}
+)
+
+var (
+	// feederCoverage is the accumulated coverage of all feeders, fed by pw_ingest
+	feederCoverage = coverage.NewAccumulator()
+)
+
+func newCoverageApi(idx int) *CoverageApiHandler {
+	api := CoverageApiHandler{
+		ApiHandler: ApiHandler{
+			idx:     idx,
+			name:    "coverage",
+			subject: "v1.coverage.*",
+		},
+	}
+	api.handler = api.coverageHandler
+
+	return &api
+}
+
+// listenForCoverage accumulates the coverage updates pw_ingest sends us. Every instance keeps the full picture.
+func listenForCoverage(server *nats_io.Server) error {
+	ch, err := server.Subscribe(export.NatsCoverageUpdates)
+	if nil != err {
+		return err
+	}
+	go func() {
+		json := jsoniter.ConfigFastest
+		for msg := range ch {
+			var updates []coverage.Coverage
+			if err := json.Unmarshal(msg.Data, &updates); nil != err {
+				log.Error().Err(err).Msg("Failed to decode coverage update")
+				continue
+			}
+			for _, update := range updates {
+				if err := feederCoverage.Merge(update); nil != err {
+					log.Error().Err(err).Str("feeder", update.SourceTag).Msg("Failed to merge coverage")
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (ca *CoverageApiHandler) coverageHandler(msg *nats.Msg) {
+	tStart := time.Now()
+	defer func() {
+		d := time.Since(tStart)
+		prometheusCounterCoverageSummary.Observe(float64(d.Microseconds()))
+	}()
+	prometheusCounterCoverage.Inc()
+	what := strings.TrimSpace(string(msg.Data))
+	ca.log.Info().
+		Str("subject", msg.Subject).
+		Str("what", what).
+		Msg("coverage request")
+
+	var respondErr error
+	var buf []byte
+	json := jsoniter.ConfigFastest
+
+	switch msg.Subject {
+	case export.NatsApiCoverageFeederV1:
+		c, ok := feederCoverage.Get(what)
+		if !ok {
+			respondErr = msg.Respond([]byte("{}"))
+			break
+		}
+		fc := export.FeederCoverage{Coverage: c}
+		fc.ReferenceOffset, respondErr = ca.referenceOffset(&c)
+		if nil == respondErr {
+			buf, respondErr = json.Marshal(fc)
+		}
+		if nil == respondErr {
+			respondErr = msg.Respond(buf)
+		}
+
+	case export.NatsApiCoverageGeoJsonV1:
+		c, ok := feederCoverage.Get(what)
+		if !ok {
+			respondErr = msg.Respond([]byte(`{"type":"FeatureCollection","features":[]}`))
+			break
+		}
+		buf, respondErr = json.Marshal(c.FeatureCollection())
+		if nil == respondErr {
+			respondErr = msg.Respond(buf)
+		}
+
+	case export.NatsApiCoverageListV1:
+		locations := make([]dbFeederLocation, 0)
+		respondErr = db.Select(&locations, "SELECT api_key, latitude, longitude FROM feeders")
+		if nil != respondErr {
+			break
+		}
+		lookup := make(map[string]dbFeederLocation, len(locations))
+		for _, l := range locations {
+			lookup[l.ApiKey] = l
+		}
+
+		all := feederCoverage.Snapshot(false)
+		summaries := make([]export.FeederCoverageSummary, len(all))
+		for i, c := range all {
+			summaries[i] = export.FeederCoverageSummary{
+				SourceTag: c.SourceTag,
+				Count:     c.Count,
+				Rejected:  c.Rejected,
+				MaxRange:  c.MaxRange,
+				LastSeen:  c.LastSeen,
+			}
+			if l, ok := lookup[c.SourceTag]; ok {
+				offset := geo.Distance(l.Latitude, l.Longitude, c.RefLat, c.RefLon)
+				summaries[i].ReferenceOffset = &offset
+			}
+		}
+		buf, respondErr = json.Marshal(summaries)
+		if nil == respondErr {
+			respondErr = msg.Respond(buf)
+		}
+
+	default:
+		respondErr = msg.Respond([]byte(fmt.Sprintf(ErrUnsupportedResponse, msg.Subject)))
+	}
+
+	if nil != respondErr {
+		ca.log.Error().Err(respondErr).Msg("Failed sending reply")
+		_ = msg.Respond([]byte(fmt.Sprintf(ErrRequestFailed, respondErr)))
+	}
+}
+
+// referenceOffset figures out how far the feeders registered location is from the reference location they decode with
+func (ca *CoverageApiHandler) referenceOffset(c *coverage.Coverage) (*float64, error) {
+	var l dbFeederLocation
+	err := db.Get(&l, "SELECT api_key, latitude, longitude FROM feeders WHERE api_key::text = $1", c.SourceTag)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if nil != err {
+		return nil, err
+	}
+	offset := geo.Distance(l.Latitude, l.Longitude, c.RefLat, c.RefLon)
+	return &offset, nil
+}
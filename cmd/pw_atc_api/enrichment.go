@@ -95,26 +95,7 @@ func (sa *EnrichmentApiHandler) enrichHandler(msg *nats.Msg) {
 		respondErr = db.Get(&route, "SELECT id,operator_id,callsign from routes WHERE callsign = $1 LIMIT 1", callSign)
 		if nil == respondErr {
 			// we have a route!
-			response.Route.CallSign = route.CallSign
-
-			operator := DbOperator{}
-			if err := db.Get(&operator, "SELECT name FROM operators WHERE id = $1", route.OperatorId); nil != err {
-				sa.log.Error().Err(err).Send()
-			}
-			response.Route.Operator = operator.Name
-
-			var segments []DbRouteSegments
-			var routeStr string
-			_ = db.Select(&segments, `SELECT a.name,a.icao_code FROM route_segments rs left join airports a on a.id = rs.airport_id  WHERE route_id=$1 order by rs."order"`, route.Id)
-			for _, segment := range segments {
-				routeStr += segment.IcaoCode + "-"
-				response.Route.Segments = append(response.Route.Segments, export.Segment{
-					Name:     segment.Name,
-					ICAOCode: segment.IcaoCode,
-				})
-			}
-			routeStr = strings.Trim(routeStr, "-")
-			response.Route.RouteCode = &routeStr
+			response.Route = sa.loadRoute(route)
 		} else {
 			sa.log.Error().Err(respondErr).Str("call sign", callSign).Msg("Failed to enrich route")
 		}
@@ -138,3 +119,28 @@ func (sa *EnrichmentApiHandler) enrichHandler(msg *nats.Msg) {
 		_ = msg.Respond([]byte(fmt.Sprintf(ErrRequestFailed, respondErr)))
 	}
 }
+
+// loadRoute fills in who flies a route we found, and where it goes
+func (a *ApiHandler) loadRoute(route DbRoute) export.Route {
+	response := export.Route{CallSign: route.CallSign}
+
+	operator := DbOperator{}
+	if err := db.Get(&operator, "SELECT name FROM operators WHERE id = $1", route.OperatorId); nil != err {
+		a.log.Error().Err(err).Send()
+	}
+	response.Operator = operator.Name
+
+	var segments []DbRouteSegments
+	var routeStr string
+	_ = db.Select(&segments, `SELECT a.name,a.icao_code FROM route_segments rs left join airports a on a.id = rs.airport_id  WHERE route_id=$1 order by rs."order"`, route.Id)
+	for _, segment := range segments {
+		routeStr += segment.IcaoCode + "-"
+		response.Segments = append(response.Segments, export.Segment{
+			Name:     segment.Name,
+			ICAOCode: segment.IcaoCode,
+		})
+	}
+	routeStr = strings.Trim(routeStr, "-")
+	response.RouteCode = &routeStr
+	return response
+}
@@ -56,6 +56,26 @@ var (
 		Help: "A Summary of the feeder request times in milliseconds",
 	})
 
+	prometheusCounterCoverage = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pw_atc_api_coverage_count",
+		Help: "The number of requests for feeder coverage",
+	})
+
+	prometheusCounterCoverageSummary = promauto.NewSummary(prometheus.SummaryOpts{
+		Name: "pw_atc_api_coverage_summary",
+		Help: "A Summary of the coverage request times in milliseconds",
+	})
+
+	prometheusCounterAirport = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pw_atc_api_airport_count",
+		Help: "The number of requests for airport lists",
+	})
+
+	prometheusCounterAirportSummary = promauto.NewSummary(prometheus.SummaryOpts{
+		Name: "pw_atc_api_airport_summary",
+		Help: "A Summary of the airport request times in milliseconds",
+	})
+
 	ErrUnsupportedResponse = `{"error":"Unsupported Request","Type":"%s"}`
 	ErrRequestFailed       = `{"error":"Something went wrong with the request","Type":"%s"}`
 )
@@ -254,17 +274,23 @@ func run(c *cli.Context) error {
 
 	server, err := nats_io.NewServer(
 		nats_io.WithServer(c.String("nats"), "pw_atc_api"),
-		nats_io.WithConnections(false, true),
+		nats_io.WithConnections(true, true),
 	)
 	if nil != err {
 		return err
 	}
 
+	if err = listenForCoverage(server); nil != err {
+		return err
+	}
+
 	numWorkers := c.Int("num-workers")
 	for i := 0; i < numWorkers; i++ {
 		go newSearchApi(i).configure(server).listen()
 		go newEnrichmentApi(i).configure(server).listen()
 		go newFeederApi(i).configure(server).listen()
+		go newCoverageApi(i).configure(server).listen()
+		go newAirportApi(i).configure(server).listen()
 	}
 
 	hc := health{}
@@ -5,9 +5,13 @@ import (
 	jsoniter "github.com/json-iterator/go"
 	"github.com/nats-io/nats.go"
 	"plane.watch/lib/export"
+	"strings"
 	"time"
 )
 
+// searchMinLength is the shortest query we search routes and operators with
+const searchMinLength = 2
+
 type (
 	SearchApiHandler struct {
 		ApiHandler
@@ -69,7 +73,48 @@ func (sa *SearchApiHandler) searchHandler(msg *nats.Msg) {
 
 		respondErr = msg.Respond(response)
 	case export.NatsApiSearchRouteV1:
-		respondErr = msg.Respond([]byte("unimplemented"))
+		// routes by callsign, or that fly to an airport (by icao or iata code)
+		query := strings.ToUpper(strings.TrimSpace(string(msg.Data)))
+		routes := make([]export.Route, 0)
+		if len(query) >= searchMinLength {
+			var found []DbRoute
+			if err := db.Select(
+				&found,
+				`SELECT r.id, r.operator_id, r.callsign FROM routes r
+				WHERE r.callsign LIKE $1 OR r.id IN (
+					SELECT rs.route_id FROM route_segments rs JOIN airports a ON a.id = rs.airport_id
+					WHERE a.icao_code = $2 OR a.iata_code = $2
+				)
+				ORDER BY r.callsign = $2 DESC, r.callsign LIMIT 10`,
+				query+"%",
+				query,
+			); nil != err {
+				sa.log.Error().Err(err).Msg("Failed to search for routes")
+				respondErr = err
+				break
+			}
+			for _, route := range found {
+				routes = append(routes, sa.loadRoute(route))
+			}
+		}
+		respondErr = sa.respond(msg, routes)
+	case export.NatsApiSearchOperatorV1:
+		query := strings.TrimSpace(string(msg.Data))
+		operators := make([]export.Operator, 0)
+		if len(query) >= searchMinLength {
+			if err := db.Select(
+				&operators,
+				`SELECT COALESCE(icao_code, '') AS icao_code, COALESCE(iata_code, '') AS iata_code, COALESCE(name, '') AS name
+				FROM operators WHERE name ILIKE $1 OR icao_code ILIKE $2 OR iata_code ILIKE $2 ORDER BY name LIMIT 10`,
+				"%"+query+"%",
+				query,
+			); nil != err {
+				sa.log.Error().Err(err).Msg("Failed to search for operators")
+				respondErr = err
+				break
+			}
+		}
+		respondErr = sa.respond(msg, operators)
 	default:
 		respondErr = msg.Respond([]byte(fmt.Sprintf(ErrUnsupportedResponse, msg.Subject)))
 	}
@@ -79,3 +124,13 @@ func (sa *SearchApiHandler) searchHandler(msg *nats.Msg) {
 		_ = msg.Respond([]byte(fmt.Sprintf(ErrRequestFailed, respondErr)))
 	}
 }
+
+// respond sends what we found as json
+func (sa *SearchApiHandler) respond(msg *nats.Msg, found any) error {
+	var json = jsoniter.ConfigFastest
+	response, err := json.Marshal(found)
+	if nil != err {
+		return err
+	}
+	return msg.Respond(response)
+}
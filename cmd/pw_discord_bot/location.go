@@ -128,7 +128,7 @@ func addAlertLocation(discordUserId, discordUserName, locationName string, lat,
 		Lat:             lat,
 		Lon:             lon,
 		AlertConfig:     standardAlerts,
-		TileGrid:        tile_grid.LookupTile(lat, lon),
+		TileGrid:        tile_grid.LookupTile(lat, lon).Tile,
 	}
 	alertLocations = append(alertLocations, loc)
 	alertLocationsRWLock.Unlock()
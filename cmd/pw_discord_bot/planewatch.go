@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"github.com/rs/zerolog"
 	"math/rand"
 	"plane.watch/lib/export"
 	"plane.watch/lib/ws_client"
+	"plane.watch/lib/ws_protocol"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,57 +19,69 @@ type (
 
 		handleUpdate func(planeLocation *export.PlaneLocation)
 
-		exiting bool
+		exiting atomic.Bool
 	}
 )
 
-// contains interactions with plane.watch to get the location info
+// contains interactions with plane.watch to get the location info.
+// once connected, the client reconnects and resubscribes by itself
 func (wsc *pwWsClient) handleWebsocketClient(host string, insecure bool) {
-	wsc.wsClient = ws_client.NewClient(host)
-	if insecure {
-		wsc.wsClient.Secure(insecure)
-	}
-	backoff := 1
-
 	if nil == wsc.handleUpdate {
 		panic("You need to specify the handleUpdate method")
 	}
 
-	for {
-		if wsc.exiting {
-			return
-		}
+	url := "wss://" + host + "/planes"
+	if insecure {
+		url = "ws://" + host + "/planes"
+	}
+	wsc.wsClient = ws_client.NewClient(url, ws_client.WithLogger(wsc.wsLog))
+	wsc.wsClient.OnLocation(wsc.handleUpdate)
+	wsc.wsClient.OnDisconnect(func(err error) {
+		wsc.wsLog.Warn().Err(err).Msg("Lost our websocket, reconnecting...")
+	})
+
+	ctx := context.Background()
+	backoff := 1
+	for !wsc.exiting.Load() {
 		wsc.wsLog.Info().Str("host", host).Bool("secure", !insecure).Msg("Connecting...")
-		if err := wsc.wsClient.Connect(); nil != err {
+		if err := wsc.wsClient.Connect(ctx); nil != err {
 			wsc.wsLog.Error().Err(err).Int("backoff seconds", backoff).Msg("Cannot connect to websocket")
-			time.Sleep(time.Duration(backoff) * time.Second)
-
-			backoff = backoff + backoff + (rand.Intn(10) - 2)
-			if backoff > 30 {
-				backoff = 30
-			}
+			backoff = wsc.wait(backoff)
 			continue
-		} else {
-			backoff = 1
 		}
+		break
+	}
 
-		if err := wsc.wsClient.Subscribe("all_high"); nil != err {
-			wsc.wsLog.Error().Err(err).Msg("Unable to subscribe to all_high feed")
-			if err := wsc.wsClient.Disconnect(); nil != err {
-				wsc.wsLog.Error().Err(err).Msg("Did not disconnect gracefully after subscribe fail")
-			}
-			continue
+	// the client only asks for the feed again after a reconnect once the broker has agreed to it, so keep asking
+	backoff = 1
+	for !wsc.exiting.Load() {
+		err := wsc.wsClient.Subscribe(ctx, ws_protocol.GridTileAllHigh)
+		if nil == err {
+			return
 		}
+		wsc.wsLog.Error().Err(err).Int("backoff seconds", backoff).Msg("Unable to subscribe to all_high feed")
+		backoff = wsc.wait(backoff)
+	}
+}
 
-		for update := range wsc.wsClient.LocationUpdates() {
-			//wsc.wsLog.Debug().Msgf("update: %+v", update)
-			wsc.handleUpdate(update)
-		}
+// wait backs off for a while, and gives how long to back off for next time
+func (wsc *pwWsClient) wait(backoff int) int {
+	time.Sleep(time.Duration(backoff) * time.Second)
+
+	backoff = backoff + backoff + (rand.Intn(10) - 2)
+	if backoff > 30 {
+		backoff = 30
 	}
+	return backoff
 }
 
 func (wsc *pwWsClient) stop() error {
-	// todo: better handle closing
-	wsc.exiting = true
-	return wsc.wsClient.Disconnect()
+	wsc.exiting.Store(true)
+	if nil == wsc.wsClient {
+		return nil
+	}
+	if err := wsc.wsClient.Close(); nil != err && !errors.Is(err, ws_client.ErrNotConnected) {
+		return err
+	}
+	return nil
 }
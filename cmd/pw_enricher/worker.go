@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/enrich"
+	"plane.watch/lib/export"
+	"plane.watch/lib/nats_io"
+	"plane.watch/lib/partition"
+)
+
+type (
+	worker struct {
+		server         *nats_io.Server
+		enricher       *enrich.Enricher
+		destRoutingKey string
+		// contentType is the wire format we publish enriched updates in
+		contentType string
+		// partitions splits our output by icao for a partitioned pw_router, 0 to not split
+		partitions int
+	}
+)
+
+func (w *worker) run(ctx context.Context, ch <-chan *nats.Msg) {
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				log.Error().Msg("Worker ending due to error.")
+				return
+			}
+			if err := w.handleMsg(msg); nil != err {
+				log.Error().Err(err).Send()
+			}
+		case <-ctx.Done():
+			log.Debug().Msg("Ending Worker")
+			return
+		}
+	}
+}
+
+func (w *worker) handleMsg(msg *nats.Msg) error {
+	update := export.PlaneLocation{}
+	if err := export.DecodePlaneLocation(msg.Header.Get(export.HeaderContentType), msg.Data, &update); nil != err {
+		updatesError.Inc()
+		return err
+	}
+	updatesProcessed.Inc()
+
+	// removed aircraft need no enrichment, send them straight through
+	if !update.Removed {
+		w.enricher.Enrich(&update)
+	}
+
+	out, err := update.Encode(w.contentType)
+	if nil != err {
+		updatesError.Inc()
+		return err
+	}
+	if err = w.publish(partition.SubjectFor(w.destRoutingKey, update.Icao, w.partitions), out); nil != err {
+		updatesError.Inc()
+		return err
+	}
+	updatesPublished.Inc()
+	return nil
+}
+
+// publish sends JSON without a header, as we always have, and anything else with its content-type
+func (w *worker) publish(subject string, msg []byte) error {
+	if "" == w.contentType || export.ContentTypeJSON == w.contentType {
+		return w.server.Publish(subject, msg)
+	}
+	return w.server.PublishWithHeaders(subject, msg, map[string]string{export.HeaderContentType: w.contentType})
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/coverage"
+	"plane.watch/lib/nats_io"
+	"plane.watch/lib/tracker"
+)
+
+// coverageObserver feeds every decoded position into our coverage accumulator, for sources that know where they are
+func coverageObserver(acc *coverage.Accumulator) tracker.PositionObserver {
+	return func(source *tracker.FrameSource, p *tracker.Plane) {
+		if nil == source || nil == source.RefLat || nil == source.RefLon || "" == source.Tag {
+			return
+		}
+		acc.Add(source.Tag, *source.RefLat, *source.RefLon, p.Lat(), p.Lon(), p.Altitude(), p.OnGround(), p.LocationUpdatedAt())
+	}
+}
+
+// publishCoverage periodically sends what we have gathered since last time, pw_atc_api does the aggregating
+func publishCoverage(acc *coverage.Accumulator, ns *nats_io.Server, subject string, interval time.Duration) {
+	json := jsoniter.ConfigFastest
+	for range time.Tick(interval) {
+		snapshot := acc.Snapshot(true)
+		if 0 == len(snapshot) {
+			continue
+		}
+		buf, err := json.Marshal(snapshot)
+		if nil != err {
+			log.Error().Err(err).Msg("Failed to encode coverage")
+			continue
+		}
+		if err = ns.Publish(subject, buf); nil != err {
+			log.Error().Err(err).Str("subject", subject).Msg("Failed to publish coverage")
+		}
+	}
+}
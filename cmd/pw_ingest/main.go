@@ -6,8 +6,10 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
 	"os"
+	"plane.watch/lib/coverage"
 	"plane.watch/lib/dedupe"
 	"plane.watch/lib/example_finder"
+	"plane.watch/lib/export"
 	"plane.watch/lib/logging"
 	"plane.watch/lib/middleware"
 	"plane.watch/lib/monitoring"
@@ -15,12 +17,15 @@ import (
 	"plane.watch/lib/setup"
 	"plane.watch/lib/sink"
 	"plane.watch/lib/tracker"
+	"time"
 )
 
 const (
 	DedupeFilter       = "dedupe-filter"
 	FilterLocationOnly = "locations-only"
 	FilterIcao         = "icao"
+	CoverageSubject    = "coverage-subject"
+	CoverageInterval   = "coverage-interval"
 )
 
 var (
@@ -88,6 +93,16 @@ func main() {
 		Name:    DedupeFilter,
 		Usage:   "Include the usage of the ADSB Message Deduplication Filter. Useful for combo feeds",
 		EnvVars: []string{"DEDUPE"},
+	}, &cli.StringFlag{
+		Name:    CoverageSubject,
+		Usage:   "Publish per feeder receiver coverage to this subject (nats sink only). Empty to disable.",
+		Value:   export.NatsCoverageUpdates,
+		EnvVars: []string{"COVERAGE_SUBJECT"},
+	}, &cli.DurationFlag{
+		Name:    CoverageInterval,
+		Usage:   "How often to publish receiver coverage.",
+		Value:   time.Minute,
+		EnvVars: []string{"COVERAGE_INTERVAL"},
 	})
 
 	app.Before = func(c *cli.Context) error {
@@ -109,24 +124,32 @@ func commonSetup(c *cli.Context) (*tracker.Tracker, error) {
 		return nil, err
 	}
 
+	sinkDest, err := setup.HandleSinkFlag(c, "pw_ingest")
+	if nil != err {
+		return nil, err
+	}
+	var ns *nats_io.Server
+	if sinkType, ok := sinkDest.(*sink.Sink); ok {
+		ns, _ = sinkType.Server().(*nats_io.Server)
+	}
+
 	trackerOpts := make([]tracker.Option, 0)
 	trackerOpts = append(trackerOpts, tracker.WithPrometheusCounters(prometheusGaugeCurrentPlanes, prometheusCounterFramesDecoded))
+	if subject := c.String(CoverageSubject); nil != ns && "" != subject {
+		acc := coverage.NewAccumulator()
+		trackerOpts = append(trackerOpts, tracker.WithPositionObserver(coverageObserver(acc)))
+		go publishCoverage(acc, ns, subject, c.Duration(CoverageInterval))
+	}
 	trk := tracker.NewTracker(trackerOpts...)
 
 	if c.Bool(DedupeFilter) {
 		trk.AddMiddleware(dedupe.NewFilter(dedupe.WithDedupeCounter(prometheusOutputFrameDedupe)))
 		// trk.AddMiddleware(dedupe.NewFilterBTree(dedupe.WithDedupeCounterBTree(prometheusOutputFrameDedupe), dedupe.WithBtreeDegree(16)))
 	}
-	sinkDest, err := setup.HandleSinkFlag(c, "pw_ingest")
-	if nil != err {
-		return nil, err
-	}
 	trk.SetSink(sinkDest)
 
-	if sinkType, ok := sinkDest.(*sink.Sink); ok {
-		if ns, ok := sinkType.Server().(*nats_io.Server); ok {
-			trk.AddMiddleware(middleware.NewIngestTap(ns))
-		}
+	if nil != ns {
+		trk.AddMiddleware(middleware.NewIngestTap(ns))
 	}
 
 	for _, p := range producers {
@@ -4,25 +4,25 @@ import (
 	"github.com/paulmach/orb"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/exp/maps"
 	"plane.watch/lib/clickhouse"
 	"plane.watch/lib/export"
+	"plane.watch/lib/flights"
 	"strconv"
 	"time"
 )
 
 type (
 	DataStream struct {
-		low, high chan *export.PlaneLocation
-		chs       *clickhouse.Server
+		low, high *clickhouse.Writer[chRow]
+		flights   *clickhouse.Writer[flightRow]
 		log       zerolog.Logger
 	}
 
+	// chRow is a row in location_updates_low and location_updates_high, see lib/clickhouse/migrations
 	chRow struct {
 		Icao            string
+		FlightId        string
 		LatLon          orb.Point
-		Lat             float64
-		Lon             float64
 		Heading         float64
 		Velocity        float64
 		Altitude        int32
@@ -53,94 +53,119 @@ type (
 	}
 )
 
-func NewDataStreams(chs *clickhouse.Server) *DataStream {
+// NewDataStreams writes our location updates and flights to clickhouse, through durable writers that share opts
+func NewDataStreams(chs *clickhouse.Server, opts ...clickhouse.WriterOption) (*DataStream, error) {
 	ds := &DataStream{
-		low:  make(chan *export.PlaneLocation, 1000),
-		high: make(chan *export.PlaneLocation, 2000),
-		chs:  chs,
-		log:  log.With().Str("section", "ch data stream").Logger(),
+		log: log.With().Str("section", "ch data stream").Logger(),
 	}
-	go ds.handleQueue(ds.low, "location_updates_low")
-	go ds.handleQueue(ds.high, "location_updates_high")
-
-	return ds
+	var err error
+	if ds.low, err = clickhouse.NewWriter[chRow](chs, "location_updates_low", opts...); nil != err {
+		return nil, err
+	}
+	if ds.high, err = clickhouse.NewWriter[chRow](chs, "location_updates_high", opts...); nil != err {
+		return nil, err
+	}
+	// flights trickle in, there is no point in sending them every second
+	flightOpts := append(append([]clickhouse.WriterOption{}, opts...), clickhouse.WithBatch(5_000, 10*time.Second))
+	if ds.flights, err = clickhouse.NewWriter[flightRow](chs, "flights", flightOpts...); nil != err {
+		return nil, err
+	}
+	return ds, nil
 }
 
 func (ds *DataStream) AddLow(frame *export.PlaneLocation) {
 	if "repeat" != frame.SourceTag {
-		ds.low <- frame
+		ds.low.Add(newChRow(frame))
 	}
 }
 
 func (ds *DataStream) AddHigh(frame *export.PlaneLocation) {
 	if "repeat" != frame.SourceTag {
-		ds.high <- frame
+		ds.high.Add(newChRow(frame))
 	}
 }
 
-// handleQueue single threadedly accumulates and sends data to clickhouse for the given queue/table
-func (ds *DataStream) handleQueue(q chan *export.PlaneLocation, table string) {
-	ticker := time.NewTicker(time.Second)
-	maxNumItems := 50_000
-	updates := make([]any, maxNumItems)
-	updateId := 0
-	unPtr := func(s *string) string {
-		if nil == s {
-			return ""
-		}
-		return *s
+// Close writes (or spools) everything we still have queued
+func (ds *DataStream) Close() {
+	ds.low.Close()
+	ds.high.Close()
+	ds.flights.Close()
+}
+
+func unPtr(s *string) string {
+	if nil == s {
+		return ""
 	}
-	send := func() {
-		ds.log.Debug().Int("num", updateId).Msg("Sending Batch To Clickhouse")
-		if err := ds.chs.Inserts(table, updates, updateId); nil != err {
-			ds.log.Err(err).Msg("Did not save location update to clickhouse")
-		}
-		updateId = 0
+	return *s
+}
+
+func newChRow(loc *export.PlaneLocation) *chRow {
+	squawk, _ := strconv.ParseUint(loc.Squawk, 10, 32)
+	return &chRow{
+		Icao:            loc.Icao,
+		FlightId:        loc.FlightId,
+		LatLon:          orb.Point{loc.Lat, loc.Lon},
+		Heading:         loc.Heading,
+		Velocity:        loc.Velocity,
+		Altitude:        int32(loc.Altitude),
+		VerticalRate:    int32(loc.VerticalRate),
+		AltitudeUnits:   loc.AltitudeUnits,
+		CallSign:        unPtr(loc.CallSign),
+		FlightStatus:    loc.FlightStatus,
+		OnGround:        loc.OnGround,
+		Airframe:        loc.Airframe,
+		AirframeType:    loc.AirframeType,
+		HasLocation:     loc.HasLocation,
+		HasHeading:      loc.HasHeading,
+		HasVerticalRate: loc.HasVerticalRate,
+		HasVelocity:     loc.HasVelocity,
+		SourceTags:      loc.PrepareSourceTags(make(map[string]uint32, 5)),
+		Squawk:          uint32(squawk),
+		Special:         loc.Special,
+		TrackedSince:    loc.TrackedSince.UTC(),
+		LastMsg:         loc.LastMsg.UTC(),
+		FlagCode:        unPtr(loc.FlagCode),
+		Operator:        unPtr(loc.Operator),
+		RegisteredOwner: unPtr(loc.RegisteredOwner),
+		Registration:    unPtr(loc.Registration),
+		RouteCode:       unPtr(loc.RouteCode),
+		Serial:          unPtr(loc.Serial),
+		TileLocation:    loc.TileLocation,
+		TypeCode:        unPtr(loc.TypeCode),
 	}
-	tags := make(map[string]uint32, 5)
-	for {
-		select {
-		case <-ticker.C:
-			send()
-		case loc := <-q:
-			maps.Clear(tags)
-			squawk, _ := strconv.ParseUint(loc.Squawk, 10, 32)
-			updates[updateId] = &chRow{
-				Icao:            loc.Icao,
-				LatLon:          orb.Point{loc.Lat, loc.Lon},
-				Heading:         loc.Heading,
-				Velocity:        loc.Velocity,
-				Altitude:        int32(loc.Altitude),
-				VerticalRate:    int32(loc.VerticalRate),
-				AltitudeUnits:   loc.AltitudeUnits,
-				CallSign:        unPtr(loc.CallSign),
-				FlightStatus:    loc.FlightStatus,
-				OnGround:        loc.OnGround,
-				Airframe:        loc.Airframe,
-				AirframeType:    loc.AirframeType,
-				HasLocation:     loc.HasLocation,
-				HasHeading:      loc.HasHeading,
-				HasVerticalRate: loc.HasVerticalRate,
-				HasVelocity:     loc.HasVelocity,
-				SourceTags:      loc.PrepareSourceTags(tags),
-				Squawk:          uint32(squawk),
-				Special:         loc.Special,
-				TrackedSince:    loc.TrackedSince.UTC(),
-				LastMsg:         loc.LastMsg.UTC(),
-				FlagCode:        unPtr(loc.FlagCode),
-				Operator:        unPtr(loc.Operator),
-				RegisteredOwner: unPtr(loc.RegisteredOwner),
-				Registration:    unPtr(loc.Registration),
-				RouteCode:       unPtr(loc.RouteCode),
-				Serial:          unPtr(loc.Serial),
-				TileLocation:    loc.TileLocation,
-				TypeCode:        unPtr(loc.TypeCode),
-			}
+}
 
-			updateId++
-			if updateId >= maxNumItems-1 {
-				send()
-			}
-		}
+type (
+	// flightRow is a row in flights
+	flightRow struct {
+		FlightId    string
+		Icao        string
+		CallSign    string
+		OpenReason  string
+		CloseReason string
+		FirstSeen   time.Time
+		LastSeen    time.Time
+		Origin      string
+		Destination string
+		MaxAltitude int32
+		Distance    float64
+		Feeders     []string
 	}
+)
+
+func (ds *DataStream) AddFlight(f *flights.Flight) {
+	ds.flights.Add(&flightRow{
+		FlightId:    f.FlightId,
+		Icao:        f.Icao,
+		CallSign:    f.CallSign,
+		OpenReason:  f.OpenReason,
+		CloseReason: f.CloseReason,
+		FirstSeen:   f.FirstSeen.UTC(),
+		LastSeen:    f.LastSeen.UTC(),
+		Origin:      f.Origin,
+		Destination: f.Destination,
+		MaxAltitude: int32(f.MaxAltitude),
+		Distance:    f.Distance,
+		Feeders:     f.Feeders,
+	})
 }
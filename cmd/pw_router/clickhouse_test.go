@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+
+	"plane.watch/lib/clickhouse"
+)
+
+func TestRowsMatchSchema(t *testing.T) {
+	tests := []struct {
+		table string
+		row   any
+	}{
+		{"location_updates_low", chRow{}},
+		{"location_updates_high", chRow{}},
+		{"flights", flightRow{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.table, func(t *testing.T) {
+			if err := clickhouse.CheckRow(tt.table, tt.row); nil != err {
+				t.Error(err)
+			}
+		})
+	}
+}
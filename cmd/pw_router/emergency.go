@@ -0,0 +1,36 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/export"
+)
+
+var (
+	emergencyEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pw_router_emergencies_total",
+		Help: "The total number of emergency start and end events published.",
+	}, []string{"reason", "state"})
+)
+
+// publishEmergencies sends out an event for every emergency that has started or ended between prev and next
+func (w *worker) publishEmergencies(prev, next *export.PlaneLocation) {
+	if "" == w.destRoutingKeyEmergency {
+		return
+	}
+	for _, ee := range export.EmergencyChanges(prev, next) {
+		msg, err := ee.ToJSONBytes()
+		if nil != err {
+			log.Error().Err(err).Str("aircraft", ee.Icao).Msg("Failed to encode emergency")
+			continue
+		}
+		log.Info().
+			Str("aircraft", ee.Icao).
+			Str("reason", ee.Reason).
+			Str("state", ee.State).
+			Msg("Emergency")
+		emergencyEvents.WithLabelValues(ee.Reason, ee.State).Inc()
+		w.publishEvent(w.destRoutingKeyEmergency, msg)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/export"
+)
+
+type (
+	// extrapolator periodically looks for aircraft we have stopped receiving positions for and publishes a dead
+	// reckoned position so that consumers of the high speed feed do not see the aircraft frozen in place.
+	extrapolator struct {
+		router *pwRouter
+
+		// after is how long a position needs to be stale before we start guessing where the aircraft is
+		after time.Duration
+		// maxAge is the oldest position we will extrapolate from
+		maxAge time.Duration
+		// interval is how often we sweep the cache
+		interval time.Duration
+
+		destRoutingKeyHigh string
+		spreadUpdates      bool
+	}
+)
+
+var (
+	updatesExtrapolated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pw_router_updates_extrapolated_total",
+		Help: "The total number of dead reckoned location updates published.",
+	})
+)
+
+func (e *extrapolator) run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	log.Info().
+		Dur("after", e.after).
+		Dur("max-age", e.maxAge).
+		Dur("interval", e.interval).
+		Msg("Extrapolating stale aircraft positions")
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Debug().Msg("Ending Extrapolator")
+			return
+		case now := <-ticker.C:
+			e.sweep(now)
+		}
+	}
+}
+
+func (e *extrapolator) sweep(now time.Time) {
+	e.router.syncSamples.Range(func(key, value any) bool {
+		loc, ok := value.(export.PlaneLocation)
+		if !ok {
+			return true
+		}
+		if now.Sub(loc.Updates.Location) < e.after {
+			return true
+		}
+		guess, ok := loc.Extrapolate(now, e.maxAge)
+		if !ok {
+			return true
+		}
+		msg, err := e.router.nats.encode(&guess)
+		if nil != err {
+			log.Error().Err(err).Str("aircraft", loc.Icao).Msg("Failed to encode extrapolated location")
+			updatesError.Inc()
+			return true
+		}
+		updatesExtrapolated.Inc()
+
+		// guesses only go to the high speed queues, they are not significant and never make it to storage
+		e.publish(e.destRoutingKeyHigh, msg)
+		if e.spreadUpdates {
+			for _, tile := range e.router.spreadTiles(&guess) {
+				e.publish(tile+qSuffixHigh, msg)
+			}
+		}
+		return true
+	})
+}
+
+func (e *extrapolator) publish(routingKey string, msg []byte) {
+	if err := e.router.nats.publishLocation(routingKey, msg); nil != err {
+		log.Warn().Err(err).Msg("Failed to send extrapolated update")
+		return
+	}
+	updatesPublished.Inc()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/flights"
+)
+
+var (
+	flightsOpened = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pw_router_flights_opened_total",
+		Help: "The total number of flight legs started.",
+	})
+	flightsClosed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pw_router_flights_closed_total",
+		Help: "The total number of flight legs finished.",
+	})
+)
+
+// newFlightTracker sets up our flight leg tracking, publishing the start and end of each flight to the given subject
+// and saving finished flights to clickhouse (if we have it). With surface tracking, flights get their origin and
+// destination from the airports we see them take off from and land at
+func newFlightTracker(router *pwRouter, subject string, gap time.Duration, ds *DataStream) *flights.Tracker {
+	var airportAt func(lat, lon float64) string
+	if nil != router.surface {
+		airportAt = func(lat, lon float64) string {
+			if ap, ok := router.surface.Nearest(lat, lon); ok {
+				return ap.Icao
+			}
+			return ""
+		}
+	}
+
+	publish := func(f *flights.Flight) {
+		if "" == subject {
+			return
+		}
+		msg, err := jsoniter.ConfigFastest.Marshal(f)
+		if nil != err {
+			log.Error().Err(err).Str("flight", f.FlightId).Msg("Failed to encode flight")
+			return
+		}
+		if err = router.nats.publish(subject, msg); nil != err {
+			return
+		}
+		updatesPublished.Inc()
+	}
+
+	return flights.NewTracker(
+		flights.WithGap(gap),
+		flights.WithAirportLookup(airportAt),
+		flights.WithFlightOpenedAction(func(f *flights.Flight) {
+			flightsOpened.Inc()
+			publish(f)
+		}),
+		flights.WithFlightClosedAction(func(f *flights.Flight) {
+			flightsClosed.Inc()
+			publish(f)
+			if nil != ds {
+				ds.AddFlight(f)
+			}
+		}),
+	)
+}
+
+// sweepFlights periodically closes the flights we have stopped hearing about
+func sweepFlights(ctx context.Context, tracker *flights.Tracker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			tracker.Close()
+			return
+		case now := <-ticker.C:
+			tracker.Sweep(now)
+		}
+	}
+}
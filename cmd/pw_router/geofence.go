@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/export"
+	"plane.watch/lib/geofence"
+)
+
+const (
+	geofenceBucket = "pw_geofences"
+
+	errGeofenceResponse = `{"error":%q}`
+)
+
+type (
+	// geofences keeps our registry in sync with the fences stored in NATS KV, so every router checks the same fences
+	geofences struct {
+		registry *geofence.Registry
+		kv       nats.KeyValue
+		log      zerolog.Logger
+	}
+)
+
+var (
+	geofenceCount = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pw_router_geofences_count",
+		Help: "The number of geofences we are checking updates against.",
+	})
+	geofenceEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pw_router_geofence_events_total",
+		Help: "The total number of geofence events published.",
+	}, []string{"event"})
+)
+
+func newGeofences(router *pwRouter) (*geofences, error) {
+	kv, err := router.nats.n.KeyValue(geofenceBucket, 0)
+	if nil != err {
+		return nil, err
+	}
+	return &geofences{
+		registry: geofence.NewRegistry(),
+		kv:       kv,
+		log:      log.With().Str("section", "geofences").Logger(),
+	}, nil
+}
+
+// watch keeps our registry up to date with every change made to the fences, by us or any other router
+func (g *geofences) watch(ctx context.Context) {
+	watcher, err := g.kv.WatchAll()
+	if nil != err {
+		g.log.Error().Err(err).Msg("Failed to watch geofences")
+		return
+	}
+	defer func() { _ = watcher.Stop() }()
+
+	json := jsoniter.ConfigFastest
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return
+			}
+			// a nil entry means we have loaded every fence that existed when we started
+			if nil == entry {
+				g.log.Info().Int("geofences", g.registry.Len()).Msg("Loaded geofences")
+				continue
+			}
+			switch entry.Operation() {
+			case nats.KeyValueDelete, nats.KeyValuePurge:
+				g.registry.Remove(entry.Key())
+			default:
+				f := geofence.Fence{}
+				if err = json.Unmarshal(entry.Value(), &f); nil == err {
+					err = g.registry.Put(f)
+				}
+				if nil != err {
+					g.log.Error().Err(err).Str("geofence", entry.Key()).Msg("Ignoring invalid geofence")
+				}
+			}
+			geofenceCount.Set(float64(g.registry.Len()))
+		}
+	}
+}
+
+// serve answers the v1.geofence.* API. Changes are written to NATS KV, and every router picks them up from there
+func (g *geofences) serve(router *pwRouter) (*nats.Subscription, error) {
+	return router.nats.n.SubscribeReply("v1.geofence.*", "pw_router", func(msg *nats.Msg) {
+		json := jsoniter.ConfigFastest
+		var buf []byte
+		var err error
+
+		switch msg.Subject {
+		case export.NatsApiGeofenceAddV1:
+			f := geofence.Fence{}
+			if err = json.Unmarshal(msg.Data, &f); nil != err {
+				break
+			}
+			if err = f.Validate(); nil != err {
+				break
+			}
+			if buf, err = json.Marshal(f); nil != err {
+				break
+			}
+			if _, err = g.kv.Put(f.Id, buf); nil != err {
+				break
+			}
+			g.log.Info().Str("geofence", f.Id).Str("name", f.Name).Msg("Added geofence")
+		case export.NatsApiGeofenceRemoveV1:
+			id := strings.TrimSpace(string(msg.Data))
+			f, ok := g.registry.Get(id)
+			if !ok {
+				err = fmt.Errorf("unknown geofence %q", id)
+				break
+			}
+			if err = g.kv.Delete(id); nil != err {
+				break
+			}
+			buf, err = json.Marshal(f)
+			g.log.Info().Str("geofence", f.Id).Str("name", f.Name).Msg("Removed geofence")
+		case export.NatsApiGeofenceListV1:
+			buf, err = json.Marshal(g.registry.List())
+		default:
+			err = fmt.Errorf("unsupported request %s", msg.Subject)
+		}
+
+		if nil != err {
+			buf = []byte(fmt.Sprintf(errGeofenceResponse, err.Error()))
+		}
+		if err = msg.Respond(buf); nil != err {
+			g.log.Error().Err(err).Str("subject", msg.Subject).Msg("Failed to respond to geofence request")
+		}
+	})
+}
+
+// publishGeofences tells everyone watching a geofence about the aircraft inside, entering or leaving it
+func (w *worker) publishGeofences(loc *export.PlaneLocation) {
+	if nil == w.router.geofences {
+		return
+	}
+	var matches []geofence.Match
+	if loc.Removed {
+		matches = w.router.geofences.registry.Forget(loc.Icao)
+	} else {
+		matches = w.router.geofences.registry.Check(loc)
+	}
+	for _, m := range matches {
+		ge := export.GeofenceEvent{
+			Fence:    m.Fence.Id,
+			Name:     m.Fence.Name,
+			Event:    m.Event,
+			Location: *loc,
+		}
+		msg, err := ge.ToJSONBytes()
+		if nil != err {
+			log.Error().Err(err).Str("aircraft", loc.Icao).Msg("Failed to encode geofence event")
+			continue
+		}
+		geofenceEvents.WithLabelValues(m.Event).Inc()
+		w.publishEvent(export.GeofenceSubject(m.Fence.Id), msg)
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog/log"
+	"plane.watch/lib/export"
 	"plane.watch/lib/nats_io"
+	"plane.watch/lib/partition"
 )
 
 type (
@@ -12,16 +15,23 @@ type (
 		natsUrl  string
 		n        *nats_io.Server
 		doneChan chan bool
+
+		// partitionMessages is where all of our partition subscriptions deliver to
+		partitionMessages chan *nats.Msg
+
+		// contentType is the wire format we publish location updates in, see export.ContentTypeJSON
+		contentType string
 	}
 )
 
-func newNatsIoRouter(natsUrl string) *natsIoRouter {
+func newNatsIoRouter(natsUrl, contentType string) *natsIoRouter {
 	if "" == natsUrl {
 		return nil
 	}
 	nr := &natsIoRouter{
-		natsUrl:  natsUrl,
-		doneChan: make(chan bool),
+		natsUrl:     natsUrl,
+		doneChan:    make(chan bool),
+		contentType: contentType,
 	}
 
 	return nr
@@ -44,32 +54,46 @@ func (nr *natsIoRouter) connect() error {
 	return err
 }
 
-func (nr *natsIoRouter) listen(subject string, incomingMessages chan []byte) error {
+func (nr *natsIoRouter) listen(subject string, incomingMessages chan *nats.Msg) error {
 	ch, err := nr.n.Subscribe(subject)
 	if nil != err {
 		return err
 	}
 
-	go func() {
-		for {
-			select {
-			case msg, ok := <-ch:
-				if !ok {
-					log.Error().Msg("failed to get message from nats.io nicely")
-					return
-				}
-
-				incomingMessages <- msg.Data
-			case <-nr.doneChan:
-				go func() {
-					nr.n.Close()
-					log.Debug().Msg("MQ Drained")
-				}()
+	go nr.pump(ch, incomingMessages)
+	return nil
+}
+
+// listenPartitioned sets us up to receive messages from the partitions we subscribe to (see subscribePartition)
+func (nr *natsIoRouter) listenPartitioned(incomingMessages chan *nats.Msg) {
+	nr.partitionMessages = make(chan *nats.Msg, nr.n.QueueDepth)
+	go nr.pump(nr.partitionMessages, incomingMessages)
+}
+
+// subscribePartition starts receiving a partition's messages. We use a queue group per partition so that while
+// ownership is moving between routers, only one of them handles each message
+func (nr *natsIoRouter) subscribePartition(subject string, part int) (*nats.Subscription, error) {
+	return nr.n.SubscribeQueueGroupChan(partition.Subject(subject, part), partition.Subject("pw_router", part), nr.partitionMessages)
+}
+
+func (nr *natsIoRouter) pump(ch chan *nats.Msg, incomingMessages chan *nats.Msg) {
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				log.Error().Msg("failed to get message from nats.io nicely")
 				return
 			}
+
+			incomingMessages <- msg
+		case <-nr.doneChan:
+			go func() {
+				nr.n.Close()
+				log.Debug().Msg("MQ Drained")
+			}()
+			return
 		}
-	}()
-	return nil
+	}
 }
 
 func (nr *natsIoRouter) publish(subject string, msg []byte) error {
@@ -81,6 +105,24 @@ func (nr *natsIoRouter) publish(subject string, msg []byte) error {
 	return nil
 }
 
+// encode gets a location update ready to publish in our wire format
+func (nr *natsIoRouter) encode(loc *export.PlaneLocation) ([]byte, error) {
+	return loc.Encode(nr.contentType)
+}
+
+// publishLocation sends a location update encoded by encode. JSON goes without a header, as it always has
+func (nr *natsIoRouter) publishLocation(subject string, msg []byte) error {
+	if "" == nr.contentType || export.ContentTypeJSON == nr.contentType {
+		return nr.publish(subject, msg)
+	}
+	err := nr.n.PublishWithHeaders(subject, msg, map[string]string{export.HeaderContentType: nr.contentType})
+	if nil != err {
+		log.Warn().Err(err).Str("mq", "nats").Msg("Failed to send update")
+		return err
+	}
+	return nil
+}
+
 func (nr *natsIoRouter) close() {
 	nr.doneChan <- true
 }
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/export"
+	"plane.watch/lib/partition"
+)
+
+const (
+	partitionMembersBucket = "pw_router_members"
+	partitionStateBucket   = "pw_router_state"
+)
+
+type (
+	// partitioner keeps track of which routers are alive and which partitions of the icao space we own.
+	// Aircraft state for a partition is checkpointed to NATS KV, so whoever owns it next can pick up where we left off
+	partitioner struct {
+		router     *pwRouter
+		id         string
+		partitions int
+		subject    string
+
+		members nats.KeyValue
+		state   nats.KeyValue
+
+		heartbeat  time.Duration
+		checkpoint time.Duration
+
+		mu    sync.RWMutex
+		owned map[int]*nats.Subscription
+
+		log zerolog.Logger
+	}
+)
+
+var (
+	partitionsOwned = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pw_router_partitions_owned_count",
+		Help: "The number of icao partitions this router owns.",
+	})
+	partitionMembers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pw_router_partition_members_count",
+		Help: "The number of routers sharing the partitions.",
+	})
+	partitionRebalances = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pw_router_partition_rebalance_total",
+		Help: "The number of times the partitions we own changed.",
+	})
+	partitionHandoff = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pw_router_partition_handoff_aircraft_total",
+		Help: "The number of aircraft states saved to and loaded from NATS KV.",
+	}, []string{"direction"})
+	partitionHandoffTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pw_router_partition_handoff_timeout_total",
+		Help: "The number of partitions we took over without the previous owner handing them off.",
+	})
+)
+
+func newPartitioner(router *pwRouter, id string, partitions int, subject string, heartbeat, checkpoint, stateAge time.Duration) (*partitioner, error) {
+	p := &partitioner{
+		router:     router,
+		id:         id,
+		partitions: partitions,
+		subject:    subject,
+		heartbeat:  heartbeat,
+		checkpoint: checkpoint,
+		owned:      make(map[int]*nats.Subscription),
+		log:        log.With().Str("section", "partitioner").Str("instance", id).Logger(),
+	}
+	var err error
+	// members that stop heart beating age out of the bucket, and we rebalance without them
+	if p.members, err = router.nats.n.KeyValue(partitionMembersBucket, 3*heartbeat); nil != err {
+		return nil, err
+	}
+	if p.state, err = router.nats.n.KeyValue(partitionStateBucket, stateAge); nil != err {
+		return nil, err
+	}
+	return p, nil
+}
+
+// owns tells us if the aircraft is in one of our partitions
+func (p *partitioner) owns(icao string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.owned[partition.Of(icao, p.partitions)]
+	return ok
+}
+
+// run heart beats, rebalances and checkpoints until we are told to stop, then hands off everything we own
+func (p *partitioner) run(ctx context.Context) {
+	heartbeat := time.NewTicker(p.heartbeat)
+	defer heartbeat.Stop()
+	checkpoint := time.NewTicker(p.checkpoint)
+	defer checkpoint.Stop()
+
+	p.rebalance()
+	for {
+		select {
+		case <-ctx.Done():
+			p.leave()
+			return
+		case <-heartbeat.C:
+			p.rebalance()
+		case <-checkpoint.C:
+			p.mu.RLock()
+			owned := make([]int, 0, len(p.owned))
+			for part := range p.owned {
+				owned = append(owned, part)
+			}
+			p.mu.RUnlock()
+			p.save(owned, false)
+			for _, part := range owned {
+				// keep our ownership records from aging out of the state bucket
+				p.claim(part)
+			}
+		}
+	}
+}
+
+// rebalance tells everyone we are alive and works out what we should own now
+func (p *partitioner) rebalance() {
+	if _, err := p.members.Put(p.id, []byte(time.Now().UTC().Format(time.RFC3339))); nil != err {
+		p.log.Error().Err(err).Msg("Failed to heartbeat, keeping our current partitions")
+		return
+	}
+	members, err := p.members.Keys()
+	if nil != err && !errors.Is(err, nats.ErrNoKeysFound) {
+		p.log.Error().Err(err).Msg("Failed to list routers, keeping our current partitions")
+		return
+	}
+	if !slices.Contains(members, p.id) {
+		members = append(members, p.id)
+	}
+	partitionMembers.Set(float64(len(members)))
+
+	want := partition.Owned(p.id, members, p.partitions)
+
+	p.mu.RLock()
+	var revoke []int
+	for part := range p.owned {
+		if !slices.Contains(want, part) {
+			revoke = append(revoke, part)
+		}
+	}
+	var assign []int
+	for _, part := range want {
+		if _, ok := p.owned[part]; !ok {
+			assign = append(assign, part)
+		}
+	}
+	p.mu.RUnlock()
+
+	if 0 == len(revoke) && 0 == len(assign) {
+		return
+	}
+	partitionRebalances.Inc()
+	p.log.Info().Strs("members", members).Ints("assign", assign).Ints("revoke", revoke).Msg("Rebalancing partitions")
+
+	// hand off first, so the new owner finds our state. We only wait on the old owners for so long, we need to be
+	// back to heart beating well before our membership ages out
+	p.revoke(revoke)
+	deadline := time.Now().Add(2 * p.heartbeat)
+	for _, part := range assign {
+		if err = p.assign(part, members, deadline); nil != err {
+			p.log.Error().Err(err).Int("partition", part).Msg("Failed to take ownership of partition")
+		}
+	}
+}
+
+// assign waits for the previous owner to hand the partition off, then loads its state and starts listening to it
+func (p *partitioner) assign(part int, members []string, deadline time.Time) error {
+	p.awaitHandoff(part, members, deadline)
+	p.load(part)
+	sub, err := p.router.nats.subscribePartition(p.subject, part)
+	if nil != err {
+		return err
+	}
+	p.mu.Lock()
+	p.owned[part] = sub
+	partitionsOwned.Set(float64(len(p.owned)))
+	p.mu.Unlock()
+
+	p.claim(part)
+	return nil
+}
+
+// claim records that we own the partition, so the next owner knows to wait for us to hand it off
+func (p *partitioner) claim(part int) {
+	if _, err := p.state.Put(ownerKey(part), []byte(p.id)); nil != err {
+		p.log.Error().Err(err).Int("partition", part).Msg("Failed to record ownership of partition")
+	}
+}
+
+// awaitHandoff waits until the partition's owner has saved and forgotten its aircraft, which it marks by removing
+// its ownership record. Without this we could load an older checkpoint and then have the old owner overwrite it.
+// An owner that is no longer in the group, or does not let go before the deadline, is taken over regardless
+func (p *partitioner) awaitHandoff(part int, members []string, deadline time.Time) {
+	entry, err := p.state.Get(ownerKey(part))
+	if nil != err {
+		if !errors.Is(err, nats.ErrKeyNotFound) {
+			p.log.Error().Err(err).Int("partition", part).Msg("Failed to find the owner of partition")
+		}
+		return
+	}
+	holder := string(entry.Value())
+	if p.id == holder || !slices.Contains(members, holder) {
+		return
+	}
+
+	watcher, err := p.state.Watch(ownerKey(part))
+	if nil != err {
+		p.log.Error().Err(err).Int("partition", part).Msg("Failed to wait for partition hand off")
+		return
+	}
+	defer func() { _ = watcher.Stop() }()
+
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+	for {
+		select {
+		case entry = <-watcher.Updates():
+			if nil == entry {
+				continue
+			}
+			if nats.KeyValuePut != entry.Operation() || holder != string(entry.Value()) {
+				return
+			}
+		case <-timeout.C:
+			partitionHandoffTimeouts.Inc()
+			p.log.Warn().Int("partition", part).Str("owner", holder).Msg("Timed out waiting for partition hand off, taking it over")
+			return
+		}
+	}
+}
+
+// revoke stops listening to the partitions and hands off their state
+func (p *partitioner) revoke(parts []int) {
+	if 0 == len(parts) {
+		return
+	}
+	p.mu.Lock()
+	for _, part := range parts {
+		if sub, ok := p.owned[part]; ok {
+			if err := sub.Unsubscribe(); nil != err {
+				p.log.Error().Err(err).Int("partition", part).Msg("Failed to unsubscribe from partition")
+			}
+			delete(p.owned, part)
+		}
+	}
+	partitionsOwned.Set(float64(len(p.owned)))
+	p.mu.Unlock()
+
+	p.save(parts, true)
+	for _, part := range parts {
+		p.release(part)
+	}
+}
+
+// release tells the next owner we have finished handing off the partition. If someone has already taken it over
+// we leave their ownership record alone
+func (p *partitioner) release(part int) {
+	entry, err := p.state.Get(ownerKey(part))
+	if nil != err {
+		if !errors.Is(err, nats.ErrKeyNotFound) {
+			p.log.Error().Err(err).Int("partition", part).Msg("Failed to release partition")
+		}
+		return
+	}
+	if p.id != string(entry.Value()) {
+		return
+	}
+	if err = p.state.Delete(ownerKey(part), nats.LastRevision(entry.Revision())); nil != err {
+		p.log.Error().Err(err).Int("partition", part).Msg("Failed to release partition")
+	}
+}
+
+// leave hands off everything we own and tells everyone we are gone
+func (p *partitioner) leave() {
+	p.mu.RLock()
+	owned := make([]int, 0, len(p.owned))
+	for part := range p.owned {
+		owned = append(owned, part)
+	}
+	p.mu.RUnlock()
+	p.revoke(owned)
+	if err := p.members.Delete(p.id); nil != err {
+		p.log.Error().Err(err).Msg("Failed to leave the router group")
+	}
+}
+
+func stateKey(part int, icao string) string {
+	return strconv.Itoa(part) + "." + icao
+}
+
+// ownerKey is where the current owner of a partition records itself, alongside the partition's aircraft state
+func ownerKey(part int) string {
+	return "owner." + strconv.Itoa(part)
+}
+
+// save checkpoints the state of every aircraft in the given partitions, forgetting them if we are handing them off
+func (p *partitioner) save(parts []int, forget bool) {
+	if 0 == len(parts) {
+		return
+	}
+	json := jsoniter.ConfigFastest
+	saved := 0
+	p.router.syncSamples.Range(func(key, value any) bool {
+		loc, ok := value.(export.PlaneLocation)
+		if !ok {
+			return true
+		}
+		part := partition.Of(loc.Icao, p.partitions)
+		if !slices.Contains(parts, part) {
+			return true
+		}
+		buf, err := json.Marshal(loc)
+		if nil == err {
+			_, err = p.state.Put(stateKey(part, strings.ToUpper(loc.Icao)), buf)
+		}
+		if nil != err {
+			p.log.Error().Err(err).Str("aircraft", loc.Icao).Msg("Failed to save aircraft state")
+		} else {
+			saved++
+		}
+		if forget {
+			// someone else looks after this aircraft now, forget it without telling anyone it is gone
+			p.router.syncSamples.Delete(key)
+			cacheEntries.Dec()
+			p.router.reaper.forget(loc.Icao)
+			p.router.lastSignificant.Delete(loc.Icao)
+			if nil != p.router.geofences {
+				p.router.geofences.registry.Forget(loc.Icao)
+			}
+		}
+		return true
+	})
+	partitionHandoff.WithLabelValues("saved").Add(float64(saved))
+	p.log.Debug().Ints("partitions", parts).Int("aircraft", saved).Bool("handoff", forget).Msg("Saved partition state")
+}
+
+// forget deletes the saved state of an aircraft we stopped tracking, so the next owner of its partition does not load
+// it back in
+func (p *partitioner) forget(icao string) {
+	icao = strings.ToUpper(icao)
+	if err := p.state.Delete(stateKey(partition.Of(icao, p.partitions), icao)); nil != err {
+		p.log.Error().Err(err).Str("aircraft", icao).Msg("Failed to delete aircraft state")
+	}
+}
+
+// load picks up the state the last owner of the partition left for us
+func (p *partitioner) load(part int) {
+	watcher, err := p.state.Watch(strconv.Itoa(part)+".*", nats.IgnoreDeletes())
+	if nil != err {
+		p.log.Error().Err(err).Int("partition", part).Msg("Failed to load partition state")
+		return
+	}
+	defer func() { _ = watcher.Stop() }()
+
+	json := jsoniter.ConfigFastest
+	loaded := 0
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case entry := <-watcher.Updates():
+			// a nil entry means we have everything that was there when we started watching
+			if nil == entry {
+				partitionHandoff.WithLabelValues("loaded").Add(float64(loaded))
+				p.log.Debug().Int("partition", part).Int("aircraft", loaded).Msg("Loaded partition state")
+				return
+			}
+			loc := export.PlaneLocation{}
+			if err = json.Unmarshal(entry.Value(), &loc); nil != err || "" == loc.Icao {
+				continue
+			}
+			if _, ok := p.router.syncSamples.Load(loc.Icao); ok {
+				continue
+			}
+			p.router.syncSamples.Store(loc.Icao, loc)
+			cacheEntries.Inc()
+			for tag := range loc.SourceTags {
+				p.router.reaper.seen(loc.Icao, tag, time.Now())
+			}
+			loaded++
+		case <-timeout:
+			p.log.Warn().Int("partition", part).Int("aircraft", loaded).Msg("Timed out loading partition state")
+			return
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/export"
+)
+
+type (
+	// sourceReaper keeps track of which upstream sources are still reporting each aircraft.
+	// One upstream losing an aircraft does not mean everyone has
+	sourceReaper struct {
+		mu sync.Mutex
+		// sources is the last time we heard about an aircraft from each source, keyed by icao then source tag
+		sources map[string]map[string]time.Time
+		maxAge  time.Duration
+	}
+)
+
+var (
+	updatesRemoved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pw_router_updates_removed_total",
+		Help: "The total number of aircraft removals published.",
+	})
+)
+
+func newSourceReaper(maxAge time.Duration) *sourceReaper {
+	return &sourceReaper{
+		sources: make(map[string]map[string]time.Time),
+		maxAge:  maxAge,
+	}
+}
+
+// seen records that the given source is reporting the aircraft
+func (r *sourceReaper) seen(icao, source string, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sources[icao]
+	if !ok {
+		s = make(map[string]time.Time)
+		r.sources[icao] = s
+	}
+	s[source] = now
+}
+
+// dropped records that the given source has lost the aircraft. Sources we have not heard from within maxAge are
+// considered to have lost it too. Returns true when no sources are left reporting the aircraft
+func (r *sourceReaper) dropped(icao, source string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sources[icao]
+	if !ok {
+		return true
+	}
+	delete(s, source)
+	for tag, lastSeen := range s {
+		if now.Sub(lastSeen) > r.maxAge {
+			delete(s, tag)
+		}
+	}
+	if 0 == len(s) {
+		delete(r.sources, icao)
+		return true
+	}
+	return false
+}
+
+// forget removes everything we know about the aircraft
+func (r *sourceReaper) forget(icao string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sources, icao)
+}
+
+// handleRemovedUpdate is called when the last upstream source drops an aircraft. We forget about it and let everyone
+// downstream know it is gone
+func (w *worker) handleRemovedUpdate(last export.PlaneLocation) {
+	w.router.syncSamples.Delete(last.Icao)
+	cacheEntries.Dec()
+	w.publishRemoved(last)
+}
+
+// publishRemoved emits the last known state of an aircraft, flagged as Removed, to both queues (and tiles)
+func (w *worker) publishRemoved(last export.PlaneLocation) {
+	if nil != w.router.reaper {
+		w.router.reaper.forget(last.Icao)
+	}
+	if nil != w.router.partitions {
+		w.router.partitions.forget(last.Icao)
+	}
+	w.router.lastSignificant.Delete(last.Icao)
+	last.New = false
+	last.Removed = true
+	msg, err := w.router.nats.encode(&last)
+	if nil != err {
+		log.Error().Err(err).Str("aircraft", last.Icao).Msg("Failed to encode removal")
+		return
+	}
+	updatesRemoved.Inc()
+	w.publishGeofences(&last)
+
+	w.publishLocationUpdate(w.destRoutingKeyLow, msg)  // to the reduced feed queue
+	w.publishLocationUpdate(w.destRoutingKeyHigh, msg) // to the full-feed queue
+
+	if w.spreadUpdates {
+		for _, tile := range w.router.spreadTiles(&last) {
+			w.publishLocationUpdate(tile+qSuffixLow, msg)  // to the low-speed tile-queue.
+			w.publishLocationUpdate(tile+qSuffixHigh, msg) // to the high-speed tile-queue.
+		}
+	}
+}
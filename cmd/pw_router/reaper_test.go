@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSourceReaper_dropped(t *testing.T) {
+	r := newSourceReaper(time.Minute)
+	now := time.Now()
+
+	r.seen("7C4516", "ingest-1", now)
+	r.seen("7C4516", "ingest-2", now)
+
+	if r.dropped("7C4516", "ingest-1", now) {
+		t.Errorf("expected the aircraft to stay while ingest-2 still reports it")
+	}
+	if !r.dropped("7C4516", "ingest-2", now) {
+		t.Errorf("expected the aircraft to be removed once every source dropped it")
+	}
+
+	r.seen("7C4516", "ingest-1", now)
+	r.seen("7C4516", "ingest-2", now.Add(-2*time.Minute))
+	if !r.dropped("7C4516", "ingest-1", now) {
+		t.Errorf("expected sources we have not heard from in a while to be ignored")
+	}
+
+	if !r.dropped("ABCDEF", "ingest-1", now) {
+		t.Errorf("expected an aircraft we know nothing about to be removed")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/export"
+	"plane.watch/lib/significance"
+)
+
+var (
+	significanceRuleResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pw_router_significance_rule_total",
+		Help: "The number of updates each significance rule decided on, and why it was significant (none when it was not).",
+	}, []string{"rule", "reason"})
+	significanceReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pw_router_significance_reload_total",
+		Help: "The number of times we reloaded the significance rules.",
+	}, []string{"result"})
+)
+
+// loadSignificanceRules reads our rules file, the default rules are used when no file is given
+func loadSignificanceRules(path string) (*significance.Engine, error) {
+	if "" == path {
+		return significance.Default(), nil
+	}
+	rules, err := significance.Load(path)
+	if nil != err {
+		return nil, err
+	}
+	log.Info().Str("file", path).Strs("rules", rules.RuleNames()).Msg("Loaded significance rules")
+	return rules, nil
+}
+
+// reloadSignificanceRules reloads our rules file whenever we get a SIGHUP. A broken file keeps the current rules
+func reloadSignificanceRules(ctx context.Context, router *pwRouter, path string) {
+	chHup := make(chan os.Signal, 1)
+	signal.Notify(chHup, syscall.SIGHUP)
+	defer signal.Stop(chHup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-chHup:
+			rules, err := loadSignificanceRules(path)
+			if nil != err {
+				significanceReloads.WithLabelValues("error").Inc()
+				log.Error().Err(err).Str("file", path).Msg("Failed to reload significance rules, keeping the current ones")
+				continue
+			}
+			significanceReloads.WithLabelValues("success").Inc()
+			router.rules.Store(rules)
+		}
+	}
+}
+
+// isSignificant checks the candidate against last using our rules, and tells prometheus which rule decided
+func (w *worker) isSignificant(last, candidate export.PlaneLocation) bool {
+	var lastSignificant time.Time
+	if t, ok := w.router.lastSignificant.Load(candidate.Icao); ok {
+		lastSignificant = t.(time.Time)
+	}
+
+	result := w.router.rules.Load().Evaluate(&last, &candidate, lastSignificant)
+	reason := result.Reason
+	if !result.Significant {
+		reason = "none"
+	}
+	significanceRuleResults.WithLabelValues(result.Rule, reason).Inc()
+
+	if result.Significant && log.Debug().Enabled() {
+		log.Debug().
+			Str("aircraft", candidate.Icao).
+			Dur("diff_time", candidate.LastMsg.Sub(last.LastMsg)).
+			Str("rule", result.Rule).
+			Str("reason", result.Reason).
+			Msg("Significant change.")
+	} else if !result.Significant && log.Trace().Enabled() {
+		log.Trace().Str("aircraft", candidate.Icao).Str("rule", result.Rule).Msg("Ignoring insignificant event.")
+	}
+
+	return result.Significant
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/export"
+	"plane.watch/lib/surface"
+)
+
+var (
+	surfaceEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pw_router_surface_events_total",
+		Help: "The total number of airport surface events (pushback, taxi-out, takeoff, landed, arrived-at-gate).",
+	}, []string{"type"})
+	surfaceAirports = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pw_router_surface_airports_count",
+		Help: "The number of airports we know about for surface tracking.",
+	})
+)
+
+// newSurfaceTracker sets up our airport surface tracking, publishing each surface event to the given subject
+func newSurfaceTracker(router *pwRouter, subject string) *surface.Tracker {
+	return surface.NewTracker(
+		surface.WithEventAction(func(e *surface.Event) {
+			surfaceEvents.WithLabelValues(e.Type).Inc()
+			if "" == subject {
+				return
+			}
+			msg, err := jsoniter.ConfigFastest.Marshal(e)
+			if nil != err {
+				log.Error().Err(err).Str("aircraft", e.Icao).Msg("Failed to encode surface event")
+				return
+			}
+			if err = router.nats.publish(subject, msg); nil != err {
+				return
+			}
+			updatesPublished.Inc()
+		}),
+	)
+}
+
+// loadAirports asks pw_atc_api for the airports we know about and adds any runways we have configured
+func loadAirports(router *pwRouter, runwaysFile string) ([]surface.Airport, error) {
+	runways := map[string][]surface.Runway{}
+	json := jsoniter.ConfigFastest
+	if "" != runwaysFile {
+		buf, err := os.ReadFile(runwaysFile)
+		if nil != err {
+			return nil, err
+		}
+		if err = json.Unmarshal(buf, &runways); nil != err {
+			return nil, err
+		}
+	}
+
+	buf, err := router.nats.n.Request(export.NatsApiAirportListV1, []byte{}, nil, 10*time.Second)
+	if nil != err {
+		return nil, err
+	}
+	var airports []export.Airport
+	if err = json.Unmarshal(buf, &airports); nil != err {
+		return nil, err
+	}
+
+	out := make([]surface.Airport, 0, len(airports))
+	for _, a := range airports {
+		icao := strings.ToUpper(a.IcaoCode)
+		out = append(out, surface.Airport{
+			Icao:    icao,
+			Iata:    a.IataCode,
+			Name:    a.Name,
+			Lat:     a.Latitude,
+			Lon:     a.Longitude,
+			Runways: runways[icao],
+		})
+	}
+	return out, nil
+}
+
+// runSurfaceTracker keeps our list of airports up to date and forgets about aircraft we no longer hear from
+func runSurfaceTracker(ctx context.Context, router *pwRouter, runwaysFile string, refresh, sweep time.Duration) {
+	load := func() bool {
+		airports, err := loadAirports(router, runwaysFile)
+		if nil != err {
+			log.Error().Err(err).Msg("Failed to load airports for surface tracking")
+			return false
+		}
+		router.surface.SetAirports(airports)
+		surfaceAirports.Set(float64(len(airports)))
+		log.Info().Int("airports", len(airports)).Msg("Loaded airports for surface tracking")
+		return true
+	}
+
+	// keep trying quickly until we have our airports, then settle down to the refresh interval
+	loaded := load()
+	refreshTicker := time.NewTicker(refresh)
+	retryTicker := time.NewTicker(30 * time.Second)
+	sweepTicker := time.NewTicker(sweep)
+	defer refreshTicker.Stop()
+	defer retryTicker.Stop()
+	defer sweepTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-retryTicker.C:
+			if !loaded {
+				loaded = load()
+			}
+		case <-refreshTicker.C:
+			load()
+		case now := <-sweepTicker.C:
+			router.surface.Sweep(now)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/export"
+	"plane.watch/lib/trust"
+)
+
+var (
+	updatesQuarantined = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pw_router_updates_quarantined_total",
+		Help: "The total number of updates ignored because their feeder is quarantined.",
+	})
+	updatesRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pw_router_updates_rejected_total",
+		Help: "The total number of updates rejected as impossible.",
+	})
+	feederTrust = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pw_router_feeder_trust",
+		Help: "How much we trust each feeder, from 0 (not at all) to 1.",
+	}, []string{"source"})
+	feedersQuarantined = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pw_router_feeders_quarantined_count",
+		Help: "The number of feeders currently quarantined.",
+	})
+)
+
+// runTrustScorer keeps our feeder metrics up to date and forgets feeders we have not heard from in a while
+func runTrustScorer(ctx context.Context, scorer *trust.Scorer, interval, forgetAfter time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			scorer.Forget(now.Add(-forgetAfter))
+			feederTrust.Reset()
+			quarantined := 0
+			for _, score := range scorer.Scores(now) {
+				feederTrust.WithLabelValues(score.SourceTag).Set(score.Trust)
+				if score.Quarantined {
+					quarantined++
+				}
+			}
+			feedersQuarantined.Set(float64(quarantined))
+		}
+	}
+}
+
+// serveTrustScores answers v1.feeder.trust with the score of every feeder, least trusted first
+func serveTrustScores(router *pwRouter) (*nats.Subscription, error) {
+	return router.nats.n.SubscribeReply(export.NatsApiFeederTrustV1, "pw_router", func(msg *nats.Msg) {
+		buf, err := jsoniter.ConfigFastest.Marshal(router.trust.Scores(time.Now()))
+		if nil != err {
+			log.Error().Err(err).Msg("Failed to encode feeder trust scores")
+			return
+		}
+		if err = msg.Respond(buf); nil != err {
+			log.Error().Err(err).Msg("Failed to respond with feeder trust scores")
+		}
+	})
+}
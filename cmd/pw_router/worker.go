@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
-	jsoniter "github.com/json-iterator/go"
+	"errors"
+	"github.com/nats-io/nats.go"
 	"github.com/rs/zerolog/log"
-	"math"
 	"plane.watch/lib/export"
+	"plane.watch/lib/tile_grid"
+	"time"
 )
 
 type (
@@ -13,154 +15,15 @@ type (
 		router             *pwRouter
 		destRoutingKeyLow  string
 		destRoutingKeyHigh string
-		spreadUpdates      bool
+		// destRoutingKeyEmergency is where emergency start/end events go, empty to not publish them
+		destRoutingKeyEmergency string
+		spreadUpdates           bool
 
 		ds *DataStream
 	}
 )
 
-const SigHeadingChange = 1.0        // at least 1.0 degrees change.
-const SigVerticalRateChange = 180.0 // at least 180 fpm change (3ft in 1min)
-const SigAltitudeChange = 10.0      // at least 10 ft in altitude change.
-
-func (w *worker) isSignificant(last, candidate export.PlaneLocation) bool {
-	// check the candidate vs last, if any of the following have changed
-	// - Heading, VerticalRate, Velocity, Altitude, FlightNumber, FlightStatus, OnGround, Special, Squawk
-
-	sigLog := log.With().
-		Str("aircraft", candidate.Icao).
-		Dur("diff_time", candidate.LastMsg.Sub(last.LastMsg)).
-		Logger()
-
-	if candidate.HasOnGround && candidate.OnGround {
-		if log.Debug().Enabled() {
-			sigLog.Debug().
-				Msg("Aircraft is on ground")
-		}
-		return true
-	}
-
-	// if any of these fields differ, indicate this update is significant
-	if candidate.HasHeading && last.HasHeading && math.Abs(candidate.Heading-last.Heading) > SigHeadingChange {
-		if candidate.Updates.Heading.After(last.Updates.Heading) {
-			if log.Debug().Enabled() {
-				sigLog.Debug().
-					Float64("last", last.Heading).
-					Float64("current", candidate.Heading).
-					Float64("diff_value", last.Heading-candidate.Heading).
-					Msg("Significant heading change.")
-			}
-			return true
-		}
-	}
-
-	if candidate.HasVelocity && last.HasVelocity && candidate.Velocity != last.Velocity {
-		if candidate.Updates.Velocity.After(last.Updates.Velocity) {
-			if log.Debug().Enabled() {
-				sigLog.Debug().
-					Float64("last", last.Velocity).
-					Float64("current", candidate.Velocity).
-					Float64("diff_value", last.Velocity-candidate.Velocity).
-					Msg("Significant velocity change.")
-			}
-			return true
-		}
-	}
-
-	if candidate.HasVerticalRate && last.HasVerticalRate && math.Abs(float64(candidate.VerticalRate-last.VerticalRate)) > SigVerticalRateChange {
-		if candidate.Updates.VerticalRate.After(last.Updates.VerticalRate) {
-			if log.Debug().Enabled() {
-				sigLog.Debug().
-					Int("last", last.VerticalRate).
-					Int("current", candidate.VerticalRate).
-					Int("diff_value", last.VerticalRate-candidate.VerticalRate).
-					Msg("Significant vertical rate change.")
-			}
-		}
-		return true
-	}
-
-	if math.Abs(float64(candidate.Altitude-last.Altitude)) > SigAltitudeChange {
-		if candidate.Updates.Altitude.After(last.Updates.Altitude) {
-			if log.Debug().Enabled() {
-				sigLog.Debug().
-					Int("last", last.Altitude).
-					Int("current", candidate.Altitude).
-					Int("diff_value", last.Altitude-candidate.Altitude).
-					Msg("Significant altitude change.")
-			}
-			return true
-		}
-	}
-
-	if candidate.FlightStatus != last.FlightStatus {
-		if candidate.Updates.FlightStatus.After(last.Updates.FlightStatus) {
-			if log.Debug().Enabled() {
-				sigLog.Debug().
-					Str("last", last.FlightStatus).
-					Str("current", candidate.FlightStatus).
-					Msg("Significant FlightStatus change.")
-			}
-			return true
-		}
-	}
-
-	if candidate.OnGround != last.OnGround {
-		if candidate.Updates.OnGround.After(last.Updates.OnGround) {
-			if log.Debug().Enabled() {
-				sigLog.Debug().
-					Bool("last", last.OnGround).
-					Bool("current", candidate.OnGround).
-					Msg("Significant OnGround change.")
-			}
-			return true
-		}
-	}
-
-	if candidate.Special != last.Special {
-		if candidate.Updates.Special.After(last.Updates.Special) {
-			if log.Debug().Enabled() {
-				sigLog.Debug().
-					Str("last", last.Special).
-					Str("current", candidate.Special).
-					Msg("Significant Special change.")
-			}
-			return true
-		}
-	}
-
-	if candidate.Squawk != last.Squawk {
-		if candidate.Updates.Squawk.After(last.Updates.Squawk) {
-			if log.Debug().Enabled() {
-				sigLog.Debug().
-					Str("last", last.Squawk).
-					Str("current", candidate.Squawk).
-					Msg("Significant Squawk change.")
-			}
-			return true
-		}
-	}
-
-	if candidate.TileLocation != last.TileLocation {
-		if candidate.Updates.Location.After(last.Updates.Location) {
-			if log.Debug().Enabled() {
-				sigLog.Debug().
-					Str("last", last.TileLocation).
-					Str("current", candidate.TileLocation).
-					Msg("Significant TileLocation change.")
-			}
-			return true
-		}
-	}
-
-	if log.Trace().Enabled() {
-		sigLog.Trace().Msg("Ignoring insignificant event.")
-	}
-
-	return false
-}
-
-func (w *worker) run(ctx context.Context, ch <-chan []byte) {
+func (w *worker) run(ctx context.Context, ch <-chan *nats.Msg) {
 	for {
 		select {
 		case msg, ok := <-ch:
@@ -180,18 +43,19 @@ func (w *worker) run(ctx context.Context, ch <-chan []byte) {
 	}
 }
 
-func (w *worker) handleMsg(msg []byte) error {
+func (w *worker) handleMsg(in *nats.Msg) error {
 	var err error
 
-	var json = jsoniter.ConfigFastest
-	// unmarshal the JSON and ensure it's valid.
+	// decode the update (JSON or protobuf, see the content-type header) and ensure it's valid.
 	// report the error if not and skip this message.
+	contentType := in.Header.Get(export.HeaderContentType)
 	update := export.PlaneLocation{}
-	if err = json.Unmarshal(msg, &update); nil != err {
-		log.Error().Err(err).Msg("Unable to unmarshal JSON")
+	if err = export.DecodePlaneLocation(contentType, in.Data, &update); nil != err {
+		log.Error().Err(err).Str("content-type", contentType).Msg("Unable to decode location update")
 		updatesError.Inc()
 		return err
 	}
+	msg := in.Data
 
 	if update.Icao == "" {
 		log.Debug().Str("payload", string(msg)).Msg("empty ICAO")
@@ -199,10 +63,32 @@ func (w *worker) handleMsg(msg []byte) error {
 		return nil
 	}
 
+	// while partitions are moving between routers we can still get updates for aircraft that are not ours
+	if nil != w.router.partitions && !w.router.partitions.owns(update.Icao) {
+		updatesIgnored.Inc()
+		return nil
+	}
+
 	updatesProcessed.Inc()
 
 	// lookup what we know about this plane.
 	item, ok := w.router.syncSamples.Load(update.Icao)
+	now := time.Now()
+
+	// quarantined feeders are still scored, so we know when they behave again, but their updates are not used
+	if nil != w.router.trust && !update.Removed && w.router.trust.Quarantined(update.SourceTag, now) {
+		if ok {
+			last := item.(export.PlaneLocation)
+			w.router.trust.Observe(&last, &update, false, now)
+		}
+		updatesQuarantined.Inc()
+		return nil
+	}
+
+	// upstream lost track of a plane we are not tracking, nothing to do
+	if !ok && update.Removed {
+		return nil
+	}
 
 	// if this Icao is not in the cache, it's new.
 	if !ok {
@@ -210,29 +96,65 @@ func (w *worker) handleMsg(msg []byte) error {
 			update.SourceTags = make(map[string]uint32)
 		}
 		update.SourceTags[update.SourceTag]++
+		if nil != w.router.flights {
+			update.FlightId = w.router.flights.Update(&update)
+		}
+		if nil != w.router.surface {
+			w.router.surface.Update(&update)
+		}
+		// we can only pass the update on untouched if we did not change it and it is already in our wire format
+		if nil != w.router.flights || nil != w.router.surface || !sameContentType(contentType, w.router.nats.contentType) {
+			if msg, err = w.router.nats.encode(&update); nil != err {
+				return err
+			}
+		}
 		w.router.syncSamples.Store(update.Icao, update)
+		if nil != w.router.reaper {
+			w.router.reaper.seen(update.Icao, update.SourceTag, now)
+		}
 
 		w.handleNewUpdate(update, msg)
+		w.publishEmergencies(nil, &update)
+		w.publishGeofences(&update)
 		return nil // finish here, no significance check as we have nothing to compare.
 	}
 
+	lastRecord := item.(export.PlaneLocation)
+
 	// upstream signals that this plane has been removed / lost.
+	// we can have multiple upstreams, and one upstream losing track of a plane does not mean it should be lost entirely
 	if update.Removed {
-		// TODO: we need to do our own reaping, since we can have multiple upstreams and one upstream losing track of
-		// TODO: a plane does not mean it should be lost entirely
-		//w.handleRemovedUpdate(update, msg)
+		if nil == w.router.reaper || w.router.reaper.dropped(update.Icao, update.SourceTag, now) {
+			w.handleRemovedUpdate(lastRecord)
+		}
 		return nil // don't need to do anything else with this.
 	}
+	if nil != w.router.reaper {
+		w.router.reaper.seen(update.Icao, update.SourceTag, now)
+	}
 
 	// is this update significant versus the previous one
-	lastRecord := item.(export.PlaneLocation)
-	merged, err := export.MergePlaneLocations(lastRecord, update)
+	var sourceTrust export.SourceTrust
+	if nil != w.router.trust {
+		sourceTrust = w.router.trust.Trust
+	}
+	merged, err := export.MergePlaneLocationsTrusted(lastRecord, update, sourceTrust)
+	if nil != w.router.trust {
+		w.router.trust.Observe(&lastRecord, &update, errors.Is(err, export.ErrImpossible), now)
+	}
 	if nil != err {
+		updatesRejected.Inc()
 		return nil
 	}
+	if nil != w.router.flights {
+		merged.FlightId = w.router.flights.Update(&merged)
+	}
+	if nil != w.router.surface {
+		w.router.surface.Update(&merged)
+	}
 	w.router.syncSamples.Store(merged.Icao, merged)
 
-	mergedMsg, err := merged.ToJSONBytes()
+	mergedMsg, err := w.router.nats.encode(&merged)
 	if nil != err {
 		return err
 	}
@@ -242,39 +164,26 @@ func (w *worker) handleMsg(msg []byte) error {
 	} else {
 		w.handleInsignificantUpdate(merged, mergedMsg)
 	}
+	w.publishEmergencies(&lastRecord, &merged)
+	w.publishGeofences(&merged)
 
 	return nil
 }
 
-func (w *worker) handleRemovedUpdate(update export.PlaneLocation, msg []byte) {
-	// check if this is a removed record and purge it from the cache and emit an event
-	// this ensures downstream pipeline components always know about a removed record.
-	// we get the removed flag from pw_ingest - this shortcuts our cache expiry for efficiency.
-	w.router.syncSamples.Delete(update.Icao)
-	cacheEntries.Dec()
-	cacheEvictions.Inc()
-
-	// emit the event to both queues
-	w.publishLocationUpdate(w.destRoutingKeyLow, msg)  // to the reduced feed queue
-	w.publishLocationUpdate(w.destRoutingKeyHigh, msg) // to the full-feed queue
-
-	if w.spreadUpdates {
-		w.publishLocationUpdate(update.TileLocation+qSuffixLow, msg)  // to the low-speed tile-queue.
-		w.publishLocationUpdate(update.TileLocation+qSuffixHigh, msg) // to the high-speed tile-queue.
-	}
-}
-
 func (w *worker) handleSignificantUpdate(update export.PlaneLocation, msg []byte) {
 	// store the new update in-place of the old one
 	// w.router.syncSamples.Store(update.Icao, update)
 	updatesSignificant.Inc()
 
 	// emit the new lastSignificant
+	w.router.lastSignificant.Store(update.Icao, update.LastMsg)
 	w.publishLocationUpdate(w.destRoutingKeyLow, msg)  // all low speed messages
 	w.publishLocationUpdate(w.destRoutingKeyHigh, msg) // all high speed messages
 	if w.spreadUpdates {
-		w.publishLocationUpdate(update.TileLocation+qSuffixLow, msg)
-		w.publishLocationUpdate(update.TileLocation+qSuffixHigh, msg)
+		for _, tile := range w.router.spreadTiles(&update) {
+			w.publishLocationUpdate(tile+qSuffixLow, msg)
+			w.publishLocationUpdate(tile+qSuffixHigh, msg)
+		}
 	}
 	if nil != w.ds {
 		w.ds.AddLow(&update)
@@ -290,13 +199,16 @@ func (w *worker) handleNewUpdate(update export.PlaneLocation, msg []byte) {
 		Msg("First time seeing aircraft.")
 
 	// new messages go to both queues
+	w.router.lastSignificant.Store(update.Icao, update.LastMsg)
 	w.publishLocationUpdate(w.destRoutingKeyLow, msg)  // all low speed messages
 	w.publishLocationUpdate(w.destRoutingKeyHigh, msg) // all high speed messages
 
 	// if spreading updates is enabled, output to spread queues
 	if w.spreadUpdates {
-		w.publishLocationUpdate(update.TileLocation+qSuffixLow, msg)
-		w.publishLocationUpdate(update.TileLocation+qSuffixHigh, msg)
+		for _, tile := range w.router.spreadTiles(&update) {
+			w.publishLocationUpdate(tile+qSuffixLow, msg)
+			w.publishLocationUpdate(tile+qSuffixHigh, msg)
+		}
 	}
 }
 
@@ -307,7 +219,9 @@ func (w *worker) handleInsignificantUpdate(update export.PlaneLocation, msg []by
 
 	if w.spreadUpdates {
 		// always publish updates to the high queue.
-		w.publishLocationUpdate(update.TileLocation+qSuffixHigh, msg)
+		for _, tile := range w.router.spreadTiles(&update) {
+			w.publishLocationUpdate(tile+qSuffixHigh, msg)
+		}
 	}
 
 	if nil != w.ds {
@@ -315,12 +229,22 @@ func (w *worker) handleInsignificantUpdate(update export.PlaneLocation, msg []by
 	}
 }
 
+// publishLocationUpdate sends a location update, encoded with w.router.nats.encode
 func (w *worker) publishLocationUpdate(routingKey string, msg []byte) {
+	w.publishMsg(routingKey, msg, w.router.nats.publishLocation)
+}
+
+// publishEvent sends one of our JSON events (emergencies, geofences)
+func (w *worker) publishEvent(routingKey string, msg []byte) {
+	w.publishMsg(routingKey, msg, w.router.nats.publish)
+}
+
+func (w *worker) publishMsg(routingKey string, msg []byte, publish func(subject string, msg []byte) error) {
 	if log.Trace().Enabled() {
 		log.Trace().Str("routing-key", routingKey).Bytes("Location", msg).Msg("Publish")
 	}
 
-	if err := w.router.nats.publish(routingKey, msg); nil != err {
+	if err := publish(routingKey, msg); nil != err {
 		log.Warn().Err(err).Msg("Failed to send update")
 		return
 	}
@@ -330,3 +254,21 @@ func (w *worker) publishLocationUpdate(routingKey string, msg []byte) {
 	}
 	updatesPublished.Inc()
 }
+
+// sameContentType tells us if two content types are the same wire format, no content type is JSON
+func sameContentType(a, b string) bool {
+	return export.IsProtobuf(a) == export.IsProtobuf(b)
+}
+
+// spreadTiles is every tile an update is spread to, its legacy tile and its cell at each of our tile levels
+func (r *pwRouter) spreadTiles(loc *export.PlaneLocation) []string {
+	tiles := make([]string, 1, 1+len(r.tileLevels))
+	tiles[0] = loc.TileLocation
+	if !loc.HasLocation || 0 == len(r.tileLevels) {
+		return tiles
+	}
+	for _, cell := range tile_grid.LookupTile(loc.Lat, loc.Lon).Cells(r.tileLevels) {
+		tiles = append(tiles, cell.String())
+	}
+	return tiles
+}
@@ -1,7 +1,31 @@
 package main
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+
+	"plane.watch/lib/export"
+)
 
 func TestWorker_handleInsignificantUpdate(t *testing.T) {
 
 }
+
+func TestPwRouter_spreadTiles(t *testing.T) {
+	perth := export.PlaneLocation{Lat: -31.952162, Lon: 115.943482, HasLocation: true, TileLocation: "tile35"}
+	router := pwRouter{}
+	if got := router.spreadTiles(&perth); !reflect.DeepEqual([]string{"tile35"}, got) {
+		t.Errorf("expected just the legacy tile without tile levels, got %v", got)
+	}
+
+	router.tileLevels = []int{2, 6}
+	if got, want := router.spreadTiles(&perth), []string{"tile35", "z2-3-2", "z6-52-37"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// without a position we only know the legacy tile (from the receiver's location)
+	perth.HasLocation = false
+	if got := router.spreadTiles(&perth); !reflect.DeepEqual([]string{"tile35"}, got) {
+		t.Errorf("expected just the legacy tile without a position, got %v", got)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/auth"
+	"plane.watch/lib/ws_protocol"
+)
+
+var (
+	prometheusIdentityClients = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Subsystem: "pw_ws_broker",
+			Name:      "identity_clients",
+			Help:      "The number of websocket clients we are serving, by identity",
+		},
+		[]string{"identity"},
+	)
+	prometheusIdentityRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "pw_ws_broker",
+			Name:      "identity_requests",
+			Help:      "The number of websocket and REST requests, by identity",
+		},
+		[]string{"identity"},
+	)
+	prometheusRateLimited = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "pw_ws_broker",
+			Name:      "rate_limited",
+			Help:      "The number of connections and requests turned away for going over a limit, by identity and limit",
+		},
+		[]string{"identity", "limit"},
+	)
+	prometheusNotEntitled = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "pw_ws_broker",
+			Name:      "not_entitled",
+			Help:      "The number of requests for something the identity is not entitled to, by tier and request",
+		},
+		[]string{"tier", "request"},
+	)
+	prometheusAuthFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "pw_ws_broker",
+			Name:      "auth_failures",
+			Help:      "The number of connections and requests we could not authenticate, by reason",
+		},
+		[]string{"reason"},
+	)
+)
+
+// everyone is who we let in when there is no auth config
+var everyone, _ = auth.NewAnonymous(auth.Unrestricted(), nil)
+
+// authenticate works out who is asking and counts the request (or connection) against their limits. It writes the
+// error response and returns nil when they cannot go ahead
+func (bw *PwWsBrokerWeb) authenticate(w http.ResponseWriter, r *http.Request, connect bool) (*auth.Identity, func()) {
+	authenticator := bw.auth
+	if nil == authenticator {
+		authenticator = everyone
+	}
+	id, err := authenticator.Authenticate(r)
+	if nil != err {
+		reason := "invalid_credentials"
+		if errors.Is(err, auth.ErrNoCredentials) {
+			reason = "no_credentials"
+		}
+		prometheusAuthFailures.WithLabelValues(reason).Inc()
+		log.Debug().Err(err).Str("Remote", r.RemoteAddr).Msg("Failed to authenticate")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="plane.watch"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, nil
+	}
+
+	release := func() {}
+	limit := "requests"
+	if connect {
+		limit = "connect"
+		release, err = bw.limits.Connect(id)
+		if errors.Is(err, auth.ErrTooManyConnections) {
+			limit = "connections"
+		}
+	} else {
+		err = bw.limits.Request(id)
+	}
+	if nil != err {
+		prometheusRateLimited.WithLabelValues(id.Name, limit).Inc()
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too Many Requests: "+err.Error(), http.StatusTooManyRequests)
+		return nil, nil
+	}
+	prometheusIdentityRequests.WithLabelValues(id.Name).Inc()
+	return id, release
+}
+
+// requestLabel is the request type, for metrics. Clients can send us anything, so types we do not know are "other"
+func requestLabel(requestType string) string {
+	switch requestType {
+	case ws_protocol.RequestTypeSubscribe, ws_protocol.RequestTypeSubscribeList, ws_protocol.RequestTypeUnsubscribe,
+		ws_protocol.RequestTypeGridPlanes, ws_protocol.RequestTypePlaneLocHistory, ws_protocol.RequestTypeTickAdjust,
+		ws_protocol.RequestTypeSearch, ws_protocol.RequestTypeSubscribeBBox, ws_protocol.RequestTypeUnsubscribeBBox,
+		ws_protocol.RequestTypeFilter, ws_protocol.RequestTypeFollow, ws_protocol.RequestTypeUnfollow,
+		ws_protocol.RequestTypeResync, ws_protocol.RequestTypeReplay, ws_protocol.RequestTypeReplayPause,
+		ws_protocol.RequestTypeReplayResume, ws_protocol.RequestTypeReplaySeek, ws_protocol.RequestTypeReplaySpeed,
+		ws_protocol.RequestTypeReplayStop:
+		return requestType
+	}
+	return "other"
+}
+
+// entitled checks the client is allowed to make the request, nil when it is
+func entitled(e *auth.Entitlements, rq *ws_protocol.WsRequest) error {
+	switch rq.Type {
+	case ws_protocol.RequestTypeSubscribe:
+		if !tileEntitled(e, rq.GridTile) {
+			return errors.New("not entitled to tile: " + rq.GridTile)
+		}
+	case ws_protocol.RequestTypeGridPlanes:
+		// grid-planes is given a tile without its speed suffix
+		if !tileEntitled(e, rq.GridTile) && !tileEntitled(e, rq.GridTile+ws_protocol.GridTileSuffixLow) &&
+			!tileEntitled(e, rq.GridTile+ws_protocol.GridTileSuffixHigh) {
+			return errors.New("not entitled to tile: " + rq.GridTile)
+		}
+	case ws_protocol.RequestTypePlaneLocHistory:
+		if !e.History {
+			return errors.New("not entitled to location history")
+		}
+	case ws_protocol.RequestTypeReplay:
+		if !e.History {
+			return errors.New("not entitled to replays")
+		}
+		if nil == rq.Replay {
+			break
+		}
+		// an area that is not a tile could be anywhere
+		if nil != rq.Replay.Bounds && !tileEntitled(e, ws_protocol.GridTileAllLow) {
+			return errors.New("not entitled to replay an area, replay a tile instead")
+		}
+		if "" != rq.Replay.GridTile && !tileEntitled(e, rq.Replay.GridTile) {
+			return errors.New("not entitled to tile: " + rq.Replay.GridTile)
+		}
+	case ws_protocol.RequestTypeSearch:
+		if !e.Search {
+			return errors.New("not entitled to search")
+		}
+	case ws_protocol.RequestTypeFollow:
+		// following an aircraft sends it wherever it goes
+		if !e.Search {
+			return errors.New("not entitled to follow aircraft")
+		}
+	}
+	return nil
+}
+
+// tileEntitled tells us if the tile can be subscribed to, all_low and all_high need AllTiles (everything)
+func tileEntitled(e *auth.Entitlements, tile string) bool {
+	if ws_protocol.GridTileAllLow == tile || ws_protocol.GridTileAllHigh == tile {
+		return e.AllTiles
+	}
+	return e.AllTiles || e.Tile(tile)
+}
+
+// entitledTiles are the tiles the client can subscribe to, out of tiles
+func entitledTiles(e *auth.Entitlements, tiles []string) []string {
+	if e.AllTiles || 0 == len(e.Tiles) {
+		return tiles
+	}
+	out := make([]string, 0, len(tiles))
+	for _, tile := range tiles {
+		if e.Tile(tile) {
+			out = append(out, tile)
+		}
+	}
+	return out
+}
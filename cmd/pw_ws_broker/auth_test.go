@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"nhooyr.io/websocket"
+	"plane.watch/lib/auth"
+	"plane.watch/lib/tile_grid"
+	"plane.watch/lib/ws_protocol"
+)
+
+const testAuthConfig = `
+api_keys:
+  - key: everything
+    identity: partner
+    entitlements: {all_tiles: true, history: true, search: true}
+  - key: limited
+    identity: limited
+    entitlements: {tiles: ["tile38_*"], max_connections: 1, request_rate: 1, request_burst: 3}
+anonymous:
+  tiles: ["tile38_low"]
+`
+
+func newTestAuthBroker(t *testing.T) *PwWsBrokerWeb {
+	t.Helper()
+	a, err := auth.Parse([]byte(testAuthConfig))
+	if nil != err {
+		t.Fatal(err)
+	}
+	bw := newTestRestBroker(t)
+	bw.auth = a
+	return bw
+}
+
+func TestEntitled(t *testing.T) {
+	everything := auth.Unrestricted()
+	limited := auth.Entitlements{Tiles: []string{"tile38_*", "z8-*"}}
+	tests := []struct {
+		name string
+		e    *auth.Entitlements
+		rq   ws_protocol.WsRequest
+		ok   bool
+	}{
+		{"sub all", &everything, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSubscribe, GridTile: ws_protocol.GridTileAllHigh}, true},
+		{"limited sub all", &limited, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSubscribe, GridTile: ws_protocol.GridTileAllLow}, false},
+		{"limited sub tile", &limited, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSubscribe, GridTile: "tile38_high"}, true},
+		{"limited sub cell", &limited, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSubscribe, GridTile: "z8-1-2_low"}, true},
+		{"limited sub other tile", &limited, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSubscribe, GridTile: "tile39_low"}, false},
+		{"limited grid planes", &limited, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeGridPlanes, GridTile: "tile38"}, true},
+		{"limited grid planes other tile", &limited, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeGridPlanes, GridTile: "tile39"}, false},
+		{"limited history", &limited, ws_protocol.WsRequest{Type: ws_protocol.RequestTypePlaneLocHistory, Icao: "7C6CA3"}, false},
+		{"limited search", &limited, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSearch, Query: "qfa"}, false},
+		{"limited follow", &limited, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeFollow, Icao: "7C6CA3"}, false},
+		{"limited filter", &limited, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeFilter}, true},
+		{"replay", &everything, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeReplay, Replay: &ws_protocol.Replay{GridTile: "tile39_low"}}, true},
+		{"replay bounds", &everything, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeReplay, Replay: &ws_protocol.Replay{Bounds: &tile_grid.GlobeIndexSpecialTile{}}}, true},
+		{"limited replay", &limited, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeReplay, Replay: &ws_protocol.Replay{GridTile: "tile38_low"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := entitled(tt.e, &tt.rq); tt.ok != (nil == err) {
+				t.Errorf("expected ok=%t, got %v", tt.ok, err)
+			}
+		})
+	}
+
+	history := auth.Entitlements{Tiles: []string{"tile38_*"}, History: true}
+	if nil != entitled(&history, &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeReplay, Replay: &ws_protocol.Replay{GridTile: "tile38_low"}}) {
+		t.Error("expected to be able to replay a tile we are entitled to")
+	}
+	if nil == entitled(&history, &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeReplay, Replay: &ws_protocol.Replay{Bounds: &tile_grid.GlobeIndexSpecialTile{}}}) {
+		t.Error("expected to not be able to replay any area")
+	}
+
+	if got := entitledTiles(&limited, []string{"z8-1-2_low", "z10-1-2_low", "tile38_low"}); 2 != len(got) {
+		t.Errorf("expected only the entitled viewport tiles, got %v", got)
+	}
+}
+
+func TestAuth_Rest(t *testing.T) {
+	bw := newTestAuthBroker(t)
+	tests := []struct {
+		name, path, key string
+		code            int
+	}{
+		{"anonymous aircraft.json", "/data/aircraft.json", "", http.StatusForbidden},
+		{"anonymous lookup", "/api/v1/aircraft/7C6CA3", "", http.StatusForbidden},
+		{"bad key", "/data/aircraft.json", "nope", http.StatusUnauthorized},
+		{"aircraft.json", "/data/aircraft.json", "everything", http.StatusOK},
+		{"list", "/api/v1/aircraft/", "everything", http.StatusOK},
+		{"limited list", "/api/v1/aircraft", "limited", http.StatusForbidden},
+		{"callsign", "/api/v1/callsign/QFA9", "everything", http.StatusOK},
+		{"grid is for everyone", "/grid", "nope", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if "" != tt.key {
+				headers[auth.HeaderApiKey] = tt.key
+			}
+			if rs := restGet(t, bw, tt.path, headers); tt.code != rs.StatusCode {
+				t.Errorf("expected %d, got %d", tt.code, rs.StatusCode)
+			}
+		})
+	}
+
+	// limited has a burst of 3 requests, and has used one of them
+	restGet(t, bw, "/api/v1/aircraft?apiKey=limited", nil)
+	restGet(t, bw, "/api/v1/aircraft?apiKey=limited", nil)
+	rs := restGet(t, bw, "/api/v1/aircraft?apiKey=limited", nil)
+	if http.StatusTooManyRequests != rs.StatusCode || "" == rs.Header.Get("Retry-After") {
+		t.Errorf("expected to be rate limited, got %d", rs.StatusCode)
+	}
+}
+
+func TestAuth_RestCaching(t *testing.T) {
+	open := restGet(t, newTestRestBroker(t), "/data/aircraft.json", nil)
+	if !strings.HasPrefix(open.Header.Get("Cache-Control"), "public") {
+		t.Errorf("expected everyone's aircraft.json to be public, got %s", open.Header.Get("Cache-Control"))
+	}
+
+	bw := newTestAuthBroker(t)
+	partner := restGet(t, bw, "/data/aircraft.json", map[string]string{auth.HeaderApiKey: "everything"})
+	if !strings.HasPrefix(partner.Header.Get("Cache-Control"), "private") {
+		t.Errorf("expected aircraft.json to be private, got %s", partner.Header.Get("Cache-Control"))
+	}
+	if vary := partner.Header.Get("Vary"); !strings.Contains(vary, "Authorization") || !strings.Contains(vary, auth.HeaderApiKey) {
+		t.Errorf("expected aircraft.json to vary by credentials, got %s", vary)
+	}
+
+	etag := partner.Header.Get("ETag")
+	if rs := restGet(t, bw, "/data/aircraft.json", map[string]string{auth.HeaderApiKey: "everything", "If-None-Match": etag}); http.StatusNotModified != rs.StatusCode {
+		t.Errorf("expected a 304 when nothing changed, got %d", rs.StatusCode)
+	}
+}
+
+func TestAuth_Websocket(t *testing.T) {
+	bw := newTestAuthBroker(t)
+	server := httptest.NewServer(bw)
+	defer server.Close()
+	url := strings.Replace(server.URL, "http://", "ws://", 1) + "/planes"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dial := func(query string) (*websocket.Conn, *http.Response, error) {
+		return websocket.Dial(ctx, url+query, &websocket.DialOptions{Subprotocols: []string{ws_protocol.WsProtocolPlanes}})
+	}
+
+	if _, rs, err := dial("?apiKey=nope"); nil == err || http.StatusUnauthorized != rs.StatusCode {
+		t.Fatalf("expected a bad key to be unauthorized, got %v", err)
+	}
+
+	conn, _, err := dial("?apiKey=limited")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "") }()
+	if _, rs, err := dial("?apiKey=limited"); nil == err || http.StatusTooManyRequests != rs.StatusCode {
+		t.Fatalf("expected a second connection to be turned away, got %v", err)
+	}
+
+	json := jsoniter.ConfigFastest
+	request := func(rq ws_protocol.WsRequest) ws_protocol.WsResponse {
+		t.Helper()
+		buf, _ := json.Marshal(rq)
+		if err := conn.Write(ctx, websocket.MessageText, buf); nil != err {
+			t.Fatal(err)
+		}
+		_, frame, err := conn.Read(ctx)
+		if nil != err {
+			t.Fatal(err)
+		}
+		var rs ws_protocol.WsResponse
+		if err = json.Unmarshal(frame, &rs); nil != err {
+			t.Fatal(err)
+		}
+		return rs
+	}
+
+	if rs := request(ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSubscribe, GridTile: ws_protocol.GridTileAllLow}); ws_protocol.ResponseTypeError != rs.Type {
+		t.Errorf("expected to not be entitled to all_low, got %+v", rs)
+	}
+	if rs := request(ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSubscribe, GridTile: "tile38_low"}); ws_protocol.ResponseTypeAckSub != rs.Type {
+		t.Errorf("expected to subscribe to an entitled tile, got %+v", rs)
+	}
+	// that is the burst used up
+	if rs := request(ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSubscribeList}); ws_protocol.ResponseTypeSubTiles != rs.Type {
+		t.Errorf("expected the sub list, got %+v", rs)
+	}
+	if rs := request(ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSubscribeList}); ws_protocol.ResponseTypeError != rs.Type || !strings.Contains(rs.Message, "Too many requests") {
+		t.Errorf("expected to be rate limited, got %+v", rs)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"github.com/rs/zerolog/log"
 	"os"
 	"os/signal"
+	"plane.watch/lib/auth"
 	"plane.watch/lib/export"
 	"plane.watch/lib/monitoring"
 	"plane.watch/lib/nats_io"
@@ -16,29 +18,43 @@ type (
 		input source
 		PwWsBrokerWeb
 		exitChan chan bool
+		// stopSearch stops us keeping the airports we search up to date
+		stopSearch context.CancelFunc
 	}
 
 	source interface {
 		configure() error
 		setProcessMessage(processMessage)
+		setProcessEmergency(processEmergency)
+		setProcessGeofence(processGeofence)
 		consumeAll(chan bool)
 		close()
 		monitoring.HealthCheck
 	}
-	processMessage func(highLow string, loc *export.PlaneLocation)
+	processMessage   func(highLow string, loc *export.PlaneLocation)
+	processEmergency func(ee *export.EmergencyEvent)
+	processGeofence  func(ge *export.GeofenceEvent)
 )
 
-func NewPlaneWatchWebSocketBroker(input source, natsRpc *nats_io.Server, httpAddr, cert, certKey string, serveTestWeb bool, sendTickDuration time.Duration) (*PwWsBroker, error) {
+func NewPlaneWatchWebSocketBroker(input source, natsRpc *nats_io.Server, httpAddr, cert, certKey string, serveTestWeb bool, sendTickDuration time.Duration, queueSize int, slowClientTimeout, deltaKeyframe time.Duration, maxReplays int, replayMaxSpan, historyMaxSpan time.Duration, tileLevels []int, authenticator auth.Authenticator) (*PwWsBroker, error) {
 
 	return &PwWsBroker{
 		input: input,
 		PwWsBrokerWeb: PwWsBrokerWeb{
-			natsRpc:          natsRpc,
-			Addr:             httpAddr,
-			ServeTest:        serveTestWeb,
-			cert:             cert,
-			certKey:          certKey,
-			sendTickDuration: sendTickDuration,
+			natsRpc:           natsRpc,
+			Addr:              httpAddr,
+			ServeTest:         serveTestWeb,
+			cert:              cert,
+			certKey:           certKey,
+			sendTickDuration:  sendTickDuration,
+			queueSize:         queueSize,
+			slowClientTimeout: slowClientTimeout,
+			deltaKeyframe:     deltaKeyframe,
+			maxReplays:        maxReplays,
+			replayMaxSpan:     replayMaxSpan,
+			historyMaxSpan:    historyMaxSpan,
+			tileLevels:        tileLevels,
+			auth:              authenticator,
 		},
 		exitChan: make(chan bool),
 	}, nil
@@ -54,8 +70,15 @@ func (b *PwWsBroker) Setup() error {
 
 	b.input.setProcessMessage(func(highLow string, loc *export.PlaneLocation) {
 		prometheusIncomingMessages.WithLabelValues(highLow).Inc()
-		tile := loc.TileLocation + highLow
-		b.clients.SendLocationUpdate(highLow, tile, loc)
+		b.clients.SendLocationUpdate(highLow, locationTiles(highLow, loc, b.tileLevels), loc)
+	})
+	b.input.setProcessEmergency(func(ee *export.EmergencyEvent) {
+		prometheusIncomingMessages.WithLabelValues("emergency").Inc()
+		b.clients.SendEmergency(ee)
+	})
+	b.input.setProcessGeofence(func(ge *export.GeofenceEvent) {
+		prometheusIncomingMessages.WithLabelValues("geofence").Inc()
+		b.clients.SendGeofence(ge)
 	})
 
 	monitoring.AddHealthCheck(b.input)
@@ -66,6 +89,10 @@ func (b *PwWsBroker) Setup() error {
 func (b *PwWsBroker) Run() {
 	go b.listenAndServe(b.exitChan)
 	go b.input.consumeAll(b.exitChan)
+
+	var ctx context.Context
+	ctx, b.stopSearch = context.WithCancel(context.Background())
+	go b.clients.searcher.refreshAirports(ctx)
 }
 
 func (b *PwWsBroker) Wait() {
@@ -80,6 +107,9 @@ func (b *PwWsBroker) Wait() {
 }
 
 func (b *PwWsBroker) Close() {
+	if nil != b.stopSearch {
+		b.stopSearch()
+	}
 	if err := b.httpServer.Close(); nil != err {
 		log.Error().Err(err).Msg("Failed to close web server cleanly")
 	}
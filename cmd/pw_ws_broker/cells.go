@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"plane.watch/lib/export"
+	"plane.watch/lib/tile_grid"
+	"plane.watch/lib/ws_protocol"
+)
+
+// maxViewportCells is the most cells a single viewport subscription can cover
+const maxViewportCells = 64
+
+// locationTiles is every tile (with its speed suffix) an update can be subscribed to by, its legacy tile and its
+// cell at each of our levels
+func locationTiles(highLow string, loc *export.PlaneLocation, levels []int) []string {
+	tiles := make([]string, 1, 1+len(levels))
+	tiles[0] = loc.TileLocation + highLow
+	if !loc.HasLocation || 0 == len(levels) {
+		return tiles
+	}
+	for _, cell := range tile_grid.LookupTile(loc.Lat, loc.Lon).Cells(levels) {
+		tiles = append(tiles, cell.String()+highLow)
+	}
+	return tiles
+}
+
+// splitSpeed splits "z6-52-37_low" into "z6-52-37" and "_low"
+func splitSpeed(tile string) (name, highLow string, ok bool) {
+	for _, suffix := range []string{ws_protocol.GridTileSuffixLow, ws_protocol.GridTileSuffixHigh} {
+		if strings.HasSuffix(tile, suffix) {
+			return strings.TrimSuffix(tile, suffix), suffix, true
+		}
+	}
+	return tile, "", false
+}
+
+// isCellTile tells us if tile is a cell at one of our levels with a speed suffix, like z6-52-37_low
+func isCellTile(tile string, levels []int) bool {
+	name, _, ok := splitSpeed(tile)
+	if !ok {
+		return false
+	}
+	cell, err := tile_grid.ParseCell(name)
+	if nil != err {
+		return false
+	}
+	for _, z := range levels {
+		if z == cell.Z {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriptionLabel is what we count a subscription as in our metrics. There are far too many cells to have a label
+// each, so they are counted by level (z6_low), and clients can make up geofence ids so they are all counted as one
+func subscriptionLabel(tile string) string {
+	if isGeofenceTile(tile) {
+		return "geofence"
+	}
+	name, highLow, ok := splitSpeed(tile)
+	if !ok {
+		return tile
+	}
+	if cell, err := tile_grid.ParseCell(name); nil == err {
+		return "z" + strconv.Itoa(cell.Z) + highLow
+	}
+	return tile
+}
+
+// viewportTiles is the cells (with the speed suffix) to subscribe to for a map viewport
+func viewportTiles(rq *ws_protocol.WsRequest, levels []int) ([]string, error) {
+	if nil == rq.Bounds {
+		return nil, tile_grid.ErrInvalidBounds
+	}
+	highLow := ws_protocol.GridTileSuffixLow
+	if "high" == rq.Speed {
+		highLow = ws_protocol.GridTileSuffixHigh
+	}
+	cells, err := tile_grid.ViewportCells(*rq.Bounds, rq.Zoom, levels, maxViewportCells)
+	if nil != err {
+		return nil, err
+	}
+	tiles := make([]string, len(cells))
+	for i, cell := range cells {
+		tiles[i] = cell.String() + highLow
+	}
+	return tiles, nil
+}
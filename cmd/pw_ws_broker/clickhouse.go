@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"github.com/paulmach/orb"
 	"github.com/rs/zerolog/log"
 	"plane.watch/lib/clickhouse"
-	"plane.watch/lib/ws_protocol"
+	"plane.watch/lib/export"
+	"plane.watch/lib/history"
+	"plane.watch/lib/tile_grid"
 	"time"
 )
 
@@ -12,6 +16,48 @@ type (
 	ClickHouseData struct {
 		server *clickhouse.Server
 	}
+
+	// historyRow is the columns of location_updates_low we build an aircraft's history from
+	historyRow struct {
+		LastMsg  time.Time
+		LatLon   orb.Point
+		Heading  float64
+		Velocity float64
+		Altitude *int32
+	}
+
+	// replayRow is the columns of location_updates_low and location_updates_high we replay
+	replayRow struct {
+		Icao            string
+		LatLon          orb.Point
+		Heading         float64
+		Velocity        float64
+		Altitude        int32
+		VerticalRate    int32
+		AltitudeUnits   string
+		CallSign        string
+		FlightStatus    string
+		OnGround        bool
+		Airframe        string
+		AirframeType    string
+		HasLocation     bool
+		HasHeading      bool
+		HasVerticalRate bool
+		HasVelocity     bool
+		SourceTags      map[string]uint32
+		Squawk          uint32
+		Special         string
+		TrackedSince    time.Time
+		LastMsg         time.Time
+		FlagCode        string
+		Operator        string
+		RegisteredOwner string
+		Registration    string
+		RouteCode       string
+		Serial          string
+		TileLocation    string
+		TypeCode        string
+	}
 )
 
 var (
@@ -28,31 +74,112 @@ func NewClickHouseData(url string) (*ClickHouseData, error) {
 	}, nil
 }
 
-func (chd *ClickHouseData) PlaneLocationHistory(icao, callSign string) []ws_protocol.LocationHistory {
-	history := make([]ws_protocol.LocationHistory, 0, 2200) // if we increase from 6 hours, increase our initial allocation
-	query := `WITH t AS (
-SELECT *
+// History gets (at most limit of) the checked query's locations, oldest first
+func (chd *ClickHouseData) History(ctx context.Context, q history.Query, limit int) ([]history.Point, error) {
+	query := `SELECT LastMsg, LatLon, Heading, Velocity, Altitude
 FROM location_updates_low
-WHERE Icao = '` + icao + `' AND CallSign = '` + callSign + `' AND HasLocation = 1 AND TileLocation != 'tileUnknown'
-  AND LastMsg > timestamp_sub(hour, 12, now())
-), t_over AS (
-    SELECT *, ROW_NUMBER() OVER(PARTITION BY toInt64(toInt64(LastMsg)/10) ORDER BY LastMsg) AS N FROM t
-)
+WHERE Icao = ? AND (? = '' OR CallSign = ?) AND HasLocation = 1 AND TileLocation != 'tileUnknown'
+  AND LastMsg >= fromUnixTimestamp64Milli(?) AND LastMsg < fromUnixTimestamp64Milli(?)
+ORDER BY LastMsg
+LIMIT ?`
 
-SELECT LatLon, Velocity, Altitude, Heading FROM t_over where N=1 ORDER BY LastMsg`
+	rows := make([]historyRow, 0, 1000)
+	if err := chd.server.Select(ctx, &rows, query, q.Icao, q.CallSign, q.CallSign, q.From.UnixMilli(), q.To.UnixMilli(), limit); nil != err {
+		return nil, fmt.Errorf("unable to get aircraft location history: %w", err)
+	}
+	log.Debug().Int("num items", len(rows)).Str("icao", q.Icao).Str("callsign", q.CallSign).Msg("history")
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	if err := chd.server.Select(ctx, &history, query, icao, callSign); nil != err {
-		log.Error().Err(err).Str("query", query).Msg("Failed to get aircraft location history")
-		return history
+	points := make([]history.Point, len(rows))
+	for i, r := range rows {
+		points[i] = history.Point{
+			Time:     r.LastMsg,
+			Lat:      r.LatLon[0],
+			Lon:      r.LatLon[1],
+			Heading:  r.Heading,
+			Velocity: r.Velocity,
+			Altitude: r.Altitude,
+		}
 	}
-	log.Debug().Int("num items", len(history)).Str("query", query).Send()
+	return points, nil
+}
 
-	for i := range history {
-		history[i].Lat = history[i].LatLon[0]
-		history[i].Lon = history[i].LatLon[1]
+// ReplayUpdates gets (at most limit of) the updates recorded between from (inclusive) and to in the area, oldest first.
+// high picks every update (location_updates_high) rather than only the significant ones (location_updates_low)
+func (chd *ClickHouseData) ReplayUpdates(ctx context.Context, high bool, area tile_grid.GlobeIndexSpecialTile, from, to time.Time, limit int) ([]*export.PlaneLocation, error) {
+	table := "location_updates_low"
+	if high {
+		table = "location_updates_high"
+	}
+	lonCheck := "LatLon.2 >= ? AND LatLon.2 < ?"
+	if area.West > area.East {
+		// across the antimeridian
+		lonCheck = "(LatLon.2 >= ? OR LatLon.2 < ?)"
 	}
+	query := `SELECT Icao, LatLon, Heading, Velocity, Altitude, VerticalRate, AltitudeUnits, CallSign, FlightStatus, OnGround,
+       Airframe, AirframeType, HasLocation, HasHeading, HasVerticalRate, HasVelocity, SourceTags, Squawk, Special,
+       TrackedSince, LastMsg, FlagCode, Operator, RegisteredOwner, Registration, RouteCode, Serial, TileLocation, TypeCode
+FROM ` + table + `
+WHERE LastMsg >= fromUnixTimestamp64Milli(?) AND LastMsg < fromUnixTimestamp64Milli(?) AND HasLocation = 1
+  AND LatLon.1 > ? AND LatLon.1 <= ? AND ` + lonCheck + `
+ORDER BY LastMsg
+LIMIT ?`
 
-	return history
+	rows := make([]replayRow, 0, 1000)
+	if err := chd.server.Select(ctx, &rows, query, from.UnixMilli(), to.UnixMilli(), area.South, area.North, area.West, area.East, limit); nil != err {
+		return nil, fmt.Errorf("unable to get updates to replay: %w", err)
+	}
+	locations := make([]*export.PlaneLocation, len(rows))
+	for i := range rows {
+		locations[i] = rows[i].location()
+	}
+	return locations, nil
+}
+
+// location turns the row back into the update it was recorded from, as best we can
+func (r *replayRow) location() *export.PlaneLocation {
+	orNil := func(s string) *string {
+		if "" == s {
+			return nil
+		}
+		return &s
+	}
+	loc := &export.PlaneLocation{
+		Icao:            r.Icao,
+		Lat:             r.LatLon[0],
+		Lon:             r.LatLon[1],
+		Heading:         r.Heading,
+		Velocity:        r.Velocity,
+		Altitude:        int(r.Altitude),
+		VerticalRate:    int(r.VerticalRate),
+		OnGround:        r.OnGround,
+		HasAltitude:     0 != r.Altitude || r.OnGround,
+		HasLocation:     r.HasLocation,
+		HasHeading:      r.HasHeading,
+		HasVerticalRate: r.HasVerticalRate,
+		HasVelocity:     r.HasVelocity,
+		HasFlightStatus: "" != r.FlightStatus,
+		AltitudeUnits:   r.AltitudeUnits,
+		FlightStatus:    r.FlightStatus,
+		Airframe:        r.Airframe,
+		AirframeType:    r.AirframeType,
+		SourceTag:       "replay",
+		SourceTags:      r.SourceTags,
+		Special:         r.Special,
+		TileLocation:    r.TileLocation,
+		TrackedSince:    r.TrackedSince,
+		LastMsg:         r.LastMsg,
+		CallSign:        orNil(r.CallSign),
+		FlagCode:        orNil(r.FlagCode),
+		Operator:        orNil(r.Operator),
+		RegisteredOwner: orNil(r.RegisteredOwner),
+		Registration:    orNil(r.Registration),
+		RouteCode:       orNil(r.RouteCode),
+		Serial:          orNil(r.Serial),
+		TypeCode:        orNil(r.TypeCode),
+	}
+	if 0 != r.Squawk {
+		// squawks are stored as the number their 4 digits make
+		loc.Squawk = fmt.Sprintf("%04d", r.Squawk)
+	}
+	return loc
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/history"
+)
+
+const (
+	// historyQueryLimit is the most locations we get from clickhouse for a history, before simplifying it
+	historyQueryLimit = 100_000
+	// historyTimeout is how long we give clickhouse to get a history
+	historyTimeout = 10 * time.Second
+
+	historyFormatJson    = "json"
+	historyFormatGeoJson = "geojson"
+	historyFormatKml     = "kml"
+)
+
+var (
+	errNoHistory = errors.New("history is not available")
+
+	prometheusHistoryPoints = promauto.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: "pw_ws_broker",
+		Name:      "history_points",
+		Help:      "The number of locations we simplified each aircraft history from",
+		Buckets:   prometheus.ExponentialBuckets(10, 4, 8),
+	})
+)
+
+type (
+	// historyStore is where we get aircraft histories from (ClickHouseData)
+	historyStore interface {
+		History(ctx context.Context, q history.Query, limit int) ([]history.Point, error)
+	}
+)
+
+// loadHistory checks the query, gets the aircraft's history and simplifies it
+func (bw *PwWsBrokerWeb) loadHistory(ctx context.Context, q history.Query) (*history.Result, error) {
+	if nil == bw.historyStore {
+		return nil, errNoHistory
+	}
+	if err := q.Check(bw.historyMaxSpan, time.Now()); nil != err {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, historyTimeout)
+	defer cancel()
+	points, err := bw.historyStore.History(ctx, q, historyQueryLimit)
+	if nil != err {
+		return nil, err
+	}
+	prometheusHistoryPoints.Observe(float64(len(points)))
+	return history.Build(q, points), nil
+}
+
+// restHistory serves an aircraft's simplified history, /api/v1/history/{icao}. It takes callsign, from and to (RFC3339),
+// maxPoints, method, tolerance and format (json, geojson or kml)
+func (bw *PwWsBrokerWeb) restHistory(w http.ResponseWriter, r *http.Request) {
+	const endpoint = "history"
+	if !restMethodOk(w, r, endpoint) || nil == bw.restEntitled(w, r, endpoint, restAnyHistory) {
+		return
+	}
+	q, format, err := parseHistoryQuery(r)
+	if nil != err {
+		bw.restServe(w, r, endpoint, http.StatusBadRequest, restError{Error: err.Error()})
+		return
+	}
+
+	result, err := bw.loadHistory(r.Context(), q)
+	switch {
+	case errors.Is(err, history.ErrInvalidQuery):
+		bw.restServe(w, r, endpoint, http.StatusBadRequest, restError{Error: err.Error()})
+		return
+	case errors.Is(err, errNoHistory):
+		bw.restServe(w, r, endpoint, http.StatusServiceUnavailable, restError{Error: err.Error()})
+		return
+	case nil != err:
+		log.Error().Err(err).Str("icao", q.Icao).Msg("Failed to get aircraft history")
+		bw.restServe(w, r, endpoint, http.StatusInternalServerError, restError{Error: "Failed to get history"})
+		return
+	}
+
+	var rs *restResponse
+	switch format {
+	case historyFormatGeoJson:
+		var body []byte
+		if body, err = restJson.Marshal(result.GeoJSON()); nil == err {
+			rs = newRestBody(body, "application/geo+json")
+		}
+	case historyFormatKml:
+		var body []byte
+		if body, err = result.KML(); nil == err {
+			rs = newRestBody(body, "application/vnd.google-earth.kml+xml")
+		}
+	default:
+		rs, err = newRestResponse(result)
+	}
+	if nil != err {
+		log.Error().Err(err).Str("format", format).Msg("Failed to encode aircraft history")
+		prometheusRestRequests.WithLabelValues(endpoint, "500").Inc()
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	rs.serve(w, r, endpoint, http.StatusOK, 0, bw.private())
+}
+
+// parseHistoryQuery reads the history query (and the format to send it in) from the request
+func parseHistoryQuery(r *http.Request) (history.Query, string, error) {
+	params := r.URL.Query()
+	q := history.Query{
+		Icao:     strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/history/"), "/"),
+		CallSign: params.Get("callsign"),
+	}
+	q.Method = params.Get("method")
+
+	var err error
+	for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if v := params.Get(name); "" != v {
+			if *t, err = time.Parse(time.RFC3339, v); nil != err {
+				return q, "", errors.New(name + " must be an RFC3339 time")
+			}
+		}
+	}
+	if v := params.Get("maxPoints"); "" != v {
+		if q.MaxPoints, err = strconv.Atoi(v); nil != err {
+			return q, "", errors.New("maxPoints must be a number")
+		}
+	}
+	if v := params.Get("tolerance"); "" != v {
+		if q.Tolerance, err = strconv.ParseFloat(v, 64); nil != err {
+			return q, "", errors.New("tolerance must be a number")
+		}
+	}
+
+	format := strings.ToLower(params.Get("format"))
+	switch format {
+	case "":
+		format = historyFormatJson
+	case historyFormatJson, historyFormatGeoJson, historyFormatKml:
+	default:
+		return q, "", errors.New("format must be json, geojson or kml")
+	}
+	return q, format, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"nhooyr.io/websocket"
+	"plane.watch/lib/auth"
+	"plane.watch/lib/history"
+	"plane.watch/lib/ws_protocol"
+)
+
+type fakeHistoryStore struct {
+	queries []history.Query
+}
+
+// History is a minute of flying east, a point a second
+func (s *fakeHistoryStore) History(_ context.Context, q history.Query, limit int) ([]history.Point, error) {
+	s.queries = append(s.queries, q)
+	altitude := int32(10000)
+	points := make([]history.Point, 0, 60)
+	for i := 0; i < 60 && i < limit; i++ {
+		points = append(points, history.Point{
+			Time:     q.From.Add(time.Duration(i) * time.Second),
+			Lat:      -31.95,
+			Lon:      115.94 + float64(i)*0.001,
+			Velocity: 216,
+			Heading:  90,
+			Altitude: &altitude,
+		})
+	}
+	return points, nil
+}
+
+func newTestHistoryBroker(t *testing.T) (*PwWsBrokerWeb, *fakeHistoryStore) {
+	t.Helper()
+	bw := newTestRestBroker(t)
+	store := &fakeHistoryStore{}
+	bw.historyStore = store
+	bw.historyMaxSpan = 24 * time.Hour
+	return bw, store
+}
+
+func TestRestHistory(t *testing.T) {
+	bw, store := newTestHistoryBroker(t)
+
+	rs := restGet(t, bw, "/api/v1/history/7c6ca3?callsign=qfa9&from=2023-10-01T00:00:00Z&to=2023-10-01T01:00:00Z&maxPoints=10", nil)
+	if http.StatusOK != rs.StatusCode {
+		t.Fatalf("expected the history, got %d", rs.StatusCode)
+	}
+	var result history.Result
+	restDecode(t, rs, &result)
+	if 60 != result.Points || 10 != len(result.Path) || 10 != len(result.Profile) || "QFA9" != result.CallSign {
+		t.Errorf("expected 60 points simplified to 10, got %d of %d", len(result.Path), result.Points)
+	}
+	if q := store.queries[0]; "7C6CA3" != q.Icao || "QFA9" != q.CallSign || time.Hour != q.To.Sub(q.From) {
+		t.Errorf("expected the store to get the checked query, got %+v", q)
+	}
+
+	rs = restGet(t, bw, "/api/v1/history/7C6CA3?method=douglas-peucker&tolerance=5&format=geojson", nil)
+	if http.StatusOK != rs.StatusCode || "application/geo+json" != rs.Header.Get("Content-Type") {
+		t.Fatalf("expected geojson, got %d %s", rs.StatusCode, rs.Header.Get("Content-Type"))
+	}
+	var fc map[string]any
+	restDecode(t, rs, &fc)
+	if "FeatureCollection" != fc["type"] {
+		t.Errorf("expected a feature collection, got %v", fc)
+	}
+
+	rs = restGet(t, bw, "/api/v1/history/7C6CA3?format=kml", nil)
+	body, _ := io.ReadAll(rs.Body)
+	if http.StatusOK != rs.StatusCode || "application/vnd.google-earth.kml+xml" != rs.Header.Get("Content-Type") || !strings.Contains(string(body), "<LineString>") {
+		t.Errorf("expected kml, got %d %s", rs.StatusCode, body)
+	}
+
+	tests := map[string]string{
+		"bad icao":      "/api/v1/history/7C6CA3'%20OR%201=1",
+		"bad callsign":  "/api/v1/history/7C6CA3?callsign=QFA9'--",
+		"bad from":      "/api/v1/history/7C6CA3?from=yesterday",
+		"backwards":     "/api/v1/history/7C6CA3?from=2023-10-01T01:00:00Z&to=2023-10-01T00:00:00Z",
+		"too long":      "/api/v1/history/7C6CA3?from=2023-10-01T00:00:00Z&to=2023-10-03T00:00:00Z",
+		"bad maxPoints": "/api/v1/history/7C6CA3?maxPoints=lots",
+		"bad method":    "/api/v1/history/7C6CA3?method=rdp",
+		"bad format":    "/api/v1/history/7C6CA3?format=gpx",
+	}
+	for name, path := range tests {
+		if rs := restGet(t, bw, path, nil); http.StatusBadRequest != rs.StatusCode {
+			t.Errorf("%s: expected a bad request, got %d", name, rs.StatusCode)
+		}
+	}
+	if 3 != len(store.queries) {
+		t.Errorf("expected bad queries to not get to the store, got %d queries", len(store.queries))
+	}
+
+	bw.historyStore = nil
+	if rs := restGet(t, bw, "/api/v1/history/7C6CA3", nil); http.StatusServiceUnavailable != rs.StatusCode {
+		t.Errorf("expected history to be unavailable without a store, got %d", rs.StatusCode)
+	}
+}
+
+func TestRestHistory_Entitled(t *testing.T) {
+	bw := newTestAuthBroker(t)
+	bw.historyStore = &fakeHistoryStore{}
+	if rs := restGet(t, bw, "/api/v1/history/7C6CA3", nil); http.StatusForbidden != rs.StatusCode {
+		t.Errorf("expected anonymous clients to not get history, got %d", rs.StatusCode)
+	}
+	if rs := restGet(t, bw, "/api/v1/history/7C6CA3", map[string]string{auth.HeaderApiKey: "everything"}); http.StatusOK != rs.StatusCode {
+		t.Errorf("expected the history, got %d", rs.StatusCode)
+	}
+}
+
+func TestWsHistory(t *testing.T) {
+	bw, _ := newTestHistoryBroker(t)
+	server := httptest.NewServer(bw)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, strings.Replace(server.URL, "http://", "ws://", 1)+"/planes", &websocket.DialOptions{Subprotocols: []string{ws_protocol.WsProtocolPlanes}})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "") }()
+
+	json := jsoniter.ConfigFastest
+	request := func(rq ws_protocol.WsRequest) ws_protocol.WsResponse {
+		t.Helper()
+		buf, _ := json.Marshal(rq)
+		if err := conn.Write(ctx, websocket.MessageText, buf); nil != err {
+			t.Fatal(err)
+		}
+		_, frame, err := conn.Read(ctx)
+		if nil != err {
+			t.Fatal(err)
+		}
+		var rs ws_protocol.WsResponse
+		if err = json.Unmarshal(frame, &rs); nil != err {
+			t.Fatal(err)
+		}
+		return rs
+	}
+
+	rs := request(ws_protocol.WsRequest{Type: ws_protocol.RequestTypePlaneLocHistory, Icao: "7c6ca3", History: &history.Options{MaxPoints: 5}})
+	if ws_protocol.ResponseTypePlaneLocHistory != rs.Type || "7C6CA3" != rs.Icao || 5 != len(rs.History) || 5 != len(rs.Profile) {
+		t.Errorf("expected 5 points of history and profile, got %+v", rs)
+	}
+	rs = request(ws_protocol.WsRequest{Type: ws_protocol.RequestTypePlaneLocHistory, Icao: "nope"})
+	if ws_protocol.ResponseTypeError != rs.Type || !strings.Contains(rs.Message, "Unable to get history") {
+		t.Errorf("expected a bad icao to be an error, got %+v", rs)
+	}
+}
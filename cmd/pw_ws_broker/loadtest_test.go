@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"nhooyr.io/websocket"
+	"plane.watch/lib/export"
+	"plane.watch/lib/tile_grid"
+	"plane.watch/lib/ws_protocol"
+)
+
+// The load test runs a broker fed by made up aircraft and connects lots of clients to it, some of which read slowly.
+// It is skipped unless asked for:
+//
+//	go test ./cmd/pw_ws_broker -run TestLoad -v -loadtest -loadtest.clients 5000 -loadtest.slow 0.1
+var (
+	loadTest         = flag.Bool("loadtest", false, "run the websocket client load test")
+	loadClients      = flag.Int("loadtest.clients", 2000, "how many websocket clients to connect")
+	loadSlow         = flag.Float64("loadtest.slow", 0.05, "the fraction of clients that read slowly")
+	loadSlowDelay    = flag.Duration("loadtest.slow-delay", 250*time.Millisecond, "how long slow clients wait between reads")
+	loadAircraft     = flag.Int("loadtest.aircraft", 5000, "how many aircraft to make up")
+	loadRate         = flag.Int("loadtest.rate", 5000, "location updates per second")
+	loadDuration     = flag.Duration("loadtest.duration", 30*time.Second, "how long to run for")
+	loadSendTick     = flag.Duration("loadtest.send-tick", 0, "the brokers --send-tick, 0 sends every update on its own")
+	loadQueueSize    = flag.Int("loadtest.queue-size", 500, "the brokers --client-queue-size")
+	loadSlowTimeout  = flag.Duration("loadtest.slow-timeout", 10*time.Second, "the brokers --slow-client-timeout")
+	loadSubscription = flag.String("loadtest.sub", "all_high", "what each client subscribes to")
+	loadDelta        = flag.Bool("loadtest.delta", false, "have clients speak the planes-delta protocol")
+	loadKeyframe     = flag.Duration("loadtest.keyframe", 30*time.Second, "the brokers --delta-keyframe")
+)
+
+type (
+	// syntheticSource is a broker source that flies aircraft around in circles instead of reading from NATS
+	syntheticSource struct {
+		aircraft, rate int
+		processMessage processMessage
+		done           chan struct{}
+	}
+
+	loadClientStats struct {
+		frames, locations atomic.Int64
+		tooSlow           atomic.Int64
+		failed            atomic.Int64
+	}
+)
+
+func (s *syntheticSource) configure() error {
+	return nil
+}
+
+func (s *syntheticSource) setProcessMessage(f processMessage) {
+	s.processMessage = f
+}
+
+func (s *syntheticSource) setProcessEmergency(processEmergency) {}
+
+func (s *syntheticSource) setProcessGeofence(processGeofence) {}
+
+func (s *syntheticSource) close() {
+	close(s.done)
+}
+
+func (s *syntheticSource) HealthCheckName() string {
+	return "Synthetic Source"
+}
+
+func (s *syntheticSource) HealthCheck() bool {
+	return true
+}
+
+func (s *syntheticSource) consumeAll(chan bool) {
+	// send updates in batches every 10ms, there is no sleeping for the gap between each one
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	perTick := int(math.Max(1, float64(s.rate)/100))
+	n := 0
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-tick.C:
+			for i := 0; i < perTick; i++ {
+				n++
+				id := n % s.aircraft
+				angle := float64(n/s.aircraft) / 100
+				lat := -30 + 20*math.Sin(float64(id)) + math.Sin(angle)
+				lon := 120 + 40*math.Cos(float64(id)) + math.Cos(angle)
+				loc := &export.PlaneLocation{
+					Icao:         fmt.Sprintf("%06X", id),
+					Lat:          lat,
+					Lon:          lon,
+					HasLocation:  true,
+					TileLocation: tile_grid.LookupTile(lat, lon).Tile,
+					LastMsg:      time.Now(),
+				}
+				s.processMessage(ws_protocol.GridTileSuffixHigh, loc)
+				if 0 == n%10 {
+					s.processMessage(ws_protocol.GridTileSuffixLow, loc)
+				}
+			}
+		}
+	}
+}
+
+func loadClient(ctx context.Context, url string, slow bool, stats *loadClientStats) {
+	protocol := ws_protocol.WsProtocolPlanes
+	if *loadDelta {
+		protocol = ws_protocol.WsProtocolPlanesDelta
+	}
+	conn, _, err := websocket.Dial(ctx, url+"/planes?compress=false", &websocket.DialOptions{
+		Subprotocols: []string{protocol},
+	})
+	if nil != err {
+		stats.failed.Add(1)
+		return
+	}
+	conn.SetReadLimit(64 << 20)
+	// reading with a context that gets cancelled makes the websocket library spin, close the connection instead
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close(websocket.StatusNormalClosure, "done")
+	}()
+
+	json := jsoniter.ConfigFastest
+	rq, _ := json.Marshal(ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSubscribe, GridTile: *loadSubscription})
+	if err = conn.Write(ctx, websocket.MessageText, rq); nil != err {
+		stats.failed.Add(1)
+		return
+	}
+	for {
+		_, frame, errRead := conn.Read(context.Background())
+		if nil != errRead {
+			if nil == ctx.Err() && websocket.StatusPolicyViolation == websocket.CloseStatus(errRead) {
+				stats.tooSlow.Add(1)
+			}
+			return
+		}
+		stats.frames.Add(1)
+		rs := ws_protocol.WsResponse{}
+		if nil == json.Unmarshal(frame, &rs) {
+			stats.locations.Add(int64(len(rs.Locations) + len(rs.Deltas)))
+			if nil != rs.Location {
+				stats.locations.Add(1)
+			}
+		}
+		if slow {
+			select {
+			case <-time.After(*loadSlowDelay):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	if !*loadTest {
+		t.Skip("load test not requested, run with -loadtest")
+	}
+
+	src := &syntheticSource{aircraft: *loadAircraft, rate: *loadRate, done: make(chan struct{})}
+	broker, err := NewPlaneWatchWebSocketBroker(src, nil, "", "", "", false, *loadSendTick, *loadQueueSize, *loadSlowTimeout, *loadKeyframe, 0, 0, 0, []int{2, 4, 6, 8, 10}, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err = broker.Setup(); nil != err {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(&broker.PwWsBrokerWeb)
+	defer server.Close()
+	defer src.close()
+	url := strings.Replace(server.URL, "http://", "ws://", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *loadDuration)
+	defer cancel()
+
+	var fast, slow loadClientStats
+	var wg sync.WaitGroup
+	numSlow := int(float64(*loadClients) * *loadSlow)
+	for i := 0; i < *loadClients; i++ {
+		wg.Add(1)
+		go func(isSlow bool) {
+			defer wg.Done()
+			if isSlow {
+				loadClient(ctx, url, true, &slow)
+			} else {
+				loadClient(ctx, url, false, &fast)
+			}
+		}(i < numSlow)
+	}
+	go src.consumeAll(nil)
+
+	started := time.Now()
+	maxGoroutines := 0
+	report := time.NewTicker(time.Second)
+	defer report.Stop()
+	for running := true; running; {
+		select {
+		case <-ctx.Done():
+			running = false
+		case <-report.C:
+			if g := runtime.NumGoroutine(); g > maxGoroutines {
+				maxGoroutines = g
+			}
+			t.Logf("%3.0fs: %d fast clients got %d frames (%d locations), %d slow clients got %d frames, %d queued, %d goroutines",
+				time.Since(started).Seconds(),
+				*loadClients-numSlow, fast.frames.Load(), fast.locations.Load(),
+				numSlow, slow.frames.Load(),
+				int(testutil.ToFloat64(prometheusQueuedMessages)),
+				runtime.NumGoroutine(),
+			)
+		}
+	}
+	wg.Wait()
+
+	t.Logf("clients: %d fast, %d slow, %d failed to connect", *loadClients-numSlow, numSlow, fast.failed.Load()+slow.failed.Load())
+	t.Logf("disconnected for being too slow: %d slow clients, %d fast clients", slow.tooSlow.Load(), fast.tooSlow.Load())
+	t.Logf("coalesced %.0f updates, dropped %.0f (queue full) and %.0f (inbound full)",
+		testutil.ToFloat64(prometheusCoalescedMessages),
+		testutil.ToFloat64(prometheusDroppedMessages.WithLabelValues("queue_full")),
+		testutil.ToFloat64(prometheusDroppedMessages.WithLabelValues("inbound_full")),
+	)
+	t.Logf("%.0f clients disconnected by the broker for being too slow", testutil.ToFloat64(prometheusSlowClients))
+	t.Logf("at most %d goroutines", maxGoroutines)
+	for _, protocol := range []string{ws_protocol.WsProtocolPlanes, ws_protocol.WsProtocolPlanesDelta} {
+		if sent := testutil.ToFloat64(prometheusLocationsSent.WithLabelValues(protocol)); sent > 0 {
+			t.Logf("%s: %.0f locations sent in %.0f bytes, %.0f bytes each", protocol, sent,
+				testutil.ToFloat64(prometheusLocationBytes.WithLabelValues(protocol)),
+				testutil.ToFloat64(prometheusLocationBytes.WithLabelValues(protocol))/sent)
+		}
+	}
+
+	if fast.tooSlow.Load() > 0 {
+		t.Errorf("%d clients that were keeping up got disconnected", fast.tooSlow.Load())
+	}
+}
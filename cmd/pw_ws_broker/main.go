@@ -2,7 +2,9 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"plane.watch/lib/auth"
 	"plane.watch/lib/nats_io"
 	"time"
 
@@ -12,6 +14,7 @@ import (
 	"github.com/urfave/cli/v2"
 	"plane.watch/lib/logging"
 	"plane.watch/lib/monitoring"
+	"plane.watch/lib/tile_grid"
 )
 
 var (
@@ -45,6 +48,22 @@ var (
 		Name:      "messages_size",
 		Help:      "the raw size of messages sent (before compression)",
 	})
+	prometheusLocationBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "pw_ws_broker",
+			Name:      "location_bytes",
+			Help:      "The raw size of location updates sent (before compression), by websocket protocol",
+		},
+		[]string{"protocol"},
+	)
+	prometheusLocationsSent = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "pw_ws_broker",
+			Name:      "locations_sent",
+			Help:      "The number of aircraft location updates sent, by websocket protocol",
+		},
+		[]string{"protocol"},
+	)
 	prometheusSubscriptions = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Subsystem: "pw_ws_broker",
@@ -104,6 +123,17 @@ func main() {
 			Value:   "location-updates-enriched-merged",
 			EnvVars: []string{"ROUTE_KEY_HIGH"},
 		},
+		&cli.StringFlag{
+			Name:    "route-key-emergencies",
+			Usage:   "The routing key that has emergency start and end events, these are sent to every client. Empty to disable",
+			Value:   "emergencies",
+			EnvVars: []string{"ROUTE_KEY_EMERGENCIES"},
+		},
+		&cli.BoolFlag{
+			Name:    "geofences",
+			Usage:   "Pass on the events pw_router publishes for its geofences, clients subscribe to geofence.<id>",
+			EnvVars: []string{"GEOFENCES"},
+		},
 		&cli.StringFlag{
 			Name:    "http-addr",
 			Usage:   "What the HTTP server listens on",
@@ -134,6 +164,53 @@ func main() {
 			EnvVars: []string{"SEND_TICK"},
 			Value:   500 * time.Millisecond,
 		},
+		&cli.IntFlag{
+			Name:    "client-queue-size",
+			Usage:   "How many messages can wait to be sent to a client before location updates are merged (by aircraft) or dropped",
+			Value:   500,
+			EnvVars: []string{"CLIENT_QUEUE_SIZE"},
+		},
+		&cli.DurationFlag{
+			Name:    "slow-client-timeout",
+			Usage:   "Disconnect clients that have not caught up with their queue for this long. 0 to never disconnect",
+			Value:   30 * time.Second,
+			EnvVars: []string{"SLOW_CLIENT_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "delta-keyframe",
+			Usage:   "How often clients speaking the planes-delta protocol are sent every field of an aircraft, not just what changed. 0 for only the first time",
+			Value:   30 * time.Second,
+			EnvVars: []string{"DELTA_KEYFRAME"},
+		},
+		&cli.IntFlag{
+			Name:    "max-replays",
+			Usage:   "How many replays (of what we recorded in clickhouse) each client can play at once. 0 turns replays off",
+			Value:   2,
+			EnvVars: []string{"MAX_REPLAYS"},
+		},
+		&cli.DurationFlag{
+			Name:    "replay-max-span",
+			Usage:   "The longest stretch of time a client can replay at once",
+			Value:   6 * time.Hour,
+			EnvVars: []string{"REPLAY_MAX_SPAN"},
+		},
+		&cli.DurationFlag{
+			Name:    "history-max-span",
+			Usage:   "The longest stretch of an aircraft's history a client can get at once",
+			Value:   24 * time.Hour,
+			EnvVars: []string{"HISTORY_MAX_SPAN"},
+		},
+		&cli.StringFlag{
+			Name:    "tile-levels",
+			Usage:   "The slippy map cell levels clients can subscribe to (z<z>-<x>-<y>_low and _high, or by viewport with sub-bbox).",
+			Value:   "2,4,6,8,10",
+			EnvVars: []string{"TILE_LEVELS"},
+		},
+		&cli.StringFlag{
+			Name:    "auth-config",
+			Usage:   "A YAML file with the API keys, JWT key set and anonymous entitlements clients are held to. Without it, everyone can do everything",
+			EnvVars: []string{"AUTH_CONFIG"},
+		},
 	}
 
 	logging.IncludeVerbosityFlags(app)
@@ -169,6 +246,18 @@ func run(c *cli.Context) error {
 		return c.Set("http-addr", ":443")
 	}
 
+	tileLevels, err := tile_grid.ParseLevels(c.String("tile-levels"))
+	if nil != err {
+		return err
+	}
+
+	var authenticator auth.Authenticator
+	if authConfig := c.String("auth-config"); "" != authConfig {
+		if authenticator, err = auth.Load(authConfig); nil != err {
+			return fmt.Errorf("failed to load auth config %s: %w", authConfig, err)
+		}
+	}
+
 	monitoring.RunWebServer(c)
 
 	nats := c.String("nats")
@@ -199,7 +288,6 @@ func run(c *cli.Context) error {
 		return errors.New("clickhouse URL must be specified")
 	}
 
-	var err error
 	GlobalClickHouseData, err = NewClickHouseData(clickHouseUrl)
 	if nil != err {
 		return err
@@ -208,7 +296,7 @@ func run(c *cli.Context) error {
 	var natsServerRpc *nats_io.Server
 
 	var input source
-	input, err = NewPwWsBrokerNats(nats, lowRoute, highRoute)
+	input, err = NewPwWsBrokerNats(nats, lowRoute, highRoute, c.String("route-key-emergencies"), c.Bool("geofences"))
 	natsServerRpc, _ = nats_io.NewServer(nats_io.WithServer(nats, "pw_ws_broker+rpc"))
 	if nil != err {
 		return err
@@ -222,6 +310,14 @@ func run(c *cli.Context) error {
 		c.String("tls-cert-key"),
 		c.Bool("serve-test-web"),
 		c.Duration("send-tick"),
+		c.Int("client-queue-size"),
+		c.Duration("slow-client-timeout"),
+		c.Duration("delta-keyframe"),
+		c.Int("max-replays"),
+		c.Duration("replay-max-span"),
+		c.Duration("history-max-span"),
+		tileLevels,
+		authenticator,
 	)
 	if nil != err {
 		return err
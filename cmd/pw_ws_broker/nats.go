@@ -13,12 +13,17 @@ import (
 type (
 	PwWsBrokerNats struct {
 		routeLow, routeHigh string
-		server              *nats_io.Server
-		processMessage      processMessage
+		routeEmergency      string
+		// geofences is true when we pass on the geofence events pw_router publishes
+		geofences        bool
+		server           *nats_io.Server
+		processMessage   processMessage
+		processEmergency processEmergency
+		processGeofence  processGeofence
 	}
 )
 
-func NewPwWsBrokerNats(url, routeLow, routeHigh string) (*PwWsBrokerNats, error) {
+func NewPwWsBrokerNats(url, routeLow, routeHigh, routeEmergency string, geofences bool) (*PwWsBrokerNats, error) {
 	svr, err := nats_io.NewServer(nats_io.WithServer(url, "pw_ws_broker"))
 	if nil != err {
 		return nil, err
@@ -28,9 +33,11 @@ func NewPwWsBrokerNats(url, routeLow, routeHigh string) (*PwWsBrokerNats, error)
 		Help: "The total number slow consumer dropped message errors.",
 	}))
 	return &PwWsBrokerNats{
-		routeLow:  routeLow,
-		routeHigh: routeHigh,
-		server:    svr,
+		routeLow:       routeLow,
+		routeHigh:      routeHigh,
+		routeEmergency: routeEmergency,
+		geofences:      geofences,
+		server:         svr,
 	}, nil
 }
 
@@ -42,6 +49,14 @@ func (n *PwWsBrokerNats) setProcessMessage(f processMessage) {
 	n.processMessage = f
 }
 
+func (n *PwWsBrokerNats) setProcessEmergency(f processEmergency) {
+	n.processEmergency = f
+}
+
+func (n *PwWsBrokerNats) setProcessGeofence(f processGeofence) {
+	n.processGeofence = f
+}
+
 func (n *PwWsBrokerNats) consume(exitChan chan bool, subject, what string) {
 	log.Debug().Str("Nats Consume", subject).Str("what", what).Send()
 	ch, err := n.server.Subscribe(subject)
@@ -57,10 +72,10 @@ func (n *PwWsBrokerNats) consume(exitChan chan bool, subject, what string) {
 	worker := func() {
 		for msg := range ch {
 			planeData := export.PlaneLocation{}
-			var json = jsoniter.ConfigFastest
-			errJson := json.Unmarshal(msg.Data, &planeData)
-			if nil != errJson {
-				log.Debug().Err(err).Msg("did not understand msg")
+			// pw_router sends JSON or protobuf, the content-type header tells us which
+			errDecode := export.DecodePlaneLocation(msg.Header.Get(export.HeaderContentType), msg.Data, &planeData)
+			if nil != errDecode {
+				log.Debug().Err(errDecode).Msg("did not understand msg")
 				continue
 			}
 			n.processMessage(what, &planeData)
@@ -80,9 +95,66 @@ func (n *PwWsBrokerNats) consume(exitChan chan bool, subject, what string) {
 	exitChan <- true
 }
 
+// consumeEmergencies listens for emergency start/end events from pw_router
+func (n *PwWsBrokerNats) consumeEmergencies(exitChan chan bool) {
+	ch, err := n.server.Subscribe(n.routeEmergency)
+	if nil != err {
+		log.Error().
+			Err(err).
+			Str("subject", n.routeEmergency).
+			Msg("Failed to consume emergencies")
+		return
+	}
+	var json = jsoniter.ConfigFastest
+	for msg := range ch {
+		ee := export.EmergencyEvent{}
+		if err = json.Unmarshal(msg.Data, &ee); nil != err {
+			log.Debug().Err(err).Msg("did not understand emergency msg")
+			continue
+		}
+		n.processEmergency(&ee)
+	}
+	log.Info().
+		Str("subject", n.routeEmergency).
+		Msg("Finished Consuming Emergencies")
+	exitChan <- true
+}
+
+// consumeGeofences listens for the events pw_router publishes for every geofence
+func (n *PwWsBrokerNats) consumeGeofences(exitChan chan bool) {
+	subject := export.NatsGeofencePrefix + ">"
+	ch, err := n.server.Subscribe(subject)
+	if nil != err {
+		log.Error().
+			Err(err).
+			Str("subject", subject).
+			Msg("Failed to consume geofences")
+		return
+	}
+	var json = jsoniter.ConfigFastest
+	for msg := range ch {
+		ge := export.GeofenceEvent{}
+		if err = json.Unmarshal(msg.Data, &ge); nil != err {
+			log.Debug().Err(err).Msg("did not understand geofence msg")
+			continue
+		}
+		n.processGeofence(&ge)
+	}
+	log.Info().
+		Str("subject", subject).
+		Msg("Finished Consuming Geofences")
+	exitChan <- true
+}
+
 func (n *PwWsBrokerNats) consumeAll(exitChan chan bool) {
 	go n.consume(exitChan, n.routeLow, "_low")
 	go n.consume(exitChan, n.routeHigh, "_high")
+	if "" != n.routeEmergency {
+		go n.consumeEmergencies(exitChan)
+	}
+	if n.geofences {
+		go n.consumeGeofences(exitChan)
+	}
 }
 
 func (n *PwWsBrokerNats) close() {
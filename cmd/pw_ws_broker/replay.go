@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"plane.watch/lib/export"
+	"plane.watch/lib/tile_grid"
+	"plane.watch/lib/ws_protocol"
+)
+
+const (
+	// replayTick is how often a replay sends what happened (in the recording) since its last tick
+	replayTick = 250 * time.Millisecond
+	// replayWindow is how much of the recording we get from clickhouse at a time, and how far back we look for
+	// where each aircraft was when a replay starts or seeks
+	replayWindow = time.Minute
+	// replayQueryLimit is the most updates we get from clickhouse at a time, busy windows are got in pieces
+	replayQueryLimit = 20_000
+)
+
+var (
+	errReplayStopped  = errors.New("replay stopped")
+	errReplayFinished = errors.New("replay finished")
+
+	prometheusReplays = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "pw_ws_broker",
+		Name:      "replays",
+		Help:      "The number of replays being played back to clients",
+	})
+)
+
+type (
+	// replayStore is where we get the recorded updates from (ClickHouseData)
+	replayStore interface {
+		ReplayUpdates(ctx context.Context, high bool, area tile_grid.GlobeIndexSpecialTile, from, to time.Time, limit int) ([]*export.PlaneLocation, error)
+	}
+
+	replayControl struct {
+		action string
+		at     time.Time
+		speed  float64
+	}
+
+	// replay plays back the updates recorded for an area to a client, as the same plane-location-list messages live
+	// updates are sent in
+	replay struct {
+		store  replayStore
+		send   func(*ws_protocol.WsResponse) error
+		filter *ws_protocol.CompiledFilter
+		area   tile_grid.GlobeIndexSpecialTile
+		high   bool
+		limit  int
+
+		state   ws_protocol.ReplayState
+		control chan replayControl
+		done    chan struct{}
+
+		// pending is what we have got from the store but not sent yet, everything up to loadedTo
+		pending  []*export.PlaneLocation
+		loadedTo time.Time
+
+		log zerolog.Logger
+	}
+)
+
+// newReplay gets a (checked) replay ready to play, send is how it sends the client messages
+func newReplay(id string, rq *ws_protocol.Replay, store replayStore, filter *ws_protocol.CompiledFilter, send func(*ws_protocol.WsResponse) error, logger zerolog.Logger) (*replay, error) {
+	area, high, err := rq.Area()
+	if nil != err {
+		return nil, err
+	}
+	return &replay{
+		store:  store,
+		send:   send,
+		filter: filter,
+		area:   area,
+		high:   high,
+		limit:  replayQueryLimit,
+		state: ws_protocol.ReplayState{
+			Id:    id,
+			Start: rq.Start,
+			End:   rq.End,
+			At:    rq.Start,
+			Speed: rq.Speed,
+		},
+		control: make(chan replayControl, 5),
+		done:    make(chan struct{}),
+		log:     logger.With().Str("replay", id).Logger(),
+	}, nil
+}
+
+// run plays the replay until it gets to the end, is stopped or the context is done
+func (r *replay) run(ctx context.Context) {
+	defer close(r.done)
+	prometheusReplays.Inc()
+	defer prometheusReplays.Dec()
+
+	err := r.seek(ctx, r.state.Start)
+	ticker := time.NewTicker(replayTick)
+	defer ticker.Stop()
+	for nil == err {
+		select {
+		case <-ctx.Done():
+			return
+		case ctl := <-r.control:
+			err = r.apply(ctx, ctl)
+		case <-ticker.C:
+			if !r.state.Paused {
+				err = r.tick(ctx)
+			}
+		}
+	}
+	if nil != ctx.Err() {
+		return
+	}
+
+	reason := "finished"
+	switch {
+	case errors.Is(err, errReplayStopped):
+		reason = "stopped"
+	case !errors.Is(err, errReplayFinished):
+		r.log.Error().Err(err).Msg("Replay failed")
+		reason = "failed"
+	}
+	state := r.state
+	_ = r.send(&ws_protocol.WsResponse{
+		Type:    ws_protocol.ResponseTypeReplayEnd,
+		Message: reason,
+		Replay:  &state,
+	})
+}
+
+// apply does what the client asked of the replay, and tells it where the replay is up to
+func (r *replay) apply(ctx context.Context, ctl replayControl) error {
+	switch ctl.action {
+	case ws_protocol.RequestTypeReplayStop:
+		return errReplayStopped
+	case ws_protocol.RequestTypeReplayPause:
+		r.state.Paused = true
+	case ws_protocol.RequestTypeReplayResume:
+		r.state.Paused = false
+	case ws_protocol.RequestTypeReplaySpeed:
+		r.state.Speed = ctl.speed
+	case ws_protocol.RequestTypeReplaySeek:
+		return r.seek(ctx, ctl.at)
+	}
+	return r.sendState()
+}
+
+// sendState acks the client with where the replay is up to
+func (r *replay) sendState() error {
+	state := r.state
+	return r.send(&ws_protocol.WsResponse{
+		Type:   ws_protocol.ResponseTypeAckReplay,
+		Replay: &state,
+	})
+}
+
+// seek jumps to at, acks and then sends where each aircraft was (in the last replayWindow) at that point
+func (r *replay) seek(ctx context.Context, at time.Time) error {
+	if at.Before(r.state.Start) {
+		at = r.state.Start
+	}
+	if at.After(r.state.End) {
+		at = r.state.End
+	}
+	r.state.At = at
+	r.pending = nil
+	r.loadedTo = at.Add(-replayWindow)
+	if err := r.sendState(); nil != err {
+		return err
+	}
+	return r.sendUntil(ctx, at)
+}
+
+// tick moves the replay on by replayTick (times its speed), sending what happened in that time
+func (r *replay) tick(ctx context.Context) error {
+	next := r.state.At.Add(time.Duration(float64(replayTick) * r.state.Speed))
+	if next.After(r.state.End) {
+		next = r.state.End
+	}
+	if err := r.sendUntil(ctx, next); nil != err {
+		return err
+	}
+	if !r.state.At.Before(r.state.End) {
+		return errReplayFinished
+	}
+	return nil
+}
+
+// sendUntil sends everything up to (not including) until, only the latest update for each aircraft like a send tick
+func (r *replay) sendUntil(ctx context.Context, until time.Time) error {
+	for r.loadedTo.Before(until) {
+		if err := r.load(ctx, until); nil != err {
+			return err
+		}
+	}
+	n := sort.Search(len(r.pending), func(i int) bool {
+		return !r.pending[i].LastMsg.Before(until)
+	})
+	batch := r.pending[:n]
+	r.pending = r.pending[n:]
+	r.state.At = until
+
+	latest := make(map[string]int, len(batch))
+	locations := make([]*export.PlaneLocation, 0, len(batch))
+	for _, loc := range batch {
+		if nil != r.filter && !r.filter.Matches(loc) {
+			continue
+		}
+		if i, ok := latest[loc.Icao]; ok {
+			locations[i] = loc
+			continue
+		}
+		latest[loc.Icao] = len(locations)
+		locations = append(locations, loc)
+	}
+	if 0 == len(locations) {
+		return nil
+	}
+	state := r.state
+	return r.send(&ws_protocol.WsResponse{
+		Type:      ws_protocol.ResponseTypePlaneLocations,
+		Locations: locations,
+		Replay:    &state,
+	})
+}
+
+// load gets the next window of the recording (at least up to until) from the store
+func (r *replay) load(ctx context.Context, until time.Time) error {
+	to := r.loadedTo.Add(replayWindow)
+	if to.Before(until) {
+		to = until
+	}
+	if to.After(r.state.End) {
+		to = r.state.End
+	}
+	queryCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	locations, err := r.store.ReplayUpdates(queryCtx, r.high, r.area, r.loadedTo, to, r.limit)
+	if nil != err {
+		return err
+	}
+	if len(locations) >= r.limit {
+		// there is more than we asked for, carry on from the last update next time. Leave out the updates at that
+		// same time, we get them again then
+		last := locations[len(locations)-1].LastMsg
+		n := len(locations)
+		for n > 0 && locations[n-1].LastMsg.Equal(last) {
+			n--
+		}
+		if n > 0 {
+			locations, to = locations[:n], last
+		}
+	}
+	r.pending = append(r.pending, locations...)
+	r.loadedTo = to
+	return nil
+}
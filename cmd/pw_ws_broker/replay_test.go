@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/export"
+	"plane.watch/lib/tile_grid"
+	"plane.watch/lib/ws_protocol"
+)
+
+// fakeReplayStore has an update every 10 seconds for two aircraft
+type fakeReplayStore struct {
+	updates []*export.PlaneLocation
+	queries int
+}
+
+func newFakeReplayStore(start time.Time, d time.Duration) *fakeReplayStore {
+	s := &fakeReplayStore{}
+	for t := start.Add(-2 * time.Minute); t.Before(start.Add(d)); t = t.Add(10 * time.Second) {
+		for _, icao := range []string{"7C6CA3", "7C0001"} {
+			s.updates = append(s.updates, &export.PlaneLocation{Icao: icao, Lat: -32, Lon: 116, HasLocation: true, LastMsg: t})
+		}
+	}
+	return s
+}
+
+func (s *fakeReplayStore) ReplayUpdates(_ context.Context, _ bool, _ tile_grid.GlobeIndexSpecialTile, from, to time.Time, limit int) ([]*export.PlaneLocation, error) {
+	s.queries++
+	i := sort.Search(len(s.updates), func(i int) bool {
+		return !s.updates[i].LastMsg.Before(from)
+	})
+	var out []*export.PlaneLocation
+	for ; i < len(s.updates) && s.updates[i].LastMsg.Before(to) && len(out) < limit; i++ {
+		out = append(out, s.updates[i])
+	}
+	return out, nil
+}
+
+func startTestReplay(t *testing.T, store replayStore, rq ws_protocol.Replay, limit int) (*replay, chan *ws_protocol.WsResponse) {
+	t.Helper()
+	if err := rq.Check(time.Hour, time.Now()); nil != err {
+		t.Fatal(err)
+	}
+	sent := make(chan *ws_protocol.WsResponse, 1000)
+	r, err := newReplay("r1", &rq, store, nil, func(rs *ws_protocol.WsResponse) error {
+		sent <- rs
+		return nil
+	}, log.Logger)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if limit > 0 {
+		r.limit = limit
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go r.run(ctx)
+	return r, sent
+}
+
+// next waits for the next message the replay sends
+func next(t *testing.T, sent chan *ws_protocol.WsResponse) *ws_protocol.WsResponse {
+	t.Helper()
+	select {
+	case rs := <-sent:
+		return rs
+	case <-time.After(5 * time.Second):
+		t.Fatal("replay did not send anything")
+	}
+	return nil
+}
+
+// nextOf waits for the next message of the type, skipping any updates from ticks in flight
+func nextOf(t *testing.T, sent chan *ws_protocol.WsResponse, rsType string) *ws_protocol.WsResponse {
+	t.Helper()
+	for {
+		if rs := next(t, sent); rsType == rs.Type {
+			return rs
+		}
+	}
+}
+
+func TestReplay_PlaysToTheEnd(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	store := newFakeReplayStore(start, 2*time.Minute)
+	_, sent := startTestReplay(t, store, ws_protocol.Replay{Start: start, End: start.Add(time.Minute), GridTile: "tile38_low", Speed: 100}, 7)
+
+	if rs := next(t, sent); ws_protocol.ResponseTypeAckReplay != rs.Type || "r1" != rs.Replay.Id {
+		t.Fatalf("expected an ack first, got %+v", rs)
+	}
+	// where everything was when the replay starts
+	rs := next(t, sent)
+	if ws_protocol.ResponseTypePlaneLocations != rs.Type || 2 != len(rs.Locations) || !rs.Locations[0].LastMsg.Equal(start.Add(-10*time.Second)) {
+		t.Fatalf("expected the aircraft as they were at the start, got %+v", rs)
+	}
+
+	var last time.Time
+	for {
+		rs = next(t, sent)
+		if ws_protocol.ResponseTypeReplayEnd == rs.Type {
+			break
+		}
+		for _, loc := range rs.Locations {
+			if loc.LastMsg.Before(start) || !loc.LastMsg.Before(start.Add(time.Minute)) {
+				t.Errorf("update at %s is outside the replay", loc.LastMsg)
+			}
+			if loc.LastMsg.Before(last) {
+				t.Errorf("updates went back in time, %s after %s", loc.LastMsg, last)
+			}
+			last = loc.LastMsg
+		}
+	}
+	if "finished" != rs.Message || !rs.Replay.At.Equal(start.Add(time.Minute)) {
+		t.Errorf("expected the replay to finish at its end, got %s at %s", rs.Message, rs.Replay.At)
+	}
+	if !last.Equal(start.Add(50 * time.Second)) {
+		t.Errorf("expected to be sent the last update, got up to %s", last)
+	}
+	if store.queries < 2 {
+		t.Errorf("expected the store to be asked in pieces, asked %d times", store.queries)
+	}
+}
+
+func TestReplay_Controls(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	store := newFakeReplayStore(start, 30*time.Minute)
+	r, sent := startTestReplay(t, store, ws_protocol.Replay{Start: start, End: start.Add(30 * time.Minute), GridTile: "tile38_low"}, 0)
+	next(t, sent) // ack
+	next(t, sent) // where everything was
+
+	r.control <- replayControl{action: ws_protocol.RequestTypeReplayPause}
+	if rs := nextOf(t, sent, ws_protocol.ResponseTypeAckReplay); !rs.Replay.Paused {
+		t.Fatalf("expected the pause to be acked, got %+v", rs.Replay)
+	}
+
+	at := start.Add(20 * time.Minute)
+	r.control <- replayControl{action: ws_protocol.RequestTypeReplaySeek, at: at}
+	if rs := next(t, sent); ws_protocol.ResponseTypeAckReplay != rs.Type || !rs.Replay.At.Equal(at) || !rs.Replay.Paused {
+		t.Fatalf("expected the seek to be acked, still paused, got %+v", rs)
+	}
+	rs := next(t, sent)
+	if 2 != len(rs.Locations) || !rs.Locations[0].LastMsg.Equal(at.Add(-10*time.Second)) {
+		t.Fatalf("expected the aircraft as they were where we seeked to, got %+v", rs.Locations)
+	}
+
+	r.control <- replayControl{action: ws_protocol.RequestTypeReplaySpeed, speed: 50}
+	if rs = next(t, sent); 50 != rs.Replay.Speed {
+		t.Errorf("expected the speed change to be acked, got %+v", rs.Replay)
+	}
+
+	r.control <- replayControl{action: ws_protocol.RequestTypeReplayStop}
+	if rs = nextOf(t, sent, ws_protocol.ResponseTypeReplayEnd); "stopped" != rs.Message {
+		t.Errorf("expected the replay to stop, got %+v", rs)
+	}
+	select {
+	case <-r.done:
+	case <-time.After(time.Second):
+		t.Error("expected the replay to be done")
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/auth"
+	"plane.watch/lib/export"
+	"plane.watch/lib/tile_grid"
+	"plane.watch/lib/tracker"
+)
+
+// restJson is jsoniter.ConfigFastest with sorted map keys, so the same aircraft always has the same ETag
+var restJson = jsoniter.Config{
+	EscapeHTML:                    false,
+	MarshalFloatWith6Digits:       true,
+	ObjectFieldMustBeSimpleString: true,
+	SortMapKeys:                   true,
+}.Froze()
+
+// aircraftJsonCacheFor is how long we hand out the same aircraft.json for, map front ends poll it every second or so
+const aircraftJsonCacheFor = time.Second
+
+var (
+	prometheusRestRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "pw_ws_broker",
+			Name:      "rest_requests",
+			Help:      "The number of REST (and aircraft.json) requests, by endpoint and status code",
+		},
+		[]string{"endpoint", "code"},
+	)
+
+	// readsbEmergencies is what our emergency reasons are called in aircraft.json
+	readsbEmergencies = map[string]string{
+		tracker.EmergencyGeneral:              "general",
+		tracker.EmergencyMedical:              "lifeguard",
+		tracker.EmergencyMinimumFuel:          "minfuel",
+		tracker.EmergencyNoCommunications:     "nordo",
+		tracker.EmergencyUnlawfulInterference: "unlawful",
+		tracker.EmergencyDowned:               "downed",
+	}
+)
+
+type (
+	// restResponse is a json (unless contentType says otherwise) response, ready to send
+	restResponse struct {
+		body        []byte
+		contentType string
+		etag        string
+		gzip        []byte
+		gzipOnce    sync.Once
+	}
+
+	// aircraftJsonCache is the aircraft.json we made last, it is the same for everyone entitled to it (all_tiles)
+	aircraftJsonCache struct {
+		mu    sync.Mutex
+		built time.Time
+		rs    *restResponse
+	}
+
+	// readsbAircraftJson is aircraft.json, as dump1090 and readsb write it (and tar1090 and friends read it)
+	readsbAircraftJson struct {
+		Now      float64          `json:"now"`
+		Messages uint64           `json:"messages"`
+		Aircraft []readsbAircraft `json:"aircraft"`
+	}
+
+	readsbAircraft struct {
+		Hex          string   `json:"hex"`
+		Type         string   `json:"type"`
+		Flight       string   `json:"flight,omitempty"`
+		Registration string   `json:"r,omitempty"`
+		TypeCode     string   `json:"t,omitempty"`
+		Operator     string   `json:"ownOp,omitempty"`
+		AltBaro      any      `json:"alt_baro,omitempty"` // feet, or "ground"
+		Gs           *float64 `json:"gs,omitempty"`
+		Track        *float64 `json:"track,omitempty"`
+		BaroRate     *int     `json:"baro_rate,omitempty"`
+		Squawk       string   `json:"squawk,omitempty"`
+		Emergency    string   `json:"emergency,omitempty"`
+		Category     string   `json:"category,omitempty"`
+		Lat          *float64 `json:"lat,omitempty"`
+		Lon          *float64 `json:"lon,omitempty"`
+		SeenPos      *float64 `json:"seen_pos,omitempty"`
+		Seen         float64  `json:"seen"`
+		Rssi         *float64 `json:"rssi,omitempty"`
+		Messages     uint32   `json:"messages"`
+	}
+
+	// restAircraftList is what the api sends for a list of aircraft
+	restAircraftList struct {
+		Now      time.Time               `json:"now"`
+		Aircraft []*export.PlaneLocation `json:"aircraft"`
+	}
+
+	restError struct {
+		Error string `json:"error"`
+	}
+)
+
+// newRestResponse encodes v, ready to send
+func newRestResponse(v any) (*restResponse, error) {
+	body, err := restJson.Marshal(v)
+	if nil != err {
+		return nil, err
+	}
+	return newRestBody(body, "application/json"), nil
+}
+
+// newRestBody is a response that is already encoded
+func newRestBody(body []byte, contentType string) *restResponse {
+	return &restResponse{
+		body:        body,
+		contentType: contentType,
+		etag:        fmt.Sprintf(`"%X"`, md5.Sum(body)),
+	}
+}
+
+// serve sends the response, gzipped if the client can take it, or a 304 if the client already has it. A private
+// response depends on who asked for it, so shared caches must not hand it to anyone else
+func (rs *restResponse) serve(w http.ResponseWriter, r *http.Request, endpoint string, code int, maxAge time.Duration, private bool) {
+	w.Header().Set("Content-Type", rs.contentType)
+	w.Header().Set("Cross-Origin-Resource-Policy", "cross-origin")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("ETag", rs.etag)
+	if private {
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+		w.Header().Set("Vary", "Accept-Encoding, Authorization, "+auth.HeaderApiKey)
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+		w.Header().Set("Vary", "Accept-Encoding")
+	}
+	if http.StatusOK == code && r.Header.Get("If-None-Match") == rs.etag {
+		prometheusRestRequests.WithLabelValues(endpoint, "304").Inc()
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	prometheusRestRequests.WithLabelValues(endpoint, strconv.Itoa(code)).Inc()
+
+	body := rs.body
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		rs.gzipOnce.Do(func() {
+			rs.gzip = mustGzipBytes(rs.body)
+		})
+		body = rs.gzip
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(code)
+	if http.MethodHead != r.Method {
+		_, _ = w.Write(body)
+	}
+}
+
+// restServe encodes and sends v
+func (bw *PwWsBrokerWeb) restServe(w http.ResponseWriter, r *http.Request, endpoint string, code int, v any) {
+	rs, err := newRestResponse(v)
+	if nil != err {
+		log.Error().Err(err).Str("endpoint", endpoint).Msg("Failed to encode REST response")
+		prometheusRestRequests.WithLabelValues(endpoint, "500").Inc()
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	rs.serve(w, r, endpoint, code, 0, bw.private())
+}
+
+// private tells us if our responses depend on who asked for them, which they do once there is an auth config
+func (bw *PwWsBrokerWeb) private() bool {
+	return nil != bw.auth
+}
+
+// restMethodOk makes sure we were asked for something we can give, we only hand things out
+func restMethodOk(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+	if http.MethodGet == r.Method || http.MethodHead == r.Method {
+		return true
+	}
+	prometheusRestRequests.WithLabelValues(endpoint, "405").Inc()
+	w.Header().Set("Allow", "GET, HEAD")
+	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// restEntitled authenticates the request, counts it against the identity's limits and makes sure the identity is
+// entitled to the endpoint. It writes the error response and returns nil when the request cannot go ahead
+func (bw *PwWsBrokerWeb) restEntitled(w http.ResponseWriter, r *http.Request, endpoint string, allowed func(e *auth.Entitlements) bool) *auth.Identity {
+	id, _ := bw.authenticate(w, r, false)
+	if nil == id {
+		return nil
+	}
+	if !allowed(&id.Entitlements) {
+		prometheusNotEntitled.WithLabelValues(id.Tier, endpoint).Inc()
+		bw.restServe(w, r, endpoint, http.StatusForbidden, restError{Error: "Not entitled to " + endpoint})
+		return nil
+	}
+	return id
+}
+
+// restAllTiles, restSearch and restAnyHistory are what the endpoints need, everything at once, looking up any
+// aircraft or where any aircraft has been
+func restAllTiles(e *auth.Entitlements) bool {
+	return e.AllTiles
+}
+
+func restSearch(e *auth.Entitlements) bool {
+	return e.Search
+}
+
+func restAnyHistory(e *auth.Entitlements) bool {
+	return e.History
+}
+
+// aircraft is every aircraft we know about that matches, sorted by icao
+func (cl *ClientList) aircraft(matches func(loc *export.PlaneLocation) bool) []*export.PlaneLocation {
+	list := make([]*export.PlaneLocation, 0, 1000)
+	cl.globalList.Range(func(_, value any) bool {
+		if loc, ok := value.(*export.PlaneLocation); ok && (nil == matches || matches(loc)) {
+			list = append(list, loc)
+		}
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Icao < list[j].Icao
+	})
+	return list
+}
+
+// restAircraftJson serves every aircraft we know about as a dump1090/readsb aircraft.json
+func (bw *PwWsBrokerWeb) restAircraftJson(w http.ResponseWriter, r *http.Request) {
+	const endpoint = "aircraft.json"
+	if !restMethodOk(w, r, endpoint) {
+		return
+	}
+	if nil == bw.restEntitled(w, r, endpoint, restAllTiles) {
+		return
+	}
+	rs, err := bw.aircraftJson.get(func(now time.Time) (*restResponse, error) {
+		return newRestResponse(newReadsbAircraftJson(bw.clients.aircraft(nil), now))
+	})
+	if nil != err {
+		log.Error().Err(err).Msg("Failed to make aircraft.json")
+		prometheusRestRequests.WithLabelValues(endpoint, "500").Inc()
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	rs.serve(w, r, endpoint, http.StatusOK, aircraftJsonCacheFor, bw.private())
+}
+
+// get is the aircraft.json we made last, building it again when it is too old
+func (c *aircraftJsonCache) get(build func(now time.Time) (*restResponse, error)) (*restResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if nil != c.rs && now.Sub(c.built) < aircraftJsonCacheFor {
+		return c.rs, nil
+	}
+	rs, err := build(now)
+	if nil != err {
+		return nil, err
+	}
+	c.rs, c.built = rs, now
+	return rs, nil
+}
+
+// restAircraft serves what we know about an aircraft, /api/v1/aircraft/{icao}
+func (bw *PwWsBrokerWeb) restAircraft(w http.ResponseWriter, r *http.Request) {
+	const endpoint = "aircraft"
+	if !restMethodOk(w, r, endpoint) {
+		return
+	}
+	icao := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/aircraft/"), "/")
+	if "" == icao {
+		bw.restAircraftList(w, r)
+		return
+	}
+	if nil == bw.restEntitled(w, r, endpoint, restSearch) {
+		return
+	}
+	loc := bw.clients.findAircraft(icao, "")
+	if nil == loc {
+		bw.restServe(w, r, endpoint, http.StatusNotFound, restError{Error: "Not tracking aircraft " + icao})
+		return
+	}
+	bw.restServe(w, r, endpoint, http.StatusOK, loc)
+}
+
+// restAircraftList serves every aircraft we know about, in the ?bbox=west,south,east,north if given
+func (bw *PwWsBrokerWeb) restAircraftList(w http.ResponseWriter, r *http.Request) {
+	const endpoint = "aircraft-list"
+	if !restMethodOk(w, r, endpoint) || nil == bw.restEntitled(w, r, endpoint, restAllTiles) {
+		return
+	}
+	var matches func(loc *export.PlaneLocation) bool
+	if bbox := r.URL.Query().Get("bbox"); "" != bbox {
+		b, err := parseBBox(bbox)
+		if nil != err {
+			bw.restServe(w, r, endpoint, http.StatusBadRequest, restError{Error: err.Error()})
+			return
+		}
+		matches = func(loc *export.PlaneLocation) bool {
+			return loc.HasLocation && inBounds(b, loc.Lat, loc.Lon)
+		}
+	}
+	bw.restServe(w, r, endpoint, http.StatusOK, restAircraftList{Now: time.Now().UTC(), Aircraft: bw.clients.aircraft(matches)})
+}
+
+// restCallSign serves the aircraft flying as a callsign, /api/v1/callsign/{cs}
+func (bw *PwWsBrokerWeb) restCallSign(w http.ResponseWriter, r *http.Request) {
+	const endpoint = "callsign"
+	if !restMethodOk(w, r, endpoint) || nil == bw.restEntitled(w, r, endpoint, restSearch) {
+		return
+	}
+	callSign := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/callsign/"), "/")
+	if "" == callSign {
+		bw.restServe(w, r, endpoint, http.StatusBadRequest, restError{Error: "Which callsign?"})
+		return
+	}
+	key := followKey("", callSign)
+	aircraft := bw.clients.aircraft(func(loc *export.PlaneLocation) bool {
+		return nil != loc.CallSign && key == followKey("", *loc.CallSign)
+	})
+	if 0 == len(aircraft) {
+		bw.restServe(w, r, endpoint, http.StatusNotFound, restError{Error: "No aircraft flying as " + callSign})
+		return
+	}
+	bw.restServe(w, r, endpoint, http.StatusOK, restAircraftList{Now: time.Now().UTC(), Aircraft: aircraft})
+}
+
+// parseBBox reads a bounding box given as west,south,east,north (min lon, min lat, max lon, max lat)
+func parseBBox(bbox string) (tile_grid.GlobeIndexSpecialTile, error) {
+	var b tile_grid.GlobeIndexSpecialTile
+	parts := strings.Split(bbox, ",")
+	if 4 != len(parts) {
+		return b, fmt.Errorf("%w: bbox is west,south,east,north", tile_grid.ErrInvalidBounds)
+	}
+	var values [4]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if nil != err || math.IsNaN(v) {
+			return b, fmt.Errorf("%w: %s is not a number", tile_grid.ErrInvalidBounds, part)
+		}
+		values[i] = v
+	}
+	b.West, b.South, b.East, b.North = values[0], values[1], values[2], values[3]
+	if b.North <= b.South || b.North > 90 || b.South < -90 || b.West < -180 || b.West > 180 || b.East < -180 || b.East > 180 {
+		return b, fmt.Errorf("%w: %s is not west,south,east,north", tile_grid.ErrInvalidBounds, bbox)
+	}
+	return b, nil
+}
+
+// inBounds tells us if the location is in the bounds, which can cross the antimeridian (West > East)
+func inBounds(b tile_grid.GlobeIndexSpecialTile, lat, lon float64) bool {
+	if lat < b.South || lat > b.North {
+		return false
+	}
+	if b.West > b.East {
+		return lon >= b.West || lon <= b.East
+	}
+	return lon >= b.West && lon <= b.East
+}
+
+// newReadsbAircraftJson makes the aircraft.json dump1090/readsb would for the aircraft
+func newReadsbAircraftJson(aircraft []*export.PlaneLocation, now time.Time) readsbAircraftJson {
+	out := readsbAircraftJson{
+		Now:      float64(now.UnixMilli()) / 1000,
+		Aircraft: make([]readsbAircraft, 0, len(aircraft)),
+	}
+	for _, loc := range aircraft {
+		a := newReadsbAircraft(loc, now)
+		out.Messages += uint64(a.Messages)
+		out.Aircraft = append(out.Aircraft, a)
+	}
+	return out
+}
+
+// newReadsbAircraft is how dump1090/readsb describe an aircraft in aircraft.json
+func newReadsbAircraft(loc *export.PlaneLocation, now time.Time) readsbAircraft {
+	unPtr := func(s *string) string {
+		if nil == s {
+			return ""
+		}
+		return strings.TrimSpace(*s)
+	}
+	seconds := func(t time.Time) float64 {
+		return math.Round(now.Sub(t).Seconds()*10) / 10
+	}
+	a := readsbAircraft{
+		Hex:          strings.ToLower(loc.Icao),
+		Type:         "adsb_icao",
+		Registration: unPtr(loc.Registration),
+		TypeCode:     unPtr(loc.TypeCode),
+		Operator:     unPtr(loc.Operator),
+		Squawk:       loc.Squawk,
+		Emergency:    "none",
+		Category:     readsbCategory(loc.AirframeType),
+		Seen:         seconds(loc.LastMsg),
+		Rssi:         loc.SignalRssi,
+	}
+	if "ADS-C" == loc.SourceTag {
+		a.Type = "adsc"
+	}
+	if callSign := unPtr(loc.CallSign); "" != callSign {
+		// dump1090 pads the flight out to 8 characters
+		a.Flight = fmt.Sprintf("%-8s", callSign)
+	}
+	switch {
+	case loc.HasOnGround && loc.OnGround:
+		a.AltBaro = "ground"
+	case loc.HasAltitude:
+		if "metres" == loc.AltitudeUnits {
+			a.AltBaro = int(math.Round(float64(loc.Altitude) * 3.28084))
+		} else {
+			a.AltBaro = loc.Altitude
+		}
+	}
+	if loc.HasVelocity {
+		a.Gs = &loc.Velocity
+	}
+	if loc.HasHeading {
+		a.Track = &loc.Heading
+	}
+	if loc.HasVerticalRate {
+		a.BaroRate = &loc.VerticalRate
+	}
+	if loc.HasLocation {
+		a.Lat, a.Lon = &loc.Lat, &loc.Lon
+		seenPos := seconds(loc.LastMsg)
+		if !loc.Updates.Location.IsZero() {
+			seenPos = seconds(loc.Updates.Location)
+		}
+		a.SeenPos = &seenPos
+	}
+	for _, reason := range loc.Emergencies {
+		if e, ok := readsbEmergencies[reason]; ok {
+			a.Emergency = e
+			break
+		}
+	}
+	for _, count := range loc.SourceTags {
+		a.Messages += count
+	}
+	return a
+}
+
+// readsbCategory turns our airframe category type ("4/5", the ADS-B type code and category) into the emitter
+// category dump1090/readsb use (A5)
+func readsbCategory(airframeType string) string {
+	tc, cat, ok := strings.Cut(airframeType, "/")
+	if !ok || 1 != len(tc) || 1 != len(cat) || tc < "1" || tc > "4" || cat < "1" || cat > "7" {
+		return ""
+	}
+	return string(rune('A'+'4'-tc[0])) + cat
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"plane.watch/lib/export"
+	"plane.watch/lib/tracker"
+)
+
+func newTestRestBroker(t *testing.T) *PwWsBrokerWeb {
+	t.Helper()
+	bw := &PwWsBrokerWeb{}
+	if err := bw.configureWeb(); nil != err {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	callSign, registration := "QFA9", "VH-ZNA"
+	bw.clients.globalListUpdate(&export.PlaneLocation{
+		Icao:            "7C6CA3",
+		Lat:             -31.95,
+		Lon:             115.94,
+		HasLocation:     true,
+		Altitude:        36000,
+		HasAltitude:     true,
+		Velocity:        480,
+		HasVelocity:     true,
+		Heading:         270,
+		HasHeading:      true,
+		AirframeType:    "4/5",
+		Squawk:          "7700",
+		Emergencies:     []string{tracker.EmergencyGeneral},
+		SourceTags:      map[string]uint32{"feeder-perth": 10, "feeder-sydney": 2},
+		CallSign:        &callSign,
+		Registration:    &registration,
+		LastMsg:         now,
+		Updates:         export.Updates{Location: now.Add(-2 * time.Second)},
+		HasOnGround:     true,
+		HasVerticalRate: false,
+	})
+	bw.clients.globalListUpdate(&export.PlaneLocation{
+		Icao:        "7C0001",
+		Lat:         -33.94,
+		Lon:         151.17,
+		HasLocation: true,
+		OnGround:    true,
+		HasOnGround: true,
+		LastMsg:     now,
+	})
+	return bw
+}
+
+func restGet(t *testing.T, bw *PwWsBrokerWeb, path string, headers map[string]string) *http.Response {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	bw.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func restDecode(t *testing.T, rs *http.Response, v any) {
+	t.Helper()
+	body := rs.Body
+	if "gzip" == rs.Header.Get("Content-Encoding") {
+		gz, err := gzip.NewReader(body)
+		if nil != err {
+			t.Fatal(err)
+		}
+		body = gz
+	}
+	buf, err := io.ReadAll(body)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err = jsoniter.ConfigFastest.Unmarshal(buf, v); nil != err {
+		t.Fatalf("%s: %s", err, buf)
+	}
+}
+
+func TestRest_AircraftJson(t *testing.T) {
+	bw := newTestRestBroker(t)
+	rs := restGet(t, bw, "/data/aircraft.json", map[string]string{"Accept-Encoding": "gzip"})
+	if http.StatusOK != rs.StatusCode || "gzip" != rs.Header.Get("Content-Encoding") {
+		t.Fatalf("expected a gzipped aircraft.json, got %d %v", rs.StatusCode, rs.Header)
+	}
+	var got struct {
+		Now      float64
+		Messages uint64
+		Aircraft []map[string]any
+	}
+	restDecode(t, rs, &got)
+	if 2 != len(got.Aircraft) || 12 != got.Messages || 0 == got.Now {
+		t.Fatalf("unexpected aircraft.json %+v", got)
+	}
+	onGround, qantas := got.Aircraft[0], got.Aircraft[1]
+	want := map[string]any{
+		"hex":       "7c6ca3",
+		"flight":    "QFA9    ",
+		"r":         "VH-ZNA",
+		"alt_baro":  float64(36000),
+		"gs":        float64(480),
+		"track":     float64(270),
+		"squawk":    "7700",
+		"emergency": "general",
+		"category":  "A5",
+		"seen_pos":  float64(2),
+		"messages":  float64(12),
+	}
+	for k, v := range want {
+		if qantas[k] != v {
+			t.Errorf("%s: got %v, want %v", k, qantas[k], v)
+		}
+	}
+	if _, ok := qantas["baro_rate"]; ok {
+		t.Error("expected no baro_rate for an aircraft without a vertical rate")
+	}
+	if "ground" != onGround["alt_baro"] || "none" != onGround["emergency"] {
+		t.Errorf("unexpected aircraft on the ground %+v", onGround)
+	}
+
+	etag := rs.Header.Get("ETag")
+	if rs = restGet(t, bw, "/data/aircraft.json", map[string]string{"If-None-Match": etag}); http.StatusNotModified != rs.StatusCode {
+		t.Errorf("expected a 304 for the same aircraft.json, got %d", rs.StatusCode)
+	}
+}
+
+func TestRest_Aircraft(t *testing.T) {
+	bw := newTestRestBroker(t)
+
+	rs := restGet(t, bw, "/api/v1/aircraft/7c6ca3", nil)
+	var loc export.PlaneLocation
+	restDecode(t, rs, &loc)
+	if http.StatusOK != rs.StatusCode || "7C6CA3" != loc.Icao {
+		t.Errorf("expected the aircraft, got %d %+v", rs.StatusCode, loc)
+	}
+	if rs = restGet(t, bw, "/api/v1/aircraft/7C6CA3", map[string]string{"If-None-Match": rs.Header.Get("ETag")}); http.StatusNotModified != rs.StatusCode {
+		t.Errorf("expected a 304 for the same aircraft, got %d", rs.StatusCode)
+	}
+	if rs = restGet(t, bw, "/api/v1/aircraft/ABCDEF", nil); http.StatusNotFound != rs.StatusCode {
+		t.Errorf("expected a 404 for an aircraft we are not tracking, got %d", rs.StatusCode)
+	}
+
+	tests := []struct {
+		path string
+		code int
+		want []string
+	}{
+		{"/api/v1/aircraft", http.StatusOK, []string{"7C0001", "7C6CA3"}},
+		{"/api/v1/aircraft?bbox=115,-32.5,116.5,-31", http.StatusOK, []string{"7C6CA3"}},
+		{"/api/v1/aircraft?bbox=0,0,1,1", http.StatusOK, []string{}},
+		{"/api/v1/aircraft?bbox=115,-31,116.5,-32.5", http.StatusBadRequest, nil},
+		{"/api/v1/aircraft?bbox=nope", http.StatusBadRequest, nil},
+		{"/api/v1/callsign/qfa9", http.StatusOK, []string{"7C6CA3"}},
+		{"/api/v1/callsign/VOZ1", http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rs := restGet(t, bw, tt.path, nil)
+			if tt.code != rs.StatusCode {
+				t.Fatalf("expected %d, got %d", tt.code, rs.StatusCode)
+			}
+			if nil == tt.want {
+				return
+			}
+			var list restAircraftList
+			restDecode(t, rs, &list)
+			if len(tt.want) != len(list.Aircraft) {
+				t.Fatalf("expected %v, got %d aircraft", tt.want, len(list.Aircraft))
+			}
+			for i, icao := range tt.want {
+				if icao != list.Aircraft[i].Icao {
+					t.Errorf("expected %v, got %s at %d", tt.want, list.Aircraft[i].Icao, i)
+				}
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/aircraft", nil)
+	w := httptest.NewRecorder()
+	bw.ServeHTTP(w, r)
+	if http.StatusMethodNotAllowed != w.Code {
+		t.Errorf("expected POST to not be allowed, got %d", w.Code)
+	}
+}
+
+func TestReadsbCategory(t *testing.T) {
+	for in, want := range map[string]string{"4/5": "A5", "1/1": "D1", "3/2": "B2", "0/0": "", "": "", "4/12": ""} {
+		if got := readsbCategory(in); want != got {
+			t.Errorf("readsbCategory(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
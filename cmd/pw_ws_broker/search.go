@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/dedupe/forgetfulmap"
+	"plane.watch/lib/export"
+	"plane.watch/lib/search"
+	"plane.watch/lib/ws_protocol"
+)
+
+const (
+	// searchLimit is the most results of each kind we send back
+	searchLimit = 10
+	// searchRpcTimeout is how long we wait for pw_atc_api to search for routes and operators
+	searchRpcTimeout = time.Second
+	// searchCacheFor is how long we remember what pw_atc_api found for a query
+	searchCacheFor = 5 * time.Minute
+	// airportRefresh is how often we reload the airports, airportRetry is how soon we try again when we could not
+	airportRefresh = time.Hour
+	airportRetry   = 30 * time.Second
+)
+
+var (
+	prometheusSearchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: "pw_ws_broker",
+		Name:      "search_duration_seconds",
+		Help:      "How long each search took",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	})
+	prometheusSearchAirports = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "pw_ws_broker",
+		Name:      "search_airports",
+		Help:      "The number of airports we have cached to search",
+	})
+)
+
+type (
+	// searchRpc is how we ask pw_atc_api for airports, routes and operators (a *nats_io.Server)
+	searchRpc interface {
+		Request(subject string, data []byte, headers map[string]string, timeout time.Duration) ([]byte, error)
+	}
+
+	// searcher finds aircraft in an index of the aircraft we know about, airports in our copy of all of them, and
+	// routes and operators by asking pw_atc_api (remembering what it said for a while)
+	searcher struct {
+		rpc      searchRpc
+		aircraft *search.Index[*export.PlaneLocation]
+		airports atomic.Pointer[search.Index[ws_protocol.AirportLocation]]
+		found    *forgetfulmap.ForgetfulSyncMap
+	}
+)
+
+func newSearcher(rpc searchRpc) *searcher {
+	s := &searcher{
+		rpc: rpc,
+		aircraft: search.NewIndex(func(a, b *export.PlaneLocation) bool {
+			if unPtr(a.CallSign) != unPtr(b.CallSign) {
+				return unPtr(a.CallSign) < unPtr(b.CallSign)
+			}
+			if unPtr(a.Registration) != unPtr(b.Registration) {
+				return unPtr(a.Registration) < unPtr(b.Registration)
+			}
+			return a.Icao < b.Icao
+		}),
+		found: forgetfulmap.NewForgetfulSyncMap(
+			forgetfulmap.UseMemSyncPool(false),
+			forgetfulmap.WithOldAgeAfter(searchCacheFor),
+			forgetfulmap.WithSweepInterval(time.Minute),
+		),
+	}
+	s.airports.Store(newAirportIndex())
+	return s
+}
+
+func newAirportIndex() *search.Index[ws_protocol.AirportLocation] {
+	return search.NewIndex(func(a, b ws_protocol.AirportLocation) bool { return a.Name < b.Name })
+}
+
+// update keeps the aircraft index up to date with what we know about an aircraft
+func (s *searcher) update(loc *export.PlaneLocation) {
+	s.aircraft.Set(loc.Icao, loc,
+		loc.Icao,
+		unPtr(loc.CallSign),
+		unPtr(loc.Registration),
+		unPtr(loc.TypeCode),
+		unPtr(loc.Operator),
+		unPtr(loc.RegisteredOwner),
+	)
+}
+
+// forget stops finding an aircraft we are no longer tracking
+func (s *searcher) forget(icao string) {
+	s.aircraft.Delete(icao)
+}
+
+// search finds the aircraft, airports, routes and operators matching query
+func (s *searcher) search(query string) ws_protocol.SearchResult {
+	tStart := time.Now()
+	defer func() {
+		prometheusSearchDuration.Observe(time.Since(tStart).Seconds())
+	}()
+
+	results := ws_protocol.SearchResult{
+		Query:    query,
+		Aircraft: ws_protocol.AircraftList{},
+		Airport:  []ws_protocol.AirportLocation{},
+		Route:    []string{},
+		Routes:   []export.Route{},
+		Operator: []export.Operator{},
+	}
+	if len(search.Normalize(query)) < search.MinQueryLength {
+		return results
+	}
+
+	// pw_atc_api looks for routes and operators while we look through what we have
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		results.Routes = s.searchRoutes(query)
+	}()
+	go func() {
+		defer wg.Done()
+		results.Operator = s.searchOperators(query)
+	}()
+
+	for _, hit := range s.aircraft.Search(query, searchLimit) {
+		results.Aircraft = append(results.Aircraft, hit.Item)
+	}
+	results.Airport = s.searchAirports(query)
+
+	wg.Wait()
+	for _, route := range results.Routes {
+		results.Route = append(results.Route, route.CallSign)
+	}
+	return results
+}
+
+// searchAirports looks through our copy of the airports, finding none until refreshAirports has loaded them
+func (s *searcher) searchAirports(query string) []ws_protocol.AirportLocation {
+	airports := make([]ws_protocol.AirportLocation, 0)
+	for _, hit := range s.airports.Load().Search(query, searchLimit) {
+		airports = append(airports, hit.Item)
+	}
+	return airports
+}
+
+// searchRoutes asks pw_atc_api for routes, the callsigns that match best first
+func (s *searcher) searchRoutes(query string) []export.Route {
+	routes := make([]export.Route, 0)
+	if ok := s.ask(export.NatsApiSearchRouteV1, query, &routes); !ok {
+		return []export.Route{}
+	}
+	rankResults(query, routes, func(r export.Route) []string {
+		return []string{r.CallSign, unPtr(r.RouteCode), unPtr(r.Operator)}
+	})
+	return routes
+}
+
+// searchOperators asks pw_atc_api for operators, the codes that match best first
+func (s *searcher) searchOperators(query string) []export.Operator {
+	operators := make([]export.Operator, 0)
+	if ok := s.ask(export.NatsApiSearchOperatorV1, query, &operators); !ok {
+		return []export.Operator{}
+	}
+	rankResults(query, operators, func(o export.Operator) []string {
+		return []string{o.IcaoCode, o.IataCode, o.Name}
+	})
+	return operators
+}
+
+// ask gets what pw_atc_api found for query into found, remembering it for searchCacheFor
+func (s *searcher) ask(subject, query string, found any) bool {
+	if nil == s.rpc {
+		return false
+	}
+	json := jsoniter.ConfigFastest
+	key := subject + ":" + search.Normalize(query)
+	if cached, ok := s.found.Load(key); ok {
+		return nil == json.Unmarshal(cached.([]byte), found)
+	}
+	resp, err := s.rpc.Request(subject, []byte(query), map[string]string{}, searchRpcTimeout)
+	if nil != err {
+		log.Error().Err(err).Str("subject", subject).Msg("Failed to search")
+		return false
+	}
+	if err = json.Unmarshal(resp, found); nil != err {
+		log.Error().Err(err).Str("subject", subject).Msg("Failed to unmarshal search results")
+		return false
+	}
+	s.found.Store(key, resp)
+	return true
+}
+
+// rankResults orders what pw_atc_api found by how well it matches, keeping its order for equally good matches
+func rankResults[T any](query string, results []T, fields func(T) []string) {
+	ranked := make([]search.Hit[T], len(results))
+	for i, r := range results {
+		m, f := search.Rank(query, fields(r)...)
+		ranked[i] = search.Hit[T]{Item: r, Match: m, Field: f}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].Match != ranked[j].Match {
+			return ranked[i].Match > ranked[j].Match
+		}
+		return ranked[i].Field < ranked[j].Field
+	})
+	for i := range ranked {
+		results[i] = ranked[i].Item
+	}
+}
+
+func indexAirports(idx *search.Index[ws_protocol.AirportLocation], airports []export.Airport) {
+	for _, a := range airports {
+		idx.Set(a.IcaoCode+"/"+a.IataCode+"/"+a.Name, ws_protocol.AirportLocation{
+			Name: a.Name,
+			Icao: a.IcaoCode,
+			Iata: a.IataCode,
+			Lat:  a.Latitude,
+			Lon:  a.Longitude,
+		}, a.IcaoCode, a.IataCode, a.Name)
+	}
+}
+
+// loadAirports replaces our copy of the airports with every airport pw_atc_api knows about
+func (s *searcher) loadAirports() error {
+	if nil == s.rpc {
+		return nil
+	}
+	buf, err := s.rpc.Request(export.NatsApiAirportListV1, []byte{}, nil, 10*time.Second)
+	if nil != err {
+		return err
+	}
+	var airports []export.Airport
+	if err = jsoniter.ConfigFastest.Unmarshal(buf, &airports); nil != err {
+		return err
+	}
+	idx := newAirportIndex()
+	indexAirports(idx, airports)
+	s.airports.Store(idx)
+	prometheusSearchAirports.Set(float64(idx.Len()))
+	log.Info().Int("airports", idx.Len()).Msg("Loaded airports to search")
+	return nil
+}
+
+// refreshAirports keeps our copy of the airports up to date, until ctx is done
+func (s *searcher) refreshAirports(ctx context.Context) {
+	if nil == s.rpc {
+		return
+	}
+	for {
+		wait := airportRefresh
+		if err := s.loadAirports(); nil != err {
+			log.Error().Err(err).Msg("Failed to load airports to search")
+			wait = airportRetry
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func unPtr[T any](what *T) T {
+	var def T
+	if nil == what {
+		return def
+	}
+	return *what
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"plane.watch/lib/export"
+)
+
+// fakeAtcApi answers the searches pw_atc_api would
+type fakeAtcApi struct {
+	mu       sync.Mutex
+	requests map[string]int
+	down     bool
+}
+
+func (a *fakeAtcApi) Request(subject string, data []byte, _ map[string]string, _ time.Duration) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if nil == a.requests {
+		a.requests = map[string]int{}
+	}
+	a.requests[subject]++
+	if a.down {
+		return nil, errors.New("no responders available for request")
+	}
+
+	perth := export.Airport{Name: "Perth International Airport", City: "Perth", IcaoCode: "YPPH", IataCode: "PER", Latitude: -31.94, Longitude: 115.97}
+	var found any
+	switch subject {
+	case export.NatsApiAirportListV1:
+		found = []export.Airport{
+			perth,
+			{Name: "Perth Airport", City: "Perth", IcaoCode: "EGPT", IataCode: "PSL"},
+			{Name: "Jandakot Airport", City: "Perth", IcaoCode: "YPJT", IataCode: "JAD"},
+			{Name: "Sydney Kingsford Smith International Airport", City: "Sydney", IcaoCode: "YSSY", IataCode: "SYD"},
+		}
+	case export.NatsApiSearchRouteV1:
+		// pw_atc_api orders by callsign, not by how well they match
+		found = []export.Route{
+			{CallSign: "QFA10", RouteCode: ptr("EGLL-YPPH")},
+			{CallSign: "QFA9", RouteCode: ptr("YPPH-EGLL")},
+		}
+	case export.NatsApiSearchOperatorV1:
+		found = []export.Operator{
+			{IcaoCode: "NQA", Name: "Not Qantas"},
+			{IcaoCode: "QFA", IataCode: "QF", Name: "Qantas"},
+		}
+	default:
+		return nil, errors.New("unexpected subject " + subject)
+	}
+	return jsoniter.ConfigFastest.Marshal(found)
+}
+
+func (a *fakeAtcApi) count(subject string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.requests[subject]
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func newTestSearchBroker(t *testing.T, rpc searchRpc) *PwWsBrokerWeb {
+	t.Helper()
+	bw := &PwWsBrokerWeb{searchRpc: rpc}
+	if err := bw.configureWeb(); nil != err {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, loc := range []*export.PlaneLocation{
+		{Icao: "7C6CA3", CallSign: ptr("QFA9"), Registration: ptr("VH-ZNA"), TypeCode: ptr("B789"), Operator: ptr("Qantas"), LastMsg: now},
+		{Icao: "7C6CA4", CallSign: ptr("QFA94"), Registration: ptr("VH-ZNB"), TypeCode: ptr("B789"), Operator: ptr("Qantas"), LastMsg: now},
+		{Icao: "7C0001", CallSign: ptr("AQFA9"), Registration: ptr("VH-QFA"), LastMsg: now},
+		{Icao: "7C4924", CallSign: ptr("VOZ1"), Registration: ptr("VH-YIA"), TypeCode: ptr("B738"), LastMsg: now},
+	} {
+		bw.clients.globalListUpdate(loc)
+	}
+	return bw
+}
+
+func aircraftCallSigns(list []*export.PlaneLocation) []string {
+	out := make([]string, len(list))
+	for i, loc := range list {
+		out[i] = unPtr(loc.CallSign)
+	}
+	return out
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSearch_Aircraft(t *testing.T) {
+	bw := newTestSearchBroker(t, nil)
+	s := bw.clients.searcher
+
+	tests := map[string][]string{
+		"qfa9":   {"QFA9", "QFA94", "AQFA9"},
+		"QF":     {"QFA9", "QFA94"},
+		"vh-zna": {"QFA9"},
+		"vhqfa":  {"AQFA9"},
+		"b789":   {"QFA9", "QFA94"},
+		"qantas": {"QFA9", "QFA94"},
+		"7c4924": {"VOZ1"},
+		"q":      {},
+	}
+	for query, want := range tests {
+		if got := aircraftCallSigns(s.search(query).Aircraft); !sameStrings(want, got) {
+			t.Errorf("search %q: expected %v, got %v", query, want, got)
+		}
+	}
+
+	// a new callsign is found, and a removed aircraft is not
+	bw.clients.globalListUpdate(&export.PlaneLocation{Icao: "7C4924", CallSign: ptr("VOZ2"), LastMsg: time.Now()})
+	if got := aircraftCallSigns(s.search("voz").Aircraft); !sameStrings([]string{"VOZ2"}, got) {
+		t.Errorf("expected the new callsign, got %v", got)
+	}
+	bw.clients.globalListUpdate(&export.PlaneLocation{Icao: "7C4924", Removed: true})
+	if got := s.search("voz").Aircraft; 0 != len(got) {
+		t.Errorf("expected a removed aircraft to not be found, got %v", aircraftCallSigns(got))
+	}
+
+	// without pw_atc_api, every group is still there
+	results := s.search("qfa")
+	if nil == results.Airport || nil == results.Route || nil == results.Routes || nil == results.Operator || "qfa" != results.Query {
+		t.Errorf("expected empty groups, got %+v", results)
+	}
+}
+
+func TestSearch_AtcApi(t *testing.T) {
+	api := &fakeAtcApi{}
+	bw := newTestSearchBroker(t, api)
+	s := bw.clients.searcher
+
+	// until the airports are loaded, we find none rather than asking pw_atc_api on every search
+	if results := s.search("ypph"); 0 != len(results.Airport) || 0 != api.count(export.NatsApiSearchAirportV1) {
+		t.Errorf("expected no airports before they are loaded, got %+v", results.Airport)
+	}
+
+	if err := s.loadAirports(); nil != err {
+		t.Fatal(err)
+	}
+	results := s.search("perth")
+	if 2 != len(results.Airport) || "Perth Airport" != results.Airport[0].Name || "Perth International Airport" != results.Airport[1].Name {
+		t.Errorf("expected the airports named perth, got %+v", results.Airport)
+	}
+	if results = s.search("per"); "YPPH" != results.Airport[0].Icao {
+		t.Errorf("expected the exact iata code first, got %+v", results.Airport)
+	}
+	if 0 != api.count(export.NatsApiSearchAirportV1) {
+		t.Error("expected to search our copy of the airports")
+	}
+
+	results = s.search("qfa9")
+	if 2 != len(results.Routes) || "QFA9" != results.Routes[0].CallSign {
+		t.Errorf("expected the exact callsign first, got %+v", results.Routes)
+	}
+	if 2 != len(results.Route) || "QFA9" != results.Route[0] || "QFA10" != results.Route[1] {
+		t.Errorf("expected the callsigns of the routes, got %+v", results.Route)
+	}
+	results = s.search("qfa")
+	if 2 != len(results.Operator) || "Qantas" != results.Operator[0].Name {
+		t.Errorf("expected the exact code first, got %+v", results.Operator)
+	}
+
+	// we remember what pw_atc_api said
+	routes, operators := api.count(export.NatsApiSearchRouteV1), api.count(export.NatsApiSearchOperatorV1)
+	s.search("QFA")
+	if routes != api.count(export.NatsApiSearchRouteV1) || operators != api.count(export.NatsApiSearchOperatorV1) {
+		t.Errorf("expected to remember what pw_atc_api found, asked %d and %d times", api.count(export.NatsApiSearchRouteV1), api.count(export.NatsApiSearchOperatorV1))
+	}
+
+	// and still find aircraft when it is not there
+	api.down = true
+	results = s.search("voz1")
+	if 1 != len(results.Aircraft) || 0 != len(results.Routes) || 0 != len(results.Operator) || 2 != len(s.search("perth").Airport) {
+		t.Errorf("expected aircraft and our copy of the airports without pw_atc_api, got %+v", results)
+	}
+	if err := s.loadAirports(); nil == err || 4 != s.airports.Load().Len() {
+		t.Error("expected to keep our copy of the airports when we cannot reload them")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"plane.watch/lib/ws_protocol"
+)
+
+var (
+	// errClientTooSlow is returned when a client has been behind for longer than we are willing to wait for it
+	errClientTooSlow = errors.New("client is too slow, it has been behind for too long")
+
+	prometheusQueuedMessages = promauto.NewGauge(prometheus.GaugeOpts{
+		Subsystem: "pw_ws_broker",
+		Name:      "queued_messages",
+		Help:      "The number of messages waiting to be written to clients, across all clients",
+	})
+	prometheusQueueDepth = promauto.NewHistogram(prometheus.HistogramOpts{
+		Subsystem: "pw_ws_broker",
+		Name:      "queue_depth",
+		Help:      "How many messages were waiting in a clients queue when another was added",
+		Buckets:   []float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000},
+	})
+	prometheusCoalescedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Subsystem: "pw_ws_broker",
+		Name:      "coalesced_messages",
+		Help:      "The number of location updates merged into an update already waiting in a full client queue",
+	})
+	prometheusDroppedMessages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Subsystem: "pw_ws_broker",
+			Name:      "dropped_messages",
+			Help:      "The number of messages that were thrown away because a client could not keep up",
+		},
+		[]string{"reason"},
+	)
+	prometheusSlowClients = promauto.NewCounter(prometheus.CounterOpts{
+		Subsystem: "pw_ws_broker",
+		Name:      "slow_clients_disconnected",
+		Help:      "The number of clients we disconnected for being behind for too long",
+	})
+)
+
+type (
+	// sendQueue is the bounded list of messages waiting to be written to a client. Once it is full, location updates
+	// are merged into the updates already waiting for the same aircraft instead of being added, so a slow client gets
+	// the latest position of each aircraft rather than falling further and further behind
+	sendQueue struct {
+		mu     sync.Mutex
+		frames []*queuedFrame
+		// pending is the single location update (not a batch) waiting for each aircraft
+		pending map[string]*queuedFrame
+		ready   chan struct{}
+		closed  bool
+
+		size        int
+		slowTimeout time.Duration
+		// behindSince is when the queue first filled up, it is reset once the client has caught up (the queue empties)
+		behindSince time.Time
+	}
+
+	queuedFrame struct {
+		rs *ws_protocol.WsResponse
+		// icaoIdx is where each aircraft is in a batch (rs.Locations), built the first time a batch is merged into it
+		icaoIdx map[string]int
+	}
+)
+
+func newSendQueue(size int, slowTimeout time.Duration) *sendQueue {
+	if size <= 0 {
+		size = 1
+	}
+	return &sendQueue{
+		frames:      make([]*queuedFrame, 0, size),
+		pending:     make(map[string]*queuedFrame),
+		ready:       make(chan struct{}, 1),
+		size:        size,
+		slowTimeout: slowTimeout,
+	}
+}
+
+// push adds a message to the queue. It fails with errClientTooSlow when the client has been behind for longer than
+// the slow timeout, or when a full queue keeps growing with messages we cannot merge or throw away
+func (q *sendQueue) push(rs *ws_protocol.WsResponse, now time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	prometheusQueueDepth.Observe(float64(len(q.frames)))
+
+	isLocation := ws_protocol.ResponseTypePlaneLocation == rs.Type || ws_protocol.ResponseTypePlaneLocations == rs.Type
+	if len(q.frames) < q.size || !isLocation {
+		// everything else (acks, history, search results) is a reply the client is waiting for, never throw those away
+		if len(q.frames) >= 2*q.size {
+			return errClientTooSlow
+		}
+		q.add(rs)
+		return nil
+	}
+
+	if q.behindSince.IsZero() {
+		q.behindSince = now
+	}
+	if ws_protocol.ResponseTypePlaneLocation == rs.Type {
+		if f, ok := q.pending[rs.Location.Icao]; ok {
+			f.rs = rs
+			prometheusCoalescedMessages.Inc()
+		} else {
+			prometheusDroppedMessages.WithLabelValues("queue_full").Inc()
+		}
+	} else {
+		q.mergeBatch(rs)
+	}
+
+	if q.slowTimeout > 0 && now.Sub(q.behindSince) > q.slowTimeout {
+		return errClientTooSlow
+	}
+	return nil
+}
+
+// add puts a frame on the end of the queue and wakes the writer
+func (q *sendQueue) add(rs *ws_protocol.WsResponse) {
+	f := &queuedFrame{rs: rs}
+	q.frames = append(q.frames, f)
+	if ws_protocol.ResponseTypePlaneLocation == rs.Type && nil != rs.Location {
+		q.pending[rs.Location.Icao] = f
+	}
+	prometheusQueuedMessages.Inc()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// mergeBatch merges a batch of locations into the last batch waiting in the queue from the same place (live, or the
+// same replay), replacing what is already there for each aircraft
+func (q *sendQueue) mergeBatch(rs *ws_protocol.WsResponse) {
+	locations := rs.Locations
+	var last *queuedFrame
+	for i := len(q.frames) - 1; i >= 0; i-- {
+		if ws_protocol.ResponseTypePlaneLocations == q.frames[i].rs.Type && replayId(q.frames[i].rs) == replayId(rs) {
+			last = q.frames[i]
+			break
+		}
+	}
+	if nil == last {
+		prometheusDroppedMessages.WithLabelValues("queue_full").Add(float64(len(locations)))
+		return
+	}
+	if nil == last.icaoIdx {
+		last.icaoIdx = make(map[string]int, len(last.rs.Locations)+len(locations))
+		for i, loc := range last.rs.Locations {
+			last.icaoIdx[loc.Icao] = i
+		}
+	}
+	for _, loc := range locations {
+		if i, ok := last.icaoIdx[loc.Icao]; ok {
+			last.rs.Locations[i] = loc
+		} else {
+			last.rs.Locations = append(last.rs.Locations, loc)
+			last.icaoIdx[loc.Icao] = len(last.rs.Locations) - 1
+		}
+	}
+	if nil != rs.Replay {
+		// the replay has moved on
+		last.rs.Replay = rs.Replay
+	}
+	prometheusCoalescedMessages.Add(float64(len(locations)))
+}
+
+// replayId is the replay a message is from, "" for live updates
+func replayId(rs *ws_protocol.WsResponse) string {
+	if nil == rs.Replay {
+		return ""
+	}
+	return rs.Replay.Id
+}
+
+// pop waits for the next message to write to the client. It returns false once the queue is closed or the context
+// is done
+func (q *sendQueue) pop(ctx context.Context) (*ws_protocol.WsResponse, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.frames) > 0 {
+			f := q.frames[0]
+			q.frames[0] = nil
+			q.frames = q.frames[1:]
+			if ws_protocol.ResponseTypePlaneLocation == f.rs.Type && nil != f.rs.Location && q.pending[f.rs.Location.Icao] == f {
+				delete(q.pending, f.rs.Location.Icao)
+			}
+			if 0 == len(q.frames) {
+				q.behindSince = time.Time{}
+			}
+			prometheusQueuedMessages.Dec()
+			q.mu.Unlock()
+			return f.rs, true
+		}
+		closed := q.closed
+		q.mu.Unlock()
+		if closed {
+			return nil, false
+		}
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// close throws away anything still waiting and stops the writer
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	prometheusQueuedMessages.Sub(float64(len(q.frames)))
+	q.frames = nil
+	q.pending = nil
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// depth is how many messages are waiting
+func (q *sendQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.frames)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"plane.watch/lib/export"
+	"plane.watch/lib/ws_protocol"
+)
+
+func locationMsg(icao string, lat float64) *ws_protocol.WsResponse {
+	return &ws_protocol.WsResponse{
+		Type:     ws_protocol.ResponseTypePlaneLocation,
+		Location: &export.PlaneLocation{Icao: icao, Lat: lat},
+	}
+}
+
+func batchMsg(locations ...*export.PlaneLocation) *ws_protocol.WsResponse {
+	return &ws_protocol.WsResponse{
+		Type:      ws_protocol.ResponseTypePlaneLocations,
+		Locations: locations,
+	}
+}
+
+func TestSendQueue_InOrder(t *testing.T) {
+	q := newSendQueue(10, 0)
+	now := time.Now()
+	for _, icao := range []string{"A", "B", "C"} {
+		if err := q.push(locationMsg(icao, 1), now); nil != err {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"A", "B", "C"} {
+		rs, ok := q.pop(context.Background())
+		if !ok || want != rs.Location.Icao {
+			t.Errorf("expected %s, got %+v", want, rs)
+		}
+	}
+}
+
+func TestSendQueue_CoalescesWhenFull(t *testing.T) {
+	q := newSendQueue(2, 0)
+	now := time.Now()
+	_ = q.push(locationMsg("A", 1), now)
+	_ = q.push(locationMsg("B", 1), now)
+	// full, A is merged into the A already waiting, C has nothing to merge into and is dropped
+	_ = q.push(locationMsg("A", 2), now)
+	_ = q.push(locationMsg("C", 1), now)
+	if 2 != q.depth() {
+		t.Fatalf("expected the queue to stay at 2, got %d", q.depth())
+	}
+	rs, _ := q.pop(context.Background())
+	if "A" != rs.Location.Icao || 2 != rs.Location.Lat {
+		t.Errorf("expected the latest A update, got %+v", rs.Location)
+	}
+
+	// replies are never thrown away
+	_ = q.push(locationMsg("D", 1), now)
+	if err := q.push(&ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeAckSub}, now); nil != err {
+		t.Fatal(err)
+	}
+	if 3 != q.depth() {
+		t.Errorf("expected the ack to be queued, got %d", q.depth())
+	}
+}
+
+func TestSendQueue_MergesBatches(t *testing.T) {
+	q := newSendQueue(1, 0)
+	now := time.Now()
+	_ = q.push(batchMsg(&export.PlaneLocation{Icao: "A", Lat: 1}, &export.PlaneLocation{Icao: "B", Lat: 1}), now)
+	_ = q.push(batchMsg(&export.PlaneLocation{Icao: "B", Lat: 2}, &export.PlaneLocation{Icao: "C", Lat: 2}), now)
+	if 1 != q.depth() {
+		t.Fatalf("expected one batch, got %d", q.depth())
+	}
+	rs, _ := q.pop(context.Background())
+	if 3 != len(rs.Locations) || "B" != rs.Locations[1].Icao || 2 != rs.Locations[1].Lat || "C" != rs.Locations[2].Icao {
+		t.Errorf("unexpected merged batch %+v", rs.Locations)
+	}
+}
+
+func TestSendQueue_KeepsReplaysApart(t *testing.T) {
+	q := newSendQueue(2, 0)
+	now := time.Now()
+	_ = q.push(batchMsg(&export.PlaneLocation{Icao: "A", Lat: 1}), now)
+	replayed := batchMsg(&export.PlaneLocation{Icao: "A", Lat: 2})
+	replayed.Replay = &ws_protocol.ReplayState{Id: "r1"}
+	_ = q.push(replayed, now)
+	// the queue is full, live updates merge into the live batch and the replay into its own
+	_ = q.push(batchMsg(&export.PlaneLocation{Icao: "A", Lat: 3}), now)
+	replayed = batchMsg(&export.PlaneLocation{Icao: "A", Lat: 4})
+	replayed.Replay = &ws_protocol.ReplayState{Id: "r1", At: now}
+	_ = q.push(replayed, now)
+
+	live, _ := q.pop(context.Background())
+	if nil != live.Replay || 3 != live.Locations[0].Lat {
+		t.Errorf("expected the live batch to have the live update, got %+v", live.Locations[0])
+	}
+	rs, _ := q.pop(context.Background())
+	if nil == rs.Replay || !now.Equal(rs.Replay.At) || 4 != rs.Locations[0].Lat {
+		t.Errorf("expected the replay batch to have the replayed update, got %+v %+v", rs.Replay, rs.Locations[0])
+	}
+}
+
+func TestSendQueue_SlowClient(t *testing.T) {
+	q := newSendQueue(1, time.Second)
+	start := time.Now()
+	_ = q.push(locationMsg("A", 1), start)
+	if err := q.push(locationMsg("A", 2), start); nil != err {
+		t.Fatalf("should not be too slow yet, %s", err)
+	}
+	if err := q.push(locationMsg("A", 3), start.Add(2*time.Second)); !errors.Is(err, errClientTooSlow) {
+		t.Errorf("expected the client to be too slow, got %v", err)
+	}
+
+	// catching up resets the clock
+	q.pop(context.Background())
+	_ = q.push(locationMsg("A", 4), start.Add(3*time.Second))
+	if err := q.push(locationMsg("A", 5), start.Add(3*time.Second)); nil != err {
+		t.Errorf("expected the client to have caught up, got %v", err)
+	}
+}
+
+func TestSendQueue_Close(t *testing.T) {
+	q := newSendQueue(10, 0)
+	_ = q.push(locationMsg("A", 1), time.Now())
+	done := make(chan bool)
+	go func() {
+		q.pop(context.Background())
+		_, ok := q.pop(context.Background())
+		done <- ok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.close()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("expected pop to fail once the queue is closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("closing the queue did not wake the writer")
+	}
+}
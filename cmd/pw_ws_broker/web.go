@@ -13,7 +13,6 @@ import (
 	"io"
 	"net/http"
 	"plane.watch/lib/nats_io"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,12 +24,15 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"nhooyr.io/websocket"
+	"plane.watch/lib/auth"
 	"plane.watch/lib/export"
+	"plane.watch/lib/geofence"
+	"plane.watch/lib/history"
 	"plane.watch/lib/tile_grid"
 	"plane.watch/lib/ws_protocol"
 )
 
-const MaxTickDuration = time.Second * 10
+const MaxTickDuration = ws_protocol.MaxTick
 
 //go:embed test-web
 var testWebDir embed.FS
@@ -69,32 +71,85 @@ type (
 		listening bool
 
 		sendTickDuration time.Duration
+		// queueSize is how many messages can wait for a client before we start merging and dropping location updates
+		queueSize int
+		// slowClientTimeout is how long a client can be behind before we disconnect it, 0 to never disconnect
+		slowClientTimeout time.Duration
+		// deltaKeyframe is how often planes-delta clients are sent every field of an aircraft
+		deltaKeyframe time.Duration
+		// replayStore is where replays are played back from, nil when we cannot replay
+		replayStore replayStore
+		// maxReplays is how many replays a client can play at once, replayMaxSpan how long each can be
+		maxReplays    int
+		replayMaxSpan time.Duration
+		// historyStore is where aircraft histories come from, nil when we have none. historyMaxSpan is how much
+		// history a client can get at once
+		historyStore   historyStore
+		historyMaxSpan time.Duration
+		// searchRpc is how we ask pw_atc_api for airports, routes and operators to search, nil when we cannot
+		searchRpc searchRpc
+
+		// aircraftJson is the aircraft.json we last handed out
+		aircraftJson aircraftJsonCache
+
+		// tileLevels are the cell levels clients can subscribe to
+		tileLevels []int
+
+		// auth works out who a client is and what they are entitled to, limits holds them to it. Without auth
+		// everyone is entitled to everything
+		auth   auth.Authenticator
+		limits *auth.Limits
 	}
 
 	loadedResponse struct {
 		out ws_protocol.WsResponse
 
 		highLow, tile string
+		// tiles is every tile (legacy and cells, with the speed suffix) a location update is in
+		tiles []string
+		// broadcast messages go to the client regardless of what it has subscribed to
+		broadcast bool
 	}
 
 	WsClient struct {
 		conn    *websocket.Conn
 		outChan chan loadedResponse
 		cmdChan chan WsCmd
+		// queue is what is waiting to be written to the websocket, by our writer
+		queue *sendQueue
+		// protocol is the websocket subprotocol we speak with the client
+		protocol string
+		// delta remembers what we sent the client for each aircraft, when it speaks planes-delta
+		delta *ws_protocol.DeltaEncoder
+		// replayDeltas are the DeltaEncoder for each replay, replays are a different view of the same aircraft
+		replayDeltas map[string]*ws_protocol.DeltaEncoder
+		deltaMu      sync.Mutex
 
 		parent     *ClientList
 		identifier string
 		log        zerolog.Logger
+		// identity is who the client is, and what it is entitled to
+		identity *auth.Identity
 
 		sendTickDuration time.Duration
+
+		// watched mirrors the geofences and aircraft (see followKey) the client subscribes to, so we only offer it
+		// the events it wants
+		watched   map[string]bool
+		watchedMu sync.RWMutex
 	}
 	WsCmd struct {
 		action     string
 		what       string
 		extra      string
 		tick       time.Duration
-		locHistory []ws_protocol.LocationHistory
+		locHistory *history.Result
 		results    ws_protocol.SearchResult
+		tiles      []string
+		filter     *ws_protocol.CompiledFilter
+		location   *export.PlaneLocation
+		replay     *ws_protocol.Replay
+		err        error
 	}
 	ClientList struct {
 		//clients     map[*WsClient]chan ws_protocol.WsResponse
@@ -103,6 +158,8 @@ type (
 		// naive approach
 		//globalList sync.Map
 		globalList *forgetfulmap.ForgetfulSyncMap
+		// searcher finds the aircraft in globalList (and airports, routes and operators) for a search
+		searcher *searcher
 
 		broker *PwWsBrokerWeb
 	}
@@ -110,11 +167,26 @@ type (
 
 // configureWeb Sets up our serve mux to handle our web endpoints
 func (bw *PwWsBrokerWeb) configureWeb() error {
+	if nil == bw.searchRpc && nil != bw.natsRpc {
+		bw.searchRpc = bw.natsRpc
+	}
 	bw.clients = newClientList(bw)
+	bw.limits = auth.NewLimits()
+	if nil == bw.replayStore && nil != GlobalClickHouseData {
+		bw.replayStore = GlobalClickHouseData
+	}
+	if nil == bw.historyStore && nil != GlobalClickHouseData {
+		bw.historyStore = GlobalClickHouseData
+	}
 
 	bw.serveMux.HandleFunc("/", bw.indexPage)
 	bw.serveMux.HandleFunc("/grid", bw.jsonGrid)
 	bw.serveMux.HandleFunc("/planes", bw.servePlanes)
+	bw.serveMux.HandleFunc("/data/aircraft.json", bw.restAircraftJson)
+	bw.serveMux.HandleFunc("/api/v1/aircraft", bw.restAircraftList)
+	bw.serveMux.HandleFunc("/api/v1/aircraft/", bw.restAircraft)
+	bw.serveMux.HandleFunc("/api/v1/callsign/", bw.restCallSign)
+	bw.serveMux.HandleFunc("/api/v1/history/", bw.restHistory)
 
 	if bw.ServeTest {
 		bw.serveMux.Handle(
@@ -236,67 +308,16 @@ func (bw *PwWsBrokerWeb) jsonGrid(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// search handles
-func (cl *ClientList) performSearch(query string) ws_protocol.SearchResult {
-
-	results := ws_protocol.SearchResult{
-		Query:    query,
-		Aircraft: []*export.PlaneLocation{},
-		Airport:  []ws_protocol.AirportLocation{},
-		Route:    []string{},
-	}
-
-	if len(query) >= 2 {
-		// find any aircraft
-		cl.globalList.Range(func(key, value interface{}) bool {
-			loc := value.(*export.PlaneLocation)
-
-			if strings.Contains(strings.ToLower(loc.Icao), query) ||
-				(nil != loc.CallSign && strings.Contains(strings.ToLower(*loc.CallSign), query)) ||
-				(nil != loc.RegisteredOwner && strings.Contains(strings.ToLower(*loc.RegisteredOwner), query)) ||
-				(nil != loc.Registration && strings.Contains(strings.ToLower(*loc.Registration), query)) {
-				results.Aircraft = append(results.Aircraft, loc)
-			}
-
-			return len(results.Aircraft) < 10
-		})
-
-		sort.Sort(results.Aircraft)
-	}
-
-	// Airport Lookup, if we have a nats connection
-	if nil != cl.broker.natsRpc {
-		headers := map[string]string{}
-		resp, err := cl.broker.natsRpc.Request(export.NatsApiSearchAirportV1, []byte(query), headers, time.Second)
-		if nil != err {
-			log.Error().Err(err).Msg("Failed to search for airport")
-		} else {
-			json := jsoniter.ConfigFastest
-			var airports []export.Airport
-			err = json.Unmarshal(resp, &airports)
-			if nil != err {
-				log.Error().Err(err).Msg("Failed to unmarshal airport search results")
-			} else {
-				for _, airport := range airports {
-					results.Airport = append(results.Airport, ws_protocol.AirportLocation{
-						Name: airport.Name,
-						Icao: airport.IcaoCode,
-						Iata: airport.IataCode,
-						Lat:  airport.Latitude,
-						Lon:  airport.Longitude,
-					})
-				}
-			}
-		}
-	}
-
-	return results
-}
-
 // servePlanes Serves our Websocket Endpoint
 func (bw *PwWsBrokerWeb) servePlanes(w http.ResponseWriter, r *http.Request) {
 	log.Debug().Str("New Connection", r.RemoteAddr).Msg("New /planes WS")
 
+	id, release := bw.authenticate(w, r, true)
+	if nil == id {
+		return
+	}
+	defer release()
+
 	compress := r.URL.Query().Get("compress")
 	wsCompression := websocket.CompressionContextTakeover
 
@@ -305,7 +326,7 @@ func (bw *PwWsBrokerWeb) servePlanes(w http.ResponseWriter, r *http.Request) {
 	}
 
 	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-		Subprotocols:       []string{ws_protocol.WsProtocolPlanes},
+		Subprotocols:       []string{ws_protocol.WsProtocolPlanes, ws_protocol.WsProtocolPlanesDelta},
 		InsecureSkipVerify: false,
 		OriginPatterns:     bw.domainsToServe,
 		CompressionMode:    wsCompression,
@@ -319,10 +340,18 @@ func (bw *PwWsBrokerWeb) servePlanes(w http.ResponseWriter, r *http.Request) {
 
 	log.Debug().Str("protocol", conn.Subprotocol()).Msg("Speaking...")
 	switch conn.Subprotocol() {
-	case ws_protocol.WsProtocolPlanes:
-		client := NewWsClient(conn, r.RemoteAddr, bw.sendTickDuration)
+	case ws_protocol.WsProtocolPlanes, ws_protocol.WsProtocolPlanesDelta:
+		client := NewWsClient(conn, r.RemoteAddr, bw.sendTickDuration, bw.queueSize, bw.slowClientTimeout)
+		client.protocol = conn.Subprotocol()
+		client.identity = id
+		client.log = client.log.With().Str("identity", id.Name).Str("key", id.Key).Logger()
+		if ws_protocol.WsProtocolPlanesDelta == client.protocol {
+			client.delta = ws_protocol.NewDeltaEncoder(bw.deltaKeyframe)
+		}
 		bw.clients.addClient(client)
+		prometheusIdentityClients.WithLabelValues(id.Name).Inc()
 		client.Handle(r.Context())
+		prometheusIdentityClients.WithLabelValues(id.Name).Dec()
 		bw.clients.removeClient(client)
 	default:
 		_ = conn.Close(websocket.StatusPolicyViolation, "Unknown Sub Protocol")
@@ -343,14 +372,16 @@ func (bw *PwWsBrokerWeb) HealthCheckName() string {
 }
 
 // NewWsClient creates a new Websocket Client. This represents an individual connection and its handling
-func NewWsClient(conn *websocket.Conn, identifier string, defaultSendTick time.Duration) *WsClient {
+func NewWsClient(conn *websocket.Conn, identifier string, defaultSendTick time.Duration, queueSize int, slowClientTimeout time.Duration) *WsClient {
 	client := WsClient{
 		conn:             conn,
 		cmdChan:          make(chan WsCmd),
 		outChan:          make(chan loadedResponse, 500),
+		queue:            newSendQueue(queueSize, slowClientTimeout),
 		identifier:       identifier,
 		log:              log.With().Str("client", identifier).Logger(),
 		sendTickDuration: defaultSendTick,
+		watched:          make(map[string]bool),
 	}
 	return &client
 }
@@ -358,6 +389,12 @@ func NewWsClient(conn *websocket.Conn, identifier string, defaultSendTick time.D
 // Handle is a top level method that is called to Handle a websocket client connection
 func (c *WsClient) Handle(ctx context.Context) {
 	err := c.planeProtocolHandler(ctx, c.conn)
+	if errors.Is(err, errClientTooSlow) {
+		prometheusSlowClients.Inc()
+		c.log.Info().Int("queued", c.queue.depth()).Msg("Disconnecting slow client")
+		_ = c.conn.Close(websocket.StatusPolicyViolation, "Too slow, unable to keep up with updates")
+		return
+	}
 	if websocket.CloseStatus(err) == websocket.StatusNormalClosure || websocket.CloseStatus(err) == websocket.StatusGoingAway {
 		return
 	}
@@ -408,19 +445,118 @@ func (c *WsClient) SendTilePlanes(tileName string) {
 	}
 }
 
-// SendPlaneLocationHistory adds a "send the location history (from clickhouse) of the requested flight" command to the queue
-func (c *WsClient) SendPlaneLocationHistory(icao, callSign string) {
-	c.log.Debug().Str("icao", icao).Str("callSign", callSign).Msg("Request Flight Path")
+// SendPlaneLocationHistory adds a "send the (simplified) location history (from clickhouse) of the requested flight"
+// command to the queue
+func (c *WsClient) SendPlaneLocationHistory(rq *ws_protocol.WsRequest) {
+	c.log.Debug().Str("icao", rq.Icao).Str("callSign", rq.CallSign).Msg("Request Flight Path")
+	q := history.Query{Icao: rq.Icao, CallSign: rq.CallSign}
+	if nil != rq.History {
+		q.Options = *rq.History
+	}
 	go func() {
+		result, err := c.parent.broker.loadHistory(context.Background(), q)
 		c.cmdChan <- WsCmd{
 			action:     ws_protocol.RequestTypePlaneLocHistory,
-			what:       icao,
-			extra:      callSign,
-			locHistory: GlobalClickHouseData.PlaneLocationHistory(icao, callSign),
+			what:       q.Icao,
+			extra:      q.CallSign,
+			locHistory: result,
+			err:        err,
 		}
 	}()
 }
 
+// SubBBox adds a "Please subscribe this client to the cells covering its map" command to the clients command queue,
+// replacing the viewport it subscribed to last time
+func (c *WsClient) SubBBox(rq *ws_protocol.WsRequest) {
+	tiles, err := viewportTiles(rq, c.parent.broker.tileLevels)
+	if nil == err && len(tiles) > 0 {
+		// only the cells the client is entitled to
+		if tiles = entitledTiles(&c.identity.Entitlements, tiles); 0 == len(tiles) {
+			err = errors.New("not entitled to any of the tiles in the viewport")
+		}
+	}
+	c.cmdChan <- WsCmd{
+		action: ws_protocol.RequestTypeSubscribeBBox,
+		tiles:  tiles,
+		err:    err,
+	}
+}
+
+// UnSubBBox adds a "Please drop this clients viewport subscription" command to the clients command queue
+func (c *WsClient) UnSubBBox() {
+	c.cmdChan <- WsCmd{
+		action: ws_protocol.RequestTypeUnsubscribeBBox,
+	}
+}
+
+// SetFilter adds a "Please only send this client the aircraft matching its filter" command to the clients command
+// queue, no filter sends everything again
+func (c *WsClient) SetFilter(f *ws_protocol.Filter) {
+	cmd := WsCmd{action: ws_protocol.RequestTypeFilter}
+	if nil != f {
+		cmd.filter, cmd.err = f.Compile()
+	}
+	c.cmdChan <- cmd
+}
+
+// Follow adds a "Please send this client every update for this aircraft" command to the clients command queue,
+// along with what we currently know about the aircraft
+func (c *WsClient) Follow(icao, callSign string) {
+	cmd := WsCmd{
+		action: ws_protocol.RequestTypeFollow,
+		what:   icao,
+		extra:  callSign,
+	}
+	if ("" == icao) == ("" == callSign) {
+		cmd.err = errors.New("follow needs either an icao or a callSign")
+	} else {
+		cmd.location = c.parent.findAircraft(icao, callSign)
+	}
+	c.cmdChan <- cmd
+}
+
+// Unfollow adds a "Please stop following this aircraft" command to the clients command queue
+func (c *WsClient) Unfollow(icao, callSign string) {
+	c.cmdChan <- WsCmd{
+		action: ws_protocol.RequestTypeUnfollow,
+		what:   icao,
+		extra:  callSign,
+	}
+}
+
+// Resync makes the next update for the aircraft (or every aircraft when icao is empty) a keyframe, for clients
+// speaking planes-delta that have lost track
+func (c *WsClient) Resync(icao string) {
+	cmd := WsCmd{
+		action: ws_protocol.RequestTypeResync,
+		what:   icao,
+	}
+	if nil == c.delta {
+		cmd.err = errors.New("resync is only for the " + ws_protocol.WsProtocolPlanesDelta + " protocol")
+	}
+	c.cmdChan <- cmd
+}
+
+// Replay adds a "Please play back what we recorded for this area" (or a control for a replay we are playing) command
+// to the clients command queue
+func (c *WsClient) Replay(action string, rq *ws_protocol.Replay) {
+	cmd := WsCmd{
+		action: action,
+		replay: rq,
+	}
+	switch {
+	case nil == rq:
+		cmd.err = errors.New(action + " needs a replay")
+	case nil == c.parent.broker.replayStore || c.parent.broker.maxReplays <= 0:
+		cmd.err = errors.New("replays are not available")
+	case ws_protocol.RequestTypeReplay == action:
+		cmd.err = rq.Check(c.parent.broker.replayMaxSpan, time.Now())
+	case ws_protocol.RequestTypeReplaySpeed == action:
+		cmd.err = ws_protocol.CheckReplaySpeed(rq.Speed)
+	}
+	c.cmdChan <- cmd
+}
+
 func (c *WsClient) AdjustSendTick(tick int) {
 	if tick > 0 {
 		tickDuration := time.Duration(tick) * time.Millisecond
@@ -441,7 +577,7 @@ func (c *WsClient) SendSearchResults(query string) {
 		c.cmdChan <- WsCmd{
 			action:  ws_protocol.RequestTypeSearch,
 			what:    query,
-			results: c.parent.performSearch(strings.ToLower(query)),
+			results: c.parent.searcher.search(strings.ToLower(query)),
 		}
 	}()
 }
@@ -471,6 +607,17 @@ func (c *WsClient) planeProtocolHandler(ctx context.Context, conn *websocket.Con
 				if err = json.Unmarshal(frame, &rq); nil != err {
 					log.Warn().Err(err).Msg("Failed to understand message from client")
 				}
+				if err = c.parent.broker.limits.Request(c.identity); nil != err {
+					prometheusRateLimited.WithLabelValues(c.identity.Name, "requests").Inc()
+					_ = c.sendError(ctx, "Too many requests, slow down")
+					continue
+				}
+				prometheusIdentityRequests.WithLabelValues(c.identity.Name).Inc()
+				if err = entitled(&c.identity.Entitlements, &rq); nil != err {
+					prometheusNotEntitled.WithLabelValues(c.identity.Tier, requestLabel(rq.Type)).Inc()
+					_ = c.sendError(ctx, "Unable to "+rq.Type+": "+err.Error())
+					continue
+				}
 				switch rq.Type {
 				case ws_protocol.RequestTypeSubscribe:
 					c.AddSub(rq.GridTile)
@@ -481,11 +628,26 @@ func (c *WsClient) planeProtocolHandler(ctx context.Context, conn *websocket.Con
 				case ws_protocol.RequestTypeGridPlanes:
 					c.SendTilePlanes(rq.GridTile)
 				case ws_protocol.RequestTypePlaneLocHistory:
-					c.SendPlaneLocationHistory(rq.Icao, rq.CallSign)
+					c.SendPlaneLocationHistory(&rq)
 				case ws_protocol.RequestTypeTickAdjust:
 					c.AdjustSendTick(rq.Tick)
 				case ws_protocol.RequestTypeSearch:
 					c.SendSearchResults(rq.Query)
+				case ws_protocol.RequestTypeSubscribeBBox:
+					c.SubBBox(&rq)
+				case ws_protocol.RequestTypeUnsubscribeBBox:
+					c.UnSubBBox()
+				case ws_protocol.RequestTypeFilter:
+					c.SetFilter(rq.Filter)
+				case ws_protocol.RequestTypeFollow:
+					c.Follow(rq.Icao, rq.CallSign)
+				case ws_protocol.RequestTypeUnfollow:
+					c.Unfollow(rq.Icao, rq.CallSign)
+				case ws_protocol.RequestTypeResync:
+					c.Resync(rq.Icao)
+				case ws_protocol.RequestTypeReplay, ws_protocol.RequestTypeReplayPause, ws_protocol.RequestTypeReplayResume,
+					ws_protocol.RequestTypeReplaySeek, ws_protocol.RequestTypeReplaySpeed, ws_protocol.RequestTypeReplayStop:
+					c.Replay(rq.Type, rq.Replay)
 				default:
 					_ = c.sendError(ctx, "Unknown request type")
 				}
@@ -496,8 +658,40 @@ func (c *WsClient) planeProtocolHandler(ctx context.Context, conn *websocket.Con
 		}
 	}()
 
+	// write everything we queue up for the client, in order, one message at a time
+	defer c.queue.close()
+	go c.writer(ctx)
+
 	// write a stream of location information
 	subs := make(map[string]bool)
+	// viewport is the cells covering the clients map, replaced every time it moves the map
+	viewport := make(map[string]bool)
+	tileLevels := c.parent.broker.tileLevels
+	// filter narrows down which aircraft in the subscribed tiles we send, nil sends them all
+	var filter *ws_protocol.CompiledFilter
+	filtered := func(loc *export.PlaneLocation) bool {
+		return nil != filter && !filter.Matches(loc)
+	}
+	// follows are the aircraft (see followKey) we send every update for, no matter where they are
+	follows := make(map[string]bool)
+	following := func(loc *export.PlaneLocation) bool {
+		if 0 == len(follows) || nil == loc {
+			return false
+		}
+		if follows[followKey(loc.Icao, "")] {
+			return true
+		}
+		return nil != loc.CallSign && follows[followKey("", *loc.CallSign)]
+	}
+
+	// replays are the replays we are playing back to the client, by id. They stop when the client goes away
+	replays := make(map[string]*replay)
+	numReplays := 0
+	replayCtx, stopReplays := context.WithCancel(ctx)
+	defer stopReplays()
+	sendReplay := func(rs *ws_protocol.WsResponse) error {
+		return c.sendPlaneMessage(replayCtx, rs)
+	}
 
 	grid := make(map[string]bool)
 	gridNames := make(map[string]bool)
@@ -530,39 +724,192 @@ func (c *WsClient) planeProtocolHandler(ctx context.Context, conn *websocket.Con
 			case "exit":
 				return nil
 			case ws_protocol.RequestTypeSubscribe:
-				if _, ok := grid[cmdMsg.what]; ok {
+				if _, ok := grid[cmdMsg.what]; ok || isGeofenceTile(cmdMsg.what) || isCellTile(cmdMsg.what, tileLevels) {
+					if !subs[cmdMsg.what] {
+						prometheusSubscriptions.WithLabelValues(subscriptionLabel(cmdMsg.what)).Inc()
+					}
 					subs[cmdMsg.what] = true
+					if isGeofenceTile(cmdMsg.what) {
+						c.watch(cmdMsg.what, true)
+					}
 					err = c.sendAck(ctx, ws_protocol.ResponseTypeAckSub, cmdMsg.what)
-					prometheusSubscriptions.WithLabelValues(cmdMsg.what).Inc()
 				} else {
 					err = c.sendError(ctx, "Unknown Tile: "+cmdMsg.what)
 				}
 			case ws_protocol.RequestTypeUnsubscribe:
 				if _, ok := subs[cmdMsg.what]; ok {
-					prometheusSubscriptions.WithLabelValues(cmdMsg.what).Dec()
+					prometheusSubscriptions.WithLabelValues(subscriptionLabel(cmdMsg.what)).Dec()
 					err = c.sendAck(ctx, ws_protocol.ResponseTypeAckUnsub, cmdMsg.what)
 				} else {
 					err = c.sendError(ctx, "Not Subbed to: "+cmdMsg.what)
 				}
 				delete(subs, cmdMsg.what)
+				c.watch(cmdMsg.what, false)
+			case ws_protocol.RequestTypeSubscribeBBox:
+				if nil != cmdMsg.err {
+					err = c.sendError(ctx, "Unable to subscribe to viewport: "+cmdMsg.err.Error())
+					break
+				}
+				for k := range viewport {
+					prometheusSubscriptions.WithLabelValues(subscriptionLabel(k)).Dec()
+				}
+				viewport = make(map[string]bool, len(cmdMsg.tiles))
+				for _, k := range cmdMsg.tiles {
+					viewport[k] = true
+					prometheusSubscriptions.WithLabelValues(subscriptionLabel(k)).Inc()
+				}
+				err = c.sendPlaneMessage(ctx, &ws_protocol.WsResponse{
+					Type:  ws_protocol.ResponseTypeAckSub,
+					Tiles: cmdMsg.tiles,
+				})
+			case ws_protocol.RequestTypeUnsubscribeBBox:
+				tiles := make([]string, 0, len(viewport))
+				for k := range viewport {
+					prometheusSubscriptions.WithLabelValues(subscriptionLabel(k)).Dec()
+					tiles = append(tiles, k)
+				}
+				viewport = make(map[string]bool)
+				err = c.sendPlaneMessage(ctx, &ws_protocol.WsResponse{
+					Type:  ws_protocol.ResponseTypeAckUnsub,
+					Tiles: tiles,
+				})
+			case ws_protocol.RequestTypeFilter:
+				if nil != cmdMsg.err {
+					err = c.sendError(ctx, "Unable to use filter: "+cmdMsg.err.Error())
+					break
+				}
+				filter = cmdMsg.filter
+				rs := ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeAckFilter}
+				if nil != filter {
+					rs.Filter = &filter.Filter
+				}
+				err = c.sendPlaneMessage(ctx, &rs)
+			case ws_protocol.RequestTypeFollow:
+				if nil != cmdMsg.err {
+					err = c.sendError(ctx, "Unable to follow: "+cmdMsg.err.Error())
+					break
+				}
+				key := followKey(cmdMsg.what, cmdMsg.extra)
+				if !follows[key] {
+					prometheusSubscriptions.WithLabelValues("follow").Inc()
+				}
+				follows[key] = true
+				c.watch(key, true)
+				err = c.sendPlaneMessage(ctx, &ws_protocol.WsResponse{
+					Type:     ws_protocol.ResponseTypeAckFollow,
+					Icao:     cmdMsg.what,
+					CallSign: cmdMsg.extra,
+					Location: cmdMsg.location,
+				})
+			case ws_protocol.RequestTypeUnfollow:
+				key := followKey(cmdMsg.what, cmdMsg.extra)
+				if !follows[key] {
+					err = c.sendError(ctx, "Not following: "+cmdMsg.what+cmdMsg.extra)
+					break
+				}
+				prometheusSubscriptions.WithLabelValues("follow").Dec()
+				delete(follows, key)
+				c.watch(key, false)
+				err = c.sendPlaneMessage(ctx, &ws_protocol.WsResponse{
+					Type:     ws_protocol.ResponseTypeAckUnfollow,
+					Icao:     cmdMsg.what,
+					CallSign: cmdMsg.extra,
+				})
+			case ws_protocol.RequestTypeResync:
+				if nil != cmdMsg.err {
+					err = c.sendError(ctx, cmdMsg.err.Error())
+					break
+				}
+				c.deltaMu.Lock()
+				c.delta.Reset(cmdMsg.what)
+				c.deltaMu.Unlock()
+				err = c.sendPlaneMessage(ctx, &ws_protocol.WsResponse{
+					Type:    ws_protocol.ResponseTypeMsg,
+					Message: "Resync " + cmdMsg.what,
+				})
+			case ws_protocol.RequestTypeReplay:
+				if nil != cmdMsg.err {
+					err = c.sendError(ctx, "Unable to replay: "+cmdMsg.err.Error())
+					break
+				}
+				for id, r := range replays {
+					select {
+					case <-r.done:
+						delete(replays, id)
+					default:
+					}
+				}
+				id := cmdMsg.replay.Id
+				if "" == id {
+					numReplays++
+					id = "replay-" + strconv.Itoa(numReplays)
+				}
+				if _, ok := replays[id]; ok {
+					err = c.sendError(ctx, "Already replaying: "+id)
+					break
+				}
+				if len(replays) >= c.parent.broker.maxReplays {
+					err = c.sendError(ctx, "Unable to replay: at most "+strconv.Itoa(c.parent.broker.maxReplays)+" replays at a time")
+					break
+				}
+				r, errReplay := newReplay(id, cmdMsg.replay, c.parent.broker.replayStore, filter, sendReplay, c.log)
+				if nil != errReplay {
+					err = c.sendError(ctx, "Unable to replay: "+errReplay.Error())
+					break
+				}
+				replays[id] = r
+				go r.run(replayCtx)
+			case ws_protocol.RequestTypeReplayPause, ws_protocol.RequestTypeReplayResume, ws_protocol.RequestTypeReplaySeek,
+				ws_protocol.RequestTypeReplaySpeed, ws_protocol.RequestTypeReplayStop:
+				if nil != cmdMsg.err {
+					err = c.sendError(ctx, "Unable to "+cmdMsg.action+": "+cmdMsg.err.Error())
+					break
+				}
+				r, ok := replays[cmdMsg.replay.Id]
+				if !ok {
+					err = c.sendError(ctx, "Not replaying: "+cmdMsg.replay.Id)
+					break
+				}
+				select {
+				case r.control <- replayControl{action: cmdMsg.action, at: cmdMsg.replay.At, speed: cmdMsg.replay.Speed}:
+				case <-r.done:
+					delete(replays, cmdMsg.replay.Id)
+					err = c.sendError(ctx, "Not replaying: "+cmdMsg.replay.Id)
+				default:
+					err = c.sendError(ctx, "Replay is busy, try again: "+cmdMsg.replay.Id)
+				}
 			case ws_protocol.RequestTypeSubscribeList:
-				tiles := make([]string, 0, len(subs))
+				tiles := make([]string, 0, len(subs)+len(viewport))
 				for k, v := range subs {
 					if v {
 						tiles = append(tiles, k)
 					}
 				}
+				for k := range viewport {
+					tiles = append(tiles, k)
+				}
 				err = c.sendPlaneMessage(ctx, &ws_protocol.WsResponse{
 					Type:  ws_protocol.ResponseTypeSubTiles,
 					Tiles: tiles,
 				})
 			case ws_protocol.RequestTypeGridPlanes:
-				if _, gridOk := gridNames[cmdMsg.what]; gridOk {
+				// legacy tiles match on the tile the update was given, cells on where the aircraft is
+				inTile := func(loc *export.PlaneLocation) bool {
+					return cmdMsg.what == loc.TileLocation
+				}
+				_, gridOk := gridNames[cmdMsg.what]
+				if cell, cellErr := tile_grid.ParseCell(cmdMsg.what); nil == cellErr {
+					gridOk = true
+					inTile = func(loc *export.PlaneLocation) bool {
+						return loc.HasLocation && cell.Contains(loc.Lat, loc.Lon)
+					}
+				}
+				if gridOk {
 					matching := 0
 					// find all things currently in requested grid
 					c.parent.globalList.Range(func(key, value interface{}) bool {
 						loc := value.(*export.PlaneLocation)
-						if cmdMsg.what == loc.TileLocation {
+						if inTile(loc) && !filtered(loc) {
 							if id, ok := icaoIdLookup[loc.Icao]; ok {
 								locationMessages[id] = loc
 							} else {
@@ -577,11 +924,16 @@ func (c *WsClient) planeProtocolHandler(ctx context.Context, conn *websocket.Con
 					err = c.sendError(ctx, "Unknown Tile: "+cmdMsg.what)
 				}
 			case ws_protocol.RequestTypePlaneLocHistory:
+				if nil != cmdMsg.err {
+					err = c.sendError(ctx, "Unable to get history: "+cmdMsg.err.Error())
+					break
+				}
 				err = c.sendPlaneMessage(ctx, &ws_protocol.WsResponse{
 					Type:     ws_protocol.ResponseTypePlaneLocHistory,
-					History:  cmdMsg.locHistory,
-					Icao:     cmdMsg.what,
-					CallSign: cmdMsg.extra,
+					History:  cmdMsg.locHistory.Path,
+					Profile:  cmdMsg.locHistory.Profile,
+					Icao:     cmdMsg.locHistory.Icao,
+					CallSign: cmdMsg.locHistory.CallSign,
 				})
 			case ws_protocol.RequestTypeTickAdjust:
 				// this is already less than 10 seconds (MaxTickDuration)
@@ -607,11 +959,47 @@ func (c *WsClient) planeProtocolHandler(ctx context.Context, conn *websocket.Con
 				err = c.sendError(ctx, "Unknown Command")
 			}
 		case planeMsg := <-c.outChan:
+			if planeMsg.broadcast {
+				err = c.sendPlaneMessage(ctx, &planeMsg.out)
+				break
+			}
+			if ws_protocol.ResponseTypeAircraftRemoved == planeMsg.out.Type {
+				if following(planeMsg.out.Location) {
+					err = c.sendPlaneMessage(ctx, &planeMsg.out)
+				}
+				break
+			}
+			if following(planeMsg.out.Location) {
+				// followed aircraft get every (high rate) update straight away, whatever tiles and filter we have.
+				// the low rate updates are copies of some of the high rate ones
+				if ws_protocol.GridTileSuffixHigh != planeMsg.highLow {
+					break
+				}
+				rs := planeMsg.out
+				if rs.Location.Removed {
+					rs = removedResponse(rs.Location)
+				}
+				err = c.sendPlaneMessage(ctx, &rs)
+				break
+			}
+			if ws_protocol.ResponseTypeGeofence == planeMsg.out.Type {
+				// geofence events are sent straight away, so nobody misses an aircraft entering or leaving
+				if subs[planeMsg.tile] {
+					err = c.sendPlaneMessage(ctx, &planeMsg.out)
+				}
+				break
+			}
 			// if we have a subscription to this planes tile or all tiles
 			// log.Debug().Str("tile", planeMsg.tile).Str("highlow", planeMsg.highLow).Msg("info")
-			tileSub, tileOk := subs[planeMsg.tile]
+			tileSub := false
+			for _, tile := range planeMsg.tiles {
+				if subs[tile] || viewport[tile] {
+					tileSub = true
+					break
+				}
+			}
 			allSub, allOk := subs["all"+planeMsg.highLow]
-			if (tileSub && tileOk) || (allSub && allOk) {
+			if (tileSub || (allSub && allOk)) && !filtered(planeMsg.out.Location) {
 				if c.sendTickDuration > 0 {
 					// limit our updates to only 1 per icao, sent periodically
 					if id, ok := icaoIdLookup[planeMsg.out.Location.Icao]; ok {
@@ -646,8 +1034,12 @@ func (c *WsClient) planeProtocolHandler(ctx context.Context, conn *websocket.Con
 
 	// tell prometheus we are no longer caring about the tiles
 	for k := range subs {
-		prometheusSubscriptions.WithLabelValues(k).Dec()
+		prometheusSubscriptions.WithLabelValues(subscriptionLabel(k)).Dec()
+	}
+	for k := range viewport {
+		prometheusSubscriptions.WithLabelValues(subscriptionLabel(k)).Dec()
 	}
+	prometheusSubscriptions.WithLabelValues("follow").Sub(float64(len(follows)))
 	return err
 }
 
@@ -670,23 +1062,98 @@ func (c *WsClient) sendError(ctx context.Context, msg string) error {
 	return c.sendPlaneMessage(ctx, &rs)
 }
 
-// sendPlaneMessage sends a message to the client, with timeout
+// sendPlaneMessage queues a message for the client, it fails with errClientTooSlow if the client cannot keep up
 func (c *WsClient) sendPlaneMessage(ctx context.Context, planeMsg *ws_protocol.WsResponse) error {
+	return c.queue.push(planeMsg, time.Now())
+}
+
+// writer writes the messages in our queue to the client, with timeout, until the queue is closed
+func (c *WsClient) writer(ctx context.Context) {
 	json := jsoniter.ConfigFastest
-	buf, err := json.Marshal(planeMsg)
-	if nil != err {
-		c.log.Debug().Err(err).Str("type", planeMsg.Type).Msg("Failed to marshal plane msg to send to client")
-		return err
-	}
-	go func() {
+	for {
+		planeMsg, ok := c.queue.pop(ctx)
+		if !ok {
+			return
+		}
+		if nil != c.delta {
+			// worked out as we write, so coalescing in the queue never loses a change
+			if planeMsg = c.encodeDeltas(planeMsg); nil == planeMsg {
+				continue
+			}
+		}
+		buf, err := json.Marshal(planeMsg)
+		if nil != err {
+			c.log.Debug().Err(err).Str("type", planeMsg.Type).Msg("Failed to marshal plane msg to send to client")
+			continue
+		}
+		switch planeMsg.Type {
+		case ws_protocol.ResponseTypePlaneLocation, ws_protocol.ResponseTypePlaneLocations, ws_protocol.ResponseTypePlaneDeltas:
+			prometheusLocationBytes.WithLabelValues(c.protocol).Add(float64(len(buf)))
+			prometheusLocationsSent.WithLabelValues(c.protocol).Add(float64(max(len(planeMsg.Locations), len(planeMsg.Deltas), 1)))
+		}
 		if err = c.writeTimeout(ctx, 3*time.Second, buf); nil != err {
 			c.log.Debug().
 				Err(err).
 				Str("type", planeMsg.Type).
 				Msgf("Failed to send message to client. %+v", err)
+			// a failed write closes the connection, there is no point writing anything else
+			c.queue.close()
+			return
 		}
-	}()
-	return nil
+	}
+}
+
+// encodeDeltas turns location updates into the deltas (the changed fields) we send planes-delta clients, nil when
+// nothing changed
+func (c *WsClient) encodeDeltas(rs *ws_protocol.WsResponse) *ws_protocol.WsResponse {
+	c.deltaMu.Lock()
+	defer c.deltaMu.Unlock()
+	now := time.Now()
+	enc := c.delta
+	if nil != rs.Replay {
+		if ws_protocol.ResponseTypeReplayEnd == rs.Type {
+			delete(c.replayDeltas, rs.Replay.Id)
+			return rs
+		}
+		if enc = c.replayDeltas[rs.Replay.Id]; nil == enc {
+			if nil == c.replayDeltas {
+				c.replayDeltas = make(map[string]*ws_protocol.DeltaEncoder)
+			}
+			enc = ws_protocol.NewDeltaEncoder(c.parent.broker.deltaKeyframe)
+			c.replayDeltas[rs.Replay.Id] = enc
+		}
+	}
+	var locations []*export.PlaneLocation
+	switch rs.Type {
+	case ws_protocol.ResponseTypePlaneLocation:
+		locations = []*export.PlaneLocation{rs.Location}
+	case ws_protocol.ResponseTypePlaneLocations:
+		locations = rs.Locations
+	default:
+		// anything else with an aircraft in it (ack-follow, aircraft-removed) sends it in full
+		enc.Sent(rs.Location, now)
+		return rs
+	}
+
+	out := &ws_protocol.WsResponse{
+		Type:   ws_protocol.ResponseTypePlaneDeltas,
+		Deltas: make([]ws_protocol.Delta, 0, len(locations)),
+		Replay: rs.Replay,
+	}
+	for _, loc := range locations {
+		d, err := enc.Encode(loc, now)
+		if nil != err {
+			c.log.Debug().Err(err).Str("icao", loc.Icao).Msg("Failed to work out delta")
+			continue
+		}
+		if d.Full || len(d.Fields) > 0 {
+			out.Deltas = append(out.Deltas, d)
+		}
+	}
+	if 0 == len(out.Deltas) {
+		return nil
+	}
+	return out
 }
 
 // writeTimeout handles the writing of a message to the actual websocket connection
@@ -702,12 +1169,17 @@ func (c *WsClient) writeTimeout(ctx context.Context, timeout time.Duration, msg
 // newClientList represents a list of websocket clients that we are currently servicing
 func newClientList(bw *PwWsBrokerWeb) *ClientList {
 	cl := ClientList{
-		broker: bw,
+		broker:   bw,
+		searcher: newSearcher(bw.searchRpc),
 	}
 	cl.globalList = forgetfulmap.NewForgetfulSyncMap(
 		forgetfulmap.WithPrometheusCounters(prometheusKnownPlanes),
 		forgetfulmap.WithPreEvictionAction(func(key, value any) {
 			log.Debug().Str("ICAO", key.(string)).Msg("Removing Aircraft due to inactivity")
+			cl.searcher.forget(key.(string))
+			if loc, ok := value.(*export.PlaneLocation); ok {
+				cl.SendRemoved(loc)
+			}
 		}),
 		forgetfulmap.WithForgettableAction(func(key, value any, added time.Time) bool {
 			result := true
@@ -754,12 +1226,63 @@ func (cl *ClientList) globalListUpdate(loc *export.PlaneLocation) {
 	if nil == loc {
 		return
 	}
+	if loc.Removed {
+		// we are no longer tracking it, so do not hand it out with grid-planes, search or follow
+		cl.globalList.Delete(loc.Icao)
+		cl.searcher.forget(loc.Icao)
+		return
+	}
 	cl.globalList.Store(loc.Icao, loc)
+	cl.searcher.update(loc)
 }
 
-// SendLocationUpdate sends an update to each listening client
-// todo: make this threaded?
-func (cl *ClientList) SendLocationUpdate(highLow, tile string, loc *export.PlaneLocation) {
+// findAircraft is what we currently know about an aircraft, by icao or callsign. When more than one aircraft has
+// the callsign, we use the one we heard from last
+func (cl *ClientList) findAircraft(icao, callSign string) *export.PlaneLocation {
+	if "" != icao {
+		if value, ok := cl.globalList.Load(strings.ToUpper(icao)); ok {
+			if loc, isLoc := value.(*export.PlaneLocation); isLoc {
+				return loc
+			}
+		}
+		return nil
+	}
+	var found *export.PlaneLocation
+	key := followKey("", callSign)
+	cl.globalList.Range(func(_, value interface{}) bool {
+		loc, ok := value.(*export.PlaneLocation)
+		if ok && nil != loc.CallSign && key == followKey("", *loc.CallSign) && (nil == found || loc.LastMsg.After(found.LastMsg)) {
+			found = loc
+		}
+		return true
+	})
+	return found
+}
+
+// followKey is how we keep track of a followed aircraft, by its icao or its callsign
+func followKey(icao, callSign string) string {
+	if "" != icao {
+		return strings.ToUpper(strings.TrimSpace(icao))
+	}
+	return "callsign:" + strings.ToUpper(strings.TrimSpace(callSign))
+}
+
+// removedResponse lets a client know an aircraft it follows is no longer being tracked
+func removedResponse(loc *export.PlaneLocation) ws_protocol.WsResponse {
+	rs := ws_protocol.WsResponse{
+		Type:     ws_protocol.ResponseTypeAircraftRemoved,
+		Icao:     loc.Icao,
+		Location: loc,
+	}
+	if nil != loc.CallSign {
+		rs.CallSign = *loc.CallSign
+	}
+	return rs
+}
+
+// SendLocationUpdate sends an update to each listening client. A client that is not keeping up with its updates
+// misses this one rather than holding up everyone else
+func (cl *ClientList) SendLocationUpdate(highLow string, tiles []string, loc *export.PlaneLocation) {
 	// Add our update to our global list
 	cl.globalListUpdate(loc)
 
@@ -771,18 +1294,131 @@ func (cl *ClientList) SendLocationUpdate(highLow, tile string, loc *export.Plane
 			}
 		}()
 		client := key.(*WsClient)
-		client.outChan <- loadedResponse{
+		reason := "inbound_full"
+		if loc.Removed {
+			// counted with the other removals, a client that misses one keeps showing the aircraft
+			reason = "removed_full"
+		}
+		client.offer(loadedResponse{
 			out: ws_protocol.WsResponse{
 				Type:     ws_protocol.ResponseTypePlaneLocation,
 				Location: loc,
 			},
 			highLow: highLow,
-			tile:    tile,
+			tiles:   tiles,
+		}, reason)
+		return true
+	})
+}
+
+// SendRemoved lets the clients following an aircraft know we have stopped tracking it
+func (cl *ClientList) SendRemoved(loc *export.PlaneLocation) {
+	keys := []string{followKey(loc.Icao, "")}
+	if nil != loc.CallSign {
+		keys = append(keys, followKey("", *loc.CallSign))
+	}
+	cl.clients.Range(func(key, value interface{}) bool {
+		defer func() {
+			if r := recover(); nil != r {
+				log.Error().Msgf("Panic: %v", r)
+			}
+		}()
+		client := key.(*WsClient)
+		if !client.watching(keys...) {
+			return true
 		}
+		client.offer(loadedResponse{
+			out: removedResponse(loc),
+		}, "removed_full")
 		return true
 	})
 }
 
+// SendEmergency lets every client know about an emergency, no matter which tiles they are looking at
+func (cl *ClientList) SendEmergency(ee *export.EmergencyEvent) {
+	cl.clients.Range(func(key, value interface{}) bool {
+		defer func() {
+			if r := recover(); nil != r {
+				log.Error().Msgf("Panic: %v", r)
+			}
+		}()
+		client := key.(*WsClient)
+		client.offer(loadedResponse{
+			out: ws_protocol.WsResponse{
+				Type:      ws_protocol.ResponseTypeEmergency,
+				Emergency: ee,
+			},
+			broadcast: true,
+		}, "emergency_full")
+		return true
+	})
+}
+
+// SendGeofence sends a geofence event to the clients subscribed to the geofence
+func (cl *ClientList) SendGeofence(ge *export.GeofenceEvent) {
+	tile := export.GeofenceSubject(ge.Fence)
+	cl.clients.Range(func(key, value interface{}) bool {
+		defer func() {
+			if r := recover(); nil != r {
+				log.Error().Msgf("Panic: %v", r)
+			}
+		}()
+		client := key.(*WsClient)
+		if !client.watching(tile) {
+			return true
+		}
+		client.offer(loadedResponse{
+			out: ws_protocol.WsResponse{
+				Type:     ws_protocol.ResponseTypeGeofence,
+				Geofence: ge,
+			},
+			tile: tile,
+		}, "geofence_full")
+		return true
+	})
+}
+
+// offer hands a response to the client without waiting on it. A client that is not keeping up misses the response,
+// and we count it against reason
+func (c *WsClient) offer(rs loadedResponse, reason string) bool {
+	select {
+	case c.outChan <- rs:
+		return true
+	default:
+		prometheusDroppedMessages.WithLabelValues(reason).Inc()
+		return false
+	}
+}
+
+// watch keeps track of what the client wants sent to it, outside its handler
+func (c *WsClient) watch(key string, watching bool) {
+	c.watchedMu.Lock()
+	defer c.watchedMu.Unlock()
+	if watching {
+		c.watched[key] = true
+	} else {
+		delete(c.watched, key)
+	}
+}
+
+// watching tells us if the client wants to hear about any of the keys
+func (c *WsClient) watching(keys ...string) bool {
+	c.watchedMu.RLock()
+	defer c.watchedMu.RUnlock()
+	for _, key := range keys {
+		if c.watched[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// isGeofenceTile tells us if the client is subscribing to a geofence (with an id a fence can have) instead of a tile
+func isGeofenceTile(tile string) bool {
+	id, ok := strings.CutPrefix(tile, ws_protocol.GridTileGeofencePrefix)
+	return ok && geofence.ValidId(id)
+}
+
 // mustGzipBytes is a helper function that dies if there is an error GZIP'ing a byte stream
 func mustGzipBytes(in []byte) []byte {
 	// make a gzip version
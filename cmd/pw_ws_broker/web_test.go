@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"plane.watch/lib/export"
+	"plane.watch/lib/ws_protocol"
+)
+
+func TestClientList_SendsOnlyToWatchers(t *testing.T) {
+	cl := &ClientList{}
+	follower := NewWsClient(nil, "follower", 0, 10, time.Second)
+	fenced := NewWsClient(nil, "fenced", 0, 10, time.Second)
+	other := NewWsClient(nil, "other", 0, 10, time.Second)
+	for _, c := range []*WsClient{follower, fenced, other} {
+		cl.addClient(c)
+		defer cl.removeClient(c)
+	}
+	follower.watch(followKey("", "qfa123"), true)
+	fenced.watch(export.GeofenceSubject("perth"), true)
+
+	cl.SendRemoved(&export.PlaneLocation{Icao: "7C4516", CallSign: ptr("QFA123")})
+	cl.SendGeofence(&export.GeofenceEvent{Fence: "perth", Event: export.GeofenceEventEnter})
+	cl.SendEmergency(&export.EmergencyEvent{Icao: "7C4516"})
+
+	expect := map[*WsClient][]string{
+		follower: {ws_protocol.ResponseTypeAircraftRemoved, ws_protocol.ResponseTypeEmergency},
+		fenced:   {ws_protocol.ResponseTypeGeofence, ws_protocol.ResponseTypeEmergency},
+		other:    {ws_protocol.ResponseTypeEmergency},
+	}
+	for c, types := range expect {
+		if len(types) != len(c.outChan) {
+			t.Errorf("%s: expected %d messages, got %d", c.identifier, len(types), len(c.outChan))
+			continue
+		}
+		for _, typ := range types {
+			if rs := <-c.outChan; typ != rs.out.Type {
+				t.Errorf("%s: expected a %s, got %s", c.identifier, typ, rs.out.Type)
+			}
+		}
+	}
+}
+
+func TestClientList_DoesNotWaitForSlowClients(t *testing.T) {
+	cl := newClientList(&PwWsBrokerWeb{})
+	c := NewWsClient(nil, "slow", 0, 10, time.Second)
+	cl.addClient(c)
+	defer cl.removeClient(c)
+	c.watch(followKey("7C4516", ""), true)
+	for len(c.outChan) < cap(c.outChan) {
+		c.outChan <- loadedResponse{}
+	}
+
+	dropped := testutil.ToFloat64(prometheusDroppedMessages.WithLabelValues("removed_full"))
+	done := make(chan bool)
+	go func() {
+		cl.SendRemoved(&export.PlaneLocation{Icao: "7C4516"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SendRemoved waited for a client that is not reading")
+	}
+	if dropped+1 != testutil.ToFloat64(prometheusDroppedMessages.WithLabelValues("removed_full")) {
+		t.Errorf("expected the dropped message to be counted")
+	}
+
+	// the last update of a removed aircraft is counted with the removals, not the other updates
+	inbound := testutil.ToFloat64(prometheusDroppedMessages.WithLabelValues("inbound_full"))
+	cl.SendLocationUpdate(ws_protocol.GridTileSuffixHigh, nil, &export.PlaneLocation{Icao: "7C4516", Removed: true})
+	cl.SendLocationUpdate(ws_protocol.GridTileSuffixHigh, nil, &export.PlaneLocation{Icao: "7C4517"})
+	if dropped+2 != testutil.ToFloat64(prometheusDroppedMessages.WithLabelValues("removed_full")) || inbound+1 != testutil.ToFloat64(prometheusDroppedMessages.WithLabelValues("inbound_full")) {
+		t.Errorf("expected the removed update to be counted as removed_full")
+	}
+}
+
+func TestSubscriptionLabel_Geofences(t *testing.T) {
+	for tile, want := range map[string]bool{
+		"geofence.perth":         true,
+		"geofence.YPPH_ctr-1":    true,
+		"geofence.":              false,
+		"geofence.a.b":           false,
+		"geofence.made up fence": false,
+	} {
+		if want != isGeofenceTile(tile) {
+			t.Errorf("%q: expected isGeofenceTile to be %v", tile, want)
+		}
+	}
+	if "geofence" != subscriptionLabel("geofence.perth") || "geofence" != subscriptionLabel("geofence.somewhere-else") {
+		t.Error("expected every geofence to be counted as one label")
+	}
+}
@@ -0,0 +1,382 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HeaderApiKey and QueryApiKey are where clients give us their API key, QueryToken is where browsers (that cannot set
+// an Authorization header on a websocket) give us their JWT
+const (
+	HeaderApiKey = "X-API-Key"
+	QueryApiKey  = "apiKey"
+	QueryToken   = "token"
+)
+
+// AnonymousName is the identity (and metrics label) of everyone that did not give us any credentials
+const AnonymousName = "anonymous"
+
+// TierApiKey, TierJwt and TierAnonymous are the tiers of identities that are not given one in the config
+const (
+	TierApiKey    = "apikey"
+	TierJwt       = "jwt"
+	TierAnonymous = AnonymousName
+)
+
+var (
+	// ErrNoCredentials means the request did not have any credentials we understand
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials means the request had credentials, but they are not ones we accept
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrTooManyConnections means the identity already has as many connections open as it is entitled to
+	ErrTooManyConnections = errors.New("too many connections")
+	// ErrRateLimited means the identity is making connections or requests faster than it is entitled to
+	ErrRateLimited = errors.New("rate limited")
+)
+
+type (
+	// Entitlements are what an identity is allowed to do, and how much of it
+	Entitlements struct {
+		// Tiles are the tiles (path.Match patterns, e.g. "z8-*_low" or "tile38_*") that can be subscribed to,
+		// empty for every tile
+		Tiles []string `yaml:"tiles" json:"tiles,omitempty"`
+		// AllTiles allows all_low and all_high, and everything at once over REST
+		AllTiles bool `yaml:"all_tiles" json:"all_tiles,omitempty"`
+		// History allows location history and replays of what we recorded
+		History bool `yaml:"history" json:"history,omitempty"`
+		// Search allows searching for and looking up (and following) any aircraft, wherever it is
+		Search bool `yaml:"search" json:"search,omitempty"`
+
+		// MaxConnections is how many websockets can be open at once, 0 for no limit
+		MaxConnections int `yaml:"max_connections" json:"max_connections,omitempty"`
+		// ConnectRate is how many connections a second can be opened (with bursts of ConnectBurst), 0 for no limit
+		ConnectRate  float64 `yaml:"connect_rate" json:"connect_rate,omitempty"`
+		ConnectBurst int     `yaml:"connect_burst" json:"connect_burst,omitempty"`
+		// RequestRate is how many requests a second can be made (with bursts of RequestBurst), across every
+		// connection and the REST API, 0 for no limit
+		RequestRate  float64 `yaml:"request_rate" json:"request_rate,omitempty"`
+		RequestBurst int     `yaml:"request_burst" json:"request_burst,omitempty"`
+	}
+
+	// Identity is who made a request, and what they are entitled to
+	Identity struct {
+		// Name is who they are, it labels metrics so there should not be too many of them
+		Name string
+		// Key is what limits are counted against, different from Name when one name covers many clients
+		Key string
+		// Tier is the plan the identity is on, for metrics that cannot have a label for every identity. It only
+		// ever comes from the config, so there are only ever a few of them
+		Tier         string
+		Entitlements Entitlements
+	}
+
+	// Authenticator works out who made a request. It returns ErrNoCredentials when the request does not have the
+	// credentials it looks for, so the next Authenticator can have a go
+	Authenticator interface {
+		Authenticate(r *http.Request) (*Identity, error)
+	}
+
+	// ApiKey is an API key we accept, and who it belongs to
+	ApiKey struct {
+		Key          string       `yaml:"key" json:"key"`
+		Identity     string       `yaml:"identity" json:"identity"`
+		Tier         string       `yaml:"tier" json:"tier"`
+		Entitlements Entitlements `yaml:"entitlements" json:"entitlements"`
+	}
+
+	// JwtConfig is how we verify JWTs
+	JwtConfig struct {
+		// KeySet is the path to a JWKS (JSON Web Key Set) file with the keys tokens can be signed with
+		KeySet   string `yaml:"key_set" json:"key_set"`
+		Issuer   string `yaml:"issuer" json:"issuer"`
+		Audience string `yaml:"audience" json:"audience"`
+		// Tier is the tier of every token, whoever it is for
+		Tier string `yaml:"tier" json:"tier"`
+		// Leeway is how much clock skew we allow when checking exp and nbf
+		Leeway time.Duration `yaml:"leeway" json:"leeway"`
+		// Entitlements are what a token is entitled to, unless its pw claim says otherwise
+		Entitlements Entitlements `yaml:"entitlements" json:"entitlements"`
+	}
+
+	// Config is how we authenticate, from a YAML file
+	Config struct {
+		ApiKeys []ApiKey   `yaml:"api_keys" json:"api_keys"`
+		Jwt     *JwtConfig `yaml:"jwt" json:"jwt"`
+		// Anonymous are the entitlements of clients without credentials, nil to turn them away
+		Anonymous *Entitlements `yaml:"anonymous" json:"anonymous"`
+		// TrustedProxies are the addresses (or CIDR ranges) of the proxies in front of us. Only they can tell us who
+		// the client is with X-Forwarded-For or X-Real-IP
+		TrustedProxies []string `yaml:"trusted_proxies" json:"trusted_proxies"`
+	}
+
+	// Proxies are the proxies we trust to tell us the client's address
+	Proxies []netip.Prefix
+
+	apiKeys struct {
+		keys []ApiKey
+	}
+
+	anonymous struct {
+		entitlements Entitlements
+		proxies      Proxies
+	}
+
+	chain []Authenticator
+)
+
+// Unrestricted is entitled to everything, without limits
+func Unrestricted() Entitlements {
+	return Entitlements{AllTiles: true, History: true, Search: true}
+}
+
+// Check makes sure the entitlements make sense
+func (e *Entitlements) Check() error {
+	for _, pattern := range e.Tiles {
+		if _, err := path.Match(pattern, ""); nil != err {
+			return fmt.Errorf("bad tile pattern %q: %w", pattern, err)
+		}
+	}
+	if e.MaxConnections < 0 || e.ConnectRate < 0 || e.ConnectBurst < 0 || e.RequestRate < 0 || e.RequestBurst < 0 {
+		return errors.New("limits cannot be negative")
+	}
+	return nil
+}
+
+// Tile tells us if the tile can be subscribed to. all_low and all_high are AllTiles, not Tiles
+func (e *Entitlements) Tile(tile string) bool {
+	if 0 == len(e.Tiles) {
+		return true
+	}
+	for _, pattern := range e.Tiles {
+		if ok, _ := path.Match(pattern, tile); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads our auth config from a YAML file
+func Load(file string) (Authenticator, error) {
+	buf, err := os.ReadFile(file)
+	if nil != err {
+		return nil, err
+	}
+	return Parse(buf)
+}
+
+// Parse reads our auth config from YAML (or JSON, which is YAML too)
+func Parse(buf []byte) (Authenticator, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(buf, &cfg); nil != err {
+		return nil, err
+	}
+	return New(cfg)
+}
+
+// New makes an Authenticator that tries API keys, then JWTs, then lets in anyone else as anonymous (when it is
+// configured to)
+func New(cfg Config) (Authenticator, error) {
+	var c chain
+	if len(cfg.ApiKeys) > 0 {
+		keys, err := NewApiKeys(cfg.ApiKeys)
+		if nil != err {
+			return nil, err
+		}
+		c = append(c, keys)
+	}
+	if nil != cfg.Jwt {
+		keys, err := LoadKeySet(cfg.Jwt.KeySet)
+		if nil != err {
+			return nil, fmt.Errorf("jwt key set: %w", err)
+		}
+		jwt, err := NewJwt(*cfg.Jwt, keys)
+		if nil != err {
+			return nil, err
+		}
+		c = append(c, jwt)
+	}
+	if nil != cfg.Anonymous {
+		proxies, err := ParseProxies(cfg.TrustedProxies)
+		if nil != err {
+			return nil, err
+		}
+		anon, err := NewAnonymous(*cfg.Anonymous, proxies)
+		if nil != err {
+			return nil, err
+		}
+		c = append(c, anon)
+	}
+	if 0 == len(c) {
+		return nil, errors.New("auth config lets nobody in, it needs api_keys, jwt or anonymous")
+	}
+	return c, nil
+}
+
+// Chain tries each Authenticator in turn, until one knows the credentials (or finds them wrong)
+func Chain(authenticators ...Authenticator) Authenticator {
+	return chain(authenticators)
+}
+
+// Authenticate implements Authenticator
+func (c chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return id, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// NewApiKeys accepts the given API keys, from the X-API-Key header or ?apiKey=
+func NewApiKeys(keys []ApiKey) (Authenticator, error) {
+	for i, k := range keys {
+		if "" == k.Key {
+			return nil, fmt.Errorf("api key %d has no key", i+1)
+		}
+		if "" == k.Identity {
+			return nil, fmt.Errorf("api key %d has no identity", i+1)
+		}
+		if err := k.Entitlements.Check(); nil != err {
+			return nil, fmt.Errorf("api key for %s: %w", k.Identity, err)
+		}
+	}
+	return &apiKeys{keys: keys}, nil
+}
+
+// Authenticate implements Authenticator
+func (a *apiKeys) Authenticate(r *http.Request) (*Identity, error) {
+	given := r.Header.Get(HeaderApiKey)
+	if "" == given {
+		given = r.URL.Query().Get(QueryApiKey)
+	}
+	if "" == given {
+		return nil, ErrNoCredentials
+	}
+	for _, k := range a.keys {
+		if 1 == subtle.ConstantTimeCompare([]byte(given), []byte(k.Key)) {
+			tier := k.Tier
+			if "" == tier {
+				tier = TierApiKey
+			}
+			return &Identity{
+				Name:         k.Identity,
+				Key:          "apikey:" + k.Identity,
+				Tier:         tier,
+				Entitlements: k.Entitlements,
+			}, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// NewAnonymous lets in everyone, with the given entitlements. Limits are counted per client IP address, as the
+// proxies tell us
+func NewAnonymous(e Entitlements, proxies Proxies) (Authenticator, error) {
+	if err := e.Check(); nil != err {
+		return nil, fmt.Errorf("anonymous: %w", err)
+	}
+	return &anonymous{entitlements: e, proxies: proxies}, nil
+}
+
+// Authenticate implements Authenticator
+func (a *anonymous) Authenticate(r *http.Request) (*Identity, error) {
+	return &Identity{
+		Name:         AnonymousName,
+		Key:          AnonymousName + ":" + a.proxies.ClientIP(r),
+		Tier:         TierAnonymous,
+		Entitlements: a.entitlements,
+	}, nil
+}
+
+// RemoteIP is the address a request came from, without its port
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if nil != err {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ParseProxies reads the addresses and CIDR ranges of the proxies we trust
+func ParseProxies(proxies []string) (Proxies, error) {
+	out := make(Proxies, 0, len(proxies))
+	for _, proxy := range proxies {
+		if prefix, err := netip.ParsePrefix(proxy); nil == err {
+			out = append(out, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(proxy)
+		if nil != err {
+			return nil, fmt.Errorf("bad trusted proxy %q: %w", proxy, err)
+		}
+		addr = addr.Unmap()
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return out, nil
+}
+
+// trusted tells us if the address is one of our proxies
+func (p Proxies) trusted(ip string) bool {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if nil != err {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP is the address of the client that made the request. When the request came through our proxies we believe
+// what they put in X-Forwarded-For (the first address from the right that is not one of our proxies) or X-Real-IP,
+// anyone else could be making those up
+func (p Proxies) ClientIP(r *http.Request) string {
+	ip := RemoteIP(r)
+	if !p.trusted(ip) {
+		return ip
+	}
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if _, err := netip.ParseAddr(hop); nil != err {
+				// not an address, so count it against the last proxy that handed it to us
+				return ip
+			}
+			ip = hop
+			if !p.trusted(hop) {
+				return ip
+			}
+		}
+		return ip
+	}
+	if realIp := strings.TrimSpace(r.Header.Get("X-Real-IP")); "" != realIp {
+		if _, err := netip.ParseAddr(realIp); nil == err {
+			return realIp
+		}
+	}
+	return ip
+}
+
+// bearerToken is the JWT in the Authorization header, or ?token=
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold("bearer ", h[:7]) {
+		return strings.TrimSpace(h[7:])
+	}
+	return r.URL.Query().Get(QueryToken)
+}
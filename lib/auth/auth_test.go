@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestApiKeys(t *testing.T) {
+	a, err := Parse([]byte(`
+api_keys:
+  - key: secret-1
+    identity: partner
+    tier: partners
+    entitlements:
+      tiles: ["z8-*"]
+      request_rate: 2
+anonymous:
+  tiles: ["tile38_low"]
+`))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, target, header string
+		wantName, wantTier   string
+		wantErr              error
+	}{
+		{"header", "/planes", "secret-1", "partner", "partners", nil},
+		{"query", "/planes?apiKey=secret-1", "", "partner", "partners", nil},
+		{"wrong key", "/planes?apiKey=secret-2", "", "", "", ErrInvalidCredentials},
+		{"no key", "/planes", "", AnonymousName, TierAnonymous, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if "" != tt.header {
+				r.Header.Set(HeaderApiKey, tt.header)
+			}
+			id, err := a.Authenticate(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if nil == tt.wantErr && (tt.wantName != id.Name || tt.wantTier != id.Tier) {
+				t.Errorf("expected %s, got %+v", tt.wantName, id)
+			}
+		})
+	}
+
+	r := httptest.NewRequest("GET", "/planes", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	id, _ := a.Authenticate(r)
+	if "anonymous:192.0.2.1" != id.Key {
+		t.Errorf("expected anonymous limits to be by ip, got %s", id.Key)
+	}
+}
+
+func TestProxies_ClientIP(t *testing.T) {
+	proxies, err := ParseProxies([]string{"10.0.0.0/8", "192.0.2.10"})
+	if nil != err {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, remote, forwarded, realIp, want string
+	}{
+		{"direct", "198.51.100.7:1234", "", "", "198.51.100.7"},
+		{"untrusted forwarded", "198.51.100.7:1234", "203.0.113.1", "203.0.113.2", "198.51.100.7"},
+		{"forwarded", "10.1.2.3:1234", "203.0.113.1", "", "203.0.113.1"},
+		{"forwarded through proxies", "10.1.2.3:1234", "203.0.113.9, 203.0.113.1, 192.0.2.10", "", "203.0.113.1"},
+		{"all proxies", "10.1.2.3:1234", "10.9.9.9, 192.0.2.10", "", "10.9.9.9"},
+		{"garbage", "10.1.2.3:1234", "nonsense, 192.0.2.10", "", "192.0.2.10"},
+		{"real ip", "192.0.2.10:1234", "", "203.0.113.5", "203.0.113.5"},
+		{"ipv4 mapped", "[::ffff:10.1.2.3]:1234", "203.0.113.1", "", "203.0.113.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/planes", nil)
+			r.RemoteAddr = tt.remote
+			if "" != tt.forwarded {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if "" != tt.realIp {
+				r.Header.Set("X-Real-IP", tt.realIp)
+			}
+			if ip := proxies.ClientIP(r); tt.want != ip {
+				t.Errorf("expected %s, got %s", tt.want, ip)
+			}
+		})
+	}
+
+	if _, err = Parse([]byte("anonymous: {}\ntrusted_proxies: [not-an-ip]")); nil == err {
+		t.Error("expected a bad trusted proxy to be an error")
+	}
+}
+
+func TestNoAnonymous(t *testing.T) {
+	a, err := Parse([]byte(`api_keys: [{key: k, identity: me}]`))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err = a.Authenticate(httptest.NewRequest("GET", "/planes", nil)); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("expected no credentials, got %v", err)
+	}
+}
+
+func TestBadConfig(t *testing.T) {
+	for name, cfg := range map[string]string{
+		"nobody":       `{}`,
+		"no key":       `api_keys: [{identity: me}]`,
+		"no identity":  `api_keys: [{key: k}]`,
+		"bad pattern":  `anonymous: {tiles: ["z8-["]}`,
+		"negative":     `anonymous: {max_connections: -1}`,
+		"no key set":   `jwt: {key_set: /does/not/exist.json}`,
+		"not yaml":     `api_keys: {`,
+		"wrong fields": `api_keys: 1`,
+	} {
+		if _, err := Parse([]byte(cfg)); nil == err {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestEntitlements_Tile(t *testing.T) {
+	e := Entitlements{Tiles: []string{"z8-*_low", "tile38_*"}}
+	for tile, want := range map[string]bool{
+		"z8-10-20_low":  true,
+		"z8-10-20_high": false,
+		"z10-1-2_low":   false,
+		"tile38_high":   true,
+		"tile39_low":    false,
+	} {
+		if got := e.Tile(tile); want != got {
+			t.Errorf("Tile(%s) = %t, want %t", tile, got, want)
+		}
+	}
+	if !(&Entitlements{}).Tile("anything") {
+		t.Error("expected no tiles to mean every tile")
+	}
+}
+
+func TestLimits_Connections(t *testing.T) {
+	l := NewLimits()
+	id := &Identity{Name: "me", Key: "me", Entitlements: Entitlements{MaxConnections: 2}}
+	release1, err := l.Connect(id)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err = l.Connect(id); nil != err {
+		t.Fatal(err)
+	}
+	if _, err = l.Connect(id); !errors.Is(err, ErrTooManyConnections) {
+		t.Fatalf("expected too many connections, got %v", err)
+	}
+	release1()
+	release1() // only counts once
+	if 1 != l.Connections(id) {
+		t.Errorf("expected one connection left, got %d", l.Connections(id))
+	}
+	if _, err = l.Connect(id); nil != err {
+		t.Errorf("expected to be able to connect again, got %v", err)
+	}
+}
+
+func TestLimits_Rates(t *testing.T) {
+	now := time.Now()
+	l := NewLimits()
+	l.now = func() time.Time { return now }
+	id := &Identity{Name: "me", Key: "me", Entitlements: Entitlements{ConnectRate: 1, RequestRate: 2, RequestBurst: 4}}
+
+	if _, err := l.Connect(id); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := l.Connect(id); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected the second connection in a second to be limited, got %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := l.Request(id); nil != err {
+			t.Fatalf("request %d should be in the burst, got %v", i+1, err)
+		}
+	}
+	if err := l.Request(id); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("expected to run out of burst, got %v", err)
+	}
+	now = now.Add(time.Second)
+	for i := 0; i < 2; i++ {
+		if err := l.Request(id); nil != err {
+			t.Errorf("expected the bucket to refill at 2 a second, got %v", err)
+		}
+	}
+
+	unlimited := &Identity{Name: "them", Key: "them"}
+	for i := 0; i < 1000; i++ {
+		if err := l.Request(unlimited); nil != err {
+			t.Fatalf("expected no limit, got %v", err)
+		}
+	}
+}
+
+func TestLimits_Sweep(t *testing.T) {
+	now := time.Now()
+	l := NewLimits()
+	l.now = func() time.Time { return now }
+	idle := &Identity{Key: "idle"}
+	busy := &Identity{Key: "busy"}
+	_ = l.Request(idle)
+	if _, err := l.Connect(busy); nil != err {
+		t.Fatal(err)
+	}
+	now = now.Add(limitsIdleFor + 2*time.Minute)
+	_ = l.Request(&Identity{Key: "someone"})
+	if _, ok := l.ids["idle"]; ok {
+		t.Error("expected the idle identity to be forgotten")
+	}
+	if 1 != l.Connections(busy) {
+		t.Error("expected the identity with a connection to be remembered")
+	}
+}
@@ -0,0 +1,381 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	// for the hashes the algorithms use
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+var jwtJson = jsoniter.ConfigCompatibleWithStandardLibrary
+
+type (
+	// KeySet is the keys JWTs can be signed with, from a JWKS (JSON Web Key Set)
+	KeySet struct {
+		keys []verifyKey
+	}
+
+	verifyKey struct {
+		kid string
+		// alg is the only algorithm the key can be used with, when the JWKS says
+		alg string
+		// key is a []byte (HMAC), *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey
+		key any
+	}
+
+	jwk struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Alg string `json:"alg"`
+		Use string `json:"use"`
+		K   string `json:"k"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+
+	jwtHeader struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	jwtClaims struct {
+		Iss string              `json:"iss"`
+		Sub string              `json:"sub"`
+		Aud audience            `json:"aud"`
+		Exp *float64            `json:"exp"`
+		Nbf *float64            `json:"nbf"`
+		Pw  jsoniter.RawMessage `json:"pw"`
+	}
+
+	// audience is a JWTs aud, which is either a string or a list of them
+	audience []string
+
+	// pwClaim is what we put in a token's pw claim, who it is and anything it is entitled to that differs from the
+	// JwtConfig Entitlements
+	pwClaim struct {
+		Identity string `json:"identity"`
+		Entitlements
+	}
+
+	jwt struct {
+		keys *KeySet
+		cfg  JwtConfig
+		now  func() time.Time
+	}
+
+	jwtAlgorithm struct {
+		hash crypto.Hash
+		// verify checks sig is the signature of digest (the hash of what was signed) with key
+		verify func(key any, hash crypto.Hash, signed, digest, sig []byte) bool
+	}
+)
+
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"HS256": {crypto.SHA256, verifyHmac},
+	"HS384": {crypto.SHA384, verifyHmac},
+	"HS512": {crypto.SHA512, verifyHmac},
+	"RS256": {crypto.SHA256, verifyRsa},
+	"RS384": {crypto.SHA384, verifyRsa},
+	"RS512": {crypto.SHA512, verifyRsa},
+	"PS256": {crypto.SHA256, verifyRsaPss},
+	"PS384": {crypto.SHA384, verifyRsaPss},
+	"PS512": {crypto.SHA512, verifyRsaPss},
+	"ES256": {crypto.SHA256, verifyEcdsa},
+	"ES384": {crypto.SHA384, verifyEcdsa},
+	"ES512": {crypto.SHA512, verifyEcdsa},
+	"EdDSA": {0, verifyEd25519},
+}
+
+// LoadKeySet reads a JWKS file
+func LoadKeySet(file string) (*KeySet, error) {
+	buf, err := os.ReadFile(file)
+	if nil != err {
+		return nil, err
+	}
+	return ParseKeySet(buf)
+}
+
+// ParseKeySet reads a JWKS, keys that are not for signatures are left out
+func ParseKeySet(buf []byte) (*KeySet, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := jwtJson.Unmarshal(buf, &set); nil != err {
+		return nil, err
+	}
+	ks := &KeySet{}
+	for i, k := range set.Keys {
+		if "" != k.Use && "sig" != k.Use {
+			continue
+		}
+		key, err := k.publicKey()
+		if nil != err {
+			return nil, fmt.Errorf("key %d (%s): %w", i+1, k.Kid, err)
+		}
+		ks.keys = append(ks.keys, verifyKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	if 0 == len(ks.keys) {
+		return nil, errors.New("key set has no signing keys")
+	}
+	return ks, nil
+}
+
+// publicKey is the key a JWK describes
+func (k *jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "oct":
+		key, err := base64.RawURLEncoding.DecodeString(k.K)
+		if nil != err || 0 == len(key) {
+			return nil, errors.New("bad k")
+		}
+		return key, nil
+	case "RSA":
+		n, errN := decodeBigInt(k.N)
+		e, errE := decodeBigInt(k.E)
+		if nil != errN || nil != errE || !e.IsInt64() || e.Int64() < 3 {
+			return nil, errors.New("bad n or e")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := decodeBigInt(k.X)
+		y, errY := decodeBigInt(k.Y)
+		if nil != errX || nil != errY || !curve.IsOnCurve(x, y) {
+			return nil, errors.New("bad x or y")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if "Ed25519" != k.Crv {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		key, err := base64.RawURLEncoding.DecodeString(k.X)
+		if nil != err || ed25519.PublicKeySize != len(key) {
+			return nil, errors.New("bad x")
+		}
+		return ed25519.PublicKey(key), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if nil != err {
+		return nil, err
+	}
+	if 0 == len(buf) {
+		return nil, errors.New("empty")
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
+
+// UnmarshalJSON takes either a single audience or a list of them
+func (a *audience) UnmarshalJSON(buf []byte) error {
+	var one string
+	if err := jwtJson.Unmarshal(buf, &one); nil == err {
+		*a = audience{one}
+		return nil
+	}
+	var many []string
+	if err := jwtJson.Unmarshal(buf, &many); nil != err {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// NewJwt accepts JWTs signed with one of keys, from the Authorization: Bearer header or ?token=. Tokens must have an
+// exp, and the iss and aud we are configured with
+func NewJwt(cfg JwtConfig, keys *KeySet) (Authenticator, error) {
+	if nil == keys || 0 == len(keys.keys) {
+		return nil, errors.New("jwt needs a key set")
+	}
+	if err := cfg.Entitlements.Check(); nil != err {
+		return nil, fmt.Errorf("jwt: %w", err)
+	}
+	return &jwt{keys: keys, cfg: cfg, now: time.Now}, nil
+}
+
+// Authenticate implements Authenticator
+func (j *jwt) Authenticate(r *http.Request) (*Identity, error) {
+	token := bearerToken(r)
+	if "" == token {
+		return nil, ErrNoCredentials
+	}
+	return j.verify(token)
+}
+
+// verify checks the token's signature and claims, and works out who it is for
+func (j *jwt) verify(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if 3 != len(parts) {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidCredentials)
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); nil != err {
+		return nil, fmt.Errorf("%w: bad header: %s", ErrInvalidCredentials, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if nil != err {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidCredentials)
+	}
+	if !j.keys.verify(header, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidCredentials)
+	}
+
+	var claims jwtClaims
+	if err = decodeSegment(parts[1], &claims); nil != err {
+		return nil, fmt.Errorf("%w: bad claims: %s", ErrInvalidCredentials, err)
+	}
+	now := j.now()
+	switch {
+	case nil == claims.Exp:
+		return nil, fmt.Errorf("%w: token has no expiry", ErrInvalidCredentials)
+	case now.Add(-j.cfg.Leeway).After(numericDate(*claims.Exp)):
+		return nil, fmt.Errorf("%w: token has expired", ErrInvalidCredentials)
+	case nil != claims.Nbf && now.Add(j.cfg.Leeway).Before(numericDate(*claims.Nbf)):
+		return nil, fmt.Errorf("%w: token is not valid yet", ErrInvalidCredentials)
+	case "" != j.cfg.Issuer && j.cfg.Issuer != claims.Iss:
+		return nil, fmt.Errorf("%w: token is from %q", ErrInvalidCredentials, claims.Iss)
+	case "" != j.cfg.Audience && !slices.Contains(claims.Aud, j.cfg.Audience):
+		return nil, fmt.Errorf("%w: token is not for us", ErrInvalidCredentials)
+	}
+
+	pw := pwClaim{Entitlements: j.cfg.Entitlements}
+	// the claim must not write into our Tiles
+	pw.Tiles = slices.Clone(pw.Tiles)
+	if len(claims.Pw) > 0 {
+		if err = jwtJson.Unmarshal(claims.Pw, &pw); nil != err {
+			return nil, fmt.Errorf("%w: bad pw claim: %s", ErrInvalidCredentials, err)
+		}
+		if err = pw.Entitlements.Check(); nil != err {
+			return nil, fmt.Errorf("%w: bad pw claim: %s", ErrInvalidCredentials, err)
+		}
+	}
+	id := &Identity{
+		Name:         pw.Identity,
+		Key:          "jwt:" + claims.Sub,
+		Tier:         j.cfg.Tier,
+		Entitlements: pw.Entitlements,
+	}
+	if "" == id.Tier {
+		id.Tier = TierJwt
+	}
+	switch {
+	case "" == claims.Sub && "" == pw.Identity:
+		return nil, fmt.Errorf("%w: token has no sub or identity", ErrInvalidCredentials)
+	case "" == claims.Sub:
+		id.Key = "jwt:" + pw.Identity
+	}
+	// every sub would be a new metrics label, so tokens without an identity share their tier's name
+	if "" == id.Name {
+		id.Name = id.Tier
+	}
+	return id, nil
+}
+
+// verify checks sig with the keys that can be used for the header's alg (and kid, if it has one)
+func (ks *KeySet) verify(header jwtHeader, signed, sig []byte) bool {
+	alg, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return false
+	}
+	var digest []byte
+	if 0 != alg.hash {
+		h := alg.hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	for _, k := range ks.keys {
+		if ("" != header.Kid && header.Kid != k.kid) || ("" != k.alg && header.Alg != k.alg) {
+			continue
+		}
+		if alg.verify(k.key, alg.hash, signed, digest, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyHmac(key any, hash crypto.Hash, signed, _, sig []byte) bool {
+	secret, ok := key.([]byte)
+	if !ok {
+		return false
+	}
+	mac := hmac.New(hash.New, secret)
+	mac.Write(signed)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+func verifyRsa(key any, hash crypto.Hash, _, digest, sig []byte) bool {
+	pub, ok := key.(*rsa.PublicKey)
+	return ok && nil == rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+}
+
+func verifyRsaPss(key any, hash crypto.Hash, _, digest, sig []byte) bool {
+	pub, ok := key.(*rsa.PublicKey)
+	return ok && nil == rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+}
+
+// verifyEcdsa checks a JWS ECDSA signature, r and s one after the other (not ASN.1), on the curve the hash goes with
+func verifyEcdsa(key any, hash crypto.Hash, _, digest, sig []byte) bool {
+	pub, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return false
+	}
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	curveHash := map[int]crypto.Hash{32: crypto.SHA256, 48: crypto.SHA384, 66: crypto.SHA512}[size]
+	if curveHash != hash || 2*size != len(sig) {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:size])
+	s := new(big.Int).SetBytes(sig[size:])
+	return ecdsa.Verify(pub, digest, r, s)
+}
+
+func verifyEd25519(key any, _ crypto.Hash, signed, _, sig []byte) bool {
+	pub, ok := key.(ed25519.PublicKey)
+	return ok && ed25519.Verify(pub, signed, sig)
+}
+
+func decodeSegment(segment string, v any) error {
+	buf, err := base64.RawURLEncoding.DecodeString(segment)
+	if nil != err {
+		return err
+	}
+	return jwtJson.Unmarshal(buf, v)
+}
+
+// numericDate is a JWT time, seconds since the epoch
+func numericDate(seconds float64) time.Time {
+	return time.UnixMilli(int64(seconds * 1000))
+}
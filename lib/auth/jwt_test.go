@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testKeys struct {
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	ed     ed25519.PrivateKey
+	set    *KeySet
+}
+
+func b64(buf []byte) string {
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	k := &testKeys{secret: []byte("a very secret secret")}
+	var err error
+	if k.rsa, err = rsa.GenerateKey(rand.Reader, 2048); nil != err {
+		t.Fatal(err)
+	}
+	if k.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); nil != err {
+		t.Fatal(err)
+	}
+	var edPub ed25519.PublicKey
+	if edPub, k.ed, err = ed25519.GenerateKey(rand.Reader); nil != err {
+		t.Fatal(err)
+	}
+	jwks := `{"keys":[
+		{"kty":"oct","kid":"hs","k":"` + b64(k.secret) + `"},
+		{"kty":"RSA","kid":"rs","alg":"RS256","n":"` + b64(k.rsa.N.Bytes()) + `","e":"` + b64(big.NewInt(int64(k.rsa.E)).Bytes()) + `"},
+		{"kty":"EC","kid":"es","crv":"P-256","x":"` + b64(k.ec.X.FillBytes(make([]byte, 32))) + `","y":"` + b64(k.ec.Y.FillBytes(make([]byte, 32))) + `"},
+		{"kty":"OKP","kid":"ed","crv":"Ed25519","x":"` + b64(edPub) + `"},
+		{"kty":"RSA","kid":"enc","use":"enc","n":"AQAB","e":"AQAB"}
+	]}`
+	if k.set, err = ParseKeySet([]byte(jwks)); nil != err {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// sign makes a token signed with alg, with the header's kid set to kid (if given)
+func (k *testKeys) sign(t *testing.T, alg, kid, claims string) string {
+	t.Helper()
+	header := `{"alg":"` + alg + `","typ":"JWT"`
+	if "" != kid {
+		header += `,"kid":"` + kid + `"`
+	}
+	signed := b64([]byte(header+"}")) + "." + b64([]byte(claims))
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	var err error
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if nil == err {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "EdDSA":
+		sig = ed25519.Sign(k.ed, []byte(signed))
+	}
+	if nil != err {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestJwt(t *testing.T) {
+	keys := newTestKeys(t)
+	now := time.Unix(1_700_000_000, 0)
+	a, err := NewJwt(JwtConfig{
+		Issuer:       "https://auth.plane.watch",
+		Audience:     "pw_ws_broker",
+		Leeway:       time.Minute,
+		Entitlements: Entitlements{Tiles: []string{"tile38_*"}, RequestRate: 5},
+	}, keys.set)
+	if nil != err {
+		t.Fatal(err)
+	}
+	a.(*jwt).now = func() time.Time { return now }
+
+	good := `{"iss":"https://auth.plane.watch","aud":["other","pw_ws_broker"],"sub":"user-1","exp":1700000600`
+	tests := []struct {
+		name, alg, kid, claims string
+		wantErr                error
+	}{
+		{"hmac", "HS256", "hs", good + `}`, nil},
+		{"rsa", "RS256", "rs", good + `}`, nil},
+		{"ecdsa", "ES256", "es", good + `}`, nil},
+		{"ed25519", "EdDSA", "ed", good + `}`, nil},
+		{"without a kid", "ES256", "", good + `}`, nil},
+		{"the wrong kid", "ES256", "rs", good + `}`, ErrInvalidCredentials},
+		{"single audience", "HS256", "hs", `{"iss":"https://auth.plane.watch","aud":"pw_ws_broker","sub":"user-1","exp":1700000600}`, nil},
+		{"expired", "HS256", "hs", `{"iss":"https://auth.plane.watch","aud":"pw_ws_broker","sub":"user-1","exp":1699999900}`, ErrInvalidCredentials},
+		{"expired within leeway", "HS256", "hs", `{"iss":"https://auth.plane.watch","aud":"pw_ws_broker","sub":"user-1","exp":1699999970}`, nil},
+		{"no expiry", "HS256", "hs", `{"iss":"https://auth.plane.watch","aud":"pw_ws_broker","sub":"user-1"}`, ErrInvalidCredentials},
+		{"not yet", "HS256", "hs", good + `,"nbf":1700000300}`, ErrInvalidCredentials},
+		{"wrong issuer", "HS256", "hs", `{"iss":"someone","aud":"pw_ws_broker","sub":"user-1","exp":1700000600}`, ErrInvalidCredentials},
+		{"wrong audience", "HS256", "hs", `{"iss":"https://auth.plane.watch","aud":"other","sub":"user-1","exp":1700000600}`, ErrInvalidCredentials},
+		{"nobody", "HS256", "hs", `{"iss":"https://auth.plane.watch","aud":"pw_ws_broker","exp":1700000600}`, ErrInvalidCredentials},
+		{"unsigned", "none", "", good + `}`, ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := keys.sign(t, tt.alg, tt.kid, tt.claims)
+			r := httptest.NewRequest("GET", "/planes", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			id, err := a.Authenticate(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if nil == tt.wantErr && (TierJwt != id.Name || "jwt:user-1" != id.Key || TierJwt != id.Tier || 5 != id.Entitlements.RequestRate) {
+				t.Errorf("unexpected identity %+v", id)
+			}
+		})
+	}
+
+	t.Run("tampered", func(t *testing.T) {
+		token := keys.sign(t, "HS256", "hs", good+`}`)
+		parts := strings.Split(token, ".")
+		parts[1] = b64([]byte(strings.Replace(good, "user-1", "admin", 1) + `}`))
+		if _, err := a.(*jwt).verify(strings.Join(parts, ".")); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("expected a tampered token to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("pw claim", func(t *testing.T) {
+		token := keys.sign(t, "RS256", "rs", good+`,"pw":{"identity":"partner","all_tiles":true,"tiles":["z8-*"]}}`)
+		id, err := a.Authenticate(httptest.NewRequest("GET", "/planes?token="+token, nil))
+		if nil != err {
+			t.Fatal(err)
+		}
+		if "partner" != id.Name || "jwt:user-1" != id.Key || !id.Entitlements.AllTiles || 5 != id.Entitlements.RequestRate {
+			t.Errorf("expected the pw claim to add to the default entitlements, got %+v", id)
+		}
+		if 1 != len(id.Entitlements.Tiles) || "z8-*" != id.Entitlements.Tiles[0] {
+			t.Errorf("expected the pw claim tiles, got %v", id.Entitlements.Tiles)
+		}
+		if "tile38_*" != a.(*jwt).cfg.Entitlements.Tiles[0] {
+			t.Error("the pw claim changed the default entitlements")
+		}
+	})
+
+	if _, err = a.Authenticate(httptest.NewRequest("GET", "/planes", nil)); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("expected no credentials without a token, got %v", err)
+	}
+}
+
+func TestParseKeySet_Bad(t *testing.T) {
+	for name, jwks := range map[string]string{
+		"empty":         `{"keys":[]}`,
+		"not json":      `{`,
+		"unknown type":  `{"keys":[{"kty":"what"}]}`,
+		"bad curve":     `{"keys":[{"kty":"EC","crv":"P-192","x":"AQAB","y":"AQAB"}]}`,
+		"not on curve":  `{"keys":[{"kty":"EC","crv":"P-256","x":"AQAB","y":"AQAB"}]}`,
+		"empty secret":  `{"keys":[{"kty":"oct","k":""}]}`,
+		"only for enc":  `{"keys":[{"kty":"oct","use":"enc","k":"AQAB"}]}`,
+		"short ed25519": `{"keys":[{"kty":"OKP","crv":"Ed25519","x":"AQAB"}]}`,
+	} {
+		if _, err := ParseKeySet([]byte(jwks)); nil == err {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limitsIdleFor is how long we remember the limits of an identity that has nothing open and has not asked for anything
+const limitsIdleFor = 10 * time.Minute
+
+type (
+	// Limits counts what each identity (by its Key) is doing, and holds them to their Entitlements
+	Limits struct {
+		mu        sync.Mutex
+		ids       map[string]*identityLimits
+		lastSweep time.Time
+		now       func() time.Time
+	}
+
+	identityLimits struct {
+		connections int
+		connect     *rate.Limiter
+		requests    *rate.Limiter
+		lastUsed    time.Time
+	}
+)
+
+// NewLimits is ready to count
+func NewLimits() *Limits {
+	return &Limits{
+		ids: make(map[string]*identityLimits),
+		now: time.Now,
+	}
+}
+
+// newLimiter is a token bucket that fills at r a second and holds burst (at least one second's worth), no limit for 0
+func newLimiter(r float64, burst int) *rate.Limiter {
+	if 0 == r {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(r)))
+	}
+	return rate.NewLimiter(rate.Limit(r), burst)
+}
+
+// limits are what we have counted for the identity, l.mu must be held
+func (l *Limits) limits(id *Identity, now time.Time) *identityLimits {
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweep(now)
+	}
+	il, ok := l.ids[id.Key]
+	if !ok {
+		il = &identityLimits{
+			connect:  newLimiter(id.Entitlements.ConnectRate, id.Entitlements.ConnectBurst),
+			requests: newLimiter(id.Entitlements.RequestRate, id.Entitlements.RequestBurst),
+		}
+		l.ids[id.Key] = il
+	}
+	il.lastUsed = now
+	return il
+}
+
+// sweep forgets about the identities that have been idle for a while, l.mu must be held
+func (l *Limits) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, il := range l.ids {
+		if 0 == il.connections && now.Sub(il.lastUsed) > limitsIdleFor {
+			delete(l.ids, key)
+		}
+	}
+}
+
+// Connect counts a new connection for the identity, call release when it closes. It fails with
+// ErrTooManyConnections or ErrRateLimited when the identity cannot have another connection right now
+func (l *Limits) Connect(id *Identity) (release func(), err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	il := l.limits(id, now)
+	if id.Entitlements.MaxConnections > 0 && il.connections >= id.Entitlements.MaxConnections {
+		return nil, ErrTooManyConnections
+	}
+	if !il.connect.AllowN(now, 1) {
+		return nil, ErrRateLimited
+	}
+	il.connections++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			il.connections--
+			il.lastUsed = l.now()
+		})
+	}, nil
+}
+
+// Request counts a request for the identity, it fails with ErrRateLimited when the identity is asking too often
+func (l *Limits) Request(id *Identity) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if !l.limits(id, now).requests.AllowN(now, 1) {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// Connections is how many connections the identity has open
+func (l *Limits) Connections(id *Identity) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if il, ok := l.ids[id.Key]; ok {
+		return il.connections
+	}
+	return 0
+}
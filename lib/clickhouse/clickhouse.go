@@ -81,11 +81,15 @@ func (chs *Server) Connect() error {
 
 // Inserts Add a batch of rows into the given clickhouse feed
 func (chs *Server) Inserts(table string, d []any, max int) error {
+	return chs.InsertsContext(context.Background(), table, d, max)
+}
+
+// InsertsContext adds a batch of rows into the given clickhouse feed, giving up when the context is done
+func (chs *Server) InsertsContext(ctx context.Context, table string, d []any, max int) error {
 	if chs.log.Trace().Enabled() {
 		chs.log.Trace().Str("table", table).Interface("data", d).Msg("insert")
 	}
 	t := time.Now()
-	ctx := context.Background()
 	batch, err := chs.conn.PrepareBatch(ctx, "INSERT INTO "+table)
 	if nil != err {
 		return err
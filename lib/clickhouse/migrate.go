@@ -0,0 +1,146 @@
+package clickhouse
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationsTable is where we keep track of the migrations that have been applied
+const migrationsTable = "schema_migrations"
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type (
+	// Migration is a numbered set of statements, from migrations/<version>_<name>.sql
+	Migration struct {
+		Version    uint32
+		Name       string
+		Statements []string
+	}
+
+	appliedMigration struct {
+		Version uint32 `ch:"Version"`
+	}
+)
+
+// Migrations lists every migration we have, in the order they are applied
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if nil != err {
+		return nil, err
+	}
+	migrations := make([]Migration, 0, len(entries))
+	for _, entry := range entries {
+		version, name, ok := strings.Cut(strings.TrimSuffix(entry.Name(), ".sql"), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", entry.Name())
+		}
+		v, err := strconv.ParseUint(version, 10, 32)
+		if nil != err {
+			return nil, fmt.Errorf("migration %s: %w", entry.Name(), err)
+		}
+		buf, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if nil != err {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{
+			Version:    uint32(v),
+			Name:       name,
+			Statements: splitStatements(string(buf)),
+		})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("migration version %d is used twice", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// splitStatements breaks a migration up into its statements (ending in ;), without the comments
+func splitStatements(sql string) []string {
+	lines := strings.Split(sql, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines[i] = ""
+		}
+	}
+	var statements []string
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if statement = strings.TrimSpace(statement); "" != statement {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+func (chs *Server) Exec(ctx context.Context, query string, args ...any) error {
+	if chs.log.Trace().Enabled() {
+		chs.log.Trace().Str("query", query).Msg("exec")
+	}
+	if !chs.connected {
+		return ErrNotConnected
+	}
+	return chs.conn.Exec(ctx, query, args...)
+}
+
+// AppliedMigrations is the versions of the migrations that have been applied to the database
+func (chs *Server) AppliedMigrations(ctx context.Context) (map[uint32]bool, error) {
+	if err := chs.Exec(ctx, `CREATE TABLE IF NOT EXISTS `+migrationsTable+` (
+    Version   UInt32,
+    Name      String,
+    AppliedAt DateTime('UTC')
+) ENGINE = ReplacingMergeTree ORDER BY Version`); nil != err {
+		return nil, err
+	}
+	var rows []appliedMigration
+	if err := chs.Select(ctx, &rows, `SELECT DISTINCT Version FROM `+migrationsTable); nil != err {
+		return nil, err
+	}
+	applied := make(map[uint32]bool, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = true
+	}
+	return applied, nil
+}
+
+// Migrate applies every migration that has not been applied yet, in order. Migrations only use IF (NOT) EXISTS
+// statements, so a migration that fails part way through can be run again once the problem is fixed
+func (chs *Server) Migrate(ctx context.Context) (int, error) {
+	migrations, err := Migrations()
+	if nil != err {
+		return 0, err
+	}
+	applied, err := chs.AppliedMigrations(ctx)
+	if nil != err {
+		return 0, err
+	}
+	count := 0
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+		chs.log.Info().Uint32("version", m.Version).Str("name", m.Name).Msg("Applying migration")
+		for _, statement := range m.Statements {
+			if err = chs.Exec(ctx, statement); nil != err {
+				return count, fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+		}
+		if err = chs.Exec(ctx, `INSERT INTO `+migrationsTable+` (Version, Name, AppliedAt) VALUES (?, ?, ?)`, m.Version, m.Name, time.Now().UTC()); nil != err {
+			return count, fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,74 @@
+-- location_updates_low has every significant update, location_updates_high has every update
+CREATE TABLE IF NOT EXISTS location_updates_low
+(
+    Icao            LowCardinality(String),
+    LatLon          Point,
+    Heading         Float64,
+    Velocity        Float64,
+    Altitude        Int32,
+    VerticalRate    Int32,
+    AltitudeUnits   LowCardinality(String),
+    CallSign        String,
+    FlightStatus    LowCardinality(String),
+    OnGround        Bool,
+    Airframe        LowCardinality(String),
+    AirframeType    LowCardinality(String),
+    HasLocation     Bool,
+    HasHeading      Bool,
+    HasVerticalRate Bool,
+    HasVelocity     Bool,
+    SourceTags      Map(String, UInt32),
+    Squawk          UInt32,
+    Special         LowCardinality(String),
+    TrackedSince    DateTime64(3, 'UTC'),
+    LastMsg         DateTime64(3, 'UTC'),
+    FlagCode        LowCardinality(String),
+    Operator        LowCardinality(String),
+    RegisteredOwner String,
+    Registration    LowCardinality(String),
+    RouteCode       String,
+    Serial          String,
+    TileLocation    LowCardinality(String),
+    TypeCode        LowCardinality(String)
+)
+ENGINE = MergeTree
+PARTITION BY toYYYYMMDD(LastMsg)
+ORDER BY (Icao, LastMsg)
+TTL toDateTime(LastMsg) + INTERVAL 90 DAY;
+
+CREATE TABLE IF NOT EXISTS location_updates_high
+(
+    Icao            LowCardinality(String),
+    LatLon          Point,
+    Heading         Float64,
+    Velocity        Float64,
+    Altitude        Int32,
+    VerticalRate    Int32,
+    AltitudeUnits   LowCardinality(String),
+    CallSign        String,
+    FlightStatus    LowCardinality(String),
+    OnGround        Bool,
+    Airframe        LowCardinality(String),
+    AirframeType    LowCardinality(String),
+    HasLocation     Bool,
+    HasHeading      Bool,
+    HasVerticalRate Bool,
+    HasVelocity     Bool,
+    SourceTags      Map(String, UInt32),
+    Squawk          UInt32,
+    Special         LowCardinality(String),
+    TrackedSince    DateTime64(3, 'UTC'),
+    LastMsg         DateTime64(3, 'UTC'),
+    FlagCode        LowCardinality(String),
+    Operator        LowCardinality(String),
+    RegisteredOwner String,
+    Registration    LowCardinality(String),
+    RouteCode       String,
+    Serial          String,
+    TileLocation    LowCardinality(String),
+    TypeCode        LowCardinality(String)
+)
+ENGINE = MergeTree
+PARTITION BY toYYYYMMDD(LastMsg)
+ORDER BY (Icao, LastMsg)
+TTL toDateTime(LastMsg) + INTERVAL 7 DAY;
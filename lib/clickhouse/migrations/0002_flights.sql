@@ -0,0 +1,20 @@
+-- flights has every finished flight leg, as pw_router closes them
+CREATE TABLE IF NOT EXISTS flights
+(
+    FlightId    String,
+    Icao        LowCardinality(String),
+    CallSign    String,
+    OpenReason  LowCardinality(String),
+    CloseReason LowCardinality(String),
+    FirstSeen   DateTime64(3, 'UTC'),
+    LastSeen    DateTime64(3, 'UTC'),
+    Origin      LowCardinality(String),
+    Destination LowCardinality(String),
+    MaxAltitude Int32,
+    Distance    Float64,
+    Feeders     Array(String)
+)
+ENGINE = ReplacingMergeTree(LastSeen)
+PARTITION BY toYYYYMM(FirstSeen)
+ORDER BY (Icao, FlightId)
+TTL toDateTime(FirstSeen) + INTERVAL 2 YEAR;
@@ -0,0 +1,35 @@
+-- tag location updates with the flight leg they belong to, and roll them up per flight as they arrive
+ALTER TABLE location_updates_low ADD COLUMN IF NOT EXISTS FlightId String AFTER Icao;
+
+ALTER TABLE location_updates_high ADD COLUMN IF NOT EXISTS FlightId String AFTER Icao;
+
+CREATE TABLE IF NOT EXISTS flight_rollups
+(
+    FlightId      String,
+    Icao          LowCardinality(String),
+    CallSign      AggregateFunction(argMax, String, DateTime64(3, 'UTC')),
+    FirstSeen     SimpleAggregateFunction(min, DateTime64(3, 'UTC')),
+    LastSeen      SimpleAggregateFunction(max, DateTime64(3, 'UTC')),
+    MaxAltitude   SimpleAggregateFunction(max, Int32),
+    MaxVelocity   SimpleAggregateFunction(max, Float64),
+    Updates       SimpleAggregateFunction(sum, UInt64),
+    Tiles         AggregateFunction(groupUniqArray, String)
+)
+ENGINE = AggregatingMergeTree
+PARTITION BY toYYYYMM(FirstSeen)
+ORDER BY (Icao, FlightId)
+TTL toDateTime(FirstSeen) + INTERVAL 90 DAY;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS flight_rollups_mv TO flight_rollups AS
+SELECT FlightId,
+       Icao,
+       argMaxState(CallSign, LastMsg)       AS CallSign,
+       min(LastMsg)                         AS FirstSeen,
+       max(LastMsg)                         AS LastSeen,
+       max(Altitude)                        AS MaxAltitude,
+       max(Velocity)                        AS MaxVelocity,
+       toUInt64(count())                    AS Updates,
+       groupUniqArrayState(CAST(TileLocation, 'String')) AS Tiles
+FROM location_updates_low
+WHERE FlightId != ''
+GROUP BY FlightId, Icao;
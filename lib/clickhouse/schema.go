@@ -0,0 +1,239 @@
+package clickhouse
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/paulmach/orb"
+)
+
+var (
+	ErrUnknownTable = errors.New("unknown table")
+
+	createTable = regexp.MustCompile(`(?is)^CREATE\s+TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?([\w.]+)\s*\(`)
+	alterTable  = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+([\w.]+)\s+(.*)$`)
+	addColumn   = regexp.MustCompile(`(?is)^ADD\s+COLUMN\s+(?:IF\s+NOT\s+EXISTS\s+)?(.*)$`)
+	dropColumn  = regexp.MustCompile(`(?is)^DROP\s+COLUMN\s+(?:IF\s+EXISTS\s+)?(\w+)$`)
+)
+
+type (
+	// Column is a column in one of our tables, as our migrations leave it
+	Column struct {
+		Name string
+		Type string
+		// Insertable is false for MATERIALIZED and ALIAS columns, they are not part of an insert
+		Insertable bool
+	}
+)
+
+// splitTopLevel splits s on sep, ignoring anything inside brackets or quotes
+func splitTopLevel(s string, sep rune) []string {
+	var parts []string
+	depth := 0
+	quoted := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case '\'' == r:
+			quoted = !quoted
+		case quoted:
+		case '(' == r:
+			depth++
+		case ')' == r:
+			depth--
+		case sep == r && 0 == depth:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseColumn turns "Name Type [DEFAULT ...|MATERIALIZED ...|ALIAS ...|CODEC(...)|AFTER x]" into a Column
+func parseColumn(def string) (Column, bool) {
+	def = strings.TrimSpace(def)
+	name, rest, ok := strings.Cut(def, " ")
+	if !ok {
+		return Column{}, false
+	}
+	switch strings.ToUpper(name) {
+	case "INDEX", "PROJECTION", "CONSTRAINT":
+		return Column{}, false
+	}
+	// the type runs until the first top level space
+	rest = strings.TrimSpace(rest)
+	depth, end := 0, len(rest)
+	for i, r := range rest {
+		if '(' == r {
+			depth++
+		} else if ')' == r {
+			depth--
+		} else if ' ' == r && 0 == depth && i > 0 && ',' != rest[i-1] {
+			end = i
+			break
+		}
+	}
+	col := Column{Name: strings.Trim(name, "`"), Type: rest[:end], Insertable: true}
+	modifiers := strings.ToUpper(rest[end:])
+	if strings.Contains(modifiers, "MATERIALIZED") || strings.Contains(modifiers, "ALIAS") {
+		col.Insertable = false
+	}
+	return col, true
+}
+
+// Columns works out what the given table looks like once every migration has been applied
+func Columns(table string) ([]Column, error) {
+	migrations, err := Migrations()
+	if nil != err {
+		return nil, err
+	}
+	var columns []Column
+	found := false
+	for _, m := range migrations {
+		for _, statement := range m.Statements {
+			if match := createTable.FindStringSubmatchIndex(statement); nil != match && statement[match[2]:match[3]] == table {
+				found = true
+				body := statement[match[1]:]
+				body = body[:strings.LastIndex(body[:strings.Index(strings.ToUpper(body), "ENGINE")], ")")]
+				columns = columns[:0]
+				for _, def := range splitTopLevel(body, ',') {
+					if col, ok := parseColumn(def); ok {
+						columns = append(columns, col)
+					}
+				}
+				continue
+			}
+			match := alterTable.FindStringSubmatch(statement)
+			if nil == match || match[1] != table {
+				continue
+			}
+			for _, action := range splitTopLevel(match[2], ',') {
+				action = strings.TrimSpace(action)
+				if add := addColumn.FindStringSubmatch(action); nil != add {
+					if col, ok := parseColumn(add[1]); ok && -1 == columnIndex(columns, col.Name) {
+						columns = append(columns, col)
+					}
+				} else if drop := dropColumn.FindStringSubmatch(action); nil != drop {
+					if i := columnIndex(columns, drop[1]); -1 != i {
+						columns = append(columns[:i], columns[i+1:]...)
+					}
+				}
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTable, table)
+	}
+	return columns, nil
+}
+
+func columnIndex(columns []Column, name string) int {
+	for i, col := range columns {
+		if col.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// CheckRow makes sure the struct we insert with has a field of a compatible type for every insertable column of the
+// table, and that none of its fields are silently ignored. Fields are matched the same way as batch.AppendStruct does
+func CheckRow(table string, row any) error {
+	columns, err := Columns(table)
+	if nil != err {
+		return err
+	}
+	t := reflect.TypeOf(row)
+	for reflect.Ptr == t.Kind() {
+		t = t.Elem()
+	}
+	fields := make(map[string]reflect.Type, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("ch"); "" != tag {
+			name = tag
+		}
+		fields[name] = f.Type
+	}
+
+	var problems []string
+	for _, col := range columns {
+		if !col.Insertable {
+			continue
+		}
+		ft, ok := fields[col.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("no field for column %s %s", col.Name, col.Type))
+			continue
+		}
+		delete(fields, col.Name)
+		if !compatible(ft, col.Type) {
+			problems = append(problems, fmt.Sprintf("field %s (%s) cannot be inserted into %s", col.Name, ft, col.Type))
+		}
+	}
+	for name := range fields {
+		problems = append(problems, fmt.Sprintf("field %s has no column", name))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s: %s", table, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	pointType = reflect.TypeOf(orb.Point{})
+)
+
+// unwrap removes a wrapping type, LowCardinality(String) becomes String
+func unwrap(chType, wrapper string) (string, bool) {
+	if strings.HasPrefix(chType, wrapper+"(") && strings.HasSuffix(chType, ")") {
+		return chType[len(wrapper)+1 : len(chType)-1], true
+	}
+	return chType, false
+}
+
+// compatible tells us if a go type can be inserted into a column of the clickhouse type
+func compatible(t reflect.Type, chType string) bool {
+	chType = strings.TrimSpace(chType)
+	chType, _ = unwrap(chType, "LowCardinality")
+	if inner, ok := unwrap(chType, "Nullable"); ok {
+		return reflect.Ptr == t.Kind() && compatible(t.Elem(), inner)
+	}
+	switch t {
+	case timeType:
+		return strings.HasPrefix(chType, "DateTime") || "Date" == chType || "Date32" == chType
+	case pointType:
+		return "Point" == chType
+	}
+	if inner, ok := unwrap(chType, "Array"); ok {
+		return reflect.Slice == t.Kind() && compatible(t.Elem(), inner)
+	}
+	if inner, ok := unwrap(chType, "Map"); ok {
+		kv := splitTopLevel(inner, ',')
+		return reflect.Map == t.Kind() && 2 == len(kv) && compatible(t.Key(), kv[0]) && compatible(t.Elem(), kv[1])
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "String" == chType || strings.HasPrefix(chType, "FixedString(") || strings.HasPrefix(chType, "Enum")
+	case reflect.Bool:
+		return "Bool" == chType || "UInt8" == chType
+	case reflect.Float32:
+		return "Float32" == chType
+	case reflect.Float64:
+		return "Float64" == chType
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return fmt.Sprintf("Int%d", t.Bits()) == chType
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fmt.Sprintf("UInt%d", t.Bits()) == chType
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package clickhouse
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 0 == len(migrations) {
+		t.Fatal("expected some migrations")
+	}
+	for i, m := range migrations {
+		if i > 0 && m.Version <= migrations[i-1].Version {
+			t.Errorf("expected migrations in version order, got %d after %d", m.Version, migrations[i-1].Version)
+		}
+		if 0 == len(m.Statements) {
+			t.Errorf("migration %d_%s has no statements", m.Version, m.Name)
+		}
+	}
+}
+
+func TestColumns(t *testing.T) {
+	columns, err := Columns("location_updates_low")
+	if nil != err {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"Icao":       "LowCardinality(String)",
+		"FlightId":   "String",
+		"SourceTags": "Map(String, UInt32)",
+		"LastMsg":    "DateTime64(3, 'UTC')",
+	}
+	for _, col := range columns {
+		if typ, ok := want[col.Name]; ok {
+			if typ != col.Type {
+				t.Errorf("expected %s to be %s, got %s", col.Name, typ, col.Type)
+			}
+			delete(want, col.Name)
+		}
+	}
+	if 0 != len(want) {
+		t.Errorf("missing columns %v", want)
+	}
+
+	if _, err = Columns("not_a_table"); !errors.Is(err, ErrUnknownTable) {
+		t.Errorf("expected an unknown table, got %v", err)
+	}
+}
+
+func TestParseColumn(t *testing.T) {
+	tests := []struct {
+		def  string
+		want Column
+		ok   bool
+	}{
+		{"Icao   LowCardinality(String)", Column{"Icao", "LowCardinality(String)", true}, true},
+		{"Tags Map(String, UInt32) CODEC(ZSTD)", Column{"Tags", "Map(String, UInt32)", true}, true},
+		{"FlightId String AFTER Icao", Column{"FlightId", "String", true}, true},
+		{"Day Date MATERIALIZED toDate(LastMsg)", Column{"Day", "Date", false}, true},
+		{"INDEX idx CallSign TYPE bloom_filter GRANULARITY 1", Column{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseColumn(tt.def)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseColumn(%q) = %+v %v, want %+v %v", tt.def, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCheckRow(t *testing.T) {
+	type good struct {
+		FlightId    string
+		Icao        string
+		CallSign    string
+		OpenReason  string
+		CloseReason string
+		FirstSeen   time.Time
+		LastSeen    time.Time
+		Origin      string
+		Destination string
+		MaxAltitude int32
+		Distance    float64
+		Feeders     []string
+	}
+	if err := CheckRow("flights", good{}); nil != err {
+		t.Errorf("expected the row to match, got %s", err)
+	}
+
+	type bad struct {
+		FlightId    string
+		Icao        string
+		CallSign    string
+		OpenReason  string
+		CloseReason string
+		FirstSeen   time.Time
+		LastSeen    time.Time
+		Origin      string
+		MaxAltitude int
+		Distance    float64
+		Feeders     []string
+		Extra       string
+	}
+	if err := CheckRow("flights", &bad{}); nil == err {
+		t.Errorf("expected a missing column, wrong type and extra field to be caught")
+	} else {
+		t.Log(err)
+	}
+}
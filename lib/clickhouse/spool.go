@@ -0,0 +1,177 @@
+package clickhouse
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+const segmentSuffix = ".jsonl"
+
+type (
+	// spool keeps batches we could not insert on disk, one segment file per batch, until we can replay them
+	spool struct {
+		dir      string
+		maxBytes int64
+	}
+
+	segment struct {
+		path    string
+		created time.Time
+		rows    int
+		size    int64
+	}
+)
+
+func newSpool(dir string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); nil != err {
+		return nil, err
+	}
+	return &spool{dir: dir, maxBytes: maxBytes}, nil
+}
+
+// segmentName sorts oldest first and tells us how many rows are in the segment without reading it
+func segmentName(created time.Time, rows int) string {
+	return fmt.Sprintf("%020d-%d%s", created.UnixNano(), rows, segmentSuffix)
+}
+
+func parseSegmentName(name string) (time.Time, int, bool) {
+	created, rows, ok := strings.Cut(strings.TrimSuffix(name, segmentSuffix), "-")
+	if !ok || !strings.HasSuffix(name, segmentSuffix) {
+		return time.Time{}, 0, false
+	}
+	nanos, err := strconv.ParseInt(created, 10, 64)
+	if nil != err {
+		return time.Time{}, 0, false
+	}
+	n, err := strconv.Atoi(rows)
+	if nil != err {
+		return time.Time{}, 0, false
+	}
+	return time.Unix(0, nanos), n, true
+}
+
+// write saves the rows as a new segment. The segment only appears once it is completely written
+func (s *spool) write(rows []any, created time.Time) (segment, error) {
+	seg := segment{path: filepath.Join(s.dir, segmentName(created, len(rows))), created: created, rows: len(rows)}
+	tmp := seg.path + ".tmp"
+	f, err := os.Create(tmp)
+	if nil != err {
+		return seg, err
+	}
+	w := bufio.NewWriter(f)
+	stream := jsoniter.ConfigFastest.BorrowStream(w)
+	defer jsoniter.ConfigFastest.ReturnStream(stream)
+	for _, row := range rows {
+		stream.WriteVal(row)
+		stream.WriteRaw("\n")
+	}
+	err = stream.Flush()
+	if nil == err {
+		err = w.Flush()
+	}
+	if nil == err {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Rename(tmp, seg.path)
+	}
+	if nil != err {
+		_ = os.Remove(tmp)
+		return seg, err
+	}
+	if info, statErr := os.Stat(seg.path); nil == statErr {
+		seg.size = info.Size()
+	}
+	return seg, nil
+}
+
+// segments lists what is in the spool, oldest first
+func (s *spool) segments() ([]segment, error) {
+	entries, err := os.ReadDir(s.dir)
+	if nil != err {
+		return nil, err
+	}
+	segments := make([]segment, 0, len(entries))
+	for _, entry := range entries {
+		created, rows, ok := parseSegmentName(entry.Name())
+		if entry.IsDir() || !ok {
+			continue
+		}
+		seg := segment{path: filepath.Join(s.dir, entry.Name()), created: created, rows: rows}
+		if info, infoErr := entry.Info(); nil == infoErr {
+			seg.size = info.Size()
+		}
+		segments = append(segments, seg)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].path < segments[j].path
+	})
+	return segments, nil
+}
+
+// trim removes the oldest segments until the spool fits in maxBytes, returning what it removed
+func (s *spool) trim() ([]segment, error) {
+	if s.maxBytes <= 0 {
+		return nil, nil
+	}
+	segments, err := s.segments()
+	if nil != err {
+		return nil, err
+	}
+	var total int64
+	for _, seg := range segments {
+		total += seg.size
+	}
+	var removed []segment
+	for _, seg := range segments {
+		if total <= s.maxBytes {
+			break
+		}
+		if err = os.Remove(seg.path); nil != err {
+			return removed, err
+		}
+		total -= seg.size
+		removed = append(removed, seg)
+	}
+	return removed, nil
+}
+
+// read decodes every row in the segment, newRow gives us somewhere to decode each row into
+func (seg segment) read(newRow func() any) ([]any, error) {
+	f, err := os.Open(seg.path)
+	if nil != err {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	rows := make([]any, 0, seg.rows)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	json := jsoniter.ConfigFastest
+	for scanner.Scan() {
+		if 0 == len(scanner.Bytes()) {
+			continue
+		}
+		row := newRow()
+		if err = json.Unmarshal(scanner.Bytes(), row); nil != err {
+			return rows, fmt.Errorf("segment %s: %w", filepath.Base(seg.path), err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+func (seg segment) remove() error {
+	return os.Remove(seg.path)
+}
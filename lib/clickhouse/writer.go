@@ -0,0 +1,450 @@
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DropNewest throws away the row being added when the queue is full
+	DropNewest DropPolicy = "newest"
+	// DropOldest throws away the oldest queued row to make room for the row being added
+	DropOldest DropPolicy = "oldest"
+	// DropNone blocks whoever is adding rows until there is room in the queue
+	DropNone DropPolicy = "none"
+
+	// segments to replay each flush interval, so replaying does not starve the live rows
+	maxReplaySegments = 10
+)
+
+var (
+	ErrUnknownDropPolicy = errors.New("unknown drop policy, expected newest, oldest or none")
+
+	writerQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pw_clickhouse_writer_queued_rows",
+		Help: "The number of rows waiting to be inserted.",
+	}, []string{"table"})
+	writerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pw_clickhouse_writer_lag_seconds",
+		Help: "How long the oldest row we have not inserted yet (queued or spooled) has been waiting.",
+	}, []string{"table"})
+	writerInserted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pw_clickhouse_writer_inserted_rows_total",
+		Help: "The total number of rows inserted, including replayed rows.",
+	}, []string{"table"})
+	writerRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pw_clickhouse_writer_retries_total",
+		Help: "The total number of batch inserts retried.",
+	}, []string{"table"})
+	writerSpilled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pw_clickhouse_writer_spilled_rows_total",
+		Help: "The total number of rows written to the disk spool because we could not insert them.",
+	}, []string{"table"})
+	writerReplayed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pw_clickhouse_writer_replayed_rows_total",
+		Help: "The total number of rows inserted from the disk spool.",
+	}, []string{"table"})
+	writerSpooled = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pw_clickhouse_writer_spooled_rows",
+		Help: "The number of rows in the disk spool waiting to be replayed.",
+	}, []string{"table"})
+	writerDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pw_clickhouse_writer_dropped_rows_total",
+		Help: "The total number of rows thrown away.",
+	}, []string{"table", "reason"})
+)
+
+type (
+	// DropPolicy decides what happens when rows are added faster than we can insert them
+	DropPolicy string
+
+	// Inserter is what the Writer inserts batches with, usually a *Server
+	Inserter interface {
+		InsertsContext(ctx context.Context, table string, d []any, max int) error
+	}
+
+	writerConfig struct {
+		queueSize     int
+		batchSize     int
+		flushInterval time.Duration
+		dropPolicy    DropPolicy
+
+		retries       int
+		minBackoff    time.Duration
+		maxBackoff    time.Duration
+		insertTimeout time.Duration
+
+		spoolDir      string
+		spoolMaxBytes int64
+	}
+
+	WriterOption func(*writerConfig)
+
+	// Writer batches rows of T into a ClickHouse table. Failed batches are retried with exponential backoff, and
+	// when ClickHouse stays unreachable they are spooled to disk (if we have a spool directory) and replayed once it
+	// is back. Rows are added through a bounded queue so a slow ClickHouse never holds up the caller, unless asked to
+	Writer[T any] struct {
+		writerConfig
+		table    string
+		inserter Inserter
+		queue    chan *T
+		spool    *spool
+
+		// healthy is false after an insert has failed, until one succeeds again
+		healthy      bool
+		batch        []any
+		batchStarted time.Time
+
+		cancel context.CancelFunc
+		done   chan struct{}
+		log    zerolog.Logger
+	}
+)
+
+// ParseDropPolicy turns a flag value into a DropPolicy
+func ParseDropPolicy(s string) (DropPolicy, error) {
+	switch p := DropPolicy(s); p {
+	case DropNewest, DropOldest, DropNone:
+		return p, nil
+	}
+	return "", ErrUnknownDropPolicy
+}
+
+// WithQueueSize sets how many rows can be waiting for a batch before the drop policy kicks in
+func WithQueueSize(size int) WriterOption {
+	return func(c *writerConfig) {
+		c.queueSize = size
+	}
+}
+
+// WithBatch sets how many rows are inserted at once, and how often a partial batch is inserted
+func WithBatch(size int, flushInterval time.Duration) WriterOption {
+	return func(c *writerConfig) {
+		c.batchSize = size
+		c.flushInterval = flushInterval
+	}
+}
+
+// WithDropPolicy decides what happens when the queue is full
+func WithDropPolicy(policy DropPolicy) WriterOption {
+	return func(c *writerConfig) {
+		c.dropPolicy = policy
+	}
+}
+
+// WithRetries retries a failed batch up to retries times, waiting minBackoff, doubling up to maxBackoff, in between
+func WithRetries(retries int, minBackoff, maxBackoff time.Duration) WriterOption {
+	return func(c *writerConfig) {
+		c.retries = retries
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// WithInsertTimeout gives up on a single insert after this long
+func WithInsertTimeout(timeout time.Duration) WriterOption {
+	return func(c *writerConfig) {
+		c.insertTimeout = timeout
+	}
+}
+
+// WithSpool spools batches we cannot insert to segment files in dir/<table>, throwing away the oldest segments when
+// there are more than maxBytes of them (0 for no limit). An empty dir disables spooling
+func WithSpool(dir string, maxBytes int64) WriterOption {
+	return func(c *writerConfig) {
+		c.spoolDir = dir
+		c.spoolMaxBytes = maxBytes
+	}
+}
+
+// NewWriter starts a Writer inserting into table. By default, rows are inserted in batches of 50,000 (or every
+// second), up to 100,000 rows can be queued before the newest are dropped, and failed batches are retried 3 times
+// with a backoff from 500ms to 10s
+func NewWriter[T any](inserter Inserter, table string, opts ...WriterOption) (*Writer[T], error) {
+	w := &Writer[T]{
+		writerConfig: writerConfig{
+			queueSize:     100_000,
+			batchSize:     50_000,
+			flushInterval: time.Second,
+			dropPolicy:    DropNewest,
+			retries:       3,
+			minBackoff:    500 * time.Millisecond,
+			maxBackoff:    10 * time.Second,
+			insertTimeout: 30 * time.Second,
+		},
+		table:    table,
+		inserter: inserter,
+		healthy:  true,
+		done:     make(chan struct{}),
+		log:      log.With().Str("section", "clickhouse writer").Str("table", table).Logger(),
+	}
+	for _, opt := range opts {
+		opt(&w.writerConfig)
+	}
+	if _, err := ParseDropPolicy(string(w.dropPolicy)); nil != err {
+		return nil, err
+	}
+	if "" != w.spoolDir {
+		var err error
+		if w.spool, err = newSpool(filepath.Join(w.spoolDir, table), w.spoolMaxBytes); nil != err {
+			return nil, err
+		}
+		w.updateSpoolMetrics()
+	}
+	w.queue = make(chan *T, w.queueSize)
+	w.batch = make([]any, 0, w.batchSize)
+
+	var ctx context.Context
+	ctx, w.cancel = context.WithCancel(context.Background())
+	go w.run(ctx)
+	return w, nil
+}
+
+// Add queues a row to be inserted. Returns false if a row (this one or an older one) was dropped to make room
+func (w *Writer[T]) Add(row *T) bool {
+	switch w.dropPolicy {
+	case DropNone:
+		w.queue <- row
+		return true
+	case DropOldest:
+		dropped := false
+		for {
+			select {
+			case w.queue <- row:
+				return !dropped
+			default:
+			}
+			// make room and try again, someone else may beat us to it
+			select {
+			case <-w.queue:
+				writerDropped.WithLabelValues(w.table, "queue-full").Inc()
+				dropped = true
+			default:
+			}
+		}
+	default:
+		select {
+		case w.queue <- row:
+			return true
+		default:
+			writerDropped.WithLabelValues(w.table, "queue-full").Inc()
+			return false
+		}
+	}
+}
+
+// Close inserts (or spools) everything still queued and stops the writer
+func (w *Writer[T]) Close() {
+	w.cancel()
+	<-w.done
+}
+
+func (w *Writer[T]) run(ctx context.Context) {
+	defer close(w.done)
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	w.replay(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			w.drain()
+			return
+		case row := <-w.queue:
+			w.append(row)
+			if len(w.batch) >= w.batchSize {
+				w.flush(ctx)
+			}
+		case <-ticker.C:
+			w.flush(ctx)
+			w.replay(ctx)
+			w.updateLag()
+		}
+	}
+}
+
+func (w *Writer[T]) append(row *T) {
+	if 0 == len(w.batch) {
+		w.batchStarted = time.Now()
+	}
+	w.batch = append(w.batch, row)
+}
+
+// drain empties the queue on our way out. We get one attempt at inserting, otherwise it is spooled (or lost)
+func (w *Writer[T]) drain() {
+	ctx := context.Background()
+	w.retries = 0
+	for {
+		select {
+		case row := <-w.queue:
+			w.append(row)
+			if len(w.batch) >= w.batchSize {
+				w.flush(ctx)
+			}
+		default:
+			w.flush(ctx)
+			writerQueued.WithLabelValues(w.table).Set(0)
+			return
+		}
+	}
+}
+
+// flush inserts the current batch, spooling it when ClickHouse is unavailable
+func (w *Writer[T]) flush(ctx context.Context) {
+	writerQueued.WithLabelValues(w.table).Set(float64(len(w.queue)))
+	if 0 == len(w.batch) {
+		return
+	}
+	rows, started := w.batch, w.batchStarted
+	w.batch = make([]any, 0, w.batchSize)
+
+	// while ClickHouse is down, straight to the spool. Replaying the spool tells us when it is back
+	if !w.healthy && nil != w.spool {
+		w.spill(rows, started)
+		return
+	}
+
+	retries := w.retries
+	if !w.healthy {
+		retries = 0
+	}
+	if err := w.insertWithRetry(ctx, rows, retries); nil != err {
+		w.log.Error().Err(err).Int("rows", len(rows)).Msg("Failed to insert batch")
+		w.healthy = false
+		if nil != w.spool {
+			w.spill(rows, started)
+		} else {
+			writerDropped.WithLabelValues(w.table, "insert-failed").Add(float64(len(rows)))
+		}
+		return
+	}
+	w.healthy = true
+	writerInserted.WithLabelValues(w.table).Add(float64(len(rows)))
+}
+
+func (w *Writer[T]) insert(ctx context.Context, rows []any) error {
+	ctx, cancel := context.WithTimeout(ctx, w.insertTimeout)
+	defer cancel()
+	return w.inserter.InsertsContext(ctx, w.table, rows, len(rows))
+}
+
+func (w *Writer[T]) insertWithRetry(ctx context.Context, rows []any, retries int) error {
+	backoff := w.minBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = w.insert(ctx, rows); nil == err || attempt >= retries {
+			return err
+		}
+		writerRetries.WithLabelValues(w.table).Inc()
+		w.log.Warn().Err(err).Int("attempt", attempt+1).Dur("backoff", backoff).Msg("Insert failed, retrying")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
+
+func (w *Writer[T]) spill(rows []any, created time.Time) {
+	if _, err := w.spool.write(rows, created); nil != err {
+		w.log.Error().Err(err).Int("rows", len(rows)).Msg("Failed to spool batch, dropping it")
+		writerDropped.WithLabelValues(w.table, "spool-failed").Add(float64(len(rows)))
+		return
+	}
+	writerSpilled.WithLabelValues(w.table).Add(float64(len(rows)))
+	removed, err := w.spool.trim()
+	if nil != err {
+		w.log.Error().Err(err).Msg("Failed to trim spool")
+	}
+	for _, seg := range removed {
+		writerDropped.WithLabelValues(w.table, "spool-full").Add(float64(seg.rows))
+	}
+	w.updateSpoolMetrics()
+}
+
+// replay inserts the oldest spooled segments, stopping at the first failure
+func (w *Writer[T]) replay(ctx context.Context) {
+	if nil == w.spool {
+		// without a spool, the next flush tells us if ClickHouse is back
+		return
+	}
+	segments, err := w.spool.segments()
+	if nil != err {
+		w.log.Error().Err(err).Msg("Failed to list spool")
+		return
+	}
+	if 0 == len(segments) {
+		// nothing was spooled, give the next batch a chance
+		w.healthy = true
+		return
+	}
+	defer w.updateSpoolMetrics()
+	for i, seg := range segments {
+		if i >= maxReplaySegments {
+			return
+		}
+		rows, err := seg.read(func() any { return new(T) })
+		if nil != err {
+			w.log.Error().Err(err).Str("segment", seg.path).Int("rows", len(rows)).Msg("Spool segment is corrupt, replaying what we can")
+			writerDropped.WithLabelValues(w.table, "spool-corrupt").Add(float64(max(0, seg.rows-len(rows))))
+		}
+		if len(rows) > 0 {
+			if err = w.insert(ctx, rows); nil != err {
+				w.healthy = false
+				w.log.Debug().Err(err).Msg("ClickHouse still unavailable, keeping spool")
+				return
+			}
+			writerInserted.WithLabelValues(w.table).Add(float64(len(rows)))
+			writerReplayed.WithLabelValues(w.table).Add(float64(len(rows)))
+		}
+		if err = seg.remove(); nil != err {
+			w.log.Error().Err(err).Str("segment", seg.path).Msg("Failed to remove replayed segment")
+			return
+		}
+		if !w.healthy {
+			w.log.Info().Msg("ClickHouse is back, replaying spool")
+		}
+		w.healthy = true
+	}
+}
+
+func (w *Writer[T]) updateSpoolMetrics() {
+	segments, err := w.spool.segments()
+	if nil != err {
+		return
+	}
+	rows := 0
+	for _, seg := range segments {
+		rows += seg.rows
+	}
+	writerSpooled.WithLabelValues(w.table).Set(float64(rows))
+}
+
+// updateLag works out how long the oldest row we have not inserted has been waiting
+func (w *Writer[T]) updateLag() {
+	var oldest time.Time
+	if len(w.batch) > 0 {
+		oldest = w.batchStarted
+	}
+	if nil != w.spool {
+		if segments, err := w.spool.segments(); nil == err && len(segments) > 0 {
+			oldest = segments[0].created
+		}
+	}
+	if oldest.IsZero() {
+		writerLag.WithLabelValues(w.table).Set(0)
+		return
+	}
+	writerLag.WithLabelValues(w.table).Set(time.Since(oldest).Seconds())
+}
@@ -0,0 +1,180 @@
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	testRow struct {
+		Id   int
+		Name string
+	}
+
+	fakeInserter struct {
+		mu   sync.Mutex
+		fail bool
+		rows []*testRow
+	}
+)
+
+var errDown = errors.New("clickhouse is down")
+
+func (f *fakeInserter) InsertsContext(_ context.Context, _ string, d []any, max int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		return errDown
+	}
+	for i := 0; i < max; i++ {
+		f.rows = append(f.rows, d[i].(*testRow))
+	}
+	return nil
+}
+
+func (f *fakeInserter) setFail(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fail
+}
+
+func (f *fakeInserter) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.rows)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriter_SpoolAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	ins := &fakeInserter{fail: true}
+	w, err := NewWriter[testRow](ins, "test_rows",
+		WithBatch(10, 20*time.Millisecond),
+		WithRetries(1, time.Millisecond, time.Millisecond),
+		WithSpool(dir, 0),
+	)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 25; i++ {
+		w.Add(&testRow{Id: i, Name: "spooled"})
+	}
+	waitFor(t, "rows to be spooled", func() bool {
+		segments, _ := w.spool.segments()
+		rows := 0
+		for _, seg := range segments {
+			rows += seg.rows
+		}
+		return 25 == rows
+	})
+
+	ins.setFail(false)
+	waitFor(t, "the spool to be replayed", func() bool { return 25 == ins.count() })
+	segments, _ := w.spool.segments()
+	if 0 != len(segments) {
+		t.Errorf("expected the spool to be empty after replaying, got %d segments", len(segments))
+	}
+
+	w.Add(&testRow{Id: 25, Name: "live"})
+	w.Close()
+	if 26 != ins.count() {
+		t.Errorf("expected close to insert the last row, got %d rows", ins.count())
+	}
+	seen := map[int]bool{}
+	for _, row := range ins.rows {
+		seen[row.Id] = true
+	}
+	if 26 != len(seen) {
+		t.Errorf("expected every row exactly once, got %d distinct rows", len(seen))
+	}
+}
+
+func TestWriter_ReplaysSpoolOnStart(t *testing.T) {
+	dir := t.TempDir()
+	ins := &fakeInserter{fail: true}
+	w, err := NewWriter[testRow](ins, "test_rows", WithSpool(dir, 0), WithRetries(0, 0, 0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	w.Add(&testRow{Id: 1})
+	w.Close()
+
+	ins.setFail(false)
+	w, err = NewWriter[testRow](ins, "test_rows", WithSpool(dir, 0))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	waitFor(t, "the spool from last time to be replayed", func() bool { return 1 == ins.count() })
+}
+
+func TestWriter_DropPolicy(t *testing.T) {
+	tests := []struct {
+		policy DropPolicy
+		want   []int
+	}{
+		{DropNewest, []int{0, 1}},
+		{DropOldest, []int{2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			// no goroutine draining the queue, so it stays full
+			w := &Writer[testRow]{
+				writerConfig: writerConfig{dropPolicy: tt.policy},
+				table:        "test_rows",
+				queue:        make(chan *testRow, 2),
+			}
+			for i := 0; i < 4; i++ {
+				w.Add(&testRow{Id: i})
+			}
+			for _, want := range tt.want {
+				if got := (<-w.queue).Id; got != want {
+					t.Errorf("expected row %d to be kept, got %d", want, got)
+				}
+			}
+		})
+	}
+
+	if _, err := ParseDropPolicy("sometimes"); !errors.Is(err, ErrUnknownDropPolicy) {
+		t.Errorf("expected an unknown drop policy to be rejected")
+	}
+}
+
+func TestSpool_Trim(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 100)
+	if nil != err {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err = s.write([]any{&testRow{Id: i, Name: "a row with a long enough name"}}, now.Add(time.Duration(i))); nil != err {
+			t.Fatal(err)
+		}
+	}
+	removed, err := s.trim()
+	if nil != err {
+		t.Fatal(err)
+	}
+	segments, _ := s.segments()
+	if 0 == len(removed) || len(removed)+len(segments) != 5 {
+		t.Fatalf("expected the oldest segments to be trimmed, removed %d, kept %d", len(removed), len(segments))
+	}
+	rows, err := segments[len(segments)-1].read(func() any { return new(testRow) })
+	if nil != err || 1 != len(rows) || 4 != rows[0].(*testRow).Id {
+		t.Errorf("expected the newest segment to be kept, got %v %v", rows, err)
+	}
+}
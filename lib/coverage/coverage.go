@@ -0,0 +1,322 @@
+package coverage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kpawlik/geojson"
+	"plane.watch/lib/geo"
+)
+
+type (
+	// Bin is a single slice of a feeders coverage, a range of bearings within an altitude band
+	Bin struct {
+		// MaxRange is the furthest position we have seen in this bin, in metres
+		MaxRange float64
+		Count    uint64
+	}
+
+	// Coverage is everything we know about what a single feeder can see
+	Coverage struct {
+		SourceTag string
+		RefLat    float64
+		RefLon    float64
+
+		// BearingBins is how many slices we cut the 360 degrees around the receiver into
+		BearingBins int
+		// AltitudeBands is the lower bound (in feet) of each altitude band, the first band is always 0 (and on ground)
+		AltitudeBands []int32
+		// Bins is indexed by [altitude band][bearing bin]
+		Bins [][]Bin
+
+		Count    uint64
+		Rejected uint64
+		MaxRange float64
+
+		FirstSeen time.Time
+		LastSeen  time.Time
+	}
+
+	// Accumulator gathers coverage information for many feeders
+	Accumulator struct {
+		mu      sync.Mutex
+		sources map[string]*Coverage
+
+		bearingBins   int
+		altitudeBands []int32
+		// maxRange is the furthest we believe a receiver can see, anything beyond this is rejected
+		maxRange float64
+	}
+
+	Option func(*Accumulator)
+)
+
+var (
+	ErrShapeMismatch = errors.New("coverage bins do not match")
+)
+
+// NewAccumulator creates somewhere to gather feeder coverage.
+// by default, we have 10 degree bearing bins, 10,000ft altitude bands and a max range of 700km
+func NewAccumulator(opts ...Option) *Accumulator {
+	a := &Accumulator{
+		sources:       make(map[string]*Coverage),
+		bearingBins:   36,
+		altitudeBands: []int32{0, 10_000, 20_000, 30_000},
+		maxRange:      700_000,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// WithBearingBins sets how many bins we split the circle around the receiver into
+func WithBearingBins(numBins int) Option {
+	return func(a *Accumulator) {
+		if numBins > 0 {
+			a.bearingBins = numBins
+		}
+	}
+}
+
+// WithAltitudeBands sets the lower bound (in feet) of each altitude band
+func WithAltitudeBands(bands ...int32) Option {
+	return func(a *Accumulator) {
+		if 0 == len(bands) {
+			return
+		}
+		a.altitudeBands = append([]int32{}, bands...)
+		sort.Slice(a.altitudeBands, func(i, j int) bool { return a.altitudeBands[i] < a.altitudeBands[j] })
+		a.altitudeBands[0] = 0
+	}
+}
+
+// WithMaxRange sets the furthest (in metres) we accept a position for, anything further is counted as rejected
+func WithMaxRange(metres float64) Option {
+	return func(a *Accumulator) {
+		a.maxRange = metres
+	}
+}
+
+func (a *Accumulator) newCoverage(sourceTag string) *Coverage {
+	c := &Coverage{
+		SourceTag:     sourceTag,
+		BearingBins:   a.bearingBins,
+		AltitudeBands: a.altitudeBands,
+		Bins:          make([][]Bin, len(a.altitudeBands)),
+	}
+	for i := range c.Bins {
+		c.Bins[i] = make([]Bin, a.bearingBins)
+	}
+	return c
+}
+
+// Add records that the given feeder saw an aircraft at lat/lon
+func (a *Accumulator) Add(sourceTag string, refLat, refLon, lat, lon float64, altitude int32, onGround bool, ts time.Time) {
+	if "" == sourceTag {
+		return
+	}
+	if onGround {
+		altitude = 0
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c, ok := a.sources[sourceTag]
+	if !ok {
+		c = a.newCoverage(sourceTag)
+		a.sources[sourceTag] = c
+		c.FirstSeen = ts
+	}
+	c.RefLat, c.RefLon = refLat, refLon
+	if ts.After(c.LastSeen) {
+		c.LastSeen = ts
+	}
+
+	distance := geo.Distance(refLat, refLon, lat, lon)
+	if distance > a.maxRange {
+		c.Rejected++
+		return
+	}
+	c.Count++
+	if distance > c.MaxRange {
+		c.MaxRange = distance
+	}
+
+	bin := &c.Bins[c.band(altitude)][c.bearingBin(geo.Bearing(refLat, refLon, lat, lon))]
+	bin.Count++
+	if distance > bin.MaxRange {
+		bin.MaxRange = distance
+	}
+}
+
+// Merge adds the given coverage into our accumulated coverage
+func (a *Accumulator) Merge(in Coverage) error {
+	if "" == in.SourceTag {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c, ok := a.sources[in.SourceTag]
+	if !ok {
+		c = a.newCoverage(in.SourceTag)
+		a.sources[in.SourceTag] = c
+	}
+	return c.merge(in)
+}
+
+// Snapshot returns a copy of the coverage for every feeder. If reset is true, we start accumulating from scratch
+func (a *Accumulator) Snapshot(reset bool) []Coverage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	out := make([]Coverage, 0, len(a.sources))
+	for _, c := range a.sources {
+		out = append(out, c.clone())
+	}
+	if reset {
+		a.sources = make(map[string]*Coverage)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SourceTag < out[j].SourceTag })
+	return out
+}
+
+// Get returns a copy of the coverage for the given feeder
+func (a *Accumulator) Get(sourceTag string) (Coverage, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c, ok := a.sources[sourceTag]
+	if !ok {
+		return Coverage{}, false
+	}
+	return c.clone(), true
+}
+
+// band figures out which altitude band the given altitude belongs in
+func (c *Coverage) band(altitude int32) int {
+	idx := 0
+	for i, lower := range c.AltitudeBands {
+		if altitude >= lower {
+			idx = i
+		}
+	}
+	return idx
+}
+
+func (c *Coverage) bearingBin(bearing float64) int {
+	idx := int(bearing / (360.0 / float64(c.BearingBins)))
+	if idx >= c.BearingBins {
+		idx = 0
+	}
+	if idx < 0 {
+		idx = 0
+	}
+	return idx
+}
+
+func (c *Coverage) merge(in Coverage) error {
+	if in.BearingBins != c.BearingBins || len(in.Bins) != len(c.Bins) {
+		return fmt.Errorf("%w for %s", ErrShapeMismatch, in.SourceTag)
+	}
+	for i := range in.Bins {
+		if len(in.Bins[i]) != c.BearingBins {
+			return fmt.Errorf("%w for %s", ErrShapeMismatch, in.SourceTag)
+		}
+	}
+	for i := range in.Bins {
+		for j, b := range in.Bins[i] {
+			c.Bins[i][j].Count += b.Count
+			if b.MaxRange > c.Bins[i][j].MaxRange {
+				c.Bins[i][j].MaxRange = b.MaxRange
+			}
+		}
+	}
+	c.RefLat, c.RefLon = in.RefLat, in.RefLon
+	c.Count += in.Count
+	c.Rejected += in.Rejected
+	if in.MaxRange > c.MaxRange {
+		c.MaxRange = in.MaxRange
+	}
+	if c.FirstSeen.IsZero() || (!in.FirstSeen.IsZero() && in.FirstSeen.Before(c.FirstSeen)) {
+		c.FirstSeen = in.FirstSeen
+	}
+	if in.LastSeen.After(c.LastSeen) {
+		c.LastSeen = in.LastSeen
+	}
+	return nil
+}
+
+func (c *Coverage) clone() Coverage {
+	out := *c
+	out.AltitudeBands = append([]int32{}, c.AltitudeBands...)
+	out.Bins = make([][]Bin, len(c.Bins))
+	for i := range c.Bins {
+		out.Bins[i] = append([]Bin{}, c.Bins[i]...)
+	}
+	return out
+}
+
+// RangeByBearing gives the max range in each bearing bin for the given altitude band. A band of -1 combines all bands
+func (c *Coverage) RangeByBearing(band int) []float64 {
+	ranges := make([]float64, c.BearingBins)
+	for i := range c.Bins {
+		if band >= 0 && band != i {
+			continue
+		}
+		for j, b := range c.Bins[i] {
+			if b.MaxRange > ranges[j] {
+				ranges[j] = b.MaxRange
+			}
+		}
+	}
+	return ranges
+}
+
+// Polygon is the outline of what this feeder can see in the given altitude band (-1 for all bands)
+func (c *Coverage) Polygon(band int) *geojson.Polygon {
+	ranges := c.RangeByBearing(band)
+	width := 360.0 / float64(c.BearingBins)
+
+	ring := make(geojson.Coordinates, 0, 2*c.BearingBins+1)
+	for i, r := range ranges {
+		// each bin is an arc from the start to the end of its bearing range
+		for _, bearing := range []float64{float64(i) * width, float64(i+1) * width} {
+			lat, lon := geo.Destination(c.RefLat, c.RefLon, bearing, r)
+			ring = append(ring, geojson.Coordinate{geojson.CoordType(lon), geojson.CoordType(lat)})
+		}
+	}
+	ring = append(ring, ring[0])
+	return geojson.NewPolygon(geojson.MultiLine{ring})
+}
+
+// FeatureCollection gives a GeoJSON feature per altitude band, along with the reference point of the receiver
+func (c *Coverage) FeatureCollection() *geojson.FeatureCollection {
+	fc := geojson.NewFeatureCollection([]*geojson.Feature{})
+	fc.AddFeatures(geojson.NewFeature(
+		geojson.NewPoint(geojson.Coordinate{geojson.CoordType(c.RefLon), geojson.CoordType(c.RefLat)}),
+		map[string]interface{}{"SourceTag": c.SourceTag, "Count": c.Count, "Rejected": c.Rejected, "MaxRange": c.MaxRange},
+		c.SourceTag,
+	))
+	for band := range c.Bins {
+		var count uint64
+		for _, b := range c.Bins[band] {
+			count += b.Count
+		}
+		props := map[string]interface{}{
+			"SourceTag":   c.SourceTag,
+			"AltitudeMin": c.AltitudeBands[band],
+			"Count":       count,
+		}
+		if band+1 < len(c.AltitudeBands) {
+			props["AltitudeMax"] = c.AltitudeBands[band+1]
+		}
+		fc.AddFeatures(geojson.NewFeature(c.Polygon(band), props, fmt.Sprintf("%s_%d", c.SourceTag, band)))
+	}
+	return fc
+}
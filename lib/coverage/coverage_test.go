@@ -0,0 +1,114 @@
+package coverage
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"plane.watch/lib/geo"
+)
+
+const (
+	perthLat = -31.9403
+	perthLon = 115.967003
+)
+
+func TestAccumulator_Add(t *testing.T) {
+	a := NewAccumulator()
+	now := time.Now()
+
+	// 100km east at 35,000ft
+	lat, lon := geo.Destination(perthLat, perthLon, 95, 100_000)
+	a.Add("feeder-1", perthLat, perthLon, lat, lon, 35_000, false, now)
+	// 50km north on the ground (altitude should be ignored)
+	lat, lon = geo.Destination(perthLat, perthLon, 5, 50_000)
+	a.Add("feeder-1", perthLat, perthLon, lat, lon, 35_000, true, now)
+	// way too far away, our reference position is probably wrong
+	lat, lon = geo.Destination(perthLat, perthLon, 180, 2_000_000)
+	a.Add("feeder-1", perthLat, perthLon, lat, lon, 35_000, false, now)
+	// no tag, no coverage
+	a.Add("", perthLat, perthLon, lat, lon, 35_000, false, now)
+
+	c, ok := a.Get("feeder-1")
+	if !ok {
+		t.Fatal("expected coverage for feeder-1")
+	}
+	if 2 != c.Count || 1 != c.Rejected {
+		t.Errorf("expected 2 counted and 1 rejected, got %d and %d", c.Count, c.Rejected)
+	}
+	if b := c.Bins[3][9]; 1 != b.Count || b.MaxRange < 99_000 || b.MaxRange > 101_000 {
+		t.Errorf("expected the east bin at 30k+ to have our position, got %+v", b)
+	}
+	if b := c.Bins[0][0]; 1 != b.Count || b.MaxRange < 49_000 || b.MaxRange > 51_000 {
+		t.Errorf("expected the north ground bin to have our position, got %+v", b)
+	}
+	if c.MaxRange < 99_000 || c.MaxRange > 101_000 {
+		t.Errorf("incorrect max range %0.2f", c.MaxRange)
+	}
+	if _, ok = a.Get(""); ok {
+		t.Errorf("should not track an empty source tag")
+	}
+}
+
+func TestAccumulator_SnapshotAndMerge(t *testing.T) {
+	ingest := NewAccumulator()
+	now := time.Now()
+	lat, lon := geo.Destination(perthLat, perthLon, 45, 100_000)
+	ingest.Add("feeder-1", perthLat, perthLon, lat, lon, 5_000, false, now)
+
+	snap := ingest.Snapshot(true)
+	if 1 != len(snap) {
+		t.Fatalf("expected a single feeder, got %d", len(snap))
+	}
+	if 0 != len(ingest.Snapshot(false)) {
+		t.Errorf("expected snapshot to reset the accumulator")
+	}
+
+	// make sure it survives the trip over the wire
+	buf, err := json.Marshal(snap)
+	if nil != err {
+		t.Fatal(err)
+	}
+	var decoded []Coverage
+	if err = json.Unmarshal(buf, &decoded); nil != err {
+		t.Fatal(err)
+	}
+
+	api := NewAccumulator()
+	for i := 0; i < 2; i++ {
+		if err = api.Merge(decoded[0]); nil != err {
+			t.Fatal(err)
+		}
+	}
+	c, _ := api.Get("feeder-1")
+	if 2 != c.Count || 2 != c.Bins[0][4].Count {
+		t.Errorf("expected merged counts to add up, got %d", c.Count)
+	}
+
+	wrongShape := NewAccumulator(WithBearingBins(8))
+	wrongShape.Add("feeder-1", perthLat, perthLon, lat, lon, 5_000, false, now)
+	if err = api.Merge(wrongShape.Snapshot(false)[0]); !errors.Is(err, ErrShapeMismatch) {
+		t.Errorf("expected a shape mismatch, got %v", err)
+	}
+}
+
+func TestCoverage_FeatureCollection(t *testing.T) {
+	a := NewAccumulator(WithBearingBins(4), WithAltitudeBands(0, 20_000))
+	lat, lon := geo.Destination(perthLat, perthLon, 45, 100_000)
+	a.Add("feeder-1", perthLat, perthLon, lat, lon, 25_000, false, time.Now())
+	c, _ := a.Get("feeder-1")
+
+	fc := c.FeatureCollection()
+	// reference point + 2 bands
+	if 3 != len(fc.Features) {
+		t.Fatalf("expected 3 features, got %d", len(fc.Features))
+	}
+	if _, err := json.Marshal(fc); nil != err {
+		t.Error(err)
+	}
+	ranges := c.RangeByBearing(-1)
+	if 4 != len(ranges) || ranges[0] < 99_000 {
+		t.Errorf("incorrect ranges %v", ranges)
+	}
+}
@@ -144,7 +144,7 @@ func (f *ForgetfulSyncMap) sweep() {
 
 		if f.forgettable(key, m.value, m.added) {
 			if f.evictionFunc != nil {
-				f.evictionFunc(key, value)
+				f.evictionFunc(key, m.value)
 			}
 			f.Delete(key)
 		} else {
@@ -90,6 +90,32 @@ func TestForgetfulSyncMap_SweepOldPlane(t *testing.T) {
 
 }
 
+func TestForgetfulSyncMap_EvictionGetsValue(t *testing.T) {
+	var evicted []any
+	testMap := NewForgetfulSyncMap(
+		WithSweepInterval(time.Hour),
+		WithOldAgeAfter(60*time.Second),
+		WithPreEvictionAction(func(key, value any) {
+			evicted = append(evicted, value)
+		}),
+	)
+	defer testMap.Stop()
+
+	plane := testPlaneLocation{Icao: "VH67SH", Index: 1}
+	testMap.lookup.Store(plane.Icao, &marble{
+		added: time.Now().Add(-61 * time.Second),
+		value: plane,
+	})
+	testMap.sweep()
+
+	if 1 != len(evicted) {
+		t.Fatalf("expected 1 eviction, got %d", len(evicted))
+	}
+	if got, ok := evicted[0].(testPlaneLocation); !ok || got != plane {
+		t.Errorf("expected the eviction action to be given our value, got %#v", evicted[0])
+	}
+}
+
 func TestForgetfulSyncMap_DontSweepNewPlane(t *testing.T) {
 	testMap := setupNonSweepingForgetfulSyncMap(1*time.Second, 60*time.Second)
 
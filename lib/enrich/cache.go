@@ -0,0 +1,76 @@
+package enrich
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	cacheEntry[T any] struct {
+		value   *T
+		expires time.Time
+	}
+
+	// cache is a bounded TTL cache. A nil value is a negative cache entry, we asked and there was nothing to find
+	cache[T any] struct {
+		mu         sync.Mutex
+		entries    map[string]cacheEntry[T]
+		maxEntries int
+	}
+)
+
+func newCache[T any](maxEntries int) *cache[T] {
+	return &cache[T]{
+		entries:    make(map[string]cacheEntry[T]),
+		maxEntries: maxEntries,
+	}
+}
+
+// get returns the cached value and whether we had a (non expired) entry for it
+func (c *cache[T]) get(key string, now time.Time) (*T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if now.After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *cache[T]) set(key string, value *T, ttl time.Duration, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = cacheEntry[T]{value: value, expires: now.Add(ttl)}
+}
+
+// evict makes room in the cache, first by dropping expired entries and then the entry closest to expiring
+func (c *cache[T]) evict(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+			continue
+		}
+		if "" == oldestKey || e.expires.Before(oldest) {
+			oldestKey = k
+			oldest = e.expires
+		}
+	}
+	if len(c.entries) >= c.maxEntries && "" != oldestKey {
+		delete(c.entries, oldestKey)
+	}
+}
+
+func (c *cache[T]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,269 @@
+package enrich
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"plane.watch/lib/export"
+	"plane.watch/lib/nats_io"
+)
+
+type (
+	// Lookup fetches enrichment data. A nil result with no error means there is nothing to find
+	Lookup interface {
+		Aircraft(icao string) (*export.Aircraft, error)
+		Route(callSign string) (*export.Route, error)
+	}
+
+	// call is a lookup in progress, everyone else asking for the same thing waits for it rather than asking again
+	call[T any] struct {
+		wg    sync.WaitGroup
+		value *T
+		err   error
+	}
+
+	Stats struct {
+		Hits     uint64
+		Misses   uint64
+		Negative uint64
+		Errors   uint64
+		Skipped  uint64
+	}
+
+	Enricher struct {
+		lookup Lookup
+
+		aircraft *cache[export.Aircraft]
+		routes   *cache[export.Route]
+
+		inflightMu       sync.Mutex
+		inflightAircraft map[string]*call[export.Aircraft]
+		inflightRoutes   map[string]*call[export.Route]
+
+		ttl         time.Duration
+		negativeTTL time.Duration
+		backoff     time.Duration
+
+		// unavailableUntil is when we will try talking to the API again after it failed (unix nanos)
+		unavailableUntil atomic.Int64
+
+		hits, misses, negative, errors, skipped atomic.Uint64
+
+		now func() time.Time
+	}
+
+	Option func(*Enricher)
+
+	// NatsLookup asks pw_atc_api for enrichment data
+	NatsLookup struct {
+		server  *nats_io.Server
+		timeout time.Duration
+	}
+)
+
+// NewEnricher creates an enricher that caches what it finds.
+// by default, we cache for an hour, remember things we could not find for 5 minutes, keep up to 100,000 entries of
+// each type, and stop asking the API for 10 seconds when it fails
+func NewEnricher(lookup Lookup, opts ...Option) *Enricher {
+	e := &Enricher{
+		lookup:           lookup,
+		inflightAircraft: make(map[string]*call[export.Aircraft]),
+		inflightRoutes:   make(map[string]*call[export.Route]),
+		ttl:              time.Hour,
+		negativeTTL:      5 * time.Minute,
+		backoff:          10 * time.Second,
+		now:              time.Now,
+	}
+	maxEntries := 100_000
+	for _, opt := range opts {
+		opt(e)
+	}
+	if nil == e.aircraft {
+		e.aircraft = newCache[export.Aircraft](maxEntries)
+		e.routes = newCache[export.Route](maxEntries)
+	}
+	return e
+}
+
+// WithTTL sets how long we remember what the API told us
+func WithTTL(ttl time.Duration) Option {
+	return func(e *Enricher) {
+		e.ttl = ttl
+	}
+}
+
+// WithNegativeTTL sets how long we remember that the API had nothing for us
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(e *Enricher) {
+		e.negativeTTL = ttl
+	}
+}
+
+// WithMaxEntries bounds how many aircraft (and routes) we keep in our cache
+func WithMaxEntries(maxEntries int) Option {
+	return func(e *Enricher) {
+		e.aircraft = newCache[export.Aircraft](maxEntries)
+		e.routes = newCache[export.Route](maxEntries)
+	}
+}
+
+// WithBackoff sets how long we pass updates through untouched after the API fails
+func WithBackoff(backoff time.Duration) Option {
+	return func(e *Enricher) {
+		e.backoff = backoff
+	}
+}
+
+// Enrich fills in the aircraft and route details for the given location.
+// If the API is unavailable, the location is left as is
+func (e *Enricher) Enrich(loc *export.PlaneLocation) {
+	if nil == loc {
+		return
+	}
+	if "" != loc.Icao {
+		if a := e.Aircraft(loc.Icao); nil != a {
+			applyAircraft(loc, a)
+		}
+	}
+	if nil != loc.CallSign {
+		if r := e.Route(*loc.CallSign); nil != r {
+			applyRoute(loc, r)
+		}
+	}
+}
+
+// Aircraft returns the details for the given ICAO, nil if we do not know (or cannot find out right now)
+func (e *Enricher) Aircraft(icao string) *export.Aircraft {
+	icao = strings.ToUpper(strings.TrimSpace(icao))
+	if "" == icao {
+		return nil
+	}
+	return fetch(e, e.aircraft, e.inflightAircraft, icao, e.lookup.Aircraft)
+}
+
+// Route returns the route for the given callsign, nil if we do not know (or cannot find out right now)
+func (e *Enricher) Route(callSign string) *export.Route {
+	callSign = strings.ToUpper(strings.TrimSpace(callSign))
+	if "" == callSign {
+		return nil
+	}
+	return fetch(e, e.routes, e.inflightRoutes, callSign, e.lookup.Route)
+}
+
+func fetch[T any](e *Enricher, c *cache[T], inflight map[string]*call[T], key string, lookup func(string) (*T, error)) *T {
+	now := e.now()
+	if value, ok := c.get(key, now); ok {
+		e.hits.Add(1)
+		return value
+	}
+	if now.UnixNano() < e.unavailableUntil.Load() {
+		e.skipped.Add(1)
+		return nil
+	}
+
+	e.inflightMu.Lock()
+	if existing, ok := inflight[key]; ok {
+		e.inflightMu.Unlock()
+		existing.wg.Wait()
+		return existing.value
+	}
+	cl := &call[T]{}
+	cl.wg.Add(1)
+	inflight[key] = cl
+	e.inflightMu.Unlock()
+
+	e.misses.Add(1)
+	cl.value, cl.err = lookup(key)
+	switch {
+	case nil != cl.err:
+		// do not cache failures, just leave the API alone for a bit
+		e.errors.Add(1)
+		e.unavailableUntil.Store(e.now().Add(e.backoff).UnixNano())
+	case nil == cl.value:
+		e.negative.Add(1)
+		c.set(key, nil, e.negativeTTL, now)
+	default:
+		c.set(key, cl.value, e.ttl, now)
+	}
+
+	e.inflightMu.Lock()
+	delete(inflight, key)
+	e.inflightMu.Unlock()
+	cl.wg.Done()
+
+	return cl.value
+}
+
+// Stats returns how our cache is going
+func (e *Enricher) Stats() Stats {
+	return Stats{
+		Hits:     e.hits.Load(),
+		Misses:   e.misses.Load(),
+		Negative: e.negative.Load(),
+		Errors:   e.errors.Load(),
+		Skipped:  e.skipped.Load(),
+	}
+}
+
+// CacheSize is how many aircraft and routes we are currently remembering
+func (e *Enricher) CacheSize() (aircraft, routes int) {
+	return e.aircraft.len(), e.routes.len()
+}
+
+func applyAircraft(loc *export.PlaneLocation, a *export.Aircraft) {
+	loc.IcaoCode = &a.Icao
+	loc.Registration = a.Registration
+	loc.TypeCode = a.TypeCode
+	loc.TypeCodeLong = a.TypeCodeLong
+	loc.Serial = a.Serial
+	loc.RegisteredOwner = a.RegisteredOwner
+	loc.COFAOwner = a.COFAOwner
+	loc.EngineType = a.EngineType
+	loc.FlagCode = a.FlagCode
+}
+
+func applyRoute(loc *export.PlaneLocation, r *export.Route) {
+	loc.Operator = r.Operator
+	loc.RouteCode = r.RouteCode
+	loc.Segments = r.Segments
+}
+
+// NewNatsLookup asks pw_atc_api for enrichment data over the given nats connection
+func NewNatsLookup(server *nats_io.Server, timeout time.Duration) *NatsLookup {
+	return &NatsLookup{server: server, timeout: timeout}
+}
+
+func (nl *NatsLookup) Aircraft(icao string) (*export.Aircraft, error) {
+	buf, err := nl.server.Request(export.NatsApiEnrichAircraftV1, []byte(icao), nil, nl.timeout)
+	if nil != err {
+		return nil, err
+	}
+	resp := export.AircraftResponse{}
+	if err = jsoniter.ConfigFastest.Unmarshal(buf, &resp); nil != err {
+		return nil, err
+	}
+	if "" == resp.Aircraft.Icao {
+		return nil, nil
+	}
+	return &resp.Aircraft, nil
+}
+
+func (nl *NatsLookup) Route(callSign string) (*export.Route, error) {
+	buf, err := nl.server.Request(export.NatsApiEnrichRouteV1, []byte(callSign), nil, nl.timeout)
+	if nil != err {
+		return nil, err
+	}
+	resp := export.RouteResponse{}
+	if err = jsoniter.ConfigFastest.Unmarshal(buf, &resp); nil != err {
+		return nil, err
+	}
+	if "" == resp.Route.CallSign {
+		return nil, nil
+	}
+	return &resp.Route, nil
+}
+
+var _ Lookup = (*NatsLookup)(nil)
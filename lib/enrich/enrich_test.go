@@ -0,0 +1,161 @@
+package enrich
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"plane.watch/lib/export"
+)
+
+type fakeLookup struct {
+	aircraftCalls, routeCalls atomic.Int32
+	fail                      atomic.Bool
+	release                   chan struct{}
+}
+
+func ptr[t any](what t) *t {
+	return &what
+}
+
+func (f *fakeLookup) Aircraft(icao string) (*export.Aircraft, error) {
+	f.aircraftCalls.Add(1)
+	if nil != f.release {
+		<-f.release
+	}
+	if f.fail.Load() {
+		return nil, errors.New("api down")
+	}
+	if "7C4516" != icao {
+		return nil, nil
+	}
+	return &export.Aircraft{Icao: icao, Registration: ptr("VH-EBA"), TypeCode: ptr("A332")}, nil
+}
+
+func (f *fakeLookup) Route(callSign string) (*export.Route, error) {
+	f.routeCalls.Add(1)
+	if f.fail.Load() {
+		return nil, errors.New("api down")
+	}
+	return &export.Route{
+		CallSign: callSign,
+		Operator: ptr("Qantas"),
+		Segments: []export.Segment{{ICAOCode: "YPPH"}, {ICAOCode: "YSSY"}},
+	}, nil
+}
+
+func TestEnricher_Enrich(t *testing.T) {
+	lookup := &fakeLookup{}
+	e := NewEnricher(lookup)
+
+	for i := 0; i < 3; i++ {
+		loc := export.PlaneLocation{Icao: "7c4516", CallSign: ptr("QFA123 ")}
+		e.Enrich(&loc)
+		if "VH-EBA" != *loc.Registration || "A332" != *loc.TypeCode {
+			t.Fatalf("expected aircraft details, got %+v", loc)
+		}
+		if "Qantas" != *loc.Operator || 2 != len(loc.Segments) {
+			t.Fatalf("expected route details, got %+v", loc)
+		}
+	}
+	if 1 != lookup.aircraftCalls.Load() || 1 != lookup.routeCalls.Load() {
+		t.Errorf("expected a single lookup of each, got %d and %d", lookup.aircraftCalls.Load(), lookup.routeCalls.Load())
+	}
+	if s := e.Stats(); 4 != s.Hits || 2 != s.Misses {
+		t.Errorf("incorrect stats %+v", s)
+	}
+}
+
+func TestEnricher_NegativeCache(t *testing.T) {
+	lookup := &fakeLookup{}
+	now := time.Now()
+	e := NewEnricher(lookup, WithNegativeTTL(time.Minute))
+	e.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if nil != e.Aircraft("ABCDEF") {
+			t.Fatalf("expected to know nothing about ABCDEF")
+		}
+	}
+	if 1 != lookup.aircraftCalls.Load() {
+		t.Errorf("expected not found to be cached, got %d lookups", lookup.aircraftCalls.Load())
+	}
+
+	now = now.Add(2 * time.Minute)
+	e.Aircraft("ABCDEF")
+	if 2 != lookup.aircraftCalls.Load() {
+		t.Errorf("expected the negative cache entry to expire")
+	}
+}
+
+func TestEnricher_Coalesce(t *testing.T) {
+	lookup := &fakeLookup{release: make(chan struct{})}
+	e := NewEnricher(lookup)
+
+	var wg sync.WaitGroup
+	results := make([]*export.Aircraft, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = e.Aircraft("7C4516")
+		}(i)
+	}
+	// give everyone a chance to pile up behind the first request
+	time.Sleep(50 * time.Millisecond)
+	close(lookup.release)
+	wg.Wait()
+
+	if 1 != lookup.aircraftCalls.Load() {
+		t.Errorf("expected concurrent requests to be coalesced, got %d lookups", lookup.aircraftCalls.Load())
+	}
+	for i, r := range results {
+		if nil == r {
+			t.Errorf("result %d is missing", i)
+		}
+	}
+}
+
+func TestEnricher_PassThrough(t *testing.T) {
+	lookup := &fakeLookup{}
+	lookup.fail.Store(true)
+	now := time.Now()
+	e := NewEnricher(lookup, WithBackoff(10*time.Second))
+	e.now = func() time.Time { return now }
+
+	loc := export.PlaneLocation{Icao: "7C4516", CallSign: ptr("QFA123")}
+	e.Enrich(&loc)
+	e.Enrich(&loc)
+	if nil != loc.Registration || nil != loc.Operator {
+		t.Errorf("expected the location to pass through untouched")
+	}
+	if 1 != lookup.aircraftCalls.Load()+lookup.routeCalls.Load() {
+		t.Errorf("expected us to stop asking once the API failed")
+	}
+
+	lookup.fail.Store(false)
+	now = now.Add(11 * time.Second)
+	e.Enrich(&loc)
+	if nil == loc.Registration {
+		t.Errorf("expected enrichment once the API is back")
+	}
+}
+
+func TestCache_Bounded(t *testing.T) {
+	c := newCache[int](2)
+	now := time.Now()
+	c.set("a", ptr(1), time.Minute, now)
+	c.set("b", ptr(2), 2*time.Minute, now)
+	c.set("c", ptr(3), 3*time.Minute, now)
+	if 2 != c.len() {
+		t.Fatalf("expected the cache to stay at 2 entries, got %d", c.len())
+	}
+	if _, ok := c.get("a", now); ok {
+		t.Errorf("expected the entry closest to expiring to be evicted")
+	}
+	if v, ok := c.get("c", now); !ok || 3 != *v {
+		t.Errorf("expected the newest entry to be cached")
+	}
+}
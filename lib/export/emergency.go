@@ -0,0 +1,101 @@
+package export
+
+import (
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"plane.watch/lib/tracker"
+)
+
+const (
+	EmergencyStateStart = "start"
+	EmergencyStateEnd   = "end"
+)
+
+type (
+	// EmergencyEvent is published whenever an aircraft starts or stops telling us about an emergency
+	EmergencyEvent struct {
+		Icao         string
+		CallSign     *string `json:",omitempty"`
+		Registration *string `json:",omitempty"`
+		FlightId     string  `json:",omitempty"`
+
+		// Reason is one of the tracker.Emergency* reason codes
+		Reason      string
+		Description string
+		// State is either EmergencyStateStart or EmergencyStateEnd
+		State  string
+		Squawk string
+
+		Lat          float64
+		Lon          float64
+		HasLocation  bool
+		Altitude     int
+		TileLocation string
+		SourceTag    string
+
+		At time.Time
+	}
+)
+
+// EmergencyChanges works out which emergencies have started and ended between prev and next.
+// prev can be nil for a plane we have not seen before
+func EmergencyChanges(prev, next *PlaneLocation) []EmergencyEvent {
+	if nil == next {
+		return nil
+	}
+	before := map[string]bool{}
+	if nil != prev {
+		for _, reason := range prev.Emergencies {
+			before[reason] = true
+		}
+	}
+	after := map[string]bool{}
+	for _, reason := range next.Emergencies {
+		after[reason] = true
+	}
+
+	var events []EmergencyEvent
+	for _, reason := range next.Emergencies {
+		if !before[reason] {
+			events = append(events, newEmergencyEvent(next, reason, EmergencyStateStart))
+		}
+	}
+	if nil != prev {
+		for _, reason := range prev.Emergencies {
+			if !after[reason] {
+				events = append(events, newEmergencyEvent(next, reason, EmergencyStateEnd))
+			}
+		}
+	}
+	return events
+}
+
+func newEmergencyEvent(loc *PlaneLocation, reason, state string) EmergencyEvent {
+	at := loc.Updates.Emergency
+	if at.IsZero() {
+		at = loc.LastMsg
+	}
+	return EmergencyEvent{
+		Icao:         loc.Icao,
+		CallSign:     loc.CallSign,
+		Registration: loc.Registration,
+		FlightId:     loc.FlightId,
+		Reason:       reason,
+		Description:  tracker.EmergencyDescription(reason),
+		State:        state,
+		Squawk:       loc.SquawkStr(),
+		Lat:          loc.Lat,
+		Lon:          loc.Lon,
+		HasLocation:  loc.HasLocation,
+		Altitude:     loc.Altitude,
+		TileLocation: loc.TileLocation,
+		SourceTag:    loc.SourceTag,
+		At:           at,
+	}
+}
+
+func (ee *EmergencyEvent) ToJSONBytes() ([]byte, error) {
+	json := jsoniter.ConfigFastest
+	return json.Marshal(ee)
+}
@@ -0,0 +1,57 @@
+package export
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEmergencyChanges(t *testing.T) {
+	now := time.Now()
+	prev := PlaneLocation{Icao: "7C4516", Squawk: "7700", Emergencies: []string{"general", "ident"}}
+	next := PlaneLocation{Icao: "7C4516", Squawk: "7700", Emergencies: []string{"general", "medical"}}
+	next.Updates.Emergency = now
+
+	events := EmergencyChanges(&prev, &next)
+	if 2 != len(events) {
+		t.Fatalf("expected 2 changes, got %d", len(events))
+	}
+	if "medical" != events[0].Reason || EmergencyStateStart != events[0].State {
+		t.Errorf("expected medical to start, got %+v", events[0])
+	}
+	if "ident" != events[1].Reason || EmergencyStateEnd != events[1].State {
+		t.Errorf("expected ident to end, got %+v", events[1])
+	}
+	if !events[0].At.Equal(now) || "" == events[0].Description {
+		t.Errorf("incorrect event details %+v", events[0])
+	}
+
+	if 0 != len(EmergencyChanges(&next, &next)) {
+		t.Errorf("expected no changes for the same location")
+	}
+	if 2 != len(EmergencyChanges(nil, &next)) {
+		t.Errorf("expected a new plane to start all of its emergencies")
+	}
+}
+
+func TestMergeEmergencies(t *testing.T) {
+	start := time.Now()
+	prev := PlaneLocation{Icao: "7C4516", Emergencies: []string{"general"}, Updates: Updates{Emergency: start}}
+	// a feeder that never saw the emergency should not clear it
+	stale := PlaneLocation{Icao: "7C4516"}
+	merged, err := MergePlaneLocations(prev, stale)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(merged.Emergencies) {
+		t.Errorf("expected the emergency to survive a merge with an older update")
+	}
+
+	ended := PlaneLocation{Icao: "7C4516", Updates: Updates{Emergency: start.Add(time.Minute)}}
+	merged, err = MergePlaneLocations(merged, ended)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 0 != len(merged.Emergencies) {
+		t.Errorf("expected the emergency to end, got %v", merged.Emergencies)
+	}
+}
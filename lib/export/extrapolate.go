@@ -0,0 +1,49 @@
+package export
+
+import (
+	"time"
+
+	"plane.watch/lib/geo"
+	"plane.watch/lib/tile_grid"
+)
+
+// Extrapolate dead reckons where this aircraft should be at the given time, based on its last known position, heading,
+// velocity and vertical rate. It returns a copy of the location with PositionExtrapolated and PositionAge set.
+// false is returned if we cannot (or should not) extrapolate. e.g. the aircraft is on the ground, we are missing
+// data or the last position is older than maxAge.
+func (pl *PlaneLocation) Extrapolate(at time.Time, maxAge time.Duration) (PlaneLocation, bool) {
+	if nil == pl || !pl.HasLocation || !pl.HasHeading || !pl.HasVelocity {
+		return PlaneLocation{}, false
+	}
+	if pl.HasOnGround && pl.OnGround {
+		// taxiing aircraft stop and turn far too often for this to be useful
+		return PlaneLocation{}, false
+	}
+	if pl.Removed || pl.Updates.Location.IsZero() {
+		return PlaneLocation{}, false
+	}
+
+	age := at.Sub(pl.Updates.Location)
+	if age <= 0 || age > maxAge {
+		return PlaneLocation{}, false
+	}
+
+	out := *pl
+	out.New = false
+	distance := pl.Velocity * geo.KnotsToMetresPerSecond * age.Seconds()
+	out.Lat, out.Lon = geo.Destination(pl.Lat, pl.Lon, pl.Heading, distance)
+
+	if pl.HasAltitude && pl.HasVerticalRate && pl.VerticalRate != 0 {
+		// vertical rate is in feet per minute
+		out.Altitude = pl.Altitude + int(float64(pl.VerticalRate)*age.Minutes())
+		if out.Altitude < 0 {
+			out.Altitude = 0
+		}
+	}
+
+	out.TileLocation = tile_grid.LookupTile(out.Lat, out.Lon).Tile
+	out.PositionExtrapolated = true
+	out.PositionAge = age.Seconds()
+
+	return out, true
+}
@@ -0,0 +1,94 @@
+package export
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"plane.watch/lib/geo"
+)
+
+func TestPlaneLocation_Extrapolate(t *testing.T) {
+	now := time.Date(2023, time.January, 9, 19, 0, 0, 0, time.UTC)
+	cruising := PlaneLocation{
+		Icao:            "7C4516",
+		Lat:             -31.9403,
+		Lon:             115.967003,
+		Heading:         90,
+		Velocity:        450,
+		Altitude:        35000,
+		VerticalRate:    -1000,
+		HasLocation:     true,
+		HasHeading:      true,
+		HasVelocity:     true,
+		HasAltitude:     true,
+		HasVerticalRate: true,
+		HasOnGround:     true,
+		Updates:         Updates{Location: now.Add(-time.Minute)},
+	}
+
+	t.Run("cruising", func(t *testing.T) {
+		got, ok := cruising.Extrapolate(now, 5*time.Minute)
+		if !ok {
+			t.Fatal("expected to extrapolate")
+		}
+		if !got.PositionExtrapolated {
+			t.Error("expected PositionExtrapolated to be set")
+		}
+		if got.PositionAge != 60 {
+			t.Errorf("expected a position age of 60 seconds, got %0.2f", got.PositionAge)
+		}
+		// 450 knots for one minute
+		expected := 450 * geo.KnotsToMetresPerSecond * 60
+		if d := geo.Distance(cruising.Lat, cruising.Lon, got.Lat, got.Lon); math.Abs(d-expected) > 1 {
+			t.Errorf("expected to travel %0.2fm, travelled %0.2fm", expected, d)
+		}
+		if got.Lon <= cruising.Lon {
+			t.Errorf("expected to head east")
+		}
+		if got.Altitude != 34000 {
+			t.Errorf("expected to descend to 34000, got %d", got.Altitude)
+		}
+		if cruising.PositionExtrapolated {
+			t.Error("should not have modified the original")
+		}
+	})
+
+	t.Run("too-old", func(t *testing.T) {
+		if _, ok := cruising.Extrapolate(now, 30*time.Second); ok {
+			t.Error("should not extrapolate a position older than max age")
+		}
+	})
+
+	t.Run("on-ground", func(t *testing.T) {
+		onGround := cruising
+		onGround.OnGround = true
+		if _, ok := onGround.Extrapolate(now, 5*time.Minute); ok {
+			t.Error("should not extrapolate aircraft on the ground")
+		}
+	})
+
+	t.Run("no-heading", func(t *testing.T) {
+		noHeading := cruising
+		noHeading.HasHeading = false
+		if _, ok := noHeading.Extrapolate(now, 5*time.Minute); ok {
+			t.Error("should not extrapolate without a heading")
+		}
+	})
+
+	t.Run("merge-ignores-extrapolated", func(t *testing.T) {
+		guess, _ := cruising.Extrapolate(now, 5*time.Minute)
+		guess.Updates.Location = now
+		guess.LastMsg = now
+		merged, err := MergePlaneLocations(cruising, guess)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if merged.Lat != cruising.Lat || merged.Lon != cruising.Lon {
+			t.Error("an extrapolated position should never replace a real one")
+		}
+		if merged.PositionExtrapolated {
+			t.Error("merged location should not be marked as extrapolated")
+		}
+	})
+}
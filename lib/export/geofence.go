@@ -0,0 +1,38 @@
+package export
+
+import (
+	jsoniter "github.com/json-iterator/go"
+)
+
+const (
+	// GeofenceEventEnter is sent the first time an aircraft is seen inside a geofence
+	GeofenceEventEnter = "enter"
+	// GeofenceEventInside is sent for every update while an aircraft stays inside a geofence
+	GeofenceEventInside = "inside"
+	// GeofenceEventExit is sent when an aircraft leaves a geofence, or we lose track of it while it is inside
+	GeofenceEventExit = "exit"
+
+	// NatsGeofencePrefix is where pw_router publishes geofence events, to geofence.<id>
+	NatsGeofencePrefix = "geofence."
+)
+
+type (
+	// GeofenceEvent is published to geofence.<id> for every update of an aircraft inside (or leaving) the geofence
+	GeofenceEvent struct {
+		Fence string
+		Name  string `json:",omitempty"`
+		// Event is one of GeofenceEventEnter, GeofenceEventInside or GeofenceEventExit
+		Event    string
+		Location PlaneLocation
+	}
+)
+
+// GeofenceSubject is the subject events for the given geofence are published to
+func GeofenceSubject(fenceId string) string {
+	return NatsGeofencePrefix + fenceId
+}
+
+func (ge *GeofenceEvent) ToJSONBytes() ([]byte, error) {
+	json := jsoniter.ConfigFastest
+	return json.Marshal(ge)
+}
@@ -29,6 +29,7 @@ func NewPlaneLocation(plane *tracker.Plane, isNew, isRemoved bool, source string
 		AirframeType:    plane.AirFrameType(),
 		Squawk:          plane.SquawkIdentityStr(),
 		Special:         plane.Special(),
+		Emergencies:     plane.Emergencies(),
 		AircraftWidth:   plane.AirFrameWidth(),
 		AircraftLength:  plane.AirFrameLength(),
 		Registration:    plane.Registration(),
@@ -54,6 +55,7 @@ func NewPlaneLocation(plane *tracker.Plane, isNew, isRemoved bool, source string
 			FlightStatus: plane.FlightStatusUpdatedAt().UTC(),
 			Special:      plane.SpecialUpdatedAt().UTC(),
 			Squawk:       plane.SquawkUpdatedAt().UTC(),
+			Emergency:    plane.EmergencyUpdatedAt().UTC(),
 		},
 		sourceTagsMutex: &sync.Mutex{},
 	}
@@ -62,8 +64,10 @@ func NewPlaneLocation(plane *tracker.Plane, isNew, isRemoved bool, source string
 func (pl *PlaneLocation) ToJSONBytes() ([]byte, error) {
 	json := jsoniter.ConfigFastest
 
-	pl.sourceTagsMutex.Lock()
-	defer pl.sourceTagsMutex.Unlock()
+	if nil != pl.sourceTagsMutex {
+		pl.sourceTagsMutex.Lock()
+		defer pl.sourceTagsMutex.Unlock()
+	}
 
 	jsonBuf, err := json.Marshal(pl)
 	if nil != err {
@@ -2,22 +2,47 @@ package export
 
 import (
 	"github.com/google/uuid"
+	"plane.watch/lib/coverage"
 	"time"
 )
 
 const (
 	// NatsApiSearchAirportV1 is the Nats API for searching for an airport
 	NatsApiSearchAirportV1 = "v1.search.airport"
-	// NatsApiSearchRouteV1 is teh Nats API for searching for route info
+	// NatsApiSearchRouteV1 is the Nats API for searching for routes, by callsign or an airport they fly to
 	NatsApiSearchRouteV1 = "v1.search.route"
+	// NatsApiSearchOperatorV1 is the Nats API for searching for operators (airlines), by name or code
+	NatsApiSearchOperatorV1 = "v1.search.operator"
 
 	// NatsApiEnrichAircraftV1 is the Nats API for requesting additional Enrichment data
 	NatsApiEnrichAircraftV1 = "v1.enrich.aircraft"
 	// NatsApiEnrichRouteV1 is the request name for enriching a  route
 	NatsApiEnrichRouteV1 = "v1.enrich.routes"
 
+	// NatsApiAirportListV1 gets every airport we know about, with its location
+	NatsApiAirportListV1 = "v1.airport.list"
+
 	NatsApiFeederListV1        = "v1.feeder.list"
 	NatsApiFeederStatsUpdateV1 = "v1.feeder.update-stats"
+	// NatsApiFeederTrustV1 lists how much pw_router trusts each feeder
+	NatsApiFeederTrustV1 = "v1.feeder.trust"
+
+	// NatsApiCoverageFeederV1 gets the receiver coverage for a single feeder
+	NatsApiCoverageFeederV1 = "v1.coverage.feeder"
+	// NatsApiCoverageGeoJsonV1 gets the receiver coverage for a single feeder as a GeoJSON feature collection
+	NatsApiCoverageGeoJsonV1 = "v1.coverage.geojson"
+	// NatsApiCoverageListV1 gets a summary of the coverage of every feeder
+	NatsApiCoverageListV1 = "v1.coverage.list"
+
+	// NatsApiGeofenceAddV1 adds (or replaces) a geofence in pw_router
+	NatsApiGeofenceAddV1 = "v1.geofence.add"
+	// NatsApiGeofenceRemoveV1 removes a geofence by id
+	NatsApiGeofenceRemoveV1 = "v1.geofence.remove"
+	// NatsApiGeofenceListV1 lists every geofence pw_router is checking updates against
+	NatsApiGeofenceListV1 = "v1.geofence.list"
+
+	// NatsCoverageUpdates is where pw_ingest publishes the coverage it has accumulated
+	NatsCoverageUpdates = "coverage-updates"
 )
 
 type (
@@ -64,6 +89,13 @@ type (
 		Segments  []Segment
 	}
 
+	// Operator is who flies a route, an airline
+	Operator struct {
+		IcaoCode string `db:"icao_code"`
+		IataCode string `db:"iata_code"`
+		Name     string `db:"name"`
+	}
+
 	Feeders []Feeder
 	Feeder  struct { // part of schema for /api/v1/feeders.json atc endpoint
 		Id            int       `db:"id"`
@@ -79,6 +111,25 @@ type (
 		Mux           string    `db:"container_name"`
 	}
 
+	// FeederCoverage is what a feeder can see, along with how far their reference position is from where they
+	// told us they are
+	FeederCoverage struct {
+		coverage.Coverage
+		// ReferenceOffset is the distance in metres between the feeders registered location and the reference
+		// location we decode with. Large values mean a misconfigured feeder
+		ReferenceOffset *float64 `json:",omitempty"`
+	}
+
+	// FeederCoverageSummary is the short version of FeederCoverage, without the bins
+	FeederCoverageSummary struct {
+		SourceTag       string
+		Count           uint64
+		Rejected        uint64
+		MaxRange        float64
+		ReferenceOffset *float64 `json:",omitempty"`
+		LastSeen        time.Time
+	}
+
 	FeederUpdates []FeederUpdate
 	FeederUpdate  struct {
 		ApiKey   string
@@ -23,6 +23,7 @@ type (
 		FlightStatus time.Time
 		Special      time.Time
 		Squawk       time.Time
+		Emergency    time.Time
 	}
 
 	// PlaneLocation is our exported data format. it encodes to JSON
@@ -54,18 +55,38 @@ type (
 		Special         string
 		TileLocation    string
 
+		// Emergencies is the list of emergency reason codes currently in effect (see tracker.Emergency*)
+		Emergencies []string `json:",omitempty"`
+
 		SourceTags      map[string]uint32 `json:",omitempty"`
 		sourceTagsMutex *sync.Mutex
 
+		// locationTrust and altitudeTrust are how much we trusted the source of the current location and altitude
+		locationTrust float64
+		altitudeTrust float64
+
 		// TrackedSince is when we first started tracking this aircraft *this time*
 		TrackedSince time.Time
 
+		// FlightId identifies the leg this aircraft is currently flying, assigned by pw_router
+		FlightId string `json:",omitempty"`
+
+		// Airport is the ICAO code of the airport an on-ground aircraft is at, assigned by pw_router
+		Airport string `json:",omitempty"`
+		// SurfaceState is what the aircraft is doing at the airport (gate, pushback, taxi, runway)
+		SurfaceState string `json:",omitempty"`
+
 		// LastMsg is the last time we heard from this aircraft
 		LastMsg time.Time
 
 		// Updates contains the list of individual fields that contain updated time stamps for various fields
 		Updates Updates
 
+		// PositionExtrapolated is true when Lat/Lon (and Altitude) have been dead reckoned from the last known position
+		PositionExtrapolated bool `json:",omitempty"`
+		// PositionAge is how many seconds old the last received position was when we extrapolated it
+		PositionAge float64 `json:",omitempty"`
+
 		SignalRssi *float64
 
 		AircraftWidth  *float32 `json:",omitempty"`
@@ -93,8 +114,15 @@ type (
 		Name     string
 		ICAOCode string
 	}
+
+	// SourceTrust tells MergePlaneLocationsTrusted how much to trust a source, from 0 (not at all) to 1 (completely)
+	SourceTrust func(sourceTag string) float64
 )
 
+// MaxTrustGrace is how much newer a location (or altitude) from an untrusted source has to be before it replaces one
+// from a completely trusted source. Sources in between get a proportional grace
+const MaxTrustGrace = 5 * time.Second
+
 var (
 	ErrImpossible = errors.New("impossible location")
 )
@@ -113,6 +141,10 @@ func (pl *PlaneLocation) Plane() string {
 }
 
 func (pl *PlaneLocation) CloneSourceTags() map[string]uint32 {
+	if nil == pl.sourceTagsMutex {
+		// freshly unmarshalled, nobody else has a hold of this yet
+		return Clone(pl.SourceTags)
+	}
 	pl.sourceTagsMutex.Lock()
 	defer pl.sourceTagsMutex.Unlock()
 
@@ -165,12 +197,33 @@ func ptr[t any](what t) *t {
 }
 
 func MergePlaneLocations(prev, next PlaneLocation) (PlaneLocation, error) {
+	return MergePlaneLocationsTrusted(prev, next, nil)
+}
+
+// trustedAfter is next.After(prev), except that a less trusted source has to be newer by some grace
+func trustedAfter(next, prev time.Time, nextTrust, prevTrust float64) bool {
+	if prevTrust > nextTrust {
+		prev = prev.Add(time.Duration((prevTrust - nextTrust) * float64(MaxTrustGrace)))
+	}
+	return next.After(prev)
+}
+
+// MergePlaneLocationsTrusted merges next into prev, taking the newest value of each field. When trust is given,
+// a location or altitude from a less trusted source only replaces one from a more trusted source once it is
+// sufficiently newer (see MaxTrustGrace), so one misbehaving feeder cannot hijack a track
+func MergePlaneLocationsTrusted(prev, next PlaneLocation, trust SourceTrust) (PlaneLocation, error) {
 	if !IsLocationPossible(prev, next) {
 		return prev, ErrImpossible
 	}
+	nextTrust := 1.0
+	if nil != trust {
+		nextTrust = trust(next.SourceTag)
+	}
 	merged := prev
 	merged.New = false
 	merged.Removed = false
+	merged.PositionExtrapolated = false
+	merged.PositionAge = 0
 	merged.LastMsg = next.LastMsg
 	merged.SignalRssi = nil // makes no sense to merge this value as it is for the individual receiver
 	if nil == merged.sourceTagsMutex {
@@ -187,11 +240,13 @@ func MergePlaneLocations(prev, next PlaneLocation) (PlaneLocation, error) {
 		merged.TrackedSince = next.TrackedSince
 	}
 
-	if next.HasLocation && next.Updates.Location.After(prev.Updates.Location) {
+	// an extrapolated position is a guess, never let it overwrite a real one
+	if next.HasLocation && !next.PositionExtrapolated && trustedAfter(next.Updates.Location, prev.Updates.Location, nextTrust, prev.locationTrust) {
 		merged.Lat = next.Lat
 		merged.Lon = next.Lon
 		merged.Updates.Location = next.Updates.Location
 		merged.HasLocation = true
+		merged.locationTrust = nextTrust
 	}
 	if next.HasHeading && next.Updates.Heading.After(prev.Updates.Heading) {
 		merged.Heading = next.Heading
@@ -203,11 +258,12 @@ func MergePlaneLocations(prev, next PlaneLocation) (PlaneLocation, error) {
 		merged.Updates.Velocity = next.Updates.Velocity
 		merged.HasVelocity = true
 	}
-	if next.HasAltitude && next.Updates.Altitude.After(prev.Updates.Altitude) {
+	if next.HasAltitude && trustedAfter(next.Updates.Altitude, prev.Updates.Altitude, nextTrust, prev.altitudeTrust) {
 		merged.Altitude = next.Altitude
 		merged.AltitudeUnits = next.AltitudeUnits
 		merged.Updates.Altitude = next.Updates.Altitude
 		merged.HasAltitude = true
+		merged.altitudeTrust = nextTrust
 	}
 	if next.HasVerticalRate && next.Updates.VerticalRate.After(prev.Updates.VerticalRate) {
 		merged.VerticalRate = next.VerticalRate
@@ -255,6 +311,10 @@ func MergePlaneLocations(prev, next PlaneLocation) (PlaneLocation, error) {
 		merged.Special = next.Special
 		merged.Updates.Special = next.Updates.Special
 	}
+	if next.Updates.Emergency.After(prev.Updates.Emergency) {
+		merged.Emergencies = next.Emergencies
+		merged.Updates.Emergency = next.Updates.Emergency
+	}
 
 	if next.TileLocation != "" {
 		merged.TileLocation = next.TileLocation
@@ -179,3 +179,45 @@ func TestPlaneLocation_PrepareSourceTags(t *testing.T) {
 		})
 	}
 }
+
+func TestMergePlaneLocationsTrusted(t *testing.T) {
+	t0 := time.Date(2023, time.January, 9, 19, 0, 0, 0, time.UTC)
+	trust := func(sourceTag string) float64 {
+		if "bad" == sourceTag {
+			return 0
+		}
+		return 1
+	}
+	at := func(source string, lat float64, when time.Time) PlaneLocation {
+		return PlaneLocation{
+			SourceTag:   source,
+			Lat:         lat,
+			HasLocation: true,
+			LastMsg:     when,
+			Updates:     Updates{Location: when},
+		}
+	}
+
+	merged, err := MergePlaneLocationsTrusted(PlaneLocation{}, at("good", -31.9, t0), trust)
+	if nil != err || -31.9 != merged.Lat {
+		t.Fatalf("expected the first location to be taken, got %f (%v)", merged.Lat, err)
+	}
+
+	// a newer location from an untrusted feeder does not replace a recent trusted one
+	merged, _ = MergePlaneLocationsTrusted(merged, at("bad", 10, t0.Add(time.Second)), trust)
+	if -31.9 != merged.Lat {
+		t.Errorf("expected the untrusted location to be ignored, got %f", merged.Lat)
+	}
+
+	// but it does once the trusted one is old enough
+	merged, _ = MergePlaneLocationsTrusted(merged, at("bad", 10, t0.Add(MaxTrustGrace+time.Second)), trust)
+	if 10 != merged.Lat {
+		t.Errorf("expected the untrusted location to be used once the trusted one is stale, got %f", merged.Lat)
+	}
+
+	// without trust, newest wins
+	merged, _ = MergePlaneLocations(at("good", -31.9, t0), at("bad", 10, t0.Add(time.Second)))
+	if 10 != merged.Lat {
+		t.Errorf("expected the newest location without trust, got %f", merged.Lat)
+	}
+}
@@ -0,0 +1,526 @@
+package export
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// HeaderContentType is the NATS header that says how a PlaneLocation was encoded. No header means JSON
+	HeaderContentType = "content-type"
+
+	// ContentTypeJSON is the JSON encoding of a PlaneLocation, what we have always sent
+	ContentTypeJSON = "application/json"
+	// ContentTypeProtobuf is the binary encoding of a PlaneLocation, see plane_location.proto
+	ContentTypeProtobuf = "application/x-protobuf; proto=planewatch.v1.PlaneLocation"
+
+	// WireFormatJSON and WireFormatProtobuf are the names we accept on the command line
+	WireFormatJSON     = "json"
+	WireFormatProtobuf = "protobuf"
+)
+
+var (
+	ErrUnknownWireFormat  = errors.New("unknown wire format")
+	ErrUnknownContentType = errors.New("unknown content type")
+	ErrInvalidProtobuf    = errors.New("invalid protobuf plane location")
+)
+
+// ParseWireFormat turns the name of a wire format (json or protobuf) into its content type
+func ParseWireFormat(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "", WireFormatJSON:
+		return ContentTypeJSON, nil
+	case WireFormatProtobuf, "proto", "pb":
+		return ContentTypeProtobuf, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownWireFormat, format)
+}
+
+// IsProtobuf tells us if the content type is our binary encoding, parameters other than proto= are ignored
+func IsProtobuf(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(strings.ToLower(mediaType))
+	return "application/x-protobuf" == mediaType || "application/protobuf" == mediaType
+}
+
+// Encode encodes the PlaneLocation with the given content type
+func (pl *PlaneLocation) Encode(contentType string) ([]byte, error) {
+	if IsProtobuf(contentType) {
+		return pl.ToProtobufBytes()
+	}
+	return pl.ToJSONBytes()
+}
+
+// DecodePlaneLocation decodes data sent with the given content type into pl. An empty content type is JSON,
+// so everything still sending without the header keeps working
+func DecodePlaneLocation(contentType string, data []byte, pl *PlaneLocation) error {
+	if IsProtobuf(contentType) {
+		return pl.FromProtobufBytes(data)
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch strings.TrimSpace(strings.ToLower(mediaType)) {
+	case "", ContentTypeJSON:
+		return jsoniter.ConfigFastest.Unmarshal(data, pl)
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownContentType, contentType)
+}
+
+// protobuf field numbers, these must match plane_location.proto (TestWire_MatchesProto checks they do)
+const (
+	pbIcao protowire.Number = iota + 1
+	pbLat
+	pbLon
+	pbHeading
+	pbVelocity
+	pbAltitude
+	pbVerticalRate
+	pbNew
+	pbRemoved
+	pbOnGround
+	pbHasAltitude
+	pbHasLocation
+	pbHasHeading
+	pbHasOnGround
+	pbHasFlightStatus
+	pbHasVerticalRate
+	pbHasVelocity
+	pbAltitudeUnits
+	pbFlightStatus
+	pbAirframe
+	pbAirframeType
+	pbSourceTag
+	pbSquawk
+	pbSpecial
+	pbTileLocation
+	pbEmergencies
+	pbSourceTags
+	pbTrackedSince
+	pbFlightId
+	pbAirport
+	pbSurfaceState
+	pbLastMsg
+	pbUpdates
+	pbPositionExtrapolated
+	pbPositionAge
+	pbSignalRssi
+	pbAircraftWidth
+	pbAircraftLength
+	pbIcaoCode
+	pbRegistration
+	pbTypeCode
+	pbTypeCodeLong
+	pbSerial
+	pbRegisteredOwner
+	pbCOFAOwner
+	pbEngineType
+	pbFlagCode
+	pbCallSign
+	pbOperator
+	pbRouteCode
+	pbSegments
+)
+
+type pbBuf []byte
+
+func (b pbBuf) string(num protowire.Number, s string) pbBuf {
+	if "" == s {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func (b pbBuf) optString(num protowire.Number, s *string) pbBuf {
+	if nil == s {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, *s)
+}
+
+func (b pbBuf) double(num protowire.Number, f float64) pbBuf {
+	if 0 == f {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(f))
+}
+
+func (b pbBuf) float(num protowire.Number, f *float32) pbBuf {
+	if nil == f {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, math.Float32bits(*f))
+}
+
+func (b pbBuf) sint(num protowire.Number, i int) pbBuf {
+	if 0 == i {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, protowire.EncodeZigZag(int64(i)))
+}
+
+func (b pbBuf) bool(num protowire.Number, v bool) pbBuf {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+// time is sent as nanoseconds since the epoch, with the zero time left out
+func (b pbBuf) time(num protowire.Number, t time.Time) pbBuf {
+	if t.IsZero() {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(t.UnixNano()))
+}
+
+func (b pbBuf) message(num protowire.Number, m pbBuf) pbBuf {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// ToProtobufBytes encodes the PlaneLocation in our binary wire format (see plane_location.proto)
+func (pl *PlaneLocation) ToProtobufBytes() ([]byte, error) {
+	b := make(pbBuf, 0, 256)
+	b = b.string(pbIcao, pl.Icao).
+		double(pbLat, pl.Lat).
+		double(pbLon, pl.Lon).
+		double(pbHeading, pl.Heading).
+		double(pbVelocity, pl.Velocity).
+		sint(pbAltitude, pl.Altitude).
+		sint(pbVerticalRate, pl.VerticalRate).
+		bool(pbNew, pl.New).
+		bool(pbRemoved, pl.Removed).
+		bool(pbOnGround, pl.OnGround).
+		bool(pbHasAltitude, pl.HasAltitude).
+		bool(pbHasLocation, pl.HasLocation).
+		bool(pbHasHeading, pl.HasHeading).
+		bool(pbHasOnGround, pl.HasOnGround).
+		bool(pbHasFlightStatus, pl.HasFlightStatus).
+		bool(pbHasVerticalRate, pl.HasVerticalRate).
+		bool(pbHasVelocity, pl.HasVelocity).
+		string(pbAltitudeUnits, pl.AltitudeUnits).
+		string(pbFlightStatus, pl.FlightStatus).
+		string(pbAirframe, pl.Airframe).
+		string(pbAirframeType, pl.AirframeType).
+		string(pbSourceTag, pl.SourceTag).
+		string(pbSquawk, pl.Squawk).
+		string(pbSpecial, pl.Special).
+		string(pbTileLocation, pl.TileLocation)
+
+	for _, e := range pl.Emergencies {
+		b = protowire.AppendTag(b, pbEmergencies, protowire.BytesType)
+		b = protowire.AppendString(b, e)
+	}
+
+	if nil != pl.sourceTagsMutex {
+		pl.sourceTagsMutex.Lock()
+	}
+	var entry pbBuf
+	for k, v := range pl.SourceTags {
+		entry = protowire.AppendTag(entry[:0], 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, 2, protowire.VarintType)
+		entry = protowire.AppendVarint(entry, uint64(v))
+		b = b.message(pbSourceTags, entry)
+	}
+	if nil != pl.sourceTagsMutex {
+		pl.sourceTagsMutex.Unlock()
+	}
+
+	b = b.time(pbTrackedSince, pl.TrackedSince).
+		string(pbFlightId, pl.FlightId).
+		string(pbAirport, pl.Airport).
+		string(pbSurfaceState, pl.SurfaceState).
+		time(pbLastMsg, pl.LastMsg)
+
+	u := make(pbBuf, 0, 100).
+		time(1, pl.Updates.Location).
+		time(2, pl.Updates.Altitude).
+		time(3, pl.Updates.Velocity).
+		time(4, pl.Updates.Heading).
+		time(5, pl.Updates.OnGround).
+		time(6, pl.Updates.VerticalRate).
+		time(7, pl.Updates.FlightStatus).
+		time(8, pl.Updates.Special).
+		time(9, pl.Updates.Squawk).
+		time(10, pl.Updates.Emergency)
+	if len(u) > 0 {
+		b = b.message(pbUpdates, u)
+	}
+
+	b = b.bool(pbPositionExtrapolated, pl.PositionExtrapolated).
+		double(pbPositionAge, pl.PositionAge)
+	if nil != pl.SignalRssi {
+		// optional, so 0 is still sent
+		b = protowire.AppendTag(b, pbSignalRssi, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(*pl.SignalRssi))
+	}
+	b = b.float(pbAircraftWidth, pl.AircraftWidth).
+		float(pbAircraftLength, pl.AircraftLength).
+		optString(pbIcaoCode, pl.IcaoCode).
+		optString(pbRegistration, pl.Registration).
+		optString(pbTypeCode, pl.TypeCode).
+		optString(pbTypeCodeLong, pl.TypeCodeLong).
+		optString(pbSerial, pl.Serial).
+		optString(pbRegisteredOwner, pl.RegisteredOwner).
+		optString(pbCOFAOwner, pl.COFAOwner).
+		optString(pbEngineType, pl.EngineType).
+		optString(pbFlagCode, pl.FlagCode).
+		optString(pbCallSign, pl.CallSign).
+		optString(pbOperator, pl.Operator).
+		optString(pbRouteCode, pl.RouteCode)
+
+	for _, s := range pl.Segments {
+		b = b.message(pbSegments, make(pbBuf, 0, 32).string(1, s.Name).string(2, s.ICAOCode))
+	}
+	return b, nil
+}
+
+// pbField is one field from a protobuf message, only the member for its wire type is set
+type pbField struct {
+	num   protowire.Number
+	typ   protowire.Type
+	value uint64
+	bytes []byte
+}
+
+// eachField calls fn for every field in the message, fields we do not know about are for fn to ignore
+func eachField(b []byte, fn func(f pbField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %s", ErrInvalidProtobuf, protowire.ParseError(n))
+		}
+		b = b[n:]
+		f := pbField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.value = uint64(v)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: field %d: %s", ErrInvalidProtobuf, num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		if err := fn(f); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f pbField) string() string {
+	return string(f.bytes)
+}
+
+func (f pbField) ptrString() *string {
+	s := string(f.bytes)
+	return &s
+}
+
+func (f pbField) double() float64 {
+	return math.Float64frombits(f.value)
+}
+
+func (f pbField) float() *float32 {
+	v := math.Float32frombits(uint32(f.value))
+	return &v
+}
+
+func (f pbField) sint() int {
+	return int(protowire.DecodeZigZag(f.value))
+}
+
+func (f pbField) bool() bool {
+	return 0 != f.value
+}
+
+func (f pbField) time() time.Time {
+	return time.Unix(0, int64(f.value)).UTC()
+}
+
+// FromProtobufBytes decodes our binary wire format (see plane_location.proto) into pl
+func (pl *PlaneLocation) FromProtobufBytes(data []byte) error {
+	*pl = PlaneLocation{}
+	return eachField(data, func(f pbField) error {
+		switch f.num {
+		case pbIcao:
+			pl.Icao = f.string()
+		case pbLat:
+			pl.Lat = f.double()
+		case pbLon:
+			pl.Lon = f.double()
+		case pbHeading:
+			pl.Heading = f.double()
+		case pbVelocity:
+			pl.Velocity = f.double()
+		case pbAltitude:
+			pl.Altitude = f.sint()
+		case pbVerticalRate:
+			pl.VerticalRate = f.sint()
+		case pbNew:
+			pl.New = f.bool()
+		case pbRemoved:
+			pl.Removed = f.bool()
+		case pbOnGround:
+			pl.OnGround = f.bool()
+		case pbHasAltitude:
+			pl.HasAltitude = f.bool()
+		case pbHasLocation:
+			pl.HasLocation = f.bool()
+		case pbHasHeading:
+			pl.HasHeading = f.bool()
+		case pbHasOnGround:
+			pl.HasOnGround = f.bool()
+		case pbHasFlightStatus:
+			pl.HasFlightStatus = f.bool()
+		case pbHasVerticalRate:
+			pl.HasVerticalRate = f.bool()
+		case pbHasVelocity:
+			pl.HasVelocity = f.bool()
+		case pbAltitudeUnits:
+			pl.AltitudeUnits = f.string()
+		case pbFlightStatus:
+			pl.FlightStatus = f.string()
+		case pbAirframe:
+			pl.Airframe = f.string()
+		case pbAirframeType:
+			pl.AirframeType = f.string()
+		case pbSourceTag:
+			pl.SourceTag = f.string()
+		case pbSquawk:
+			pl.Squawk = f.string()
+		case pbSpecial:
+			pl.Special = f.string()
+		case pbTileLocation:
+			pl.TileLocation = f.string()
+		case pbEmergencies:
+			pl.Emergencies = append(pl.Emergencies, f.string())
+		case pbSourceTags:
+			var key string
+			var count uint32
+			if err := eachField(f.bytes, func(e pbField) error {
+				switch e.num {
+				case 1:
+					key = e.string()
+				case 2:
+					count = uint32(e.value)
+				}
+				return nil
+			}); nil != err {
+				return err
+			}
+			if nil == pl.SourceTags {
+				pl.SourceTags = make(map[string]uint32)
+			}
+			pl.SourceTags[key] = count
+		case pbTrackedSince:
+			pl.TrackedSince = f.time()
+		case pbFlightId:
+			pl.FlightId = f.string()
+		case pbAirport:
+			pl.Airport = f.string()
+		case pbSurfaceState:
+			pl.SurfaceState = f.string()
+		case pbLastMsg:
+			pl.LastMsg = f.time()
+		case pbUpdates:
+			return eachField(f.bytes, func(u pbField) error {
+				switch u.num {
+				case 1:
+					pl.Updates.Location = u.time()
+				case 2:
+					pl.Updates.Altitude = u.time()
+				case 3:
+					pl.Updates.Velocity = u.time()
+				case 4:
+					pl.Updates.Heading = u.time()
+				case 5:
+					pl.Updates.OnGround = u.time()
+				case 6:
+					pl.Updates.VerticalRate = u.time()
+				case 7:
+					pl.Updates.FlightStatus = u.time()
+				case 8:
+					pl.Updates.Special = u.time()
+				case 9:
+					pl.Updates.Squawk = u.time()
+				case 10:
+					pl.Updates.Emergency = u.time()
+				}
+				return nil
+			})
+		case pbPositionExtrapolated:
+			pl.PositionExtrapolated = f.bool()
+		case pbPositionAge:
+			pl.PositionAge = f.double()
+		case pbSignalRssi:
+			rssi := f.double()
+			pl.SignalRssi = &rssi
+		case pbAircraftWidth:
+			pl.AircraftWidth = f.float()
+		case pbAircraftLength:
+			pl.AircraftLength = f.float()
+		case pbIcaoCode:
+			pl.IcaoCode = f.ptrString()
+		case pbRegistration:
+			pl.Registration = f.ptrString()
+		case pbTypeCode:
+			pl.TypeCode = f.ptrString()
+		case pbTypeCodeLong:
+			pl.TypeCodeLong = f.ptrString()
+		case pbSerial:
+			pl.Serial = f.ptrString()
+		case pbRegisteredOwner:
+			pl.RegisteredOwner = f.ptrString()
+		case pbCOFAOwner:
+			pl.COFAOwner = f.ptrString()
+		case pbEngineType:
+			pl.EngineType = f.ptrString()
+		case pbFlagCode:
+			pl.FlagCode = f.ptrString()
+		case pbCallSign:
+			pl.CallSign = f.ptrString()
+		case pbOperator:
+			pl.Operator = f.ptrString()
+		case pbRouteCode:
+			pl.RouteCode = f.ptrString()
+		case pbSegments:
+			var s Segment
+			if err := eachField(f.bytes, func(sf pbField) error {
+				switch sf.num {
+				case 1:
+					s.Name = sf.string()
+				case 2:
+					s.ICAOCode = sf.string()
+				}
+				return nil
+			}); nil != err {
+				return err
+			}
+			pl.Segments = append(pl.Segments, s)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,326 @@
+package export
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func wireTestLocation() PlaneLocation {
+	now := time.Date(2023, time.March, 4, 5, 6, 7, 891011121, time.UTC)
+	return PlaneLocation{
+		Icao:            "7C4EE8",
+		Lat:             -31.942017,
+		Lon:             115.964594,
+		Heading:         14.116942,
+		Velocity:        143.5,
+		Altitude:        -125,
+		VerticalRate:    -640,
+		New:             true,
+		OnGround:        false,
+		HasAltitude:     true,
+		HasLocation:     true,
+		HasHeading:      true,
+		HasOnGround:     true,
+		HasFlightStatus: true,
+		HasVerticalRate: true,
+		HasVelocity:     true,
+		AltitudeUnits:   "feet",
+		FlightStatus:    "Airborne",
+		Airframe:        "Large",
+		AirframeType:    "Transport",
+		SourceTag:       "YPPH-0001",
+		Squawk:          "3456",
+		Special:         "ident",
+		TileLocation:    "tile12",
+		Emergencies:     []string{"squawk-7700"},
+		SourceTags:      map[string]uint32{"YPPH-0001": 12, "YPPH-0002": 3},
+		sourceTagsMutex: &sync.Mutex{},
+		TrackedSince:    now.Add(-time.Hour),
+		FlightId:        "7C4EE8-1677906367",
+		LastMsg:         now,
+		Updates: Updates{
+			Location:  now,
+			Altitude:  now.Add(-time.Second),
+			Velocity:  now,
+			Heading:   now,
+			Squawk:    now.Add(-time.Minute),
+			Emergency: now,
+		},
+		PositionAge:    1.5,
+		SignalRssi:     ptr(0.0),
+		AircraftWidth:  ptr(float32(35.8)),
+		AircraftLength: ptr(float32(39.5)),
+		Registration:   ptr("VH-VXA"),
+		TypeCode:       ptr("B738"),
+		Operator:       ptr(""),
+		CallSign:       ptr("QFA123"),
+		RouteCode:      ptr("YPPH-YSSY"),
+		Segments:       []Segment{{Name: "Perth", ICAOCode: "YPPH"}, {Name: "Sydney", ICAOCode: "YSSY"}},
+	}
+}
+
+func TestPlaneLocation_ProtobufRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		loc  PlaneLocation
+	}{
+		{name: "full", loc: wireTestLocation()},
+		{name: "empty", loc: PlaneLocation{}},
+		{name: "removed", loc: PlaneLocation{Icao: "ABCDEF", Removed: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := tt.loc.Encode(ContentTypeProtobuf)
+			if nil != err {
+				t.Fatal(err)
+			}
+			var got PlaneLocation
+			if err = DecodePlaneLocation(ContentTypeProtobuf, buf, &got); nil != err {
+				t.Fatal(err)
+			}
+			want := tt.loc
+			want.sourceTagsMutex = nil
+			if !reflect.DeepEqual(want, got) {
+				t.Errorf("round trip changed the location\nwant %+v\n got %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestPlaneLocation_ProtobufMatchesJSON(t *testing.T) {
+	loc := wireTestLocation()
+	js, err := loc.Encode(ContentTypeJSON)
+	if nil != err {
+		t.Fatal(err)
+	}
+	pb, err := loc.Encode(ContentTypeProtobuf)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(pb) >= len(js) {
+		t.Errorf("expected protobuf (%d bytes) to be smaller than JSON (%d bytes)", len(pb), len(js))
+	}
+
+	var fromJSON, fromPB PlaneLocation
+	if err = DecodePlaneLocation("", js, &fromJSON); nil != err {
+		t.Fatal(err)
+	}
+	if err = DecodePlaneLocation(ContentTypeProtobuf, pb, &fromPB); nil != err {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromJSON, fromPB) {
+		t.Errorf("JSON and protobuf decode differently\n json %+v\n   pb %+v", fromJSON, fromPB)
+	}
+}
+
+func TestDecodePlaneLocation_Errors(t *testing.T) {
+	var pl PlaneLocation
+	if err := DecodePlaneLocation("text/csv", []byte("a,b"), &pl); !errors.Is(err, ErrUnknownContentType) {
+		t.Errorf("expected an unknown content type error, got %v", err)
+	}
+	buf, _ := (&PlaneLocation{Icao: "ABCDEF"}).ToProtobufBytes()
+	if err := DecodePlaneLocation(ContentTypeProtobuf, buf[:len(buf)-2], &pl); !errors.Is(err, ErrInvalidProtobuf) {
+		t.Errorf("expected a truncated message to fail, got %v", err)
+	}
+	if _, err := ParseWireFormat("xml"); !errors.Is(err, ErrUnknownWireFormat) {
+		t.Errorf("expected an unknown wire format error, got %v", err)
+	}
+}
+
+func BenchmarkPlaneLocation_ToJSONBytes(b *testing.B) {
+	loc := wireTestLocation()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = loc.ToJSONBytes()
+	}
+}
+
+func BenchmarkPlaneLocation_ToProtobufBytes(b *testing.B) {
+	loc := wireTestLocation()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = loc.ToProtobufBytes()
+	}
+}
+
+func BenchmarkPlaneLocation_UnmarshalJSON(b *testing.B) {
+	loc := wireTestLocation()
+	buf, _ := loc.ToJSONBytes()
+	json := jsoniter.ConfigFastest
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		var pl PlaneLocation
+		_ = json.Unmarshal(buf, &pl)
+	}
+}
+
+func BenchmarkPlaneLocation_FromProtobufBytes(b *testing.B) {
+	loc := wireTestLocation()
+	buf, _ := loc.ToProtobufBytes()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		var pl PlaneLocation
+		_ = pl.FromProtobufBytes(buf)
+	}
+}
+
+// protoMessages reads the messages in plane_location.proto, giving us each field's name and wire type by number
+func protoMessages(t *testing.T) map[string]map[protowire.Number]protoField {
+	t.Helper()
+	src, err := os.ReadFile("plane_location.proto")
+	if nil != err {
+		t.Fatal(err)
+	}
+	messageStart := regexp.MustCompile(`^message (\w+) \{`)
+	fieldDef := regexp.MustCompile(`^(repeated |optional )?(map<[^>]+>|\w+) (\w+) = (\d+);`)
+	messages := make(map[string]map[protowire.Number]protoField)
+	var current map[protowire.Number]protoField
+	for i, line := range strings.Split(string(src), "\n") {
+		line = strings.TrimSpace(line)
+		if m := messageStart.FindStringSubmatch(line); nil != m {
+			current = make(map[protowire.Number]protoField)
+			messages[m[1]] = current
+			continue
+		}
+		if "}" == line {
+			current = nil
+			continue
+		}
+		m := fieldDef.FindStringSubmatch(line)
+		if nil == m || nil == current {
+			continue
+		}
+		num, _ := strconv.Atoi(m[4])
+		f := protoField{name: m[3], typ: protowire.BytesType, message: m[2]}
+		switch m[2] {
+		case "double":
+			f.typ = protowire.Fixed64Type
+		case "float":
+			f.typ = protowire.Fixed32Type
+		case "bool", "int32", "int64", "uint32", "uint64", "sint32", "sint64":
+			f.typ = protowire.VarintType
+		}
+		if _, dupe := current[protowire.Number(num)]; dupe {
+			t.Fatalf("plane_location.proto:%d reuses field number %d", i+1, num)
+		}
+		current[protowire.Number(num)] = f
+	}
+	return messages
+}
+
+type protoField struct {
+	name    string
+	typ     protowire.Type
+	message string
+}
+
+func TestWire_MatchesProto(t *testing.T) {
+	messages := protoMessages(t)
+
+	// every field number we use in wire.go, by its name in the .proto
+	numbers := map[string]protowire.Number{
+		"icao": pbIcao, "lat": pbLat, "lon": pbLon, "heading": pbHeading, "velocity": pbVelocity,
+		"altitude": pbAltitude, "vertical_rate": pbVerticalRate, "new": pbNew, "removed": pbRemoved,
+		"on_ground": pbOnGround, "has_altitude": pbHasAltitude, "has_location": pbHasLocation,
+		"has_heading": pbHasHeading, "has_on_ground": pbHasOnGround, "has_flight_status": pbHasFlightStatus,
+		"has_vertical_rate": pbHasVerticalRate, "has_velocity": pbHasVelocity, "altitude_units": pbAltitudeUnits,
+		"flight_status": pbFlightStatus, "airframe": pbAirframe, "airframe_type": pbAirframeType,
+		"source_tag": pbSourceTag, "squawk": pbSquawk, "special": pbSpecial, "tile_location": pbTileLocation,
+		"emergencies": pbEmergencies, "source_tags": pbSourceTags, "tracked_since": pbTrackedSince,
+		"flight_id": pbFlightId, "airport": pbAirport, "surface_state": pbSurfaceState, "last_msg": pbLastMsg,
+		"updates": pbUpdates, "position_extrapolated": pbPositionExtrapolated, "position_age": pbPositionAge,
+		"signal_rssi": pbSignalRssi, "aircraft_width": pbAircraftWidth, "aircraft_length": pbAircraftLength,
+		"icao_code": pbIcaoCode, "registration": pbRegistration, "type_code": pbTypeCode,
+		"type_code_long": pbTypeCodeLong, "serial": pbSerial, "registered_owner": pbRegisteredOwner,
+		"cofa_owner": pbCOFAOwner, "engine_type": pbEngineType, "flag_code": pbFlagCode, "call_sign": pbCallSign,
+		"operator": pbOperator, "route_code": pbRouteCode, "segments": pbSegments,
+	}
+	fields := messages["PlaneLocation"]
+	if len(fields) != len(numbers) {
+		t.Errorf("plane_location.proto has %d PlaneLocation fields, wire.go knows %d", len(fields), len(numbers))
+	}
+	for name, num := range numbers {
+		if f, ok := fields[num]; !ok || name != f.name {
+			t.Errorf("wire.go sends %s as field %d, plane_location.proto has %q there", name, num, f.name)
+		}
+	}
+
+	// a location with every field set, so everything is on the wire
+	now := time.Now()
+	loc := wireTestLocation()
+	loc.Removed = true
+	loc.OnGround = true
+	loc.Airport = "YPPH"
+	loc.SurfaceState = "taxi"
+	loc.PositionExtrapolated = true
+	loc.Updates.OnGround = now
+	loc.Updates.VerticalRate = now
+	loc.Updates.FlightStatus = now
+	loc.Updates.Special = now
+	loc.IcaoCode = ptr("QFA")
+	loc.TypeCodeLong = ptr("Boeing 737-838")
+	loc.Serial = ptr("34195")
+	loc.RegisteredOwner = ptr("Qantas Airways")
+	loc.COFAOwner = ptr("Qantas Airways")
+	loc.EngineType = ptr("Jet")
+	loc.FlagCode = ptr("AU")
+	buf, err := loc.ToProtobufBytes()
+	if nil != err {
+		t.Fatal(err)
+	}
+	// map entries are a message with the key as field 1 and the value as field 2
+	messages["SourceTagsEntry"] = map[protowire.Number]protoField{
+		1: {name: "key", typ: protowire.BytesType},
+		2: {name: "value", typ: protowire.VarintType},
+	}
+
+	// every field of every message should have been sent, with the wire type the .proto gives it
+	seen := make(map[string]map[protowire.Number]bool)
+	var check func(message string, b []byte)
+	check = func(message string, b []byte) {
+		if nil == seen[message] {
+			seen[message] = make(map[protowire.Number]bool)
+		}
+		err := eachField(b, func(f pbField) error {
+			def, ok := messages[message][f.num]
+			if !ok {
+				t.Errorf("%s field %d is not in plane_location.proto", message, f.num)
+				return nil
+			}
+			if def.typ != f.typ {
+				t.Errorf("%s.%s is sent as wire type %d, plane_location.proto says %d", message, def.name, f.typ, def.typ)
+			}
+			seen[message][f.num] = true
+			switch {
+			case strings.HasPrefix(def.message, "map<"):
+				check("SourceTagsEntry", f.bytes)
+			case nil != messages[def.message]:
+				check(def.message, f.bytes)
+			}
+			return nil
+		})
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+	check("PlaneLocation", buf)
+	for message, fields := range messages {
+		for num, f := range fields {
+			if !seen[message][num] {
+				t.Errorf("%s.%s (%d) was never sent", message, f.name, num)
+			}
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package flights
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"plane.watch/lib/export"
+	"plane.watch/lib/geo"
+)
+
+const (
+	// StateOpen is a flight that is still in progress
+	StateOpen = "open"
+	// StateClosed is a flight that has finished, the summary will no longer change
+	StateClosed = "closed"
+
+	OpenReasonFirstSeen        = "first-seen"
+	OpenReasonTakeoff          = "takeoff"
+	OpenReasonCallSignChange   = "callsign-change"
+	OpenReasonGap              = "gap"
+	CloseReasonLanded          = "landed"
+	CloseReasonTimeout         = "timeout"
+	CloseReasonCallSignChanged = "callsign-change"
+	CloseReasonGap             = "gap"
+	CloseReasonShutdown        = "shutdown"
+)
+
+type (
+	// Flight is a single leg flown by an aircraft. It is what we publish when a flight starts and ends
+	Flight struct {
+		FlightId    string
+		Icao        string
+		CallSign    string
+		State       string
+		OpenReason  string
+		CloseReason string `json:",omitempty"`
+
+		FirstSeen time.Time
+		LastSeen  time.Time
+		TakeOff   *time.Time `json:",omitempty"`
+		Landed    *time.Time `json:",omitempty"`
+
+		// Origin and Destination are our best guess at the airports (ICAO code) for this flight, where we saw it take
+		// off and land or, when we did not, its route
+		Origin      string `json:",omitempty"`
+		Destination string `json:",omitempty"`
+
+		MaxAltitude int
+		// Distance is how far we have seen this aircraft fly, in metres
+		Distance float64
+		// Feeders is the list of source tags that contributed to this flight
+		Feeders []string
+	}
+
+	// leg is our working state for a single aircraft
+	leg struct {
+		flight   *Flight
+		airborne bool // have we seen this flight in the air
+		// lastSeen is when we last heard from the aircraft, it keeps moving after the flight has closed
+		lastSeen time.Time
+
+		onGround    bool
+		hasOnGround bool
+		lat, lon    float64
+		hasLocation bool
+		// airport is where we last saw the aircraft on the ground, until it takes off
+		airport string
+		// landedAt is the airport we saw the flight land at, it wins over the route's destination
+		landedAt bool
+
+		feeders map[string]struct{}
+	}
+
+	// Tracker keeps track of the current flight for each aircraft
+	Tracker struct {
+		mu   sync.Mutex
+		legs map[string]*leg
+
+		// gap is how long we can go without hearing from an aircraft before we consider it a new flight
+		gap time.Duration
+		// airportAt finds the airport (ICAO code) at a position, for on-ground aircraft we have not been told the
+		// airport of
+		airportAt func(lat, lon float64) string
+
+		onOpen  func(*Flight)
+		onClose func(*Flight)
+		// pending are the open/close events waiting to be handed to onOpen/onClose once mu is released
+		pending []event
+
+		log zerolog.Logger
+	}
+
+	event struct {
+		opened bool
+		flight Flight
+	}
+
+	Option func(*Tracker)
+)
+
+// NewTracker creates a flight leg tracker
+func NewTracker(opts ...Option) *Tracker {
+	t := &Tracker{
+		legs: make(map[string]*leg),
+		gap:  30 * time.Minute,
+		log:  log.With().Str("section", "flights").Logger(),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// WithGap sets how long an aircraft can be silent before we decide it is on a new flight
+func WithGap(d time.Duration) Option {
+	return func(t *Tracker) {
+		t.gap = d
+	}
+}
+
+// WithAirportLookup finds the airport (ICAO code) an on-ground aircraft is at, or "" when it is not at one. It gives
+// flights their origin and destination without a route
+func WithAirportLookup(f func(lat, lon float64) string) Option {
+	return func(t *Tracker) {
+		t.airportAt = f
+	}
+}
+
+// WithFlightOpenedAction is called whenever a new flight is started
+func WithFlightOpenedAction(f func(*Flight)) Option {
+	return func(t *Tracker) {
+		t.onOpen = f
+	}
+}
+
+// WithFlightClosedAction is called whenever a flight is finished. The flight will not be modified after this call.
+func WithFlightClosedAction(f func(*Flight)) Option {
+	return func(t *Tracker) {
+		t.onClose = f
+	}
+}
+
+// Update feeds a location update into the tracker and returns the flight id the location belongs to
+func (t *Tracker) Update(loc *export.PlaneLocation) string {
+	if nil == loc || "" == loc.Icao {
+		return ""
+	}
+	seen := loc.LastMsg
+	if seen.IsZero() {
+		seen = time.Now()
+	}
+
+	callSign := callSignOf(loc)
+	airport := ""
+	if loc.HasOnGround && loc.OnGround {
+		airport = t.airportOf(loc)
+	}
+
+	t.mu.Lock()
+	defer t.notify()
+
+	l, ok := t.legs[loc.Icao]
+	if !ok {
+		l = &leg{}
+		t.legs[loc.Icao] = l
+		t.open(l, loc, seen, OpenReasonFirstSeen)
+	} else if seen.Sub(l.lastSeen) > t.gap {
+		if StateOpen == l.flight.State {
+			t.close(l, CloseReasonGap)
+		}
+		t.open(l, loc, seen, OpenReasonGap)
+	} else if "" != callSign && "" != l.flight.CallSign && callSign != l.flight.CallSign {
+		if StateOpen == l.flight.State {
+			t.close(l, CloseReasonCallSignChanged)
+		}
+		t.open(l, loc, seen, OpenReasonCallSignChange)
+	}
+
+	if loc.HasOnGround {
+		if l.hasOnGround && l.onGround && !loc.OnGround {
+			// takeoff
+			if StateClosed == l.flight.State || l.airborne {
+				if StateOpen == l.flight.State {
+					// we missed the landing somewhere
+					t.close(l, CloseReasonLanded)
+				}
+				t.open(l, loc, seen, OpenReasonTakeoff)
+				l.flight.Origin = l.airport
+			}
+			takeOff := seen
+			l.flight.TakeOff = &takeOff
+		} else if l.hasOnGround && !l.onGround && loc.OnGround && StateOpen == l.flight.State && l.airborne {
+			t.accumulate(l, loc, airport, seen)
+			landed := seen
+			l.flight.Landed = &landed
+			t.close(l, CloseReasonLanded)
+		}
+		l.hasOnGround = true
+		l.onGround = loc.OnGround
+		if "" != airport {
+			l.airport = airport
+		}
+		if !loc.OnGround {
+			l.airborne = true
+			l.airport = ""
+		}
+	} else if loc.HasAltitude && loc.Altitude > 0 && !loc.OnGround {
+		l.airborne = true
+	}
+
+	if seen.After(l.lastSeen) {
+		l.lastSeen = seen
+	}
+	if StateOpen == l.flight.State {
+		t.accumulate(l, loc, airport, seen)
+	}
+	return l.flight.FlightId
+}
+
+// Sweep closes any flights we have not heard from recently. This should be called periodically.
+func (t *Tracker) Sweep(now time.Time) {
+	t.mu.Lock()
+	defer t.notify()
+
+	for icao, l := range t.legs {
+		if now.Sub(l.lastSeen) <= t.gap {
+			continue
+		}
+		if StateOpen == l.flight.State {
+			t.close(l, CloseReasonTimeout)
+		}
+		delete(t.legs, icao)
+	}
+}
+
+// Close finishes all open flights, used when shutting down
+func (t *Tracker) Close() {
+	t.mu.Lock()
+	defer t.notify()
+
+	for icao, l := range t.legs {
+		if StateOpen == l.flight.State {
+			t.close(l, CloseReasonShutdown)
+		}
+		delete(t.legs, icao)
+	}
+}
+
+// Current returns a copy of the flight currently associated with the given aircraft
+func (t *Tracker) Current(icao string) (Flight, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l, ok := t.legs[icao]
+	if !ok {
+		return Flight{}, false
+	}
+	return l.snapshot(), true
+}
+
+func (t *Tracker) open(l *leg, loc *export.PlaneLocation, seen time.Time, reason string) {
+	l.flight = &Flight{
+		FlightId:   uuid.New().String(),
+		Icao:       loc.Icao,
+		CallSign:   callSignOf(loc),
+		State:      StateOpen,
+		OpenReason: reason,
+		FirstSeen:  seen,
+		LastSeen:   seen,
+	}
+	l.airborne = false
+	l.lastSeen = seen
+	l.hasLocation = false
+	l.landedAt = false
+	l.feeders = make(map[string]struct{})
+
+	if t.log.Debug().Enabled() {
+		t.log.Debug().
+			Str("aircraft", loc.Icao).
+			Str("flight", l.flight.FlightId).
+			Str("reason", reason).
+			Msg("Flight Opened")
+	}
+	if nil != t.onOpen {
+		t.pending = append(t.pending, event{opened: true, flight: l.snapshot()})
+	}
+}
+
+func (t *Tracker) close(l *leg, reason string) {
+	l.flight.State = StateClosed
+	l.flight.CloseReason = reason
+
+	if t.log.Debug().Enabled() {
+		t.log.Debug().
+			Str("aircraft", l.flight.Icao).
+			Str("flight", l.flight.FlightId).
+			Str("reason", reason).
+			Msg("Flight Closed")
+	}
+	if nil != t.onClose {
+		t.pending = append(t.pending, event{flight: l.snapshot()})
+	}
+}
+
+// notify releases mu and then hands any queued events to the callbacks, so they are free to call back into the tracker
+func (t *Tracker) notify() {
+	events := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	for i := range events {
+		if events[i].opened {
+			t.onOpen(&events[i].flight)
+		} else {
+			t.onClose(&events[i].flight)
+		}
+	}
+}
+
+// accumulate adds the details of this location (at airport, if it is on the ground at one) to the flight summary
+func (t *Tracker) accumulate(l *leg, loc *export.PlaneLocation, airport string, seen time.Time) {
+	f := l.flight
+	if seen.After(f.LastSeen) {
+		f.LastSeen = seen
+	}
+	if "" == f.CallSign {
+		f.CallSign = callSignOf(loc)
+	}
+	if loc.HasAltitude && loc.Altitude > f.MaxAltitude {
+		f.MaxAltitude = loc.Altitude
+	}
+	if loc.HasLocation && !loc.PositionExtrapolated {
+		if l.hasLocation {
+			f.Distance += geo.Distance(l.lat, l.lon, loc.Lat, loc.Lon)
+		}
+		l.lat, l.lon, l.hasLocation = loc.Lat, loc.Lon, true
+	}
+	if "" != airport {
+		// before it takes off it is at its origin, after it has flown it is at its destination
+		if l.airborne {
+			f.Destination = airport
+			l.landedAt = true
+		} else {
+			f.Origin = airport
+		}
+	}
+	if n := len(loc.Segments); n > 0 {
+		if "" == f.Origin {
+			f.Origin = loc.Segments[0].ICAOCode
+		}
+		if !l.landedAt {
+			f.Destination = loc.Segments[n-1].ICAOCode
+		}
+	}
+	if "" != loc.SourceTag {
+		l.feeders[loc.SourceTag] = struct{}{}
+	}
+	for tag := range loc.CloneSourceTags() {
+		l.feeders[tag] = struct{}{}
+	}
+}
+
+// snapshot gives us a copy of the flight that is safe to hand to other goroutines
+func (l *leg) snapshot() Flight {
+	f := *l.flight
+	f.Feeders = make([]string, 0, len(l.feeders))
+	for tag := range l.feeders {
+		f.Feeders = append(f.Feeders, tag)
+	}
+	sort.Strings(f.Feeders)
+	return f
+}
+
+// airportOf is the airport an on-ground aircraft is at, as pw_router assigned it or found by airportAt
+func (t *Tracker) airportOf(loc *export.PlaneLocation) string {
+	if "" != loc.Airport {
+		return loc.Airport
+	}
+	if nil == t.airportAt || !loc.HasLocation {
+		return ""
+	}
+	return t.airportAt(loc.Lat, loc.Lon)
+}
+
+// callSignOf is the aircraft's callsign without the padding some feeds leave on it
+func callSignOf(loc *export.PlaneLocation) string {
+	if nil == loc.CallSign {
+		return ""
+	}
+	return strings.TrimSpace(*loc.CallSign)
+}
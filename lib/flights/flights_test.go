@@ -0,0 +1,246 @@
+package flights
+
+import (
+	"testing"
+	"time"
+
+	"plane.watch/lib/export"
+)
+
+func ptr[t any](what t) *t {
+	return &what
+}
+
+func TestTracker_TakeoffAndLanding(t *testing.T) {
+	var opened, closed []Flight
+	tr := NewTracker(
+		WithGap(2*time.Hour),
+		WithFlightOpenedAction(func(f *Flight) { opened = append(opened, *f) }),
+		WithFlightClosedAction(func(f *Flight) { closed = append(closed, *f) }),
+	)
+	start := time.Date(2023, time.January, 9, 19, 0, 0, 0, time.UTC)
+
+	loc := export.PlaneLocation{
+		Icao:        "7C4516",
+		CallSign:    ptr("QFA123"),
+		HasOnGround: true,
+		OnGround:    true,
+		HasLocation: true,
+		Lat:         -31.9403,
+		Lon:         115.967003,
+		SourceTag:   "feeder-1",
+		LastMsg:     start,
+		Segments:    []export.Segment{{ICAOCode: "YPPH"}, {ICAOCode: "YSSY"}},
+	}
+	taxiId := tr.Update(&loc)
+	if "" == taxiId {
+		t.Fatal("expected a flight id")
+	}
+
+	// takeoff should keep the flight we were taxiing on
+	loc.OnGround = false
+	loc.HasAltitude = true
+	loc.Altitude = 37000
+	loc.Lat = -31.0
+	loc.SourceTag = "feeder-2"
+	loc.LastMsg = start.Add(5 * time.Minute)
+	if id := tr.Update(&loc); id != taxiId {
+		t.Errorf("expected takeoff to continue the taxi flight %s, got %s", taxiId, id)
+	}
+
+	// landing closes the flight
+	loc.OnGround = true
+	loc.Altitude = 0
+	loc.Lat = -30.0
+	loc.LastMsg = start.Add(time.Hour)
+	if id := tr.Update(&loc); id != taxiId {
+		t.Errorf("expected landing to belong to flight %s, got %s", taxiId, id)
+	}
+
+	if 1 != len(opened) {
+		t.Fatalf("expected 1 flight opened, got %d", len(opened))
+	}
+	if 1 != len(closed) {
+		t.Fatalf("expected 1 flight closed, got %d", len(closed))
+	}
+	f := closed[0]
+	if CloseReasonLanded != f.CloseReason {
+		t.Errorf("expected flight to close because it landed, got %s", f.CloseReason)
+	}
+	if 37000 != f.MaxAltitude {
+		t.Errorf("incorrect max altitude %d", f.MaxAltitude)
+	}
+	if "YPPH" != f.Origin || "YSSY" != f.Destination {
+		t.Errorf("incorrect route guess %s -> %s", f.Origin, f.Destination)
+	}
+	if f.Distance < 200_000 || f.Distance > 230_000 {
+		t.Errorf("expected to fly ~2 degrees of latitude, got %0.2fm", f.Distance)
+	}
+	if 2 != len(f.Feeders) || "feeder-1" != f.Feeders[0] || "feeder-2" != f.Feeders[1] {
+		t.Errorf("incorrect feeders %v", f.Feeders)
+	}
+	if nil == f.TakeOff || nil == f.Landed {
+		t.Errorf("expected takeoff and landing times")
+	}
+
+	// taking off again is a new flight
+	loc.OnGround = false
+	loc.LastMsg = start.Add(90 * time.Minute)
+	if id := tr.Update(&loc); id == taxiId || "" == id {
+		t.Errorf("expected a new flight on takeoff")
+	}
+	if 2 != len(opened) || OpenReasonTakeoff != opened[1].OpenReason {
+		t.Errorf("expected the second flight to be opened by a takeoff")
+	}
+}
+
+func TestTracker_CallSignChange(t *testing.T) {
+	var closed []Flight
+	tr := NewTracker(WithFlightClosedAction(func(f *Flight) { closed = append(closed, *f) }))
+	now := time.Now()
+
+	loc := export.PlaneLocation{Icao: "7C4516", CallSign: ptr("QFA123"), LastMsg: now}
+	first := tr.Update(&loc)
+
+	loc.CallSign = ptr("QFA456")
+	loc.LastMsg = now.Add(time.Second)
+	second := tr.Update(&loc)
+
+	if first == second {
+		t.Errorf("expected a callsign change to start a new flight")
+	}
+	if 1 != len(closed) || CloseReasonCallSignChanged != closed[0].CloseReason {
+		t.Errorf("expected the first flight to close on callsign change")
+	}
+	if f, ok := tr.Current("7C4516"); !ok || "QFA456" != f.CallSign {
+		t.Errorf("expected the current flight to be QFA456")
+	}
+
+	// some feeds pad the callsign, that is not a new flight
+	loc.CallSign = ptr("QFA456  ")
+	loc.LastMsg = now.Add(2 * time.Second)
+	if third := tr.Update(&loc); third != second || 1 != len(closed) {
+		t.Errorf("expected a padded callsign to keep the flight")
+	}
+}
+
+func TestTracker_AirportsWithoutRoute(t *testing.T) {
+	var closed []Flight
+	tr := NewTracker(
+		WithGap(2*time.Hour),
+		WithFlightClosedAction(func(f *Flight) { closed = append(closed, *f) }),
+		WithAirportLookup(func(lat, lon float64) string {
+			switch {
+			case lat < -31.5:
+				return "YPPH"
+			case lat > -30.8:
+				return "YPKG"
+			}
+			return ""
+		}),
+	)
+	start := time.Date(2023, time.January, 9, 19, 0, 0, 0, time.UTC)
+	loc := export.PlaneLocation{Icao: "7C4516", HasOnGround: true, OnGround: true, HasLocation: true, Lat: -31.9, LastMsg: start}
+	update := func(onGround bool, lat float64, after time.Duration) {
+		loc.OnGround, loc.Lat, loc.LastMsg = onGround, lat, start.Add(after)
+		tr.Update(&loc)
+	}
+
+	update(true, -31.9, time.Minute)  // taxi at Perth
+	update(false, -31.0, time.Hour)   // in the air
+	update(true, -30.7, 2*time.Hour)  // lands at Kalgoorlie
+	update(true, -30.7, 3*time.Hour)  // waits at the gate
+	update(false, -31.0, 4*time.Hour) // takes off again
+	update(true, -31.9, 5*time.Hour)  // lands at Perth
+
+	if 2 != len(closed) {
+		t.Fatalf("expected two flights, got %d", len(closed))
+	}
+	if "YPPH" != closed[0].Origin || "YPKG" != closed[0].Destination {
+		t.Errorf("expected the first flight to be YPPH-YPKG, got %s-%s", closed[0].Origin, closed[0].Destination)
+	}
+	if "YPKG" != closed[1].Origin || "YPPH" != closed[1].Destination {
+		t.Errorf("expected the second flight to be YPKG-YPPH, got %s-%s", closed[1].Origin, closed[1].Destination)
+	}
+
+	// what we saw wins over the route
+	loc.Segments = []export.Segment{{ICAOCode: "YSSY"}, {ICAOCode: "YMML"}}
+	update(false, -31.0, 6*time.Hour)
+	update(true, -30.7, 7*time.Hour)
+	if 3 != len(closed) || "YPPH" != closed[2].Origin || "YPKG" != closed[2].Destination {
+		t.Errorf("expected the airports we saw over the route, got %+v", closed[len(closed)-1])
+	}
+}
+
+func TestTracker_GapAndSweep(t *testing.T) {
+	var closed []Flight
+	tr := NewTracker(
+		WithGap(time.Minute),
+		WithFlightClosedAction(func(f *Flight) { closed = append(closed, *f) }),
+	)
+	now := time.Now()
+
+	loc := export.PlaneLocation{Icao: "7C4516", LastMsg: now}
+	first := tr.Update(&loc)
+	loc.LastMsg = now.Add(2 * time.Minute)
+	second := tr.Update(&loc)
+	if first == second {
+		t.Errorf("expected a gap to start a new flight")
+	}
+	if 1 != len(closed) || CloseReasonGap != closed[0].CloseReason {
+		t.Fatalf("expected the first flight to close on a gap")
+	}
+
+	tr.Sweep(now.Add(10 * time.Minute))
+	if 2 != len(closed) || CloseReasonTimeout != closed[1].CloseReason {
+		t.Fatalf("expected the sweep to time out the second flight")
+	}
+	if _, ok := tr.Current("7C4516"); ok {
+		t.Errorf("expected the aircraft to be forgotten")
+	}
+}
+
+func TestTracker_LongGroundStay(t *testing.T) {
+	var opened []Flight
+	tr := NewTracker(
+		WithGap(30*time.Minute),
+		WithFlightOpenedAction(func(f *Flight) { opened = append(opened, *f) }),
+	)
+	start := time.Now()
+
+	loc := export.PlaneLocation{Icao: "7C4516", HasOnGround: true, OnGround: false, LastMsg: start}
+	tr.Update(&loc)
+	loc.OnGround = true
+	loc.LastMsg = start.Add(time.Minute)
+	tr.Update(&loc)
+
+	// sit on the ground for a few hours, still being heard
+	for i := 1; i <= 24; i++ {
+		loc.LastMsg = start.Add(time.Minute + time.Duration(i)*10*time.Minute)
+		tr.Update(&loc)
+	}
+	tr.Sweep(loc.LastMsg)
+	if 1 != len(opened) {
+		t.Fatalf("expected sitting on the ground not to open a new flight, got %d opened", len(opened))
+	}
+
+	loc.OnGround = false
+	loc.LastMsg = loc.LastMsg.Add(time.Minute)
+	tr.Update(&loc)
+	if 2 != len(opened) || OpenReasonTakeoff != opened[1].OpenReason {
+		t.Errorf("expected the next flight to be opened by a takeoff, got %+v", opened)
+	}
+}
+
+func TestTracker_CallbacksOutsideLock(t *testing.T) {
+	var tr *Tracker
+	var current Flight
+	tr = NewTracker(WithFlightOpenedAction(func(f *Flight) {
+		// this would deadlock if we were called with the tracker locked
+		current, _ = tr.Current(f.Icao)
+	}))
+	id := tr.Update(&export.PlaneLocation{Icao: "7C4516", LastMsg: time.Now()})
+	if id != current.FlightId {
+		t.Errorf("expected the callback to see flight %s, got %s", id, current.FlightId)
+	}
+}
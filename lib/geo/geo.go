@@ -0,0 +1,53 @@
+package geo
+
+import "math"
+
+const (
+	// EarthRadiusMetres is the mean radius of the earth, good enough for the spherical maths we do
+	EarthRadiusMetres = 6371000
+
+	// KnotsToMetresPerSecond converts a speed in knots to metres per second
+	KnotsToMetresPerSecond = 0.514444
+
+	degToRad = math.Pi / 180
+	radToDeg = 180 / math.Pi
+)
+
+// Distance returns the great circle distance (in metres) between two lat/lon pairs using the haversine formula
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	la1 := lat1 * degToRad
+	la2 := lat2 * degToRad
+	dLat := (lat2 - lat1) * degToRad
+	dLon := (lon2 - lon1) * degToRad
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(la1)*math.Cos(la2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * EarthRadiusMetres * math.Asin(math.Sqrt(h))
+}
+
+// Bearing returns the initial bearing (0-360 degrees) to travel from the first point to the second
+func Bearing(lat1, lon1, lat2, lon2 float64) float64 {
+	la1 := lat1 * degToRad
+	la2 := lat2 * degToRad
+	dLon := (lon2 - lon1) * degToRad
+
+	y := math.Sin(dLon) * math.Cos(la2)
+	x := math.Cos(la1)*math.Sin(la2) - math.Sin(la1)*math.Cos(la2)*math.Cos(dLon)
+
+	return math.Mod(math.Atan2(y, x)*radToDeg+360, 360)
+}
+
+// Destination returns the point reached by travelling the given number of metres from lat/lon on the given bearing
+func Destination(lat, lon, bearing, metres float64) (float64, float64) {
+	la1 := lat * degToRad
+	lo1 := lon * degToRad
+	brng := bearing * degToRad
+	d := metres / EarthRadiusMetres
+
+	la2 := math.Asin(math.Sin(la1)*math.Cos(d) + math.Cos(la1)*math.Sin(d)*math.Cos(brng))
+	lo2 := lo1 + math.Atan2(math.Sin(brng)*math.Sin(d)*math.Cos(la1), math.Cos(d)-math.Sin(la1)*math.Sin(la2))
+
+	// normalise our longitude to -180..180
+	lon2 := math.Mod(lo2*radToDeg+540, 360) - 180
+	return la2 * radToDeg, lon2
+}
@@ -0,0 +1,66 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{name: "same-point", lat1: -31.94, lon1: 115.96, lat2: -31.94, lon2: 115.96, want: 0},
+		{name: "statue-liberty-eiffel-tower", lat1: 40.6892, lon1: -74.0444, lat2: 48.8583, lon2: 2.2945, want: 5_837_413},
+		{name: "one-degree-of-latitude", lat1: 0, lon1: 0, lat2: 1, lon2: 0, want: 111_195},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Distance(tt.lat1, tt.lon1, tt.lat2, tt.lon2); math.Abs(got-tt.want) > 1 {
+				t.Errorf("Distance() = %0.2f, want %0.2f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBearing(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{name: "north", lat1: 0, lon1: 0, lat2: 1, lon2: 0, want: 0},
+		{name: "east", lat1: 0, lon1: 0, lat2: 0, lon2: 1, want: 90},
+		{name: "south", lat1: 0, lon1: 0, lat2: -1, lon2: 0, want: 180},
+		{name: "west", lat1: 0, lon1: 0, lat2: 0, lon2: -1, want: 270},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Bearing(tt.lat1, tt.lon1, tt.lat2, tt.lon2); math.Abs(got-tt.want) > 0.001 {
+				t.Errorf("Bearing() = %0.4f, want %0.4f", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDestination(t *testing.T) {
+	// travel 100km from Perth in a few directions and make sure we end up that far away, on that bearing
+	lat, lon := -31.9403, 115.967003
+	for _, bearing := range []float64{0, 45, 90, 135, 180, 225, 270, 315} {
+		dLat, dLon := Destination(lat, lon, bearing, 100_000)
+		if d := Distance(lat, lon, dLat, dLon); math.Abs(d-100_000) > 1 {
+			t.Errorf("bearing %0.0f: expected to travel 100000m, travelled %0.2f", bearing, d)
+		}
+		b := Bearing(lat, lon, dLat, dLon)
+		if delta := math.Abs(math.Mod(b-bearing+540, 360) - 180); delta > 0.5 {
+			t.Errorf("expected bearing %0.0f, got %0.2f", bearing, b)
+		}
+	}
+
+	// crossing the anti-meridian keeps our longitude in range
+	_, dLon := Destination(0, 179.9, 90, 50_000)
+	if dLon > 180 || dLon < -180 {
+		t.Errorf("longitude out of range: %0.4f", dLon)
+	}
+}
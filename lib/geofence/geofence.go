@@ -0,0 +1,338 @@
+package geofence
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"sync"
+
+	"plane.watch/lib/export"
+	"plane.watch/lib/geo"
+)
+
+// cellSize is the size (in degrees) of the cells in our spatial index
+const cellSize = 1.0
+
+var (
+	ErrInvalidId    = errors.New("geofence id must be letters, numbers, - or _")
+	ErrInvalidShape = errors.New("geofence needs either a polygon of at least 3 points or a circle with a radius")
+	ErrInvalidPoint = errors.New("geofence point out of range")
+	ErrAntimeridian = errors.New("geofences crossing the antimeridian are not supported")
+
+	validId = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+type (
+	Point struct {
+		Lat, Lon float64
+	}
+
+	Circle struct {
+		Lat, Lon     float64
+		RadiusMetres float64
+	}
+
+	// Fence is an area we want to know about aircraft entering and leaving. It is either a polygon or a circle,
+	// optionally limited to an altitude band
+	Fence struct {
+		// Id is used in the subject we publish to (geofence.<id>)
+		Id   string
+		Name string `json:",omitempty"`
+
+		// Polygon is the outline of the area, it does not need to be closed
+		Polygon []Point `json:",omitempty"`
+		Circle  *Circle `json:",omitempty"`
+
+		// MinAltitude and MaxAltitude are in feet, aircraft without an altitude are never inside a fence with a band
+		MinAltitude *int `json:",omitempty"`
+		MaxAltitude *int `json:",omitempty"`
+	}
+
+	// Match is an aircraft's relationship with a geofence after an update
+	Match struct {
+		Fence Fence
+		// Event is one of the export.GeofenceEvent* constants
+		Event string
+	}
+
+	cell struct {
+		lat, lon int
+	}
+
+	box struct {
+		minLat, minLon, maxLat, maxLon float64
+	}
+
+	// Registry holds our geofences, indexed by a grid of cells, and which fences each aircraft is inside
+	Registry struct {
+		mu     sync.RWMutex
+		fences map[string]*Fence
+		cells  map[cell][]*Fence
+		// inside is the set of fence ids each aircraft is inside, by icao
+		inside map[string]map[string]bool
+	}
+)
+
+// ValidId tells us if id is one a fence can have
+func ValidId(id string) bool {
+	return validId.MatchString(id)
+}
+
+// Validate makes sure the fence has an id we can publish to and exactly one valid shape
+func (f *Fence) Validate() error {
+	if !ValidId(f.Id) {
+		return ErrInvalidId
+	}
+	if (nil == f.Circle) == (0 == len(f.Polygon)) {
+		return ErrInvalidShape
+	}
+	if nil != f.Circle {
+		if f.Circle.RadiusMetres <= 0 {
+			return ErrInvalidShape
+		}
+		if !validPoint(f.Circle.Lat, f.Circle.Lon) {
+			return fmt.Errorf("%w: %0.4f,%0.4f", ErrInvalidPoint, f.Circle.Lat, f.Circle.Lon)
+		}
+	} else {
+		if len(f.Polygon) < 3 {
+			return ErrInvalidShape
+		}
+		for _, p := range f.Polygon {
+			if !validPoint(p.Lat, p.Lon) {
+				return fmt.Errorf("%w: %0.4f,%0.4f", ErrInvalidPoint, p.Lat, p.Lon)
+			}
+		}
+	}
+	if b := f.bounds(); b.maxLon-b.minLon > 180 || b.minLon < -180 || b.maxLon > 180 {
+		return ErrAntimeridian
+	}
+	return nil
+}
+
+func validPoint(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// bounds is the bounding box of the fence
+func (f *Fence) bounds() box {
+	if nil != f.Circle {
+		dLat := f.Circle.RadiusMetres / geo.EarthRadiusMetres * 180 / math.Pi
+		dLon := 180.0
+		if cos := math.Cos(f.Circle.Lat * math.Pi / 180); cos > 0.0001 {
+			dLon = dLat / cos
+		}
+		return box{
+			minLat: math.Max(-90, f.Circle.Lat-dLat),
+			maxLat: math.Min(90, f.Circle.Lat+dLat),
+			minLon: f.Circle.Lon - dLon,
+			maxLon: f.Circle.Lon + dLon,
+		}
+	}
+	b := box{minLat: 90, minLon: 180, maxLat: -90, maxLon: -180}
+	for _, p := range f.Polygon {
+		b.minLat = math.Min(b.minLat, p.Lat)
+		b.maxLat = math.Max(b.maxLat, p.Lat)
+		b.minLon = math.Min(b.minLon, p.Lon)
+		b.maxLon = math.Max(b.maxLon, p.Lon)
+	}
+	return b
+}
+
+// Contains tells us if the aircraft is inside the fence (and its altitude band)
+func (f *Fence) Contains(loc *export.PlaneLocation) bool {
+	if nil == loc || !loc.HasLocation {
+		return false
+	}
+	if nil != f.MinAltitude || nil != f.MaxAltitude {
+		if !loc.HasAltitude {
+			return false
+		}
+		if nil != f.MinAltitude && loc.Altitude < *f.MinAltitude {
+			return false
+		}
+		if nil != f.MaxAltitude && loc.Altitude > *f.MaxAltitude {
+			return false
+		}
+	}
+	if nil != f.Circle {
+		return geo.Distance(f.Circle.Lat, f.Circle.Lon, loc.Lat, loc.Lon) <= f.Circle.RadiusMetres
+	}
+	return inPolygon(f.Polygon, loc.Lat, loc.Lon)
+}
+
+// inPolygon casts a ray from the point and counts how many edges it crosses
+func inPolygon(polygon []Point, lat, lon float64) bool {
+	inside := false
+	j := len(polygon) - 1
+	for i := range polygon {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > lat) != (b.Lat > lat) && lon < (b.Lon-a.Lon)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+		j = i
+	}
+	return inside
+}
+
+func cellOf(lat, lon float64) cell {
+	return cell{lat: int(math.Floor(lat / cellSize)), lon: int(math.Floor(lon / cellSize))}
+}
+
+// cells is every cell the fence's bounding box touches
+func (f *Fence) cells() []cell {
+	b := f.bounds()
+	lo, hi := cellOf(b.minLat, b.minLon), cellOf(b.maxLat, b.maxLon)
+	cells := make([]cell, 0, (hi.lat-lo.lat+1)*(hi.lon-lo.lon+1))
+	for lat := lo.lat; lat <= hi.lat; lat++ {
+		for lon := lo.lon; lon <= hi.lon; lon++ {
+			cells = append(cells, cell{lat: lat, lon: lon})
+		}
+	}
+	return cells
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		fences: make(map[string]*Fence),
+		cells:  make(map[cell][]*Fence),
+		inside: make(map[string]map[string]bool),
+	}
+}
+
+// Put adds the fence, replacing any fence with the same id
+func (r *Registry) Put(f Fence) error {
+	if err := f.Validate(); nil != err {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.remove(f.Id)
+	r.fences[f.Id] = &f
+	for _, c := range f.cells() {
+		r.cells[c] = append(r.cells[c], &f)
+	}
+	return nil
+}
+
+// Remove deletes the fence, returns false if we did not have it
+func (r *Registry) Remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.remove(id)
+}
+
+func (r *Registry) remove(id string) bool {
+	f, ok := r.fences[id]
+	if !ok {
+		return false
+	}
+	delete(r.fences, id)
+	for _, c := range f.cells() {
+		fences := r.cells[c]
+		for i := range fences {
+			if fences[i] == f {
+				fences = append(fences[:i], fences[i+1:]...)
+				break
+			}
+		}
+		if 0 == len(fences) {
+			delete(r.cells, c)
+		} else {
+			r.cells[c] = fences
+		}
+	}
+	for icao, fences := range r.inside {
+		delete(fences, id)
+		if 0 == len(fences) {
+			delete(r.inside, icao)
+		}
+	}
+	return true
+}
+
+// Get finds a fence by id
+func (r *Registry) Get(id string) (Fence, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	f, ok := r.fences[id]
+	if !ok {
+		return Fence{}, false
+	}
+	return *f, true
+}
+
+// List is every fence we have, by id
+func (r *Registry) List() []Fence {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	fences := make([]Fence, 0, len(r.fences))
+	for _, f := range r.fences {
+		fences = append(fences, *f)
+	}
+	sort.Slice(fences, func(i, j int) bool {
+		return fences[i].Id < fences[j].Id
+	})
+	return fences
+}
+
+// Len is how many fences we have
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.fences)
+}
+
+// Check works out which fences the aircraft is in after this update, and which ones it has left.
+// Updates without a position leave the aircraft where it was
+func (r *Registry) Check(loc *export.PlaneLocation) []Match {
+	if nil == loc || !loc.HasLocation {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	before := r.inside[loc.Icao]
+	after := make(map[string]bool)
+	var matches []Match
+	for _, f := range r.cells[cellOf(loc.Lat, loc.Lon)] {
+		if !f.Contains(loc) {
+			continue
+		}
+		after[f.Id] = true
+		event := export.GeofenceEventInside
+		if !before[f.Id] {
+			event = export.GeofenceEventEnter
+		}
+		matches = append(matches, Match{Fence: *f, Event: event})
+	}
+	for id := range before {
+		if !after[id] {
+			if f, ok := r.fences[id]; ok {
+				matches = append(matches, Match{Fence: *f, Event: export.GeofenceEventExit})
+			}
+		}
+	}
+
+	if 0 == len(after) {
+		delete(r.inside, loc.Icao)
+	} else {
+		r.inside[loc.Icao] = after
+	}
+	return matches
+}
+
+// Forget is called when we lose track of an aircraft, it leaves every fence it was in
+func (r *Registry) Forget(icao string) []Match {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var matches []Match
+	for id := range r.inside[icao] {
+		if f, ok := r.fences[id]; ok {
+			matches = append(matches, Match{Fence: *f, Event: export.GeofenceEventExit})
+		}
+	}
+	delete(r.inside, icao)
+	return matches
+}
@@ -0,0 +1,171 @@
+package geofence
+
+import (
+	"errors"
+	"testing"
+
+	"plane.watch/lib/export"
+)
+
+func location(lat, lon float64, altitude int) *export.PlaneLocation {
+	return &export.PlaneLocation{
+		Icao:        "7C4516",
+		Lat:         lat,
+		Lon:         lon,
+		HasLocation: true,
+		Altitude:    altitude,
+		HasAltitude: true,
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// perth is a box around Perth Airport, spanning a cell boundary
+var perth = Fence{
+	Id:   "YPPH",
+	Name: "Perth Airport",
+	Polygon: []Point{
+		{-31.90, 115.90},
+		{-31.90, 116.05},
+		{-32.00, 116.05},
+		{-32.00, 115.90},
+	},
+	MaxAltitude: intPtr(5000),
+}
+
+func TestFence_Validate(t *testing.T) {
+	tests := []struct {
+		name  string
+		fence Fence
+		want  error
+	}{
+		{"polygon", perth, nil},
+		{"circle", Fence{Id: "c", Circle: &Circle{Lat: -31.94, Lon: 115.96, RadiusMetres: 10_000}}, nil},
+		{"bad id", Fence{Id: "a.b", Circle: &Circle{RadiusMetres: 1}}, ErrInvalidId},
+		{"no shape", Fence{Id: "a"}, ErrInvalidShape},
+		{"both shapes", Fence{Id: "a", Polygon: perth.Polygon, Circle: &Circle{RadiusMetres: 1}}, ErrInvalidShape},
+		{"line", Fence{Id: "a", Polygon: perth.Polygon[:2]}, ErrInvalidShape},
+		{"bad point", Fence{Id: "a", Polygon: []Point{{0, 0}, {91, 0}, {0, 1}}}, ErrInvalidPoint},
+		{"antimeridian", Fence{Id: "a", Polygon: []Point{{0, 179}, {1, -179}, {0, -179}}}, ErrAntimeridian},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fence.Validate(); !errors.Is(err, tt.want) {
+				t.Errorf("Validate() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFence_Contains(t *testing.T) {
+	circle := Fence{Id: "c", Circle: &Circle{Lat: -31.94, Lon: 115.96, RadiusMetres: 10_000}, MinAltitude: intPtr(1000)}
+	noAltitude := location(-31.94, 115.97, 0)
+	noAltitude.HasAltitude = false
+
+	tests := []struct {
+		name  string
+		fence Fence
+		loc   *export.PlaneLocation
+		want  bool
+	}{
+		{"inside polygon", perth, location(-31.94, 115.97, 1000), true},
+		{"outside polygon", perth, location(-31.85, 115.97, 1000), false},
+		{"above polygon", perth, location(-31.94, 115.97, 10000), false},
+		{"no altitude", perth, noAltitude, false},
+		{"inside circle", circle, location(-31.99, 115.96, 2000), true},
+		{"outside circle", circle, location(-32.04, 115.96, 2000), false},
+		{"below circle", circle, location(-31.94, 115.96, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.fence.Contains(tt.loc); got != tt.want {
+				t.Errorf("Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func events(matches []Match) map[string]string {
+	out := make(map[string]string, len(matches))
+	for _, m := range matches {
+		out[m.Fence.Id] = m.Event
+	}
+	return out
+}
+
+func TestRegistry_Check(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Put(perth); nil != err {
+		t.Fatal(err)
+	}
+	if err := r.Put(Fence{Id: "wa", Polygon: []Point{{-13, 112}, {-13, 129}, {-35, 129}, {-35, 112}}}); nil != err {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name string
+		loc  *export.PlaneLocation
+		want map[string]string
+	}{
+		{"outside everything", location(-20, 140, 1000), map[string]string{}},
+		{"enter both", location(-31.94, 115.97, 1000), map[string]string{"YPPH": export.GeofenceEventEnter, "wa": export.GeofenceEventEnter}},
+		{"climb out of the airport", location(-31.94, 115.97, 6000), map[string]string{"YPPH": export.GeofenceEventExit, "wa": export.GeofenceEventInside}},
+		{"no position", &export.PlaneLocation{Icao: "7C4516"}, map[string]string{}},
+		{"leave the state", location(-31.94, 140, 6000), map[string]string{"wa": export.GeofenceEventExit}},
+		{"come back", location(-31.5, 115.97, 6000), map[string]string{"wa": export.GeofenceEventEnter}},
+	}
+	for _, step := range steps {
+		got := events(r.Check(step.loc))
+		if len(got) != len(step.want) {
+			t.Fatalf("%s: got %v, want %v", step.name, got, step.want)
+		}
+		for id, event := range step.want {
+			if got[id] != event {
+				t.Fatalf("%s: got %v, want %v", step.name, got, step.want)
+			}
+		}
+	}
+
+	if got := events(r.Forget("7C4516")); 1 != len(got) || export.GeofenceEventExit != got["wa"] {
+		t.Errorf("expected forgetting the aircraft to exit the state, got %v", got)
+	}
+	if 0 != len(r.Forget("7C4516")) {
+		t.Errorf("expected nothing left to exit")
+	}
+}
+
+func TestRegistry_PutRemove(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Put(Fence{Id: "bad"}); nil == err {
+		t.Errorf("expected an invalid fence to be rejected")
+	}
+	if err := r.Put(perth); nil != err {
+		t.Fatal(err)
+	}
+	r.Check(location(-31.94, 115.97, 1000))
+
+	// move the fence somewhere else, the aircraft is no longer in it
+	moved := perth
+	moved.Polygon = []Point{{10, 10}, {10, 11}, {11, 11}}
+	if err := r.Put(moved); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != r.Len() {
+		t.Errorf("expected replacing a fence to keep 1 fence, got %d", r.Len())
+	}
+	if got := r.Check(location(-31.94, 115.97, 1000)); 0 != len(got) {
+		t.Errorf("expected no matches after moving the fence, got %v", got)
+	}
+	if got := events(r.Check(location(10.5, 10.7, 1000))); export.GeofenceEventEnter != got["YPPH"] {
+		t.Errorf("expected to enter the moved fence, got %v", got)
+	}
+
+	if !r.Remove("YPPH") || r.Remove("YPPH") {
+		t.Errorf("expected to remove the fence exactly once")
+	}
+	if 0 != len(r.List()) || 0 != len(r.cells) || 0 != len(r.inside) {
+		t.Errorf("expected nothing left after removing the fence")
+	}
+}
@@ -0,0 +1,119 @@
+package history
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kpawlik/geojson"
+)
+
+const feetToMetres = 0.3048
+
+type (
+	kmlDocument struct {
+		XMLName  xml.Name `xml:"http://www.opengis.net/kml/2.2 kml"`
+		Document struct {
+			Name      string       `xml:"name"`
+			Placemark kmlPlacemark `xml:"Placemark"`
+		} `xml:"Document"`
+	}
+
+	kmlPlacemark struct {
+		Name     string `xml:"name"`
+		TimeSpan struct {
+			Begin string `xml:"begin"`
+			End   string `xml:"end"`
+		} `xml:"TimeSpan"`
+		LineString struct {
+			AltitudeMode string `xml:"altitudeMode"`
+			Coordinates  string `xml:"coordinates"`
+		} `xml:"LineString"`
+	}
+)
+
+// name is what we call the path, the icao and callsign
+func (r *Result) name() string {
+	if "" == r.CallSign {
+		return r.Icao
+	}
+	return r.Icao + " " + r.CallSign
+}
+
+// altitudes are the path's altitudes (in metres), points without one use the last altitude we had
+func (r *Result) altitudes() []float64 {
+	out := make([]float64, len(r.Path))
+	last := 0.0
+	for i, p := range r.Path {
+		if nil != p.Altitude {
+			last = float64(*p.Altitude) * feetToMetres
+		}
+		out[i] = last
+	}
+	return out
+}
+
+// GeoJSON is the path as a LineString feature (longitude, latitude and altitude in metres), with the time, altitude
+// (in feet), velocity and heading at each point in its properties
+func (r *Result) GeoJSON() *geojson.FeatureCollection {
+	altitudes := r.altitudes()
+	coordinates := make(geojson.Coordinates, len(r.Path))
+	times := make([]string, len(r.Path))
+	altitudeFeet := make([]*int32, len(r.Path))
+	velocities := make([]float64, len(r.Path))
+	headings := make([]float64, len(r.Path))
+	for i, p := range r.Path {
+		coordinates[i] = geojson.Coordinate{geojson.CoordType(p.Lon), geojson.CoordType(p.Lat), geojson.CoordType(altitudes[i])}
+		times[i] = p.Time.UTC().Format(time.RFC3339Nano)
+		altitudeFeet[i] = p.Altitude
+		velocities[i] = p.Velocity
+		headings[i] = p.Heading
+	}
+	props := map[string]interface{}{
+		"icao":       r.Icao,
+		"callSign":   r.CallSign,
+		"from":       r.From.UTC().Format(time.RFC3339),
+		"to":         r.To.UTC().Format(time.RFC3339),
+		"method":     r.Method,
+		"points":     r.Points,
+		"times":      times,
+		"altitudes":  altitudeFeet,
+		"velocities": velocities,
+		"headings":   headings,
+	}
+	fc := geojson.NewFeatureCollection([]*geojson.Feature{})
+	fc.AddFeatures(geojson.NewFeature(geojson.NewLineString(coordinates), props, r.Icao))
+	return fc
+}
+
+// KML is the path as a KML LineString, at its altitude
+func (r *Result) KML() ([]byte, error) {
+	doc := kmlDocument{}
+	doc.Document.Name = r.name()
+	pm := &doc.Document.Placemark
+	pm.Name = r.name()
+	pm.TimeSpan.Begin = r.From.UTC().Format(time.RFC3339)
+	pm.TimeSpan.End = r.To.UTC().Format(time.RFC3339)
+	pm.LineString.AltitudeMode = "absolute"
+
+	altitudes := r.altitudes()
+	coordinates := strings.Builder{}
+	for i, p := range r.Path {
+		if i > 0 {
+			coordinates.WriteByte(' ')
+		}
+		coordinates.WriteString(strconv.FormatFloat(p.Lon, 'f', -1, 64))
+		coordinates.WriteByte(',')
+		coordinates.WriteString(strconv.FormatFloat(p.Lat, 'f', -1, 64))
+		coordinates.WriteByte(',')
+		coordinates.WriteString(strconv.FormatFloat(altitudes[i], 'f', 1, 64))
+	}
+	pm.LineString.Coordinates = coordinates.String()
+
+	buf, err := xml.MarshalIndent(doc, "", "  ")
+	if nil != err {
+		return nil, err
+	}
+	return append([]byte(xml.Header), buf...), nil
+}
@@ -0,0 +1,157 @@
+package history
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"plane.watch/lib/geo"
+)
+
+// The ways we can simplify a path down to MaxPoints
+const (
+	// MethodTime keeps the first point in each of MaxPoints equal slices of time
+	MethodTime = "time"
+	// MethodDouglasPeucker keeps the points that do the most to keep the shape of the path
+	MethodDouglasPeucker = "douglas-peucker"
+)
+
+const (
+	// DefaultSpan is how far back we look when we are not told where to start
+	DefaultSpan = 12 * time.Hour
+	// DefaultMaxPoints is how many points a path (and profile) is simplified to when we are not told
+	DefaultMaxPoints = 2000
+	// MaxPoints is the most points a path (and profile) can have
+	MaxPoints = 10_000
+)
+
+var (
+	ErrInvalidQuery = errors.New("invalid history query")
+
+	icaoPattern     = regexp.MustCompile(`^[0-9A-F]{6}$`)
+	callSignPattern = regexp.MustCompile(`^[A-Z0-9]{1,8}$`)
+)
+
+type (
+	// Options are how much of an aircraft's history we want, and how to simplify it
+	Options struct {
+		// From and To are the time range, the DefaultSpan up to now when left out
+		From time.Time `json:"from,omitempty"`
+		To   time.Time `json:"to,omitempty"`
+		// MaxPoints is the most points to send (for the path and for the profile), DefaultMaxPoints when left out
+		MaxPoints int `json:"maxPoints,omitempty"`
+		// Method is how to simplify the path, MethodTime (the default) or MethodDouglasPeucker
+		Method string `json:"method,omitempty"`
+		// Tolerance is how far (in metres) MethodDouglasPeucker can leave the path out by, 0 to only go by MaxPoints
+		Tolerance float64 `json:"tolerance,omitempty"`
+	}
+
+	// Query is the history of an aircraft, by icao and (optionally) the callsign it flew as
+	Query struct {
+		Icao     string `json:"icao"`
+		CallSign string `json:"callSign,omitempty"`
+		Options
+	}
+
+	// Point is where an aircraft was
+	Point struct {
+		Time              time.Time
+		Lat, Lon          float64
+		Heading, Velocity float64
+		Altitude          *int32
+	}
+
+	// ProfilePoint is the aircraft's altitude and speed, and how far it had flown, at a point in time
+	ProfilePoint struct {
+		Time time.Time
+		// Distance is how far (in metres) the aircraft had flown since the start of the history
+		Distance float64
+		Altitude *int32
+		Velocity float64
+	}
+
+	// Result is the simplified path and profile of an aircraft
+	Result struct {
+		Query
+		// Points is how many points there were before simplifying
+		Points  int
+		Path    []Point
+		Profile []ProfilePoint
+	}
+)
+
+// Check makes sure the query is one we can run, spanning no more than maxSpan (when > 0), and fills in the defaults
+func (q *Query) Check(maxSpan time.Duration, now time.Time) error {
+	q.Icao = strings.ToUpper(strings.TrimSpace(q.Icao))
+	q.CallSign = strings.ToUpper(strings.TrimSpace(q.CallSign))
+	if !icaoPattern.MatchString(q.Icao) {
+		return fmt.Errorf("%w: icao must be 6 hex digits", ErrInvalidQuery)
+	}
+	if "" != q.CallSign && !callSignPattern.MatchString(q.CallSign) {
+		return fmt.Errorf("%w: callsign must be up to 8 letters and numbers", ErrInvalidQuery)
+	}
+	if q.To.IsZero() {
+		q.To = now
+	}
+	if q.From.IsZero() {
+		q.From = q.To.Add(-DefaultSpan)
+	}
+	if !q.From.Before(q.To) {
+		return fmt.Errorf("%w: from must be before to", ErrInvalidQuery)
+	}
+	if maxSpan > 0 && q.To.Sub(q.From) > maxSpan {
+		return fmt.Errorf("%w: can get at most %s at a time", ErrInvalidQuery, maxSpan)
+	}
+	if 0 == q.MaxPoints {
+		q.MaxPoints = DefaultMaxPoints
+	}
+	if q.MaxPoints < 2 || q.MaxPoints > MaxPoints {
+		return fmt.Errorf("%w: maxPoints must be from 2 to %d", ErrInvalidQuery, MaxPoints)
+	}
+	switch q.Method {
+	case "":
+		q.Method = MethodTime
+	case MethodTime, MethodDouglasPeucker:
+	default:
+		return fmt.Errorf("%w: method must be %s or %s", ErrInvalidQuery, MethodTime, MethodDouglasPeucker)
+	}
+	if q.Tolerance < 0 {
+		return fmt.Errorf("%w: tolerance cannot be negative", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// Build simplifies the (checked) query's points, oldest first, into its path and profile
+func Build(q Query, points []Point) *Result {
+	r := &Result{
+		Query:   q,
+		Points:  len(points),
+		Profile: TimeBuckets(profile(points), q.MaxPoints, func(p ProfilePoint) time.Time { return p.Time }),
+	}
+	if MethodDouglasPeucker == q.Method {
+		r.Path = DouglasPeucker(points, q.MaxPoints, q.Tolerance)
+	} else {
+		r.Path = TimeBuckets(points, q.MaxPoints, func(p Point) time.Time { return p.Time })
+	}
+	return r
+}
+
+// profile is the altitude, speed and distance flown at each point
+func profile(points []Point) []ProfilePoint {
+	out := make([]ProfilePoint, len(points))
+	distance := 0.0
+	for i, p := range points {
+		if i > 0 {
+			distance += geo.Distance(points[i-1].Lat, points[i-1].Lon, p.Lat, p.Lon)
+		}
+		out[i] = ProfilePoint{
+			Time:     p.Time,
+			Distance: distance,
+			Altitude: p.Altitude,
+			Velocity: p.Velocity,
+		}
+	}
+	return out
+}
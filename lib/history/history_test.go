@@ -0,0 +1,173 @@
+package history
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/kpawlik/geojson"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// straightFlight flies east along the equator at about 111m (0.001 degrees) a second, climbing 10ft a second
+func straightFlight(start time.Time, n int) []Point {
+	points := make([]Point, n)
+	for i := range points {
+		points[i] = Point{
+			Time:     start.Add(time.Duration(i) * time.Second),
+			Lon:      float64(i) * 0.001,
+			Velocity: 216,
+			Heading:  90,
+			Altitude: ptr(int32(i * 10)),
+		}
+	}
+	return points
+}
+
+func TestQuery_Check(t *testing.T) {
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	q := Query{Icao: " 7c6ca3", CallSign: "qfa9 "}
+	if err := q.Check(24*time.Hour, now); nil != err {
+		t.Fatal(err)
+	}
+	if "7C6CA3" != q.Icao || "QFA9" != q.CallSign || !q.To.Equal(now) || !q.From.Equal(now.Add(-DefaultSpan)) ||
+		DefaultMaxPoints != q.MaxPoints || MethodTime != q.Method {
+		t.Errorf("expected the defaults to be filled in, got %+v", q)
+	}
+
+	tests := map[string]Query{
+		"short icao":      {Icao: "7C6CA"},
+		"not hex":         {Icao: "7C6CAZ"},
+		"injection":       {Icao: "7C6CA3' OR 1=1 --"},
+		"bad callsign":    {Icao: "7C6CA3", CallSign: "QFA9'--"},
+		"long callsign":   {Icao: "7C6CA3", CallSign: "QFA123456"},
+		"backwards":       {Icao: "7C6CA3", Options: Options{From: now, To: now.Add(-time.Hour)}},
+		"too long":        {Icao: "7C6CA3", Options: Options{From: now.Add(-48 * time.Hour), To: now}},
+		"too many points": {Icao: "7C6CA3", Options: Options{MaxPoints: MaxPoints + 1}},
+		"one point":       {Icao: "7C6CA3", Options: Options{MaxPoints: 1}},
+		"unknown method":  {Icao: "7C6CA3", Options: Options{Method: "rdp"}},
+		"tolerance":       {Icao: "7C6CA3", Options: Options{Tolerance: -1}},
+	}
+	for name, q := range tests {
+		if err := q.Check(24*time.Hour, now); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: expected an invalid query, got %v", name, err)
+		}
+	}
+}
+
+func TestTimeBuckets(t *testing.T) {
+	points := straightFlight(time.Now(), 1000)
+	at := func(p Point) time.Time { return p.Time }
+	got := TimeBuckets(points, 100, at)
+	if 100 != len(got) {
+		t.Fatalf("expected 100 points, got %d", len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if gap := got[i].Time.Sub(got[i-1].Time); gap < 9*time.Second || gap > 11*time.Second {
+			t.Errorf("expected points about 10s apart, got %s at %d", gap, i)
+		}
+	}
+	if got = TimeBuckets(points[:50], 100, at); 50 != len(got) {
+		t.Errorf("expected short paths to be left alone, got %d", len(got))
+	}
+	same := []Point{points[0], points[0], points[0]}
+	if got = TimeBuckets(same, 2, at); 1 != len(got) {
+		t.Errorf("expected points at the same time to be one point, got %d", len(got))
+	}
+}
+
+func TestDouglasPeucker(t *testing.T) {
+	// east for 100 points, then north for 100
+	points := straightFlight(time.Now(), 200)
+	for i := 100; i < 200; i++ {
+		points[i].Lon = points[99].Lon
+		points[i].Lat = float64(i-99) * 0.001
+	}
+	// a 50m wobble
+	points[50].Lat = 50.0 / metresPerDegree
+
+	got := DouglasPeucker(points, 3, 0)
+	if 3 != len(got) || 0 != got[0].Lon || !got[1].Time.Equal(points[99].Time) || !got[2].Time.Equal(points[199].Time) {
+		t.Errorf("expected the start, corner and end, got %+v", got)
+	}
+	if got = DouglasPeucker(points, 4, 0); 4 != len(got) || !got[1].Time.Equal(points[50].Time) {
+		t.Errorf("expected the wobble to be next most important, got %+v", got)
+	}
+	if got = DouglasPeucker(points, 100, 60); 3 != len(got) {
+		t.Errorf("expected the wobble to be in tolerance, got %d points", len(got))
+	}
+	// the wobble is a spike, the points either side of it are off the path without them too
+	if got = DouglasPeucker(points, 100, 40); 6 != len(got) {
+		t.Errorf("expected the wobble to be out of tolerance, got %d points", len(got))
+	}
+}
+
+func TestOffPath(t *testing.T) {
+	a := Point{Lat: 0, Lon: 179.999}
+	b := Point{Lat: 0, Lon: -179.999}
+	p := Point{Lat: 0.001, Lon: 180}
+	if d := offPath(p, a, b); math.Abs(d-111.195) > 0.5 {
+		t.Errorf("expected about 111m across the antimeridian, got %f", d)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	start := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+	q := Query{Icao: "7C6CA3", Options: Options{From: start, To: start.Add(time.Hour), MaxPoints: 10, Method: MethodDouglasPeucker, Tolerance: 1}}
+	if err := q.Check(0, start.Add(time.Hour)); nil != err {
+		t.Fatal(err)
+	}
+	r := Build(q, straightFlight(start, 1000))
+	if 1000 != r.Points || 2 != len(r.Path) || 10 != len(r.Profile) {
+		t.Fatalf("expected a straight path of 2 points and a profile of 10, got %d and %d", len(r.Path), len(r.Profile))
+	}
+	last := r.Profile[len(r.Profile)-1]
+	if 9000 != *last.Altitude || math.Abs(last.Distance-900*111.195) > 100 {
+		t.Errorf("expected the profile to climb and fly along, got %+v", last)
+	}
+}
+
+func TestResult_Export(t *testing.T) {
+	start := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+	r := &Result{
+		Query: Query{Icao: "7C6CA3", CallSign: "QFA9", Options: Options{From: start, To: start.Add(time.Hour)}},
+		Path:  straightFlight(start, 3),
+	}
+	r.Path[1].Altitude = nil
+
+	buf, err := jsoniter.Marshal(r.GeoJSON())
+	if nil != err {
+		t.Fatal(err)
+	}
+	var fc geojson.FeatureCollection
+	if err = jsoniter.Unmarshal(buf, &fc); nil != err {
+		t.Fatal(err)
+	}
+	if 1 != len(fc.Features) || "QFA9" != fc.Features[0].Properties["callSign"] {
+		t.Fatalf("unexpected geojson %s", buf)
+	}
+	if !strings.Contains(string(buf), `"coordinates":[[0,0,0],[0.001,0,0],[0.002,0,6.096]]`) {
+		t.Errorf("expected lon, lat and altitude in metres, got %s", buf)
+	}
+
+	kml, err := r.KML()
+	if nil != err {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<kml xmlns="http://www.opengis.net/kml/2.2">`,
+		`<name>7C6CA3 QFA9</name>`,
+		`<begin>2023-10-01T00:00:00Z</begin>`,
+		`<coordinates>0,0,0.0 0.001,0,0.0 0.002,0,6.1</coordinates>`,
+	} {
+		if !strings.Contains(string(kml), want) {
+			t.Errorf("expected %s in %s", want, kml)
+		}
+	}
+}
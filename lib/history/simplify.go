@@ -0,0 +1,106 @@
+package history
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// metresPerDegree is how long a degree of latitude is, near enough
+const metresPerDegree = 111_195
+
+// TimeBuckets cuts the time the items (oldest first) cover into maxPoints equal slices, and keeps the first item in
+// each slice
+func TimeBuckets[T any](items []T, maxPoints int, at func(T) time.Time) []T {
+	if len(items) <= maxPoints {
+		return items
+	}
+	first := at(items[0])
+	span := float64(at(items[len(items)-1]).Sub(first))
+	out := make([]T, 0, maxPoints)
+	last := -1
+	for _, item := range items {
+		bucket := maxPoints - 1
+		if span > 0 {
+			bucket = min(int(float64(at(item).Sub(first))/span*float64(maxPoints)), maxPoints-1)
+		}
+		if bucket != last {
+			out = append(out, item)
+			last = bucket
+		}
+	}
+	return out
+}
+
+// DouglasPeucker keeps the (at most maxPoints) points that do the most to keep the shape of the path, leaving out any
+// that are within tolerance metres of it
+func DouglasPeucker(points []Point, maxPoints int, tolerance float64) []Point {
+	n := len(points)
+	if n <= 2 || (n <= maxPoints && 0 == tolerance) {
+		return points
+	}
+
+	// importance is how far the point is off the path without it, at most as important as the point that split
+	// its part of the path so the points we keep always make up a Douglas-Peucker simplification
+	importance := make([]float64, n)
+	importance[0], importance[n-1] = math.Inf(1), math.Inf(1)
+	type part struct {
+		from, to int
+		limit    float64
+	}
+	parts := []part{{0, n - 1, math.Inf(1)}}
+	for len(parts) > 0 {
+		p := parts[len(parts)-1]
+		parts = parts[:len(parts)-1]
+		if p.to-p.from < 2 {
+			continue
+		}
+		furthest, distance := p.from+1, -1.0
+		for i := p.from + 1; i < p.to; i++ {
+			if d := offPath(points[i], points[p.from], points[p.to]); d > distance {
+				furthest, distance = i, d
+			}
+		}
+		distance = math.Min(distance, p.limit)
+		importance[furthest] = distance
+		parts = append(parts, part{p.from, furthest, distance}, part{furthest, p.to, distance})
+	}
+
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return importance[order[i]] > importance[order[j]]
+	})
+	keep := make([]bool, n)
+	for k, i := range order {
+		if k >= maxPoints || importance[i] < tolerance {
+			break
+		}
+		keep[i] = true
+	}
+	out := make([]Point, 0, min(n, maxPoints))
+	for i, p := range points {
+		if keep[i] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// offPath is how far (in metres) p is from the line between a and b, flattened out around a
+func offPath(p, a, b Point) float64 {
+	cosLat := math.Cos(a.Lat * math.Pi / 180)
+	flatten := func(q Point) (float64, float64) {
+		dLon := math.Mod(q.Lon-a.Lon+540, 360) - 180 // the short way, across the antimeridian if need be
+		return dLon * cosLat, q.Lat - a.Lat
+	}
+	px, py := flatten(p)
+	bx, by := flatten(b)
+	t := 0.0
+	if length := bx*bx + by*by; length > 0 {
+		t = math.Max(0, math.Min(1, (px*bx+py*by)/length))
+	}
+	return math.Hypot(px-t*bx, py-t*by) * metresPerDegree
+}
@@ -218,6 +218,36 @@ func (n *Server) SubscribeQueueGroup(subject, queueGroup string) (chan *nats.Msg
 	return ch, nil
 }
 
+// SubscribeQueueGroupChan is SubscribeQueueGroup delivering to a channel we already have, the subscription is
+// returned so that it can be unsubscribed from
+func (n *Server) SubscribeQueueGroupChan(subject, queueGroup string, ch chan *nats.Msg) (*nats.Subscription, error) {
+	if nil == n.incoming {
+		return nil, errors.New("incoming nats connection not set up")
+	}
+	sub, err := n.incoming.ChanQueueSubscribe(subject, queueGroup, ch)
+	if nil != err {
+		return nil, err
+	}
+	n.log.Info().Str("subject", subject).Str("queue-group", queueGroup).Msg("subscribed")
+	return sub, nil
+}
+
+// KeyValue gets the JetStream key value bucket, creating it if it does not exist. Keys expire after ttl (0 for never)
+func (n *Server) KeyValue(bucket string, ttl time.Duration) (nats.KeyValue, error) {
+	if nil == n.outgoing {
+		return nil, errors.New("outgoing nats connection not set up")
+	}
+	js, err := n.outgoing.JetStream()
+	if nil != err {
+		return nil, err
+	}
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket, TTL: ttl})
+	}
+	return kv, err
+}
+
 func (n *Server) Request(subject string, data []byte, headers map[string]string, timeout time.Duration) ([]byte, error) {
 	if nil == n.outgoing {
 		return nil, errors.New("outgoing nats connection not set up")
@@ -0,0 +1,62 @@
+package partition
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Of tells us which of the given number of partitions an aircraft belongs in
+func Of(icao string, partitions int) int {
+	if partitions <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(strings.ToUpper(strings.TrimSpace(icao))))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// Subject is the partitioned version of a subject, e.g. location-updates.3
+func Subject(subject string, partition int) string {
+	return subject + "." + strconv.Itoa(partition)
+}
+
+// SubjectFor is the partitioned subject for an aircraft, the subject is unchanged when we are not partitioning
+func SubjectFor(subject, icao string, partitions int) string {
+	if partitions <= 0 {
+		return subject
+	}
+	return Subject(subject, Of(icao, partitions))
+}
+
+// Owner picks the member that owns a partition. We use rendezvous hashing so that when a member comes or goes
+// only the partitions it owned move
+func Owner(partition int, members []string) string {
+	var owner string
+	var best uint64
+	p := strconv.Itoa(partition)
+	for _, m := range members {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(m))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(p))
+		score := h.Sum64()
+		if "" == owner || score > best || (score == best && m < owner) {
+			owner, best = m, score
+		}
+	}
+	return owner
+}
+
+// Owned lists the partitions (in order) that self owns out of the given members
+func Owned(self string, members []string, partitions int) []int {
+	owned := make([]int, 0)
+	for p := 0; p < partitions; p++ {
+		if Owner(p, members) == self {
+			owned = append(owned, p)
+		}
+	}
+	sort.Ints(owned)
+	return owned
+}
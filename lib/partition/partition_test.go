@@ -0,0 +1,66 @@
+package partition
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestOf(t *testing.T) {
+	if Of("7c4516", 16) != Of(" 7C4516", 16) {
+		t.Errorf("expected the partition to not care about case or spaces")
+	}
+	if 0 != Of("7C4516", 0) || 0 != Of("7C4516", 1) {
+		t.Errorf("expected everything in partition 0 when not partitioning")
+	}
+	counts := make([]int, 8)
+	for i := 0; i < 8000; i++ {
+		counts[Of(fmt.Sprintf("%06X", i*37), 8)]++
+	}
+	for p, c := range counts {
+		if c < 800 || c > 1200 {
+			t.Errorf("partition %d has %d aircraft, expected roughly 1000", p, c)
+		}
+	}
+}
+
+func TestSubjectFor(t *testing.T) {
+	if got := SubjectFor("location-updates", "7C4516", 0); "location-updates" != got {
+		t.Errorf("expected an unpartitioned subject, got %s", got)
+	}
+	if got := SubjectFor("location-updates", "7C4516", 16); Subject("location-updates", Of("7C4516", 16)) != got {
+		t.Errorf("unexpected subject %s", got)
+	}
+}
+
+func TestOwned(t *testing.T) {
+	const partitions = 64
+	members := []string{"a", "b", "c"}
+
+	seen := make(map[int]string)
+	for _, m := range members {
+		for _, p := range Owned(m, members, partitions) {
+			if other, ok := seen[p]; ok {
+				t.Fatalf("partition %d owned by %s and %s", p, other, m)
+			}
+			seen[p] = m
+		}
+	}
+	if partitions != len(seen) {
+		t.Fatalf("expected every partition to be owned, got %d", len(seen))
+	}
+
+	// when c goes away, only c's partitions should move
+	for p, owner := range seen {
+		newOwner := Owner(p, []string{"b", "a"})
+		if "c" != owner && newOwner != owner {
+			t.Errorf("partition %d moved from %s to %s when c left", p, owner, newOwner)
+		}
+		if "c" == newOwner {
+			t.Errorf("partition %d still owned by c", p)
+		}
+	}
+
+	if 0 != len(Owned("z", members, partitions)) {
+		t.Errorf("expected a non member to own nothing")
+	}
+}
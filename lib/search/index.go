@@ -0,0 +1,252 @@
+package search
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MinQueryLength is the shortest (normalised) query we look for anything with
+const MinQueryLength = 2
+
+// How well a query matches, the better matches rank first
+const (
+	MatchNone Match = iota
+	// MatchContains is a query found somewhere in a field, queries shorter than 3 never match like this
+	MatchContains
+	// MatchPrefix is a field that starts with the query
+	MatchPrefix
+	// MatchExact is a field that is the query
+	MatchExact
+)
+
+type (
+	Match int
+
+	// Hit is something that matched a query, and how well
+	Hit[T any] struct {
+		Item  T
+		Match Match
+		// Field is the first of the item's fields that matched this well, earlier fields rank first
+		Field int
+	}
+
+	// Index finds items by any of their fields. Every field is indexed by its trigrams (and the prefix a two letter
+	// query matches) so that a search only looks at the items that could match.
+	Index[T any] struct {
+		mu    sync.RWMutex
+		docs  map[string]*doc[T]
+		grams map[string]map[string]struct{}
+		less  func(a, b T) bool
+	}
+
+	doc[T any] struct {
+		item   T
+		raw    []string
+		fields []string
+	}
+)
+
+// NewIndex is an empty index, where hits that match equally well are ordered by less (if we have one)
+func NewIndex[T any](less func(a, b T) bool) *Index[T] {
+	return &Index[T]{
+		docs:  make(map[string]*doc[T]),
+		grams: make(map[string]map[string]struct{}),
+		less:  less,
+	}
+}
+
+// Normalize is how fields and queries are compared, lower case letters and digits only. So "VH-ZNA" is found
+// with "vhzna" and "vh zna"
+func Normalize(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// Rank is how well query matches the best of fields, and which field that was
+func Rank(query string, fields ...string) (Match, int) {
+	normalized := make([]string, len(fields))
+	for i, f := range fields {
+		normalized[i] = Normalize(f)
+	}
+	return rank(Normalize(query), normalized)
+}
+
+func rank(q string, fields []string) (Match, int) {
+	best, field := MatchNone, 0
+	for i, f := range fields {
+		m := MatchNone
+		switch {
+		case "" == f:
+		case q == f:
+			m = MatchExact
+		case strings.HasPrefix(f, q):
+			m = MatchPrefix
+		case utf8.RuneCountInString(q) > MinQueryLength && strings.Contains(f, q):
+			m = MatchContains
+		}
+		if m > best {
+			best, field = m, i
+		}
+	}
+	return best, field
+}
+
+// grams are the index keys for a normalised field or query: the two letter prefix, and every trigram
+func grams(s string, prefix, trigrams bool) []string {
+	runes := []rune(s)
+	out := make([]string, 0, len(runes))
+	if prefix && len(runes) >= MinQueryLength {
+		out = append(out, "^"+string(runes[:MinQueryLength]))
+	}
+	if trigrams {
+		for i := 0; i+3 <= len(runes); i++ {
+			out = append(out, string(runes[i:i+3]))
+		}
+	}
+	return out
+}
+
+// Set adds (or updates) an item, found by its fields. Setting an item with the same fields as it had is cheap
+func (idx *Index[T]) Set(id string, item T, fields ...string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if d, ok := idx.docs[id]; ok {
+		if sameFields(d.raw, fields) {
+			d.item = item
+			return
+		}
+		idx.unindex(id, d)
+	}
+	d := &doc[T]{item: item, raw: append([]string(nil), fields...), fields: make([]string, len(fields))}
+	for i, f := range fields {
+		d.fields[i] = Normalize(f)
+	}
+	idx.docs[id] = d
+	for _, f := range d.fields {
+		for _, g := range grams(f, true, true) {
+			ids, ok := idx.grams[g]
+			if !ok {
+				ids = make(map[string]struct{})
+				idx.grams[g] = ids
+			}
+			ids[id] = struct{}{}
+		}
+	}
+}
+
+// Delete forgets about an item
+func (idx *Index[T]) Delete(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if d, ok := idx.docs[id]; ok {
+		idx.unindex(id, d)
+	}
+}
+
+func (idx *Index[T]) unindex(id string, d *doc[T]) {
+	for _, f := range d.fields {
+		for _, g := range grams(f, true, true) {
+			if ids, ok := idx.grams[g]; ok {
+				delete(ids, id)
+				if 0 == len(ids) {
+					delete(idx.grams, g)
+				}
+			}
+		}
+	}
+	delete(idx.docs, id)
+}
+
+// Len is how many items we have
+func (idx *Index[T]) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.docs)
+}
+
+// Search finds the items matching query, exact matches first, then prefixes, then anything containing it. At most
+// limit hits are returned, unless limit is 0
+func (idx *Index[T]) Search(query string, limit int) []Hit[T] {
+	q := Normalize(query)
+	n := utf8.RuneCountInString(q)
+	if n < MinQueryLength {
+		return nil
+	}
+
+	idx.mu.RLock()
+	// a two letter query only matches the start of fields, longer ones have to have all of their trigrams
+	candidates := idx.candidates(grams(q, n == MinQueryLength, n > MinQueryLength))
+	hits := make([]Hit[T], 0, len(candidates))
+	for id := range candidates {
+		d := idx.docs[id]
+		if m, f := rank(q, d.fields); MatchNone != m {
+			hits = append(hits, Hit[T]{Item: d.item, Match: m, Field: f})
+		}
+	}
+	idx.mu.RUnlock()
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Match != hits[j].Match {
+			return hits[i].Match > hits[j].Match
+		}
+		if hits[i].Field != hits[j].Field {
+			return hits[i].Field < hits[j].Field
+		}
+		return nil != idx.less && idx.less(hits[i].Item, hits[j].Item)
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+// candidates are the ids that have every one of keys, starting from the rarest key
+func (idx *Index[T]) candidates(keys []string) map[string]struct{} {
+	if 0 == len(keys) {
+		return nil
+	}
+	sets := make([]map[string]struct{}, 0, len(keys))
+	for _, k := range keys {
+		ids, ok := idx.grams[k]
+		if !ok {
+			return nil
+		}
+		sets = append(sets, ids)
+	}
+	sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+	if 1 == len(sets) {
+		return sets[0]
+	}
+	out := make(map[string]struct{}, len(sets[0]))
+next:
+	for id := range sets[0] {
+		for _, ids := range sets[1:] {
+			if _, ok := ids[id]; !ok {
+				continue next
+			}
+		}
+		out[id] = struct{}{}
+	}
+	return out
+}
+
+func sameFields(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
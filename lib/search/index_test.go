@@ -0,0 +1,155 @@
+package search
+
+import (
+	"testing"
+)
+
+type testAircraft struct {
+	icao, callSign, registration, typeCode, operator string
+}
+
+func (a testAircraft) fields() []string {
+	return []string{a.icao, a.callSign, a.registration, a.typeCode, a.operator}
+}
+
+func newTestIndex() *Index[testAircraft] {
+	idx := NewIndex(func(a, b testAircraft) bool { return a.callSign < b.callSign })
+	for _, a := range []testAircraft{
+		{"7C6CA3", "QFA9", "VH-ZNA", "B789", "Qantas"},
+		{"7C6CA4", "QFA94", "VH-ZNB", "B789", "Qantas"},
+		{"7C4924", "VOZ1", "VH-YIA", "B738", "Virgin Australia"},
+		{"7C0001", "AQFA", "VH-QFA", "A320", "Not Qantas"},
+		{"406A3B", "BAW15", "G-XWBA", "A35K", "British Airways"},
+	} {
+		idx.Set(a.icao, a, a.fields()...)
+	}
+	return idx
+}
+
+func names[T any](hits []Hit[T], name func(T) string) []string {
+	out := make([]string, len(hits))
+	for i, h := range hits {
+		out[i] = name(h.Item)
+	}
+	return out
+}
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"VH-ZNA":            "vhzna",
+		" qfa 9 ":           "qfa9",
+		"Perth Int'l (PER)": "perthintlper",
+		"Zürich":            "zürich",
+		"--":                "",
+	}
+	for in, want := range tests {
+		if got := Normalize(in); want != got {
+			t.Errorf("Normalize(%q): expected %q, got %q", in, want, got)
+		}
+	}
+}
+
+func TestRank(t *testing.T) {
+	tests := []struct {
+		query  string
+		fields []string
+		match  Match
+		field  int
+	}{
+		{"qfa9", []string{"7C6CA3", "QFA9"}, MatchExact, 1},
+		{"qfa", []string{"7C6CA3", "QFA9"}, MatchPrefix, 1},
+		{"fa9", []string{"7C6CA3", "QFA9"}, MatchContains, 1},
+		{"vhzna", []string{"7C6CA3", "QFA9", "VH-ZNA"}, MatchExact, 2},
+		{"fa", []string{"QFA9"}, MatchNone, 0},
+		{"qfa", []string{"AQFA", "QFA9"}, MatchPrefix, 1},
+		{"nope", []string{"QFA9", ""}, MatchNone, 0},
+	}
+	for _, tt := range tests {
+		if m, f := Rank(tt.query, tt.fields...); tt.match != m || tt.field != f {
+			t.Errorf("Rank(%q, %v): expected %d in field %d, got %d in field %d", tt.query, tt.fields, tt.match, tt.field, m, f)
+		}
+	}
+}
+
+func TestIndex_Search(t *testing.T) {
+	idx := newTestIndex()
+	name := func(a testAircraft) string { return a.callSign }
+	tests := []struct {
+		query string
+		limit int
+		want  []string
+	}{
+		// exact first, then the prefixes, then anything containing it
+		{"qfa9", 0, []string{"QFA9", "QFA94"}},
+		{"qfa", 0, []string{"QFA9", "QFA94", "AQFA"}},
+		{"QF", 0, []string{"QFA9", "QFA94"}},
+		{"qfa", 2, []string{"QFA9", "QFA94"}},
+		{"vh-qfa", 0, []string{"AQFA"}},
+		{"7c6ca", 0, []string{"QFA9", "QFA94"}},
+		{"b789", 0, []string{"QFA9", "QFA94"}},
+		{"australia", 0, []string{"VOZ1"}},
+		{"airways", 0, []string{"BAW15"}},
+		// an earlier field ranks first when they match as well
+		{"qantas", 0, []string{"QFA9", "QFA94", "AQFA"}},
+		{"q", 0, []string{}},
+		{"zzz", 0, []string{}},
+	}
+	for _, tt := range tests {
+		got := names(idx.Search(tt.query, tt.limit), name)
+		if len(tt.want) != len(got) {
+			t.Errorf("Search(%q): expected %v, got %v", tt.query, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if tt.want[i] != got[i] {
+				t.Errorf("Search(%q): expected %v, got %v", tt.query, tt.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestIndex_SetDelete(t *testing.T) {
+	idx := newTestIndex()
+	if 5 != idx.Len() {
+		t.Errorf("expected 5 aircraft, got %d", idx.Len())
+	}
+
+	// same fields, the item is still updated
+	updated := testAircraft{"7C4924", "VOZ1", "VH-YIA", "B738", "Virgin Australia"}
+	idx.Set(updated.icao, updated, updated.fields()...)
+	if hits := idx.Search("voz1", 0); 1 != len(hits) || MatchExact != hits[0].Match {
+		t.Errorf("expected to still find VOZ1, got %+v", hits)
+	}
+
+	// a new callsign, the old one is not found any more
+	updated.callSign = "VOZ2"
+	idx.Set(updated.icao, updated, updated.fields()...)
+	if hits := idx.Search("voz1", 0); 0 != len(hits) {
+		t.Errorf("expected the old callsign to be gone, got %+v", hits)
+	}
+	if hits := idx.Search("voz2", 0); 1 != len(hits) {
+		t.Errorf("expected the new callsign, got %+v", hits)
+	}
+
+	idx.Delete("7C4924")
+	idx.Delete("7C4924")
+	if hits := idx.Search("vhyia", 0); 0 != len(hits) || 4 != idx.Len() {
+		t.Errorf("expected VOZ2 to be gone, got %+v and %d aircraft", hits, idx.Len())
+	}
+	for g, ids := range idx.grams {
+		if _, ok := ids["7C4924"]; ok {
+			t.Errorf("expected 7C4924 to be gone from %s", g)
+		}
+	}
+}
+
+func BenchmarkIndex_Set(b *testing.B) {
+	idx := newTestIndex()
+	a := testAircraft{"7C6CA3", "QFA9", "VH-ZNA", "B789", "Qantas"}
+	fields := a.fields()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		idx.Set(a.icao, a, fields...)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
 	"net/url"
+	"plane.watch/lib/export"
 	"plane.watch/lib/sink"
 	"plane.watch/lib/tracker"
 	"strings"
@@ -16,6 +17,8 @@ import (
 const (
 	Sink             = "sink"
 	SinkCollectDelay = "sink-collect-delay"
+	SinkPartitions   = "sink-partitions"
+	SinkFormat       = "sink-format"
 )
 
 var (
@@ -42,6 +45,17 @@ func IncludeSinkFlags(app *cli.App) {
 			Usage:   "Instead of emitting an update for every update we get, collect updates and send a deduplicated list (based on icao) every period",
 			EnvVars: []string{"SINK_COLLECT_DELAY"},
 		},
+		&cli.IntFlag{
+			Name:    SinkPartitions,
+			Usage:   "Split location updates by icao across this many subjects (location-updates.<n>) for a partitioned pw_router. 0 to not split",
+			EnvVars: []string{"SINK_PARTITIONS"},
+		},
+		&cli.StringFlag{
+			Name:    SinkFormat,
+			Value:   export.WireFormatJSON,
+			Usage:   "The wire format for location updates, json or protobuf. Consumers accept both, upgrade them before switching",
+			EnvVars: []string{"SINK_FORMAT"},
+		},
 	}...)
 }
 
@@ -49,9 +63,14 @@ func HandleSinkFlag(c *cli.Context, connName string) (tracker.Sink, error) {
 	defaultDelay := c.Duration(SinkCollectDelay)
 	defaultTag := c.String(Tag)
 
+	contentType, err := export.ParseWireFormat(c.String(SinkFormat))
+	if nil != err {
+		return nil, err
+	}
+
 	sinkUrl := c.String(Sink)
 	log.Debug().Str("sink-url", sinkUrl).Msg("With Sink")
-	s, err := handleSink(connName, sinkUrl, defaultTag, defaultDelay)
+	s, err := handleSink(connName, sinkUrl, defaultTag, defaultDelay, c.Int(SinkPartitions), contentType)
 	if nil != err {
 		log.Error().Err(err).Str("url", sinkUrl).Str("what", "sink").Msg("Failed setup sink")
 		return nil, err
@@ -60,7 +79,7 @@ func HandleSinkFlag(c *cli.Context, connName string) (tracker.Sink, error) {
 	return s, nil
 }
 
-func handleSink(connName, urlSink, defaultTag string, sendDelay time.Duration) (tracker.Sink, error) {
+func handleSink(connName, urlSink, defaultTag string, sendDelay time.Duration, partitions int, contentType string) (tracker.Sink, error) {
 	parsedUrl, err := url.Parse(urlSink)
 	if nil != err {
 		return nil, err
@@ -75,6 +94,8 @@ func handleSink(connName, urlSink, defaultTag string, sendDelay time.Duration) (
 		sink.WithSourceTag(getTag(parsedUrl, defaultTag)),
 		sink.WithPrometheusCounters(prometheusOutputFrame, prometheusOutputPlaneLocation),
 		sink.WithSendDelay(sendDelay),
+		sink.WithPartitions(partitions),
+		sink.WithContentType(contentType),
 	}
 
 	switch strings.ToLower(parsedUrl.Scheme) {
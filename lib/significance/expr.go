@@ -0,0 +1,305 @@
+package significance
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A tiny expression language for rules, e.g. `altitude < 10000 && d_heading > 3`
+// supports numbers, "strings", true/false, the variables below, comparisons, &&, || ! and brackets
+//
+// variables:
+//   altitude, velocity, heading, vertical_rate, on_ground, squawk, flight_status, special, callsign, airframe,
+//   airframe_type, silence (seconds since the last significant update)
+//   d_altitude, d_velocity, d_heading, d_vertical_rate (the absolute change since the previous update)
+
+type (
+	value struct {
+		kind byte // 'n'umber, 's'tring, 'b'ool
+		num  float64
+		str  string
+		bool bool
+	}
+
+	// vars resolves a variable name to its value
+	vars func(name string) (value, bool)
+
+	node interface {
+		eval(v vars) (value, error)
+	}
+
+	literal  struct{ v value }
+	variable struct{ name string }
+	not      struct{ n node }
+	binary   struct {
+		op          string
+		left, right node
+	}
+
+	parser struct {
+		tokens []string
+		pos    int
+	}
+)
+
+var (
+	ErrUnknownVariable = errors.New("unknown variable")
+	ErrTypeMismatch    = errors.New("type mismatch")
+)
+
+func number(f float64) value { return value{kind: 'n', num: f} }
+func str(s string) value     { return value{kind: 's', str: s} }
+func boolean(b bool) value   { return value{kind: 'b', bool: b} }
+
+// compile parses an expression
+func compile(expr string) (node, error) {
+	tokens, err := tokenise(expr)
+	if nil != err {
+		return nil, err
+	}
+	p := parser{tokens: tokens}
+	n, err := p.or()
+	if nil != err {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in expression %q", p.tokens[p.pos], expr)
+	}
+	return n, nil
+}
+
+func tokenise(expr string) ([]string, error) {
+	var tokens []string
+	r := []rune(expr)
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case '(' == c || ')' == c:
+			tokens = append(tokens, string(c))
+			i++
+		case strings.ContainsRune("=!<>&|", c):
+			if i+1 < len(r) && strings.Contains("== != <= >= && ||", string(r[i:i+2])) {
+				tokens = append(tokens, string(r[i:i+2]))
+				i += 2
+			} else if strings.ContainsRune("!<>", c) {
+				tokens = append(tokens, string(c))
+				i++
+			} else {
+				return nil, fmt.Errorf("unexpected %q in expression %q", c, expr)
+			}
+		case '"' == c:
+			end := i + 1
+			for end < len(r) && '"' != r[end] {
+				end++
+			}
+			if end == len(r) {
+				return nil, fmt.Errorf("unterminated string in expression %q", expr)
+			}
+			tokens = append(tokens, string(r[i:end+1]))
+			i = end + 1
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || '_' == c || '.' == c || '-' == c:
+			end := i + 1
+			for end < len(r) && (unicode.IsLetter(r[end]) || unicode.IsDigit(r[end]) || '_' == r[end] || '.' == r[end]) {
+				end++
+			}
+			tokens = append(tokens, string(r[i:end]))
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected %q in expression %q", c, expr)
+		}
+	}
+	return tokens, nil
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	for nil == err && "||" == p.peek() {
+		p.next()
+		var right node
+		if right, err = p.and(); nil == err {
+			left = binary{op: "||", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.unary()
+	for nil == err && "&&" == p.peek() {
+		p.next()
+		var right node
+		if right, err = p.unary(); nil == err {
+			left = binary{op: "&&", left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) unary() (node, error) {
+	if "!" == p.peek() {
+		p.next()
+		n, err := p.unary()
+		return not{n: n}, err
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (node, error) {
+	left, err := p.operand()
+	if nil != err {
+		return nil, err
+	}
+	switch op := p.peek(); op {
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.operand()
+		if nil != err {
+			return nil, err
+		}
+		return binary{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) operand() (node, error) {
+	t := p.next()
+	switch {
+	case "" == t:
+		return nil, errors.New("unexpected end of expression")
+	case "(" == t:
+		n, err := p.or()
+		if nil != err {
+			return nil, err
+		}
+		if ")" != p.next() {
+			return nil, errors.New("missing closing bracket")
+		}
+		return n, nil
+	case strings.HasPrefix(t, `"`):
+		return literal{v: str(strings.Trim(t, `"`))}, nil
+	case "true" == t || "false" == t:
+		return literal{v: boolean("true" == t)}, nil
+	}
+	if f, err := strconv.ParseFloat(t, 64); nil == err {
+		return literal{v: number(f)}, nil
+	}
+	if _, ok := knownVariables[t]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownVariable, t)
+	}
+	return variable{name: t}, nil
+}
+
+func (l literal) eval(vars) (value, error) {
+	return l.v, nil
+}
+
+func (vr variable) eval(v vars) (value, error) {
+	val, ok := v(vr.name)
+	if !ok {
+		return value{}, fmt.Errorf("%w: %s", ErrUnknownVariable, vr.name)
+	}
+	return val, nil
+}
+
+func (n not) eval(v vars) (value, error) {
+	val, err := n.n.eval(v)
+	if nil != err {
+		return value{}, err
+	}
+	if 'b' != val.kind {
+		return value{}, fmt.Errorf("%w: ! needs a bool", ErrTypeMismatch)
+	}
+	return boolean(!val.bool), nil
+}
+
+func (b binary) eval(v vars) (value, error) {
+	left, err := b.left.eval(v)
+	if nil != err {
+		return value{}, err
+	}
+	// short circuit our logic operators
+	if "&&" == b.op || "||" == b.op {
+		if 'b' != left.kind {
+			return value{}, fmt.Errorf("%w: %s needs bools", ErrTypeMismatch, b.op)
+		}
+		if ("&&" == b.op && !left.bool) || ("||" == b.op && left.bool) {
+			return left, nil
+		}
+		right, err := b.right.eval(v)
+		if nil != err {
+			return value{}, err
+		}
+		if 'b' != right.kind {
+			return value{}, fmt.Errorf("%w: %s needs bools", ErrTypeMismatch, b.op)
+		}
+		return right, nil
+	}
+
+	right, err := b.right.eval(v)
+	if nil != err {
+		return value{}, err
+	}
+	if left.kind != right.kind {
+		return value{}, fmt.Errorf("%w: cannot compare %c with %c", ErrTypeMismatch, left.kind, right.kind)
+	}
+	switch b.op {
+	case "==":
+		return boolean(left == right), nil
+	case "!=":
+		return boolean(left != right), nil
+	}
+	var cmp int
+	switch left.kind {
+	case 'n':
+		switch {
+		case left.num < right.num:
+			cmp = -1
+		case left.num > right.num:
+			cmp = 1
+		}
+	case 's':
+		cmp = strings.Compare(left.str, right.str)
+	default:
+		return value{}, fmt.Errorf("%w: cannot order bools", ErrTypeMismatch)
+	}
+	switch b.op {
+	case "<":
+		return boolean(cmp < 0), nil
+	case "<=":
+		return boolean(cmp <= 0), nil
+	case ">":
+		return boolean(cmp > 0), nil
+	default:
+		return boolean(cmp >= 0), nil
+	}
+}
+
+// evalBool runs an expression that must give us a bool
+func evalBool(n node, v vars) (bool, error) {
+	val, err := n.eval(v)
+	if nil != err {
+		return false, err
+	}
+	if 'b' != val.kind {
+		return false, fmt.Errorf("%w: expression is not a bool", ErrTypeMismatch)
+	}
+	return val.bool, nil
+}
@@ -0,0 +1,368 @@
+package significance
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"plane.watch/lib/export"
+)
+
+// The reasons an update can be significant, exact change fields use the same names in a rules Fields list
+const (
+	ReasonAlways       = "always"
+	ReasonHeading      = "heading"
+	ReasonVelocity     = "velocity"
+	ReasonVerticalRate = "vertical_rate"
+	ReasonAltitude     = "altitude"
+	ReasonFlightStatus = "flight_status"
+	ReasonOnGround     = "on_ground"
+	ReasonSpecial      = "special"
+	ReasonSquawk       = "squawk"
+	ReasonEmergencies  = "emergencies"
+	ReasonTile         = "tile"
+	ReasonCallSign     = "callsign"
+	ReasonMaxSilence   = "max_silence"
+	ReasonExpr         = "expr"
+)
+
+// DefaultRuleName is the name of the built-in catch-all rule
+const DefaultRuleName = "default"
+
+type (
+	// Match decides which aircraft a rule applies to, everything given must match
+	Match struct {
+		// MinAltitude and MaxAltitude are an altitude band in feet (inclusive)
+		MinAltitude *int  `yaml:"min_altitude" json:"min_altitude"`
+		MaxAltitude *int  `yaml:"max_altitude" json:"max_altitude"`
+		OnGround    *bool `yaml:"on_ground" json:"on_ground"`
+		// Airframe matches the airframe category (e.g. "Heavy") or category type (e.g. "4/5")
+		Airframe []string `yaml:"airframe" json:"airframe"`
+		// Expr is an optional expression that must be true for the rule to apply
+		Expr string `yaml:"expr" json:"expr"`
+	}
+
+	// Thresholds are how much a value needs to change by to be significant, nil to ignore that value
+	Thresholds struct {
+		Heading      *float64 `yaml:"heading" json:"heading"`
+		Velocity     *float64 `yaml:"velocity" json:"velocity"`
+		VerticalRate *float64 `yaml:"vertical_rate" json:"vertical_rate"`
+		Altitude     *float64 `yaml:"altitude" json:"altitude"`
+	}
+
+	Rule struct {
+		Name  string `yaml:"name" json:"name"`
+		Match Match  `yaml:"match" json:"match"`
+		// Always makes every update for a matching aircraft significant
+		Always     bool       `yaml:"always" json:"always"`
+		Thresholds Thresholds `yaml:"thresholds" json:"thresholds"`
+		// Fields are values where any change is significant
+		Fields []string `yaml:"fields" json:"fields"`
+		// MaxSilence forces a significant update when we have not sent one for this long
+		MaxSilence time.Duration `yaml:"max_silence" json:"max_silence"`
+		// Expr is an optional expression that makes an update significant when true
+		Expr string `yaml:"expr" json:"expr"`
+	}
+
+	Config struct {
+		Rules []Rule `yaml:"rules" json:"rules"`
+	}
+
+	compiledRule struct {
+		Rule
+		match node
+		expr  node
+	}
+
+	// Engine decides if location updates are significant. The first rule that matches an aircraft decides,
+	// the DefaultRules come after the configured ones so every aircraft matches something
+	Engine struct {
+		rules []compiledRule
+	}
+
+	// Result tells us what rule decided and why
+	Result struct {
+		Significant bool
+		Rule        string
+		Reason      string
+	}
+)
+
+var allFields = []string{
+	ReasonFlightStatus, ReasonOnGround, ReasonSpecial, ReasonSquawk, ReasonEmergencies, ReasonTile,
+}
+
+var knownVariables = map[string]struct{}{
+	"altitude": {}, "velocity": {}, "heading": {}, "vertical_rate": {}, "on_ground": {}, "squawk": {},
+	"flight_status": {}, "special": {}, "callsign": {}, "airframe": {}, "airframe_type": {}, "silence": {},
+	"d_altitude": {}, "d_velocity": {}, "d_heading": {}, "d_vertical_rate": {},
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// DefaultRules are the rules we have always used: everything on the ground, at least a 1 degree heading change,
+// any velocity change, 180fpm vertical rate change or 10ft altitude change, and any change of the other fields
+func DefaultRules() []Rule {
+	return []Rule{
+		{
+			Name:   "on-ground",
+			Match:  Match{OnGround: ptr(true)},
+			Always: true,
+		},
+		{
+			Name: DefaultRuleName,
+			Thresholds: Thresholds{
+				Heading:      ptr(1.0),
+				Velocity:     ptr(0.0),
+				VerticalRate: ptr(180.0),
+				Altitude:     ptr(10.0),
+			},
+			Fields: allFields,
+		},
+	}
+}
+
+// Default is an engine with the DefaultRules
+func Default() *Engine {
+	e, err := New(Config{})
+	if nil != err {
+		panic(err)
+	}
+	return e
+}
+
+// Load reads our rules from a YAML (or JSON) file
+func Load(path string) (*Engine, error) {
+	buf, err := os.ReadFile(path)
+	if nil != err {
+		return nil, err
+	}
+	return Parse(buf)
+}
+
+// Parse reads our rules from YAML (or JSON, which is YAML too)
+func Parse(buf []byte) (*Engine, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(buf, &cfg); nil != err {
+		return nil, err
+	}
+	return New(cfg)
+}
+
+// New compiles the given rules. Aircraft that match none of them use the DefaultRules
+func New(cfg Config) (*Engine, error) {
+	e := &Engine{}
+	for i, r := range append(cfg.Rules, DefaultRules()...) {
+		if "" == r.Name {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		cr, err := compileRule(r)
+		if nil != err {
+			return nil, err
+		}
+		e.rules = append(e.rules, cr)
+	}
+	return e, nil
+}
+
+func compileRule(r Rule) (compiledRule, error) {
+	cr := compiledRule{Rule: r}
+	var err error
+	for _, f := range r.Fields {
+		if !slices.Contains(allFields, f) && ReasonCallSign != f {
+			return cr, fmt.Errorf("rule %s: unknown field %q", r.Name, f)
+		}
+	}
+	if "" != r.Match.Expr {
+		if cr.match, err = compile(r.Match.Expr); nil != err {
+			return cr, fmt.Errorf("rule %s: match: %w", r.Name, err)
+		}
+	}
+	if "" != r.Expr {
+		if cr.expr, err = compile(r.Expr); nil != err {
+			return cr, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+	}
+	return cr, nil
+}
+
+// RuleNames are the names of all our rules, in order
+func (e *Engine) RuleNames() []string {
+	names := make([]string, 0, len(e.rules))
+	for _, r := range e.rules {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+// Evaluate decides if candidate is significant compared to last.
+// lastSignificant is when we last sent a significant update for this aircraft
+func (e *Engine) Evaluate(last, candidate *export.PlaneLocation, lastSignificant time.Time) Result {
+	v := variables(last, candidate, lastSignificant)
+	// the last default rule matches everything
+	rule := &e.rules[len(e.rules)-1]
+	for i := range e.rules {
+		if e.rules[i].matches(candidate, v) {
+			rule = &e.rules[i]
+			break
+		}
+	}
+	reason := rule.reason(last, candidate, lastSignificant, v)
+	return Result{
+		Significant: "" != reason,
+		Rule:        rule.Name,
+		Reason:      reason,
+	}
+}
+
+func (r *compiledRule) matches(candidate *export.PlaneLocation, v vars) bool {
+	m := r.Match
+	if nil != m.OnGround && (!candidate.HasOnGround || candidate.OnGround != *m.OnGround) {
+		return false
+	}
+	if nil != m.MinAltitude && (!candidate.HasAltitude || candidate.Altitude < *m.MinAltitude) {
+		return false
+	}
+	if nil != m.MaxAltitude && (!candidate.HasAltitude || candidate.Altitude > *m.MaxAltitude) {
+		return false
+	}
+	if len(m.Airframe) > 0 && !slices.Contains(m.Airframe, candidate.Airframe) && !slices.Contains(m.Airframe, candidate.AirframeType) {
+		return false
+	}
+	if nil != r.match {
+		ok, err := evalBool(r.match, v)
+		return nil == err && ok
+	}
+	return true
+}
+
+// reason is why the candidate is significant under this rule, empty when it is not
+func (r *compiledRule) reason(last, candidate *export.PlaneLocation, lastSignificant time.Time, v vars) string {
+	if r.Always {
+		return ReasonAlways
+	}
+	t := r.Thresholds
+	if nil != t.Heading && candidate.HasHeading && last.HasHeading && headingDiff(candidate.Heading, last.Heading) > *t.Heading {
+		if candidate.Updates.Heading.After(last.Updates.Heading) {
+			return ReasonHeading
+		}
+	}
+	if nil != t.Velocity && candidate.HasVelocity && last.HasVelocity && math.Abs(candidate.Velocity-last.Velocity) > *t.Velocity {
+		if candidate.Updates.Velocity.After(last.Updates.Velocity) {
+			return ReasonVelocity
+		}
+	}
+	if nil != t.VerticalRate && candidate.HasVerticalRate && last.HasVerticalRate && math.Abs(float64(candidate.VerticalRate-last.VerticalRate)) > *t.VerticalRate {
+		if candidate.Updates.VerticalRate.After(last.Updates.VerticalRate) {
+			return ReasonVerticalRate
+		}
+	}
+	if nil != t.Altitude && math.Abs(float64(candidate.Altitude-last.Altitude)) > *t.Altitude {
+		if candidate.Updates.Altitude.After(last.Updates.Altitude) {
+			return ReasonAltitude
+		}
+	}
+
+	for _, f := range r.Fields {
+		if fieldChanged(f, last, candidate) {
+			return f
+		}
+	}
+
+	if r.MaxSilence > 0 && !lastSignificant.IsZero() && candidate.LastMsg.Sub(lastSignificant) >= r.MaxSilence {
+		return ReasonMaxSilence
+	}
+
+	if nil != r.expr {
+		if ok, err := evalBool(r.expr, v); nil == err && ok {
+			return ReasonExpr
+		}
+	}
+	return ""
+}
+
+func fieldChanged(field string, last, candidate *export.PlaneLocation) bool {
+	switch field {
+	case ReasonFlightStatus:
+		return candidate.FlightStatus != last.FlightStatus && candidate.Updates.FlightStatus.After(last.Updates.FlightStatus)
+	case ReasonOnGround:
+		return candidate.OnGround != last.OnGround && candidate.Updates.OnGround.After(last.Updates.OnGround)
+	case ReasonSpecial:
+		return candidate.Special != last.Special && candidate.Updates.Special.After(last.Updates.Special)
+	case ReasonSquawk:
+		return candidate.Squawk != last.Squawk && candidate.Updates.Squawk.After(last.Updates.Squawk)
+	case ReasonEmergencies:
+		return !slices.Equal(candidate.Emergencies, last.Emergencies) && candidate.Updates.Emergency.After(last.Updates.Emergency)
+	case ReasonTile:
+		return candidate.TileLocation != last.TileLocation && candidate.Updates.Location.After(last.Updates.Location)
+	case ReasonCallSign:
+		return nil != candidate.CallSign && strings.TrimSpace(*candidate.CallSign) != strings.TrimSpace(unPtr(last.CallSign))
+	}
+	return false
+}
+
+// headingDiff is the smallest angle between two headings
+func headingDiff(a, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), 360)
+	if d > 180 {
+		d = 360 - d
+	}
+	return d
+}
+
+func unPtr[T any](v *T) T {
+	var t T
+	if nil == v {
+		return t
+	}
+	return *v
+}
+
+func variables(last, candidate *export.PlaneLocation, lastSignificant time.Time) vars {
+	return func(name string) (value, bool) {
+		switch name {
+		case "altitude":
+			return number(float64(candidate.Altitude)), true
+		case "velocity":
+			return number(candidate.Velocity), true
+		case "heading":
+			return number(candidate.Heading), true
+		case "vertical_rate":
+			return number(float64(candidate.VerticalRate)), true
+		case "on_ground":
+			return boolean(candidate.OnGround), true
+		case "squawk":
+			return str(candidate.Squawk), true
+		case "flight_status":
+			return str(candidate.FlightStatus), true
+		case "special":
+			return str(candidate.Special), true
+		case "callsign":
+			return str(strings.TrimSpace(unPtr(candidate.CallSign))), true
+		case "airframe":
+			return str(candidate.Airframe), true
+		case "airframe_type":
+			return str(candidate.AirframeType), true
+		case "silence":
+			if lastSignificant.IsZero() {
+				return number(0), true
+			}
+			return number(candidate.LastMsg.Sub(lastSignificant).Seconds()), true
+		case "d_altitude":
+			return number(math.Abs(float64(candidate.Altitude - last.Altitude))), true
+		case "d_velocity":
+			return number(math.Abs(candidate.Velocity - last.Velocity)), true
+		case "d_heading":
+			return number(headingDiff(candidate.Heading, last.Heading)), true
+		case "d_vertical_rate":
+			return number(math.Abs(float64(candidate.VerticalRate - last.VerticalRate))), true
+		}
+		return value{}, false
+	}
+}
@@ -0,0 +1,160 @@
+package significance
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"plane.watch/lib/export"
+)
+
+func location(altitude int, heading float64, at time.Time) *export.PlaneLocation {
+	return &export.PlaneLocation{
+		Icao:        "7C4516",
+		Altitude:    altitude,
+		HasAltitude: true,
+		Heading:     heading,
+		HasHeading:  true,
+		HasOnGround: true,
+		LastMsg:     at,
+		Updates: export.Updates{
+			Altitude: at,
+			Heading:  at,
+		},
+	}
+}
+
+func TestDefault(t *testing.T) {
+	e := Default()
+	now := time.Now()
+	last := location(30000, 90, now)
+
+	tests := []struct {
+		name      string
+		candidate *export.PlaneLocation
+		want      Result
+	}{
+		{"small heading change", location(30000, 90.5, now.Add(time.Second)), Result{false, DefaultRuleName, ""}},
+		{"heading change", location(30000, 92, now.Add(time.Second)), Result{true, DefaultRuleName, ReasonHeading}},
+		{"altitude change", location(30100, 90, now.Add(time.Second)), Result{true, DefaultRuleName, ReasonAltitude}},
+		{"stale altitude", location(30100, 90, now.Add(-time.Second)), Result{false, DefaultRuleName, ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := e.Evaluate(last, tt.candidate, now); got != tt.want {
+				t.Errorf("Evaluate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// 359.5 -> 0.2 is a small turn, not a 359 degree one
+	if got := e.Evaluate(location(30000, 359.5, now), location(30000, 0.2, now.Add(time.Second)), now); got.Significant {
+		t.Errorf("expected heading changes to wrap around north, got %+v", got)
+	}
+
+	onGround := location(0, 90, now.Add(time.Second))
+	onGround.OnGround = true
+	if got := e.Evaluate(last, onGround, now); !got.Significant || "on-ground" != got.Rule {
+		t.Errorf("expected on ground aircraft to always be significant, got %+v", got)
+	}
+}
+
+func TestParse(t *testing.T) {
+	e, err := Parse([]byte(`
+rules:
+  - name: cruise
+    match:
+      min_altitude: 20000
+    thresholds:
+      heading: 5
+      altitude: 500
+    max_silence: 30s
+  - name: approach
+    match:
+      max_altitude: 5000
+      expr: 'vertical_rate < 0'
+    thresholds:
+      altitude: 50
+    expr: 'd_heading > 0.5 && callsign != "TEST"'
+`))
+	if nil != err {
+		t.Fatal(err)
+	}
+	want := []string{"cruise", "approach", "on-ground", DefaultRuleName}
+	if got := e.RuleNames(); !slices.Equal(got, want) {
+		t.Errorf("RuleNames() = %v, want %v", got, want)
+	}
+
+	now := time.Now()
+	last := location(30000, 90, now)
+	if got := e.Evaluate(last, location(30200, 93, now.Add(time.Second)), now); got.Significant || "cruise" != got.Rule {
+		t.Errorf("expected small cruise changes to be ignored, got %+v", got)
+	}
+	if got := e.Evaluate(last, location(30200, 93, now.Add(31*time.Second)), now); ReasonMaxSilence != got.Reason {
+		t.Errorf("expected a forced update after 30s of silence, got %+v", got)
+	}
+
+	last = location(3000, 90, now)
+	candidate := location(3000, 91, now.Add(time.Second))
+	candidate.VerticalRate = -500
+	if got := e.Evaluate(last, candidate, now); "approach" != got.Rule || ReasonExpr != got.Reason {
+		t.Errorf("expected the approach expression to fire, got %+v", got)
+	}
+	candidate.VerticalRate = 500
+	if got := e.Evaluate(last, candidate, now); DefaultRuleName != got.Rule {
+		t.Errorf("expected climbing aircraft to fall through to the default rule, got %+v", got)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	if _, err := Parse([]byte(`{"rules": [{"name": "bad", "expr": "wingspan > 3"}]}`)); !errors.Is(err, ErrUnknownVariable) {
+		t.Errorf("expected an unknown variable error, got %v", err)
+	}
+	if _, err := Parse([]byte(`{"rules": [{"name": "bad", "fields": ["colour"]}]}`)); nil == err {
+		t.Errorf("expected an unknown field error")
+	}
+	if _, err := Parse([]byte(`{"rules": [{"name": "bad", "expr": "(altitude > 3"}]}`)); nil == err {
+		t.Errorf("expected a syntax error")
+	}
+}
+
+func TestExpr(t *testing.T) {
+	v := func(name string) (value, bool) {
+		switch name {
+		case "altitude":
+			return number(1000), true
+		case "squawk":
+			return str("7700"), true
+		case "on_ground":
+			return boolean(false), true
+		}
+		return value{}, false
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`altitude > 500`, true},
+		{`altitude >= 1000 && altitude <= 1000`, true},
+		{`altitude < 500 || squawk == "7700"`, true},
+		{`!on_ground && !(altitude != 1000)`, true},
+		{`on_ground == true`, false},
+		{`altitude > -1`, true},
+	}
+	for _, tt := range tests {
+		n, err := compile(tt.expr)
+		if nil != err {
+			t.Fatalf("compile(%q): %s", tt.expr, err)
+		}
+		got, err := evalBool(n, v)
+		if nil != err || got != tt.want {
+			t.Errorf("%q = %v (%v), want %v", tt.expr, got, err, tt.want)
+		}
+	}
+
+	n, _ := compile(`altitude == "1000"`)
+	if _, err := evalBool(n, v); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expected a type mismatch, got %v", err)
+	}
+}
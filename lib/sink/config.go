@@ -5,6 +5,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"os"
+	"plane.watch/lib/export"
 	"sync"
 	"time"
 )
@@ -33,6 +34,12 @@ type (
 
 		sendDelay time.Duration
 
+		// partitions splits location updates across this many subjects by icao, 0 to not split
+		partitions int
+
+		// contentType is the wire format location updates are encoded with, see export.ContentTypeJSON
+		contentType string
+
 		// for remembering if we have recently sent this message
 	}
 
@@ -41,6 +48,7 @@ type (
 
 func (c *Config) setupConfig(opts []Option) {
 	c.sendDelay = 300 * time.Millisecond
+	c.contentType = export.ContentTypeJSON
 
 	c.queue = map[string]string{}
 	for _, opt := range opts {
@@ -99,3 +107,18 @@ func WithSendDelay(delay time.Duration) Option {
 		conf.sendDelay = delay
 	}
 }
+
+// WithPartitions publishes location updates to location-updates.<partition>, split by icao, instead of a single subject
+func WithPartitions(partitions int) Option {
+	return func(conf *Config) {
+		conf.partitions = partitions
+	}
+}
+
+// WithContentType sets the wire format location updates are encoded with, export.ContentTypeJSON or
+// export.ContentTypeProtobuf
+func WithContentType(contentType string) Option {
+	return func(conf *Config) {
+		conf.contentType = contentType
+	}
+}
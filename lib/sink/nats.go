@@ -4,6 +4,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"net"
 	"net/url"
+	"plane.watch/lib/export"
 	"plane.watch/lib/nats_io"
 	"plane.watch/lib/tracker"
 	"regexp"
@@ -56,8 +57,12 @@ func (n *NatsSink) connect() error {
 	return err
 }
 
-func (n *NatsSink) PublishJson(subject string, msg []byte) error {
-	return n.server.Publish(subject, msg)
+// PublishLocation sends JSON as it always has (no header), anything else gets a content-type header
+func (n *NatsSink) PublishLocation(subject, contentType string, msg []byte) error {
+	if "" == contentType || export.ContentTypeJSON == contentType {
+		return n.server.Publish(subject, msg)
+	}
+	return n.server.PublishWithHeaders(subject, msg, map[string]string{export.HeaderContentType: contentType})
 }
 
 func (n *NatsSink) Stop() {
@@ -8,12 +8,14 @@ import (
 	"plane.watch/lib/dedupe/forgetfulmap"
 	"plane.watch/lib/export"
 	"plane.watch/lib/monitoring"
+	"plane.watch/lib/partition"
 	"plane.watch/lib/tracker"
 )
 
 type (
 	Destination interface {
-		PublishJson(queue string, msg []byte) error
+		// PublishLocation sends an encoded location update, with the content type it was encoded with
+		PublishLocation(queue, contentType string, msg []byte) error
 		Stop()
 		monitoring.HealthCheck
 	}
@@ -65,14 +67,23 @@ func (s *Sink) Stop() {
 	s.sendTicker.Stop()
 }
 
-func (s *Sink) trackerMsgJson(le *tracker.PlaneLocationEvent) ([]byte, error) {
+// trackerMsg encodes the location update in our configured wire format
+func (s *Sink) trackerMsg(le *tracker.PlaneLocationEvent) ([]byte, error) {
 	plane := le.Plane()
 	if nil == plane {
 		return nil, errors.New("no plane")
 	}
 
 	eventStruct := export.NewPlaneLocation(plane, le.New(), le.Removed(), s.config.sourceTag)
-	return eventStruct.ToJSONBytes()
+	return eventStruct.Encode(s.config.contentType)
+}
+
+// locationQueue is where we send location updates for a plane
+func (s *Sink) locationQueue(le *tracker.PlaneLocationEvent) string {
+	if s.config.partitions <= 0 || nil == le.Plane() {
+		return QueueLocationUpdates
+	}
+	return partition.SubjectFor(QueueLocationUpdates, le.Plane().IcaoIdentifierStr(), s.config.partitions)
 }
 
 func (s *Sink) doSend() {
@@ -88,10 +99,10 @@ func (s *Sink) sendLocationList() {
 	s.sendListMutex.Unlock()
 	for _, le := range list {
 		// warning, this code is a duplicate of the OnEvent handling
-		var jsonBuf []byte
-		jsonBuf, err = s.trackerMsgJson(le)
-		if nil != jsonBuf && nil == err {
-			_ = s.dest.PublishJson(QueueLocationUpdates, jsonBuf)
+		var buf []byte
+		buf, err = s.trackerMsg(le)
+		if nil != buf && nil == err {
+			_ = s.dest.PublishLocation(s.locationQueue(le), s.config.contentType, buf)
 			if nil != s.config.stats.planeLoc {
 				s.config.stats.planeLoc.Inc()
 			}
@@ -105,10 +116,10 @@ func (s *Sink) OnEvent(e tracker.Event) {
 	if le, ok := e.(*tracker.PlaneLocationEvent); ok {
 		if 0 == s.config.sendDelay {
 			// warning, this code is a duplicate of the sendLocationList handling
-			var jsonBuf []byte
-			jsonBuf, err = s.trackerMsgJson(le)
-			if nil != jsonBuf && nil == err {
-				_ = s.dest.PublishJson(QueueLocationUpdates, jsonBuf)
+			var buf []byte
+			buf, err = s.trackerMsg(le)
+			if nil != buf && nil == err {
+				_ = s.dest.PublishLocation(s.locationQueue(le), s.config.contentType, buf)
 				if nil != s.config.stats.planeLoc {
 					s.config.stats.planeLoc.Inc()
 				}
@@ -119,6 +130,18 @@ func (s *Sink) OnEvent(e tracker.Event) {
 			s.sendListMutex.Unlock()
 		}
 	}
+	if ee, ok := e.(*tracker.EmergencyEvent); ok && 0 != s.config.sendDelay {
+		// emergencies do not wait for the next batch, get the planes current state out the door now
+		var buf []byte
+		le := tracker.NewPlaneLocationEvent(ee.Plane())
+		buf, err = s.trackerMsg(le)
+		if nil != buf && nil == err {
+			_ = s.dest.PublishLocation(s.locationQueue(le), s.config.contentType, buf)
+			if nil != s.config.stats.planeLoc {
+				s.config.stats.planeLoc.Inc()
+			}
+		}
+	}
 }
 
 func (s *Sink) HealthCheckName() string {
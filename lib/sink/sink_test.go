@@ -2,6 +2,7 @@ package sink
 
 import (
 	"github.com/rs/zerolog"
+	"plane.watch/lib/export"
 	"plane.watch/lib/tracker"
 	"testing"
 )
@@ -11,7 +12,7 @@ type drain struct {
 	numTextPublished int
 }
 
-func (d *drain) PublishJson(queue string, msg []byte) error {
+func (d *drain) PublishLocation(queue, contentType string, msg []byte) error {
 	d.numJsonPublished++
 	return nil
 }
@@ -40,7 +41,19 @@ func BenchmarkSink_TrackerMsgJson(b *testing.B) {
 	le := tracker.NewPlaneLocationEvent(plane)
 
 	for n := 0; n < b.N; n++ {
-		_, _ = sink.trackerMsgJson(le)
+		_, _ = sink.trackerMsg(le)
+	}
+}
+
+func BenchmarkSink_TrackerMsgProtobuf(b *testing.B) {
+	zerolog.SetGlobalLevel(zerolog.NoLevel)
+	sink := NewSink(&Config{sourceTag: "test", contentType: export.ContentTypeProtobuf}, nil).(*Sink)
+	plane := tracker.NewTracker().GetPlane(0x223344)
+
+	le := tracker.NewPlaneLocationEvent(plane)
+
+	for n := 0; n < b.N; n++ {
+		_, _ = sink.trackerMsg(le)
 	}
 }
 
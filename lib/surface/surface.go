@@ -0,0 +1,346 @@
+package surface
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"plane.watch/lib/export"
+	"plane.watch/lib/geo"
+)
+
+// The states an aircraft can be in while it is on the ground at an airport
+const (
+	StateGate     = "gate"
+	StatePushback = "pushback"
+	StateTaxi     = "taxi"
+	StateRunway   = "runway"
+)
+
+// The departure board style events we emit as an aircraft moves around an airport
+const (
+	EventPushback      = "pushback"
+	EventTaxiOut       = "taxi-out"
+	EventTakeoff       = "takeoff"
+	EventLanded        = "landed"
+	EventArrivedAtGate = "arrived-at-gate"
+)
+
+type (
+	// Runway is the centreline of a runway, from one threshold to the other
+	Runway struct {
+		Name string
+		Lat1 float64
+		Lon1 float64
+		Lat2 float64
+		Lon2 float64
+		// Width in metres
+		Width float64
+	}
+
+	Airport struct {
+		Icao    string
+		Iata    string
+		Name    string
+		Lat     float64
+		Lon     float64
+		Runways []Runway `json:",omitempty"`
+	}
+
+	// Event is something interesting an aircraft did at an airport
+	Event struct {
+		Type     string
+		Icao     string
+		CallSign string `json:",omitempty"`
+		FlightId string `json:",omitempty"`
+		Airport  string
+		Runway   string `json:",omitempty"`
+		At       time.Time
+	}
+
+	aircraft struct {
+		airport *Airport
+		state   string
+		runway  string
+
+		airborne bool
+		// departing is true until the aircraft takes off, after it lands it is arriving
+		departing bool
+		taxiedOut bool
+
+		stoppedSince time.Time
+		lastSeen     time.Time
+	}
+
+	// Tracker snaps on-ground aircraft to their nearest airport and works out what they are doing there
+	Tracker struct {
+		mu       sync.Mutex
+		airports []Airport
+		aircraft map[string]*aircraft
+
+		snapRadius      float64
+		gateDwell       time.Duration
+		stationarySpeed float64
+		pushbackSpeed   float64
+		timeout         time.Duration
+
+		eventAction func(*Event)
+	}
+
+	Option func(*Tracker)
+)
+
+// NewTracker creates a new surface movement tracker.
+// by default, we snap aircraft within 5km of an airport and consider an aircraft at the gate once it has been
+// stationary for 2 minutes
+func NewTracker(opts ...Option) *Tracker {
+	t := &Tracker{
+		aircraft:        make(map[string]*aircraft),
+		snapRadius:      5_000,
+		gateDwell:       2 * time.Minute,
+		stationarySpeed: 1,
+		pushbackSpeed:   5,
+		timeout:         10 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// WithAirports sets the list of airports we know about
+func WithAirports(airports []Airport) Option {
+	return func(t *Tracker) {
+		t.airports = airports
+	}
+}
+
+// WithSnapRadius sets how close (in metres) an on-ground aircraft needs to be to an airport to be considered at it
+func WithSnapRadius(metres float64) Option {
+	return func(t *Tracker) {
+		t.snapRadius = metres
+	}
+}
+
+// WithGateDwell sets how long an aircraft needs to be stationary before we consider it at the gate
+func WithGateDwell(dwell time.Duration) Option {
+	return func(t *Tracker) {
+		t.gateDwell = dwell
+	}
+}
+
+// WithEventAction is called for each surface event (pushback, taxi-out, takeoff, landed, arrived-at-gate)
+func WithEventAction(f func(*Event)) Option {
+	return func(t *Tracker) {
+		t.eventAction = f
+	}
+}
+
+// SetAirports replaces the list of airports we know about
+func (t *Tracker) SetAirports(airports []Airport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.airports = airports
+	// our aircraft may point at airports that no longer exist, let them re-snap
+	for _, a := range t.aircraft {
+		a.airport = nil
+	}
+}
+
+// Nearest finds the closest airport to the given position within our snap radius
+func (t *Tracker) Nearest(lat, lon float64) (*Airport, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ap := t.nearest(lat, lon)
+	return ap, nil != ap
+}
+
+func (t *Tracker) nearest(lat, lon float64) *Airport {
+	// a cheap bounding box check before we do the expensive distance calculation
+	latDelta := t.snapRadius / 111_000
+	lonDelta := latDelta / math.Max(math.Cos(lat*math.Pi/180), 0.01)
+
+	var best *Airport
+	bestDistance := t.snapRadius
+	for i := range t.airports {
+		ap := &t.airports[i]
+		if math.Abs(ap.Lat-lat) > latDelta || math.Abs(ap.Lon-lon) > lonDelta {
+			continue
+		}
+		if d := geo.Distance(lat, lon, ap.Lat, ap.Lon); d <= bestDistance {
+			best = ap
+			bestDistance = d
+		}
+	}
+	return best
+}
+
+// Update works out where on the surface the given aircraft is, setting the Airport and SurfaceState fields
+func (t *Tracker) Update(loc *export.PlaneLocation) {
+	if nil == loc || !loc.HasLocation || !loc.HasOnGround {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ts := loc.LastMsg
+	a, ok := t.aircraft[loc.Icao]
+	if !ok {
+		a = &aircraft{airborne: !loc.OnGround, departing: loc.OnGround}
+		t.aircraft[loc.Icao] = a
+	}
+	a.lastSeen = ts
+
+	if !loc.OnGround {
+		if !a.airborne && nil != a.airport && "" != a.state {
+			t.emit(EventTakeoff, loc, a.airport, a.runway, ts)
+		}
+		a.airborne = true
+		a.departing = false
+		a.taxiedOut = false
+		a.airport = nil
+		a.state = ""
+		a.runway = ""
+		loc.Airport = ""
+		loc.SurfaceState = ""
+		return
+	}
+
+	if nil == a.airport || geo.Distance(loc.Lat, loc.Lon, a.airport.Lat, a.airport.Lon) > t.snapRadius {
+		a.airport = t.nearest(loc.Lat, loc.Lon)
+		if nil == a.airport {
+			a.state = ""
+			loc.Airport = ""
+			loc.SurfaceState = ""
+			a.airborne = false
+			return
+		}
+	}
+
+	prev := a.state
+	state := t.state(a, loc, ts)
+	a.runway = runwayAt(a.airport, loc.Lat, loc.Lon)
+	if "" != a.runway {
+		state = StateRunway
+	}
+
+	if a.airborne {
+		t.emit(EventLanded, loc, a.airport, a.runway, ts)
+		a.airborne = false
+		a.departing = false
+	}
+
+	switch {
+	case a.departing && StatePushback == state && StateGate == prev:
+		t.emit(EventPushback, loc, a.airport, "", ts)
+	case a.departing && StateTaxi == state && !a.taxiedOut:
+		t.emit(EventTaxiOut, loc, a.airport, "", ts)
+		a.taxiedOut = true
+	case !a.departing && StateGate == state && StateGate != prev:
+		t.emit(EventArrivedAtGate, loc, a.airport, "", ts)
+		// the next time it moves, it is heading out again
+		a.departing = true
+	}
+
+	a.state = state
+	loc.Airport = a.airport.Icao
+	loc.SurfaceState = state
+}
+
+// state figures out if the aircraft is parked, being pushed back or taxiing
+func (t *Tracker) state(a *aircraft, loc *export.PlaneLocation, ts time.Time) string {
+	speed := 0.0
+	if loc.HasVelocity {
+		speed = loc.Velocity
+	}
+
+	if speed <= t.stationarySpeed {
+		if a.stoppedSince.IsZero() {
+			a.stoppedSince = ts
+		}
+		switch {
+		case "" == a.state:
+			// first time we have seen it, and it is not moving
+			return StateGate
+		case ts.Sub(a.stoppedSince) >= t.gateDwell:
+			return StateGate
+		case StateRunway == a.state:
+			// stopped on the runway, holding short or lined up
+			return StateTaxi
+		}
+		return a.state
+	}
+
+	a.stoppedSince = time.Time{}
+	if a.departing && speed <= t.pushbackSpeed && (StateGate == a.state || StatePushback == a.state) {
+		return StatePushback
+	}
+	return StateTaxi
+}
+
+func (t *Tracker) emit(eventType string, loc *export.PlaneLocation, ap *Airport, runway string, ts time.Time) {
+	if nil == t.eventAction || nil == ap {
+		return
+	}
+	e := &Event{
+		Type:     eventType,
+		Icao:     loc.Icao,
+		FlightId: loc.FlightId,
+		Airport:  ap.Icao,
+		Runway:   runway,
+		At:       ts,
+	}
+	if nil != loc.CallSign {
+		e.CallSign = *loc.CallSign
+	}
+	t.eventAction(e)
+}
+
+// Sweep forgets about the aircraft we have not heard from in a while
+func (t *Tracker) Sweep(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for icao, a := range t.aircraft {
+		if now.Sub(a.lastSeen) > t.timeout {
+			delete(t.aircraft, icao)
+		}
+	}
+}
+
+// runwayAt returns the name of the runway the given position is on
+func runwayAt(ap *Airport, lat, lon float64) string {
+	if nil == ap {
+		return ""
+	}
+	for _, rw := range ap.Runways {
+		if rw.contains(ap.Lat, lat, lon) {
+			return rw.Name
+		}
+	}
+	return ""
+}
+
+// contains determines if the given point is within the runway, using a flat projection around the airport
+func (rw *Runway) contains(refLat, lat, lon float64) bool {
+	project := func(lat, lon float64) (float64, float64) {
+		x := lon * math.Pi / 180 * geo.EarthRadiusMetres * math.Cos(refLat*math.Pi/180)
+		y := lat * math.Pi / 180 * geo.EarthRadiusMetres
+		return x, y
+	}
+	x1, y1 := project(rw.Lat1, rw.Lon1)
+	x2, y2 := project(rw.Lat2, rw.Lon2)
+	px, py := project(lat, lon)
+
+	dx, dy := x2-x1, y2-y1
+	length := dx*dx + dy*dy
+	if 0 == length {
+		return false
+	}
+	// how far along the centreline we are, 0 is threshold 1 and 1 is threshold 2
+	along := ((px-x1)*dx + (py-y1)*dy) / length
+	if along < 0 || along > 1 {
+		return false
+	}
+	cx, cy := x1+along*dx, y1+along*dy
+	return math.Hypot(px-cx, py-cy) <= rw.Width/2
+}
@@ -0,0 +1,170 @@
+package surface
+
+import (
+	"testing"
+	"time"
+
+	"plane.watch/lib/export"
+	"plane.watch/lib/geo"
+)
+
+var perth = Airport{
+	Icao: "YPPH",
+	Iata: "PER",
+	Name: "Perth",
+	Lat:  -31.9403,
+	Lon:  115.967003,
+	Runways: []Runway{
+		// 03/21, roughly
+		{Name: "03/21", Lat1: -31.9660, Lon1: 115.9560, Lat2: -31.9290, Lon2: 115.9800, Width: 60},
+	},
+}
+
+func TestTracker_Nearest(t *testing.T) {
+	tr := NewTracker(WithAirports([]Airport{
+		perth,
+		{Icao: "YPJT", Lat: -32.0975, Lon: 115.881},
+	}))
+
+	if ap, ok := tr.Nearest(-31.95, 115.97); !ok || "YPPH" != ap.Icao {
+		t.Errorf("expected to snap to YPPH")
+	}
+	if ap, ok := tr.Nearest(-32.09, 115.88); !ok || "YPJT" != ap.Icao {
+		t.Errorf("expected to snap to YPJT")
+	}
+	if _, ok := tr.Nearest(-31.0, 115.0); ok {
+		t.Errorf("expected to be too far away from any airport")
+	}
+}
+
+func TestRunway_contains(t *testing.T) {
+	rw := perth.Runways[0]
+	midLat, midLon := (rw.Lat1+rw.Lat2)/2, (rw.Lon1+rw.Lon2)/2
+	if !rw.contains(perth.Lat, midLat, midLon) {
+		t.Errorf("expected the middle of the runway to be on the runway")
+	}
+	bearing := geo.Bearing(rw.Lat1, rw.Lon1, rw.Lat2, rw.Lon2)
+	lat, lon := geo.Destination(midLat, midLon, bearing+90, 100)
+	if rw.contains(perth.Lat, lat, lon) {
+		t.Errorf("100m to the side of the centreline is not on the runway")
+	}
+	lat, lon = geo.Destination(rw.Lat1, rw.Lon1, bearing+180, 200)
+	if rw.contains(perth.Lat, lat, lon) {
+		t.Errorf("before the threshold is not on the runway")
+	}
+}
+
+func TestTracker_Departure(t *testing.T) {
+	var events []Event
+	tr := NewTracker(
+		WithAirports([]Airport{perth}),
+		WithEventAction(func(e *Event) { events = append(events, *e) }),
+	)
+	start := time.Date(2023, time.January, 9, 19, 0, 0, 0, time.UTC)
+	callSign := "QFA123"
+	loc := export.PlaneLocation{
+		Icao:        "7C4516",
+		CallSign:    &callSign,
+		HasLocation: true,
+		HasOnGround: true,
+		OnGround:    true,
+		HasVelocity: true,
+		Lat:         -31.9403,
+		Lon:         115.967003,
+		LastMsg:     start,
+	}
+
+	tr.Update(&loc)
+	if "YPPH" != loc.Airport || StateGate != loc.SurfaceState {
+		t.Fatalf("expected to be at the gate at YPPH, got %s at %s", loc.SurfaceState, loc.Airport)
+	}
+
+	steps := []struct {
+		velocity float64
+		lat, lon float64
+		onGround bool
+		state    string
+	}{
+		{velocity: 3, lat: -31.9404, lon: 115.9670, onGround: true, state: StatePushback},
+		{velocity: 15, lat: -31.9420, lon: 115.9660, onGround: true, state: StateTaxi},
+		{velocity: 140, lat: -31.9475, lon: 115.9680, onGround: true, state: StateRunway},
+		{velocity: 160, lat: -31.9300, lon: 115.9790, onGround: false, state: ""},
+	}
+	for i, step := range steps {
+		loc.Velocity = step.velocity
+		loc.Lat, loc.Lon = step.lat, step.lon
+		loc.OnGround = step.onGround
+		loc.LastMsg = start.Add(time.Duration(i+1) * time.Minute)
+		tr.Update(&loc)
+		if step.state != loc.SurfaceState {
+			t.Errorf("step %d: expected state %s, got %s", i, step.state, loc.SurfaceState)
+		}
+	}
+
+	expected := []string{EventPushback, EventTaxiOut, EventTakeoff}
+	if len(expected) != len(events) {
+		t.Fatalf("expected %d events, got %d: %+v", len(expected), len(events), events)
+	}
+	for i, e := range expected {
+		if e != events[i].Type {
+			t.Errorf("expected event %d to be %s, got %s", i, e, events[i].Type)
+		}
+	}
+	if "03/21" != events[2].Runway || "QFA123" != events[2].CallSign {
+		t.Errorf("expected takeoff from 03/21 by QFA123, got %+v", events[2])
+	}
+	if "" != loc.Airport {
+		t.Errorf("an airborne aircraft is not at an airport")
+	}
+}
+
+func TestTracker_Arrival(t *testing.T) {
+	var events []Event
+	tr := NewTracker(
+		WithAirports([]Airport{perth}),
+		WithGateDwell(time.Minute),
+		WithEventAction(func(e *Event) { events = append(events, *e) }),
+	)
+	start := time.Date(2023, time.January, 9, 19, 0, 0, 0, time.UTC)
+	loc := export.PlaneLocation{
+		Icao:        "7C4516",
+		HasLocation: true,
+		HasOnGround: true,
+		HasVelocity: true,
+		Velocity:    150,
+		Lat:         -31.9800,
+		Lon:         115.9400,
+		LastMsg:     start,
+	}
+	tr.Update(&loc)
+
+	// touch down on the runway
+	loc.OnGround = true
+	loc.Velocity = 120
+	loc.Lat, loc.Lon = -31.9475, 115.9680
+	loc.LastMsg = start.Add(time.Minute)
+	tr.Update(&loc)
+
+	// taxi in and stop at the gate
+	loc.Velocity = 10
+	loc.Lat, loc.Lon = -31.9410, 115.9670
+	loc.LastMsg = start.Add(2 * time.Minute)
+	tr.Update(&loc)
+	loc.Velocity = 0
+	for i := 3; i < 6; i++ {
+		loc.LastMsg = start.Add(time.Duration(i) * time.Minute)
+		tr.Update(&loc)
+	}
+
+	if 2 != len(events) || EventLanded != events[0].Type || EventArrivedAtGate != events[1].Type {
+		t.Fatalf("expected to land and arrive at the gate, got %+v", events)
+	}
+	if "03/21" != events[0].Runway {
+		t.Errorf("expected to land on 03/21, got %s", events[0].Runway)
+	}
+
+	tr.Sweep(start.Add(time.Hour))
+	if 0 != len(tr.aircraft) {
+		t.Errorf("expected sweep to forget our aircraft")
+	}
+}
@@ -0,0 +1,260 @@
+package tile_grid
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxLevel is the most detailed cell level we work out, about 600m across at the equator
+	MaxLevel = 16
+	// MaxLatitude is as far north (and south) as slippy map (web mercator) cells go, anything past it is in the
+	// top (or bottom) row of cells
+	MaxLatitude = 85.0511287798
+)
+
+var (
+	ErrInvalidCell   = errors.New("invalid cell")
+	ErrInvalidLevel  = errors.New("invalid cell level")
+	ErrInvalidBounds = errors.New("invalid bounds")
+	ErrTooManyCells  = errors.New("too many cells")
+)
+
+type (
+	// Cell is a slippy map (z/x/y) tile, the same tiles web maps are drawn with. Each cell is split into 4 cells
+	// at the next level down, so a location is in exactly one cell at every level
+	Cell struct {
+		Z, X, Y int
+	}
+
+	// Chain is every tile a location is in: the legacy worldGrid tile (so the old tile names keep working) and the
+	// cell at every level from 0 (the whole world) to MaxLevel
+	Chain struct {
+		// Tile is the name of the legacy tile, tile0 to tile74
+		Tile string
+		// cell is the MaxLevel cell, every other level is a parent of it
+		cell Cell
+	}
+)
+
+// CellAt finds the cell at level z the location is in
+func CellAt(lat, lon float64, z int) Cell {
+	lat = math.Max(-MaxLatitude, math.Min(MaxLatitude, lat))
+	n := 1 << z
+	latRad := lat * math.Pi / 180
+	x := int(math.Floor((lon + 180) / 360 * float64(n)))
+	y := int(math.Floor((1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * float64(n)))
+	return Cell{Z: z, X: clamp(x, 0, n-1), Y: clamp(y, 0, n-1)}
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// String is the name we use for the cell, z<z>-<x>-<y>
+func (c Cell) String() string {
+	return "z" + strconv.Itoa(c.Z) + "-" + strconv.Itoa(c.X) + "-" + strconv.Itoa(c.Y)
+}
+
+// IsCellName tells us if name looks like a cell (z<z>-<x>-<y>) rather than one of the legacy tiles
+func IsCellName(name string) bool {
+	_, err := ParseCell(name)
+	return nil == err
+}
+
+// ParseCell turns the name of a cell (z<z>-<x>-<y>) back into the cell
+func ParseCell(name string) (Cell, error) {
+	if !strings.HasPrefix(name, "z") {
+		return Cell{}, fmt.Errorf("%w: %s", ErrInvalidCell, name)
+	}
+	parts := strings.Split(name[1:], "-")
+	if 3 != len(parts) {
+		return Cell{}, fmt.Errorf("%w: %s", ErrInvalidCell, name)
+	}
+	var v [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if nil != err {
+			return Cell{}, fmt.Errorf("%w: %s", ErrInvalidCell, name)
+		}
+		v[i] = n
+	}
+	c := Cell{Z: v[0], X: v[1], Y: v[2]}
+	if !c.Valid() {
+		return Cell{}, fmt.Errorf("%w: %s", ErrInvalidCell, name)
+	}
+	return c, nil
+}
+
+// Valid tells us if the cell exists
+func (c Cell) Valid() bool {
+	if c.Z < 0 || c.Z > MaxLevel {
+		return false
+	}
+	n := 1 << c.Z
+	return c.X >= 0 && c.X < n && c.Y >= 0 && c.Y < n
+}
+
+// Parent is the cell one level up that contains this one, the level 0 cell is its own parent
+func (c Cell) Parent() Cell {
+	return c.AtLevel(c.Z - 1)
+}
+
+// AtLevel is the cell at level z that contains this one, z must not be more detailed than the cell
+func (c Cell) AtLevel(z int) Cell {
+	if z < 0 {
+		z = 0
+	}
+	if z >= c.Z {
+		return c
+	}
+	shift := c.Z - z
+	return Cell{Z: z, X: c.X >> shift, Y: c.Y >> shift}
+}
+
+// Contains tells us if the location is in this cell
+func (c Cell) Contains(lat, lon float64) bool {
+	return CellAt(lat, lon, c.Z) == c
+}
+
+// Bounds is the area the cell covers
+func (c Cell) Bounds() GlobeIndexSpecialTile {
+	n := float64(int(1) << c.Z)
+	lon := func(x int) float64 {
+		return float64(x)/n*360 - 180
+	}
+	lat := func(y int) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi
+	}
+	return GlobeIndexSpecialTile{
+		North: lat(c.Y),
+		South: lat(c.Y + 1),
+		West:  lon(c.X),
+		East:  lon(c.X + 1),
+	}
+}
+
+// LookupTile finds every tile the location is in, the legacy tile and its cells
+func LookupTile(lat, lon float64) Chain {
+	return Chain{
+		Tile: lookupTilePreCalc(lat, lon),
+		cell: CellAt(lat, lon, MaxLevel),
+	}
+}
+
+// Cell is the cell at level z
+func (ch Chain) Cell(z int) Cell {
+	return ch.cell.AtLevel(z)
+}
+
+// Cells is the cell at each of the given levels
+func (ch Chain) Cells(levels []int) []Cell {
+	cells := make([]Cell, len(levels))
+	for i, z := range levels {
+		cells[i] = ch.cell.AtLevel(z)
+	}
+	return cells
+}
+
+// ParseLevels reads a comma separated list of cell levels ("2,4,6"), returning them sorted from least to most detailed
+func ParseLevels(levels string) ([]int, error) {
+	var out []int
+	seen := map[int]bool{}
+	for _, s := range strings.Split(levels, ",") {
+		if s = strings.TrimSpace(s); "" == s {
+			continue
+		}
+		z, err := strconv.Atoi(s)
+		if nil != err || z < 0 || z > MaxLevel {
+			return nil, fmt.Errorf("%w: %s (0-%d)", ErrInvalidLevel, s, MaxLevel)
+		}
+		if !seen[z] {
+			seen[z] = true
+			out = append(out, z)
+		}
+	}
+	sort.Ints(out)
+	return out, nil
+}
+
+// cellRange is the x and y cells at level z that the bounds cover. When the bounds cross the antimeridian
+// (West > East) x runs from x0 around to x1
+func cellRange(b GlobeIndexSpecialTile, z int) (x0, x1, y0, y1, count int) {
+	nw := CellAt(b.North, b.West, z)
+	// East and South are the edge of the bounds, step back a hair so a bound on a cell edge does not pull in the
+	// next cell over
+	se := CellAt(b.South+1e-9, b.East-1e-9, z)
+	if b.East >= 180 {
+		se.X = (1 << z) - 1
+	}
+	width := se.X - nw.X + 1
+	if b.West > b.East {
+		width += 1 << z
+	}
+	return nw.X, se.X, nw.Y, se.Y, width * (se.Y - nw.Y + 1)
+}
+
+// CellsInBounds lists the cells at level z that cover the bounds, failing with ErrTooManyCells if there would be
+// more than max of them
+func CellsInBounds(b GlobeIndexSpecialTile, z, max int) ([]Cell, error) {
+	if b.North < b.South || b.North > 90 || b.South < -90 || b.West < -180 || b.West > 180 || b.East < -180 || b.East > 180 {
+		return nil, fmt.Errorf("%w: %+v", ErrInvalidBounds, b)
+	}
+	if z < 0 || z > MaxLevel {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidLevel, z)
+	}
+	x0, x1, y0, y1, count := cellRange(b, z)
+	if count <= 0 {
+		return nil, fmt.Errorf("%w: %+v covers no cells", ErrInvalidBounds, b)
+	}
+	if count > max {
+		return nil, fmt.Errorf("%w: %d cells at level %d", ErrTooManyCells, count, z)
+	}
+	n := 1 << z
+	cells := make([]Cell, 0, count)
+	for y := y0; y <= y1; y++ {
+		for x := x0; ; x = (x + 1) % n {
+			cells = append(cells, Cell{Z: z, X: x, Y: y})
+			if x == x1 {
+				break
+			}
+		}
+	}
+	return cells, nil
+}
+
+// ViewportCells picks the cells to subscribe to for a map showing the bounds at the given zoom. It uses the most
+// detailed of levels that is at least 2 levels less detailed than the zoom (so a screen full of map is a handful
+// of cells), and less detailed levels again until there are no more than max cells
+func ViewportCells(b GlobeIndexSpecialTile, zoom int, levels []int, max int) ([]Cell, error) {
+	if 0 == len(levels) {
+		return nil, fmt.Errorf("%w: no levels", ErrInvalidLevel)
+	}
+	i := 0
+	for j, z := range levels {
+		if z <= zoom-2 {
+			i = j
+		}
+	}
+	var err error
+	for ; i >= 0; i-- {
+		var cells []Cell
+		if cells, err = CellsInBounds(b, levels[i], max); nil == err {
+			return cells, nil
+		}
+		if !errors.Is(err, ErrTooManyCells) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
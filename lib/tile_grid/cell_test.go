@@ -0,0 +1,145 @@
+package tile_grid
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCellAt(t *testing.T) {
+	tests := []struct {
+		name     string
+		lat, lon float64
+		z        int
+		want     Cell
+	}{
+		{"world", -31.952162, 115.943482, 0, Cell{0, 0, 0}},
+		{"Perth z6", -31.952162, 115.943482, 6, Cell{6, 52, 37}},
+		{"Perth z10", -31.952162, 115.943482, 10, Cell{10, 841, 607}},
+		{"London z8", 51.5, -0.12, 8, Cell{8, 127, 85}},
+		{"north pole is in the top row", 90, 0, 4, Cell{4, 8, 0}},
+		{"south pole is in the bottom row", -90, 0, 4, Cell{4, 8, 15}},
+		{"antimeridian is in the last column", 0, 180, 4, Cell{4, 15, 8}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := CellAt(tt.lat, tt.lon, tt.z)
+			if got != tt.want {
+				t.Errorf("CellAt() = %v, want %v", got, tt.want)
+			}
+			if !got.Contains(tt.lat, tt.lon) {
+				t.Errorf("%v does not contain the location it was found for", got)
+			}
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	chain := LookupTile(-31.952162, 115.943482)
+	if "tile35" != chain.Tile {
+		t.Errorf("expected the legacy tile to still be tile35, got %s", chain.Tile)
+	}
+	for z := 0; z <= MaxLevel; z++ {
+		if want := CellAt(-31.952162, 115.943482, z); chain.Cell(z) != want {
+			t.Errorf("level %d: got %v, want %v", z, chain.Cell(z), want)
+		}
+	}
+	cells := chain.Cells([]int{2, 6})
+	if 2 != len(cells) || cells[0] != cells[1].AtLevel(2) || cells[1].Parent().Parent() != chain.Cell(4) {
+		t.Errorf("unexpected cell chain %v", cells)
+	}
+}
+
+func TestParseCell(t *testing.T) {
+	c := Cell{Z: 6, X: 52, Y: 37}
+	got, err := ParseCell(c.String())
+	if nil != err || got != c {
+		t.Errorf("ParseCell(%s) = %v, %v", c, got, err)
+	}
+	for _, bad := range []string{"tile35", "z6-52", "z6-64-0", "z17-0-0", "z-1-0-0", "zA-1-2", ""} {
+		if _, err = ParseCell(bad); !errors.Is(err, ErrInvalidCell) {
+			t.Errorf("expected %q to be an invalid cell, got %v", bad, err)
+		}
+	}
+}
+
+func TestCell_Bounds(t *testing.T) {
+	c := CellAt(-31.952162, 115.943482, 8)
+	b := c.Bounds()
+	if !(b.North > -31.952162 && b.South < -31.952162 && b.West < 115.943482 && b.East > 115.943482) {
+		t.Errorf("bounds %+v do not contain the location", b)
+	}
+	if b.North <= b.South || b.East <= b.West {
+		t.Errorf("bounds %+v are inside out", b)
+	}
+}
+
+func TestCellsInBounds(t *testing.T) {
+	// exactly the 4 quadrants of the level 1 world
+	cells, err := CellsInBounds(GlobeIndexSpecialTile{North: 90, South: -90, West: -180, East: 180}, 1, 10)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if want := []Cell{{1, 0, 0}, {1, 1, 0}, {1, 0, 1}, {1, 1, 1}}; !reflect.DeepEqual(want, cells) {
+		t.Errorf("got %v, want %v", cells, want)
+	}
+
+	// a cell's own bounds only cover that cell
+	c := Cell{Z: 7, X: 100, Y: 70}
+	if cells, err = CellsInBounds(c.Bounds(), 7, 10); nil != err || 1 != len(cells) || cells[0] != c {
+		t.Errorf("expected only %v, got %v %v", c, cells, err)
+	}
+
+	// across the antimeridian, from Fiji to Samoa
+	cells, err = CellsInBounds(GlobeIndexSpecialTile{North: -10, South: -20, West: 175, East: -170}, 3, 10)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if want := []Cell{{3, 7, 4}, {3, 0, 4}}; !reflect.DeepEqual(want, cells) {
+		t.Errorf("got %v, want %v", cells, want)
+	}
+
+	if _, err = CellsInBounds(GlobeIndexSpecialTile{North: 90, South: -90, West: -180, East: 180}, 6, 100); !errors.Is(err, ErrTooManyCells) {
+		t.Errorf("expected too many cells, got %v", err)
+	}
+	if _, err = CellsInBounds(GlobeIndexSpecialTile{North: -20, South: -10, West: 0, East: 10}, 6, 100); !errors.Is(err, ErrInvalidBounds) {
+		t.Errorf("expected invalid bounds, got %v", err)
+	}
+	if cells, err = CellsInBounds(GlobeIndexSpecialTile{North: 10, South: 10, West: 5, East: 5}, 6, 100); nil != err || 1 != len(cells) || !cells[0].Contains(10, 5) {
+		t.Errorf("expected a point to be in the one cell, got %v %v", cells, err)
+	}
+}
+
+func TestViewportCells(t *testing.T) {
+	levels := []int{2, 4, 6, 8, 10}
+	perth := GlobeIndexSpecialTile{North: -31.5, South: -32.5, West: 115.5, East: 116.5}
+	cells, err := ViewportCells(perth, 10, levels, 16)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if 8 != cells[0].Z {
+		t.Errorf("expected a zoom 10 map to use level 8 cells, got %v", cells)
+	}
+
+	// zoomed out over the whole world, too many level 4 cells so we fall back to level 2
+	world := GlobeIndexSpecialTile{North: 85, South: -85, West: -180, East: 180}
+	if cells, err = ViewportCells(world, 6, levels, 64); nil != err || 16 != len(cells) || 2 != cells[0].Z {
+		t.Errorf("expected the 16 level 2 cells, got %v %v", cells, err)
+	}
+	if _, err = ViewportCells(world, 6, []int{6}, 64); !errors.Is(err, ErrTooManyCells) {
+		t.Errorf("expected too many cells, got %v", err)
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	levels, err := ParseLevels("8, 4,4,12")
+	if nil != err || !reflect.DeepEqual([]int{4, 8, 12}, levels) {
+		t.Errorf("got %v %v", levels, err)
+	}
+	if levels, err = ParseLevels(""); nil != err || 0 != len(levels) {
+		t.Errorf("expected no levels, got %v %v", levels, err)
+	}
+	if _, err = ParseLevels("4,17"); !errors.Is(err, ErrInvalidLevel) {
+		t.Errorf("expected level 17 to be invalid, got %v", err)
+	}
+}
@@ -30,10 +30,6 @@ func init() {
 	}
 }
 
-func LookupTile(lat, lon float64) string {
-	return lookupTilePreCalc(lat, lon)
-}
-
 func lookupTilePreCalc(lat, lon float64) string {
 	latInt := int(math.Floor(lat))
 	lonInt := int(math.Floor(lon))
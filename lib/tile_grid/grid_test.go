@@ -148,7 +148,7 @@ func Test_LookupTile(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := LookupTile(tt.args.lat, tt.args.lon); got != tt.want {
+			if got := LookupTile(tt.args.lat, tt.args.lon).Tile; got != tt.want {
 				t.Errorf("LookupTile() = %v, want %v", got, tt.want)
 			}
 		})
@@ -0,0 +1,200 @@
+package tracker
+
+import (
+	"sort"
+	"time"
+)
+
+const PlaneEmergencyEventType = "plane-emergency-event"
+
+// Emergency reason codes. These are what we send downstream, so do not change them lightly
+const (
+	EmergencyGeneral              = "general"               // squawk 7700, TC28 general emergency
+	EmergencyNoCommunications     = "no-communications"     // squawk 7600, TC28 no communications
+	EmergencyUnlawfulInterference = "unlawful-interference" // squawk 7500, TC28 unlawful interference
+	EmergencyMedical              = "medical"               // TC28 lifeguard/medical
+	EmergencyMinimumFuel          = "minimum-fuel"          // TC28 minimum fuel
+	EmergencyDowned               = "downed"                // TC28 downed aircraft
+	EmergencyIdent                = "ident"                 // flight status SPI (the IDENT button)
+	EmergencyAlert                = "alert"                 // flight status alert bit
+)
+
+type (
+	// emergency keeps track of the various ways an aircraft can tell us something is going on
+	emergency struct {
+		squawkReason string
+		stateReason  string
+		ident        bool
+		alert        bool
+
+		// active is the reasons currently in effect and when they started
+		active map[string]time.Time
+		ts     time.Time
+	}
+
+	// EmergencyEvent is sent whenever an emergency reason starts or ends for a plane
+	EmergencyEvent struct {
+		p       *Plane
+		reason  string
+		started bool
+		since   time.Time
+	}
+)
+
+var (
+	emergencyDescriptions = map[string]string{
+		EmergencyGeneral:              "General emergency",
+		EmergencyNoCommunications:     "No communications",
+		EmergencyUnlawfulInterference: "Unlawful interference",
+		EmergencyMedical:              "Lifeguard/Medical",
+		EmergencyMinimumFuel:          "Minimum fuel",
+		EmergencyDowned:               "Downed aircraft",
+		EmergencyIdent:                "Special position identification",
+		EmergencyAlert:                "Alert",
+	}
+
+	// emergencyStateReasons maps the DF17 TC28 emergency state to our reason
+	emergencyStateReasons = map[int]string{
+		1: EmergencyGeneral,
+		2: EmergencyMedical,
+		3: EmergencyMinimumFuel,
+		4: EmergencyNoCommunications,
+		5: EmergencyUnlawfulInterference,
+		6: EmergencyDowned,
+	}
+)
+
+// EmergencyDescription gives a human-readable description of an emergency reason code
+func EmergencyDescription(reason string) string {
+	return emergencyDescriptions[reason]
+}
+
+// squawkEmergencyReason determines if the given squawk is one of the special emergency codes
+func squawkEmergencyReason(squawk uint32) string {
+	switch squawk {
+	case 7500:
+		return EmergencyUnlawfulInterference
+	case 7600:
+		return EmergencyNoCommunications
+	case 7700:
+		return EmergencyGeneral
+	}
+	return ""
+}
+
+func (p *Plane) setEmergencyState(emergencyId int) {
+	p.rwLock.Lock()
+	defer p.rwLock.Unlock()
+	p.emergency.stateReason = emergencyStateReasons[emergencyId]
+}
+
+func (p *Plane) setEmergencyFlightStatus(ident, alert bool) {
+	p.rwLock.Lock()
+	defer p.rwLock.Unlock()
+	p.emergency.ident = ident
+	p.emergency.alert = alert
+}
+
+// updateEmergencies works out which emergency reasons have started and ended since the last time we were called
+func (p *Plane) updateEmergencies(ts time.Time) []*EmergencyEvent {
+	p.rwLock.Lock()
+	defer p.rwLock.Unlock()
+
+	current := make(map[string]bool, 4)
+	for _, reason := range []string{p.emergency.squawkReason, p.emergency.stateReason} {
+		if "" != reason {
+			current[reason] = true
+		}
+	}
+	if p.emergency.ident {
+		current[EmergencyIdent] = true
+	}
+	if p.emergency.alert {
+		current[EmergencyAlert] = true
+	}
+
+	if nil == p.emergency.active {
+		p.emergency.active = make(map[string]time.Time)
+	}
+	var events []*EmergencyEvent
+	for reason := range current {
+		if _, ok := p.emergency.active[reason]; !ok {
+			p.emergency.active[reason] = ts
+			events = append(events, newEmergencyEvent(p, reason, true, ts))
+		}
+	}
+	for reason, since := range p.emergency.active {
+		if !current[reason] {
+			delete(p.emergency.active, reason)
+			events = append(events, newEmergencyEvent(p, reason, false, since))
+		}
+	}
+	if len(events) > 0 {
+		p.emergency.ts = ts
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].reason < events[j].reason })
+	return events
+}
+
+// Emergencies is the list of emergency reason codes currently in effect for this plane
+func (p *Plane) Emergencies() []string {
+	p.rwLock.RLock()
+	defer p.rwLock.RUnlock()
+	if 0 == len(p.emergency.active) {
+		return nil
+	}
+	reasons := make([]string, 0, len(p.emergency.active))
+	for reason := range p.emergency.active {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	return reasons
+}
+
+// EmergencyUpdatedAt is when an emergency reason last started or ended
+func (p *Plane) EmergencyUpdatedAt() time.Time {
+	p.rwLock.RLock()
+	defer p.rwLock.RUnlock()
+	return p.emergency.ts
+}
+
+// EmergencySince is when the given emergency reason started
+func (p *Plane) EmergencySince(reason string) (time.Time, bool) {
+	p.rwLock.RLock()
+	defer p.rwLock.RUnlock()
+	since, ok := p.emergency.active[reason]
+	return since, ok
+}
+
+func newEmergencyEvent(p *Plane, reason string, started bool, since time.Time) *EmergencyEvent {
+	return &EmergencyEvent{p: p, reason: reason, started: started, since: since}
+}
+
+func (e *EmergencyEvent) Type() string {
+	return PlaneEmergencyEventType
+}
+func (e *EmergencyEvent) String() string {
+	state := "ended"
+	if e.started {
+		state = "started"
+	}
+	return e.p.IcaoIdentifierStr() + " " + e.reason + " " + state
+}
+func (e *EmergencyEvent) Plane() *Plane {
+	return e.p
+}
+
+// Reason is one of the Emergency* reason codes
+func (e *EmergencyEvent) Reason() string {
+	return e.reason
+}
+
+// Started is true when this emergency has just begun, false when it has just finished
+func (e *EmergencyEvent) Started() bool {
+	return e.started
+}
+
+// Since is when the emergency started
+func (e *EmergencyEvent) Since() time.Time {
+	return e.since
+}
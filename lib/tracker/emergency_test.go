@@ -0,0 +1,63 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPlane_updateEmergencies(t *testing.T) {
+	trk := NewTracker()
+	plane := trk.GetPlane(7778)
+	start := time.Now()
+
+	if events := plane.updateEmergencies(start); 0 != len(events) {
+		t.Fatalf("expected no emergencies for a new plane, got %d", len(events))
+	}
+
+	plane.setSquawkIdentity(7700, start)
+	plane.setEmergencyState(2)
+	events := plane.updateEmergencies(start)
+	if 2 != len(events) {
+		t.Fatalf("expected 2 emergencies to start, got %d", len(events))
+	}
+	if EmergencyGeneral != events[0].Reason() || !events[0].Started() {
+		t.Errorf("expected general emergency to start, got %s", events[0])
+	}
+	if EmergencyMedical != events[1].Reason() || !events[1].Started() {
+		t.Errorf("expected medical emergency to start, got %s", events[1])
+	}
+	if 0 != len(plane.updateEmergencies(start.Add(time.Second))) {
+		t.Errorf("expected ongoing emergencies to not start again")
+	}
+
+	end := start.Add(time.Minute)
+	plane.setSquawkIdentity(1200, end)
+	events = plane.updateEmergencies(end)
+	if 1 != len(events) || EmergencyGeneral != events[0].Reason() || events[0].Started() {
+		t.Fatalf("expected the general emergency to end")
+	}
+	if !events[0].Since().Equal(start) {
+		t.Errorf("expected the ended emergency to report when it started")
+	}
+	if reasons := plane.Emergencies(); 1 != len(reasons) || EmergencyMedical != reasons[0] {
+		t.Errorf("expected only medical to remain, got %v", reasons)
+	}
+	if !plane.EmergencyUpdatedAt().Equal(end) {
+		t.Errorf("incorrect emergency updated at")
+	}
+}
+
+func Test_squawkEmergencyReason(t *testing.T) {
+	tests := map[uint32]string{
+		7500: EmergencyUnlawfulInterference,
+		7600: EmergencyNoCommunications,
+		7700: EmergencyGeneral,
+		1200: "",
+		0:    "",
+	}
+	for squawk, want := range tests {
+		if got := squawkEmergencyReason(squawk); got != want {
+			t.Errorf("squawkEmergencyReason(%d) = %s, want %s", squawk, got, want)
+		}
+	}
+}
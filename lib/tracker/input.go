@@ -55,6 +55,9 @@ type (
 		monitoring.HealthCheck
 	}
 
+	// PositionObserver is told about every position we successfully decode and the source that gave it to us
+	PositionObserver func(source *FrameSource, p *Plane)
+
 	// Middleware has a chance to modify a frame before we send it to the plane Tracker
 	Middleware interface {
 		fmt.Stringer
@@ -82,6 +85,15 @@ func WithPrometheusCounters(currentPlanes prometheus.Gauge, decodedFrames promet
 	}
 }
 
+// WithPositionObserver adds a function that is called every time we decode a new position for a plane
+func WithPositionObserver(observer PositionObserver) Option {
+	return func(t *Tracker) {
+		if nil != observer {
+			t.positionObservers = append(t.positionObservers, observer)
+		}
+	}
+}
+
 // Finish begins the ending of the tracking by closing our decoding queue
 func (t *Tracker) Finish() {
 	if t.finishDone {
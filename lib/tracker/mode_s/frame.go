@@ -839,6 +839,31 @@ func (f *Frame) Emergency() string {
 	return f.emergency
 }
 
+// EmergencyId is the DF17 Type Code 28 emergency state, 0 is no emergency. see emergencyStateTable
+func (f *Frame) EmergencyId() int {
+	if nil == f {
+		return 0
+	}
+	return f.emergencyID
+}
+
+// HasFlightStatus is true for the downlink formats that carry a flight status (DF4, DF5, DF20, DF21)
+func (f *Frame) HasFlightStatus() bool {
+	if nil == f {
+		return false
+	}
+	switch f.downLinkFormat {
+	case 4, 5, 20, 21:
+		return true
+	}
+	return false
+}
+
+// SpecialPositionIdentification is true when the pilot has pressed the IDENT button
+func (f *Frame) SpecialPositionIdentification() bool {
+	return f.HasFlightStatus() && (4 == f.fs || 5 == f.fs)
+}
+
 // the first character can be * or @ (or left out)
 // if the entire string is then 0's, it's a noop
 var noopRw = regexp.MustCompile("^[*@]?0+;?$")
@@ -81,6 +81,7 @@ type (
 		special         map[string]string
 		msgCount        uint64
 		airframe        airframe
+		emergency       emergency
 
 		squawkTs  time.Time
 		specialTs time.Time
@@ -522,6 +523,7 @@ func (p *Plane) setSquawkIdentity(ident uint32, ts time.Time) bool {
 	hasChanged := p.squawk != ident
 	p.squawk = ident
 	p.squawkTs = ts
+	p.emergency.squawkReason = squawkEmergencyReason(ident)
 	return hasChanged
 }
 
@@ -826,7 +828,7 @@ func (p *Plane) addLatLong(lat, lon float64, ts time.Time, velocityCheck bool) (
 		}
 	}
 	if needsLookup {
-		p.location.SetTileGrid(tile_grid.LookupTile(lat, lon))
+		p.location.SetTileGrid(tile_grid.LookupTile(lat, lon).Tile)
 	}
 	p.locationHistory = append(p.locationHistory, p.location.Copy())
 	return
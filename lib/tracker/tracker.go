@@ -28,6 +28,8 @@ type (
 		middlewares []Middleware
 		sink        Sink
 
+		positionObservers []PositionObserver
+
 		producerWaiter      sync.WaitGroup
 		middlewareWaiter    sync.WaitGroup
 		eventsWaiter        sync.WaitGroup
@@ -144,6 +146,13 @@ func (t *Tracker) GetPlane(icao uint32) *Plane {
 	return p
 }
 
+// observePosition lets anyone interested know that we have a new position for this plane
+func (t *Tracker) observePosition(source *FrameSource, p *Plane) {
+	for _, observer := range t.positionObservers {
+		observer(source, p)
+	}
+}
+
 func (t *Tracker) EachPlane(pi PlaneIterator) {
 	t.planeList.Range(func(key, value interface{}) bool {
 		return pi(value.(*Plane))
@@ -201,7 +210,7 @@ func (p *Plane) HandleModeSFrame(frame *mode_s.Frame, source *FrameSource) {
 	// as the receiver. This will be "fixed" for aircraft sending lat/lon within a few frames if it is different.
 	// this means that all the aircraft that do not send locations, will at least have a chance of showing up.
 	if p.GridTileLocation() == "" && nil != refLat && nil != refLon {
-		p.location.SetTileGrid(tile_grid.LookupTile(*refLat, *refLon))
+		p.location.SetTileGrid(tile_grid.LookupTile(*refLat, *refLon).Tile)
 	}
 
 	// determine what to do with our given frame
@@ -242,6 +251,7 @@ func (p *Plane) HandleModeSFrame(frame *mode_s.Frame, source *FrameSource) {
 			hasChanged = p.setAltitude(alt, frame.AltitudeUnits(), frame.TimeStamp()) || hasChanged
 		}
 		hasChanged = p.setFlightStatus(frame.FlightStatus(), frame.FlightStatusString(), frame.TimeStamp()) || hasChanged
+		p.setEmergencyFlightStatus(frame.SpecialPositionIdentification(), frame.Alert())
 
 		if frame.DownLinkType() == 5 { // || 21 == frame.DownLinkType()
 			hasChanged = p.setSquawkIdentity(frame.SquawkIdentity(), frame.TimeStamp()) || hasChanged
@@ -290,10 +300,14 @@ func (p *Plane) HandleModeSFrame(frame *mode_s.Frame, source *FrameSource) {
 				} else {
 					_ = p.setCprOddLocation(float64(frame.Latitude()), float64(frame.Longitude()), frame.TimeStamp())
 				}
+				lastDecoded := p.LocationUpdatedAt()
 				if err := p.decodeCprFilledRefLatLon(refLat, refLon, checkVelocity); nil != err {
 					debugMessage("%s", err)
 				} else {
 					hasChanged = true
+					if p.LocationUpdatedAt().After(lastDecoded) {
+						p.tracker.observePosition(source, p)
+					}
 				}
 
 				debugMessage(" is on the ground and has heading %s and is travelling at %0.2f knots\033[0m", p.HeadingStr(), p.Velocity())
@@ -314,10 +328,14 @@ func (p *Plane) HandleModeSFrame(frame *mode_s.Frame, source *FrameSource) {
 
 			altitude, _ := frame.Altitude()
 			hasChanged = p.setAltitude(altitude, frame.AltitudeUnits(), frame.TimeStamp()) || hasChanged
+			lastDecoded := p.LocationUpdatedAt()
 			if err := p.decodeCpr(0, 0, checkVelocity); nil != err {
 				debugMessage("%s", err)
 			} else {
 				hasChanged = true
+				if p.LocationUpdatedAt().After(lastDecoded) {
+					p.tracker.observePosition(source, p)
+				}
 			}
 
 			if dt := p.DistanceTravelled(); dt.Valid() {
@@ -370,6 +388,7 @@ func (p *Plane) HandleModeSFrame(frame *mode_s.Frame, source *FrameSource) {
 					hasChanged = p.setSpecial("special", frame.Special(), frame.TimeStamp()) || hasChanged
 					hasChanged = p.setSpecial("emergency", frame.Emergency(), frame.TimeStamp()) || hasChanged
 				}
+				p.setEmergencyState(frame.EmergencyId())
 				hasChanged = p.setSquawkIdentity(frame.SquawkIdentity(), frame.TimeStamp()) || hasChanged
 			}
 		case mode_s.DF17FrameTcasRA:
@@ -390,6 +409,7 @@ func (p *Plane) HandleModeSFrame(frame *mode_s.Frame, source *FrameSource) {
 		}
 
 	case 20, 21:
+		p.setEmergencyFlightStatus(frame.SpecialPositionIdentification(), frame.Alert())
 		switch frame.BdsMessageType() {
 		case mode_s.BdsElsDataLinkCap: // 1.0
 			hasChanged = p.setSquawkIdentity(frame.SquawkIdentity(), frame.TimeStamp()) || hasChanged
@@ -407,11 +427,17 @@ func (p *Plane) HandleModeSFrame(frame *mode_s.Frame, source *FrameSource) {
 
 	if p.location.HasTileGrid() && nil != refLat && nil != refLon {
 		// do not have a grid tile for this plane, let's assume it is in same tile as the receiver
-		p.location.SetTileGrid(tile_grid.LookupTile(*refLat, *refLon))
+		p.location.SetTileGrid(tile_grid.LookupTile(*refLat, *refLon).Tile)
 		hasChanged = p.location.TileGrid() != "" || hasChanged
 	}
 
-	if hasChanged {
+	emergencies := p.updateEmergencies(frame.TimeStamp())
+	for _, e := range emergencies {
+		debugMessage(" \033[38;5;196mEmergency: %s\033[0m", e)
+		p.tracker.sink.OnEvent(e)
+	}
+
+	if hasChanged || len(emergencies) > 0 {
 		p.tracker.sink.OnEvent(NewPlaneLocationEvent(p))
 	}
 }
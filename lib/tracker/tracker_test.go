@@ -242,6 +242,29 @@ func TestTrackingLocationHistory(t *testing.T) {
 	}
 }
 
+func TestTracker_PositionObserver(t *testing.T) {
+	var observed int
+	var observedSource *FrameSource
+	source := &FrameSource{Tag: "feeder-1"}
+	trk := NewTracker(WithPositionObserver(func(s *FrameSource, p *Plane) {
+		observed++
+		observedSource = s
+	}))
+	for _, msg := range []string{"8D7C75285841B71C2FB174E7746B", "8D7C75285841C2C178571CF5234E"} {
+		frame, err := mode_s.DecodeString(msg, time.Now())
+		if nil != err {
+			t.Fatal(err)
+		}
+		trk.GetPlane(frame.Icao()).HandleModeSFrame(frame, source)
+	}
+	if 1 != observed {
+		t.Errorf("expected a single position to be observed, got %d", observed)
+	}
+	if source != observedSource {
+		t.Errorf("expected to be told the source of the position")
+	}
+}
+
 func TestPlane_HasLocation(t *testing.T) {
 	trk := NewTracker()
 	p := trk.GetPlane(0x010101)
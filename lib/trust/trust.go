@@ -0,0 +1,263 @@
+package trust
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"plane.watch/lib/export"
+	"plane.watch/lib/geo"
+)
+
+const knotsToMetresPerSecond = 0.514444
+
+type (
+	// Score is how much we trust a feeder, and why
+	Score struct {
+		SourceTag string
+		// Trust is from 0 (not at all) to 1 (completely)
+		Trust float64
+		// Agreement is how often (0-1) the feeders positions agree with where everyone else says the aircraft is
+		Agreement float64
+		// ClockSkew is how far ahead (positive) or behind the feeders timestamps are compared to ours
+		ClockSkew time.Duration
+		// RejectRate is how often (0-1) the feeders updates are rejected as impossible
+		RejectRate float64
+
+		Samples          uint64
+		Rejected         uint64
+		Quarantined      bool
+		QuarantinedUntil *time.Time `json:",omitempty"`
+		LastSeen         time.Time
+	}
+
+	feeder struct {
+		agreement  float64
+		skew       float64 // seconds
+		rejectRate float64
+		samples    uint64
+		rejected   uint64
+
+		quarantinedUntil time.Time
+		lastSeen         time.Time
+	}
+
+	// Scorer keeps a reputation for every feeder (source tag) based on how well it agrees with everyone else
+	Scorer struct {
+		mu      sync.RWMutex
+		feeders map[string]*feeder
+
+		// alpha is how much each new observation moves our averages
+		alpha float64
+		// tolerance is how far (metres) a position can be from where we expect the aircraft before it disagrees
+		tolerance float64
+		// maxSkew is the clock skew at which we stop trusting a feeder entirely
+		maxSkew time.Duration
+		// minSamples is how many observations we need before we judge a feeder
+		minSamples uint64
+		// quarantineBelow is the trust under which a feeder is quarantined, for quarantineFor
+		quarantineBelow float64
+		quarantineFor   time.Duration
+	}
+
+	Option func(*Scorer)
+)
+
+// NewScorer creates a Scorer. By default, positions within 2km of where we expect the aircraft agree, a clock 30s out
+// is not trusted at all, and feeders with a trust under 0.3 after 50 observations are quarantined for 10 minutes
+func NewScorer(opts ...Option) *Scorer {
+	s := &Scorer{
+		feeders:         make(map[string]*feeder),
+		alpha:           0.05,
+		tolerance:       2_000,
+		maxSkew:         30 * time.Second,
+		minSamples:      50,
+		quarantineBelow: 0.3,
+		quarantineFor:   10 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithTolerance sets how far (in metres) a position can be from where we expect the aircraft and still agree
+func WithTolerance(metres float64) Option {
+	return func(s *Scorer) {
+		s.tolerance = metres
+	}
+}
+
+// WithMaxClockSkew sets the clock skew at which we stop trusting a feeder
+func WithMaxClockSkew(skew time.Duration) Option {
+	return func(s *Scorer) {
+		s.maxSkew = skew
+	}
+}
+
+// WithQuarantine quarantines feeders whose trust drops below the threshold (after minSamples observations) for the
+// given duration. A threshold of 0 disables quarantine
+func WithQuarantine(threshold float64, minSamples uint64, duration time.Duration) Option {
+	return func(s *Scorer) {
+		s.quarantineBelow = threshold
+		s.minSamples = minSamples
+		s.quarantineFor = duration
+	}
+}
+
+func (s *Scorer) feeder(sourceTag string) *feeder {
+	f, ok := s.feeders[sourceTag]
+	if !ok {
+		// everyone starts out trusted
+		f = &feeder{agreement: 1}
+		s.feeders[sourceTag] = f
+	}
+	return f
+}
+
+func (s *Scorer) ewma(current, observed float64) float64 {
+	return current + s.alpha*(observed-current)
+}
+
+// Observe scores an update from a feeder against what we already know about the aircraft (the consensus).
+// rejected is true when the update was thrown out as impossible, now is when we received the update
+func (s *Scorer) Observe(consensus, update *export.PlaneLocation, rejected bool, now time.Time) {
+	if nil == update || "" == update.SourceTag {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.feeder(update.SourceTag)
+	f.samples++
+	f.lastSeen = now
+	if rejected {
+		f.rejected++
+		f.rejectRate = s.ewma(f.rejectRate, 1)
+	} else {
+		f.rejectRate = s.ewma(f.rejectRate, 0)
+	}
+
+	if !update.LastMsg.IsZero() {
+		f.skew = s.ewma(f.skew, update.LastMsg.Sub(now).Seconds())
+	}
+
+	if nil != consensus && agreementCheckable(consensus, update) {
+		agrees := 0.0
+		if s.distanceFromExpected(consensus, update) <= s.tolerance {
+			agrees = 1
+		}
+		f.agreement = s.ewma(f.agreement, agrees)
+	}
+	s.checkQuarantine(f, now)
+}
+
+func (s *Scorer) checkQuarantine(f *feeder, now time.Time) {
+	if s.quarantineBelow <= 0 || f.samples < s.minSamples || now.Before(f.quarantinedUntil) {
+		return
+	}
+	if s.trust(f, now) < s.quarantineBelow {
+		f.quarantinedUntil = now.Add(s.quarantineFor)
+	}
+}
+
+// agreementCheckable is true when both have a position and the consensus position is recent enough to project forward
+func agreementCheckable(consensus, update *export.PlaneLocation) bool {
+	if !consensus.HasLocation || !update.HasLocation || update.PositionExtrapolated {
+		return false
+	}
+	dt := update.Updates.Location.Sub(consensus.Updates.Location)
+	return dt > -time.Minute && dt < time.Minute
+}
+
+// distanceFromExpected is how far (metres) the update is from where the consensus says the aircraft should be by now
+func (s *Scorer) distanceFromExpected(consensus, update *export.PlaneLocation) float64 {
+	lat, lon := consensus.Lat, consensus.Lon
+	if consensus.HasHeading && consensus.HasVelocity {
+		dt := update.Updates.Location.Sub(consensus.Updates.Location).Seconds()
+		lat, lon = geo.Destination(lat, lon, consensus.Heading, consensus.Velocity*knotsToMetresPerSecond*dt)
+	}
+	return geo.Distance(lat, lon, update.Lat, update.Lon)
+}
+
+func (s *Scorer) skewFactor(skewSeconds float64) float64 {
+	if s.maxSkew <= 0 {
+		return 1
+	}
+	// a couple of seconds is just network delay
+	const grace = 2.0
+	skew := math.Abs(skewSeconds)
+	if skew <= grace {
+		return 1
+	}
+	return math.Max(0, 1-(skew-grace)/(s.maxSkew.Seconds()-grace))
+}
+
+func (s *Scorer) trust(f *feeder, now time.Time) float64 {
+	if now.Before(f.quarantinedUntil) {
+		return 0
+	}
+	return f.agreement * s.skewFactor(f.skew) * (1 - f.rejectRate)
+}
+
+// Trust is how much we trust the feeder, from 0 (not at all, or quarantined) to 1. Feeders we do not know are trusted
+func (s *Scorer) Trust(sourceTag string) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.feeders[sourceTag]
+	if !ok {
+		return 1
+	}
+	return s.trust(f, time.Now())
+}
+
+// Quarantined tells us if we are ignoring the feeder
+func (s *Scorer) Quarantined(sourceTag string, now time.Time) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.feeders[sourceTag]
+	return ok && now.Before(f.quarantinedUntil)
+}
+
+// Scores lists every feeder we know about, least trusted first
+func (s *Scorer) Scores(now time.Time) []Score {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	scores := make([]Score, 0, len(s.feeders))
+	for tag, f := range s.feeders {
+		score := Score{
+			SourceTag:   tag,
+			Trust:       s.trust(f, now),
+			Agreement:   f.agreement,
+			ClockSkew:   time.Duration(f.skew * float64(time.Second)),
+			RejectRate:  f.rejectRate,
+			Samples:     f.samples,
+			Rejected:    f.rejected,
+			Quarantined: now.Before(f.quarantinedUntil),
+			LastSeen:    f.lastSeen,
+		}
+		if score.Quarantined {
+			until := f.quarantinedUntil
+			score.QuarantinedUntil = &until
+		}
+		scores = append(scores, score)
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].Trust != scores[j].Trust {
+			return scores[i].Trust < scores[j].Trust
+		}
+		return scores[i].SourceTag < scores[j].SourceTag
+	})
+	return scores
+}
+
+// Forget removes feeders we have not heard from since the given time
+func (s *Scorer) Forget(before time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tag, f := range s.feeders {
+		if f.lastSeen.Before(before) {
+			delete(s.feeders, tag)
+		}
+	}
+}
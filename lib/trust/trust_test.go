@@ -0,0 +1,82 @@
+package trust
+
+import (
+	"testing"
+	"time"
+
+	"plane.watch/lib/export"
+)
+
+func location(source string, lat, lon float64, at time.Time) *export.PlaneLocation {
+	return &export.PlaneLocation{
+		SourceTag:   source,
+		Lat:         lat,
+		Lon:         lon,
+		HasLocation: true,
+		LastMsg:     at,
+		Updates:     export.Updates{Location: at},
+	}
+}
+
+func TestScorer_Agreement(t *testing.T) {
+	s := NewScorer(WithQuarantine(0.3, 20, time.Minute))
+	now := time.Now()
+	consensus := location("merged", -31.95, 115.86, now)
+
+	for i := 0; i < 100; i++ {
+		s.Observe(consensus, location("good", -31.951, 115.861, now), false, now)
+		// 100km away
+		s.Observe(consensus, location("bad", -32.85, 115.86, now), false, now)
+	}
+
+	if got := s.Trust("good"); got < 0.9 {
+		t.Errorf("expected the agreeing feeder to be trusted, got %f", got)
+	}
+	if !s.Quarantined("bad", now) || 0 != s.Trust("bad") {
+		t.Errorf("expected the disagreeing feeder to be quarantined")
+	}
+	if s.Quarantined("bad", now.Add(2*time.Minute)) {
+		t.Errorf("expected the quarantine to end")
+	}
+	if 1 != s.Trust("unknown") {
+		t.Errorf("expected feeders we do not know about to be trusted")
+	}
+
+	scores := s.Scores(now)
+	if 2 != len(scores) || "bad" != scores[0].SourceTag || !scores[0].Quarantined || nil == scores[0].QuarantinedUntil {
+		t.Errorf("expected the least trusted feeder first, got %+v", scores)
+	}
+}
+
+func TestScorer_ClockSkew(t *testing.T) {
+	s := NewScorer(WithQuarantine(0, 0, 0))
+	now := time.Now()
+	for i := 0; i < 200; i++ {
+		s.Observe(nil, location("skewed", 0, 0, now.Add(20*time.Second)), false, now)
+		s.Observe(nil, location("fine", 0, 0, now.Add(-500*time.Millisecond)), false, now)
+	}
+	scores := s.Scores(now)
+	if "skewed" != scores[0].SourceTag || scores[0].ClockSkew < 15*time.Second {
+		t.Errorf("expected the skewed feeder to have a large clock skew, got %+v", scores[0])
+	}
+	if s.Trust("skewed") > 0.5 || s.Trust("fine") < 0.99 {
+		t.Errorf("expected clock skew to reduce trust, got %f and %f", s.Trust("skewed"), s.Trust("fine"))
+	}
+}
+
+func TestScorer_Rejected(t *testing.T) {
+	s := NewScorer(WithQuarantine(0, 0, 0))
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		s.Observe(nil, location("rejected", 0, 0, now), true, now)
+	}
+	scores := s.Scores(now)
+	if 100 != scores[0].Rejected || scores[0].RejectRate < 0.9 || scores[0].Trust > 0.1 {
+		t.Errorf("expected rejections to reduce trust, got %+v", scores[0])
+	}
+
+	s.Forget(now.Add(time.Second))
+	if 0 != len(s.Scores(now)) {
+		t.Errorf("expected old feeders to be forgotten")
+	}
+}
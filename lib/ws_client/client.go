@@ -2,167 +2,573 @@ package ws_client
 
 import (
 	"context"
-	"encoding/json"
-	"github.com/rs/zerolog/log"
-	"io"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
+	"plane.watch/lib/auth"
 	"plane.watch/lib/export"
-	"plane.watch/lib/tile_grid"
 	"plane.watch/lib/ws_protocol"
-	"sync"
-	"time"
+)
+
+const (
+	// connectTimeout is how long we give the broker to accept our websocket
+	connectTimeout = 5 * time.Second
+	// readLimit is the biggest message we take from the broker, histories can be big
+	readLimit = 8 << 20
+	// deltasForgetAfter is how long we remember an aircraft we are not sent deltas for, the broker sends keyframes far
+	// more often than this
+	deltasForgetAfter = 10 * time.Minute
+	// defaultRequestTimeout is how long a request waits for its reply when its context has no deadline
+	defaultRequestTimeout = 30 * time.Second
+)
+
+var (
+	ErrNotConnected       = errors.New("not connected to the broker")
+	ErrAlreadyConnected   = errors.New("already connected, a client connects once")
+	ErrUnexpectedProtocol = errors.New("unexpected websocket protocol")
+	// ErrBroker is what the broker said went wrong with a request
+	ErrBroker = errors.New("broker error")
+	// ErrInvalidTick is a tick the broker would ignore, see ws_protocol.MaxTick
+	ErrInvalidTick = errors.New("invalid tick")
+
+	json = jsoniter.ConfigFastest
 )
 
 type (
+	// Client talks to pw_ws_broker over its websocket. It keeps the connection up, reconnecting (and asking for
+	// everything it asked for before) when it drops, until it is closed.
+	//
+	// What the broker sends us is handed to the handlers (OnLocation and friends) one message at a time, from the
+	// goroutine reading the websocket. Handlers need to be quick, and must not make requests themselves.
 	Client struct {
-		conn          *websocket.Conn
-		secure        bool
-		host          string // expected format "plane.watch:8080"
-		locationChan  chan *export.PlaneLocation
-		gridTilesChan chan []string
-		ackSubChan    chan []string
-		ackUnsubChan  chan []string
+		url        string
+		header     http.Header
+		httpClient *http.Client
+		protocol   string
+		reconnect  bool
+		maxBackoff time.Duration
+		// requestTimeout is how long a request without a deadline waits for its reply
+		requestTimeout time.Duration
+		logger         zerolog.Logger
+
+		// mu guards conn, pending and state. ctx, cancel and done are set once, when we connect
+		mu      sync.Mutex
+		conn    *websocket.Conn
+		pending *pendingRequest
+		state   state
+		ctx     context.Context
+		cancel  context.CancelFunc
+		done    chan struct{}
+
+		// requestMu makes sure only one request is waiting for its reply at a time, the broker does not say which
+		// request a reply (or an error) is for
+		requestMu sync.Mutex
+
+		handlersMu sync.RWMutex
+		handlers   handlers
+
+		// locations is LocationUpdates
+		locations     chan *export.PlaneLocation
+		locationsOnce sync.Once
+
+		// aircraft is what we know of each aircraft, when speaking planes-delta. Only the reader uses it
+		aircraft  map[string]*deltaAircraft
+		lastSweep time.Time
+	}
 
-		subLock, unsubLock, gridLock sync.Mutex
+	handlers struct {
+		response   []func(*ws_protocol.WsResponse)
+		location   []func(*export.PlaneLocation)
+		removed    []func(*export.PlaneLocation)
+		emergency  []func(*export.EmergencyEvent)
+		geofence   []func(*export.GeofenceEvent)
+		replay     []func(*ws_protocol.ReplayState, []*export.PlaneLocation)
+		error      []func(string)
+		connect    []func()
+		disconnect []func(error)
 	}
+
+	// pendingRequest is a request waiting on one of the want response types (or an error)
+	pendingRequest struct {
+		want  []string
+		reply chan *ws_protocol.WsResponse
+	}
+
+	deltaAircraft struct {
+		loc  export.PlaneLocation
+		seen time.Time
+	}
+
+	Option func(*Client)
 )
 
-func NewClient(host string) *Client {
-	return &Client{
-		host:         host,
-		secure:       true,
-		locationChan: make(chan *export.PlaneLocation, 100),
-		// response channels
-		gridTilesChan: make(chan []string),
-		ackSubChan:    make(chan []string),
-		ackUnsubChan:  make(chan []string),
+// WithLogger logs what the client gets up to with logger
+func WithLogger(logger zerolog.Logger) Option {
+	return func(c *Client) {
+		c.logger = logger
 	}
 }
 
-// Secure sets whether we use TLS to connect to the host
-func (c *Client) Secure(isSecure bool) {
-	c.secure = isSecure
+// WithApiKey connects with an API key
+func WithApiKey(key string) Option {
+	return func(c *Client) {
+		c.header.Set(auth.HeaderApiKey, key)
+	}
 }
 
-func (c *Client) Connect() (err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	conf := websocket.DialOptions{
-		Subprotocols:    []string{"planes"},
-		CompressionMode: websocket.CompressionContextTakeover,
+// WithToken connects with a (JWT) bearer token
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// WithInsecure does not check the broker's TLS certificate
+func WithInsecure() Option {
+	return func(c *Client) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		c.httpClient = &http.Client{Transport: transport}
+	}
+}
+
+// WithHTTPClient connects (and gets the grid) with httpClient
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithDeltas speaks the planes-delta protocol, the handlers still get whole locations
+func WithDeltas() Option {
+	return func(c *Client) {
+		c.protocol = ws_protocol.WsProtocolPlanesDelta
+	}
+}
+
+// WithoutReconnect stops the client when the connection drops, instead of reconnecting
+func WithoutReconnect() Option {
+	return func(c *Client) {
+		c.reconnect = false
+	}
+}
+
+// WithMaxBackoff is the longest we wait between attempts to reconnect
+func WithMaxBackoff(maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// WithRequestTimeout is how long requests wait for their reply when their context has no deadline of its own
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.requestTimeout = timeout
+	}
+}
+
+// NewClient makes a client for the broker's websocket at url, e.g. https://plane.watch/planes (or wss://)
+func NewClient(url string, opts ...Option) *Client {
+	c := &Client{
+		url:        url,
+		header:     http.Header{},
+		httpClient: http.DefaultClient,
+		protocol:   ws_protocol.WsProtocolPlanes,
+		reconnect:  true,
+		maxBackoff: 30 * time.Second,
+		logger:     zerolog.Nop(),
+		state:      newState(),
+		locations:  make(chan *export.PlaneLocation, 100),
+		aircraft:   make(map[string]*deltaAircraft),
+
+		requestTimeout: defaultRequestTimeout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// OnResponse is called with every message the broker sends, before any other handler
+func (c *Client) OnResponse(f func(rs *ws_protocol.WsResponse)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.handlers.response = append(c.handlers.response, f)
+}
+
+// OnLocation is called with each (live) location update, from the tiles we subscribed to and the aircraft we follow
+func (c *Client) OnLocation(f func(loc *export.PlaneLocation)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.handlers.location = append(c.handlers.location, f)
+}
+
+// OnAircraftRemoved is called when an aircraft we follow is no longer being tracked
+func (c *Client) OnAircraftRemoved(f func(loc *export.PlaneLocation)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.handlers.removed = append(c.handlers.removed, f)
+}
+
+// OnEmergency is called with every emergency the broker knows of
+func (c *Client) OnEmergency(f func(e *export.EmergencyEvent)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.handlers.emergency = append(c.handlers.emergency, f)
+}
+
+// OnGeofence is called with the events of the geofences we subscribed to
+func (c *Client) OnGeofence(f func(e *export.GeofenceEvent)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.handlers.geofence = append(c.handlers.geofence, f)
+}
+
+// OnReplay is called with the locations replayed by our replays, and with no locations when a replay ends
+func (c *Client) OnReplay(f func(state *ws_protocol.ReplayState, locations []*export.PlaneLocation)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.handlers.replay = append(c.handlers.replay, f)
+}
+
+// OnError is called with the errors the broker sends that are not the reply to a request
+func (c *Client) OnError(f func(msg string)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.handlers.error = append(c.handlers.error, f)
+}
+
+// OnConnect is called every time we (re)connect, before we ask for what we asked for before
+func (c *Client) OnConnect(f func()) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.handlers.connect = append(c.handlers.connect, f)
+}
+
+// OnDisconnect is called every time the connection drops, with why
+func (c *Client) OnDisconnect(f func(err error)) {
+	c.handlersMu.Lock()
+	defer c.handlersMu.Unlock()
+	c.handlers.disconnect = append(c.handlers.disconnect, f)
+}
+
+// LocationUpdates is a channel of the location updates (see OnLocation), it is closed when the client stops
+func (c *Client) LocationUpdates() <-chan *export.PlaneLocation {
+	c.locationsOnce.Do(func() {
+		c.OnLocation(func(loc *export.PlaneLocation) {
+			// handlers are only called once we are connected
+			c.mu.Lock()
+			ctx := c.ctx
+			c.mu.Unlock()
+			select {
+			case c.locations <- loc:
+			case <-ctx.Done():
+			}
+		})
+	})
+	return c.locations
+}
+
+// Connect connects to the broker and keeps the connection up until ctx is done or the client is closed. Only the first
+// attempt to connect is returned, after that we keep trying
+func (c *Client) Connect(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if nil != c.done {
+		return ErrAlreadyConnected
 	}
-	c.conn, _, err = websocket.Dial(ctx, "ws://"+c.host+"/planes", &conf)
-	if nil == err {
-		go c.listen()
+	conn, err := c.dial(ctx)
+	if nil != err {
+		return err
 	}
-	return err
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.done = make(chan struct{})
+	c.conn = conn
+	go c.run(c.ctx, conn)
+	return nil
 }
 
-func (c *Client) Disconnect() error {
-	close(c.locationChan)
-	if nil != c.conn {
-		return c.conn.Close(websocket.StatusNormalClosure, "Closing...")
+// Close disconnects from the broker, and waits for the client to stop
+func (c *Client) Close() error {
+	c.mu.Lock()
+	cancel, done := c.cancel, c.done
+	c.mu.Unlock()
+	if nil == done {
+		return ErrNotConnected
 	}
+	cancel()
+	<-done
 	return nil
 }
 
-func (c *Client) listen() {
+// Connected tells us if we are connected to the broker right now
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return nil != c.conn
+}
+
+// dial connects to the broker, making sure it speaks our protocol
+func (c *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, c.url, &websocket.DialOptions{
+		HTTPClient:      c.httpClient,
+		HTTPHeader:      c.header,
+		Subprotocols:    []string{c.protocol},
+		CompressionMode: websocket.CompressionContextTakeover,
+	})
+	if nil != err {
+		return nil, fmt.Errorf("failed to connect to the plane.watch websocket: %w", err)
+	}
+	if c.protocol != conn.Subprotocol() {
+		_ = conn.Close(websocket.StatusProtocolError, "Expected "+c.protocol)
+		return nil, fmt.Errorf("%w: wanted %s, got %s", ErrUnexpectedProtocol, c.protocol, conn.Subprotocol())
+	}
+	conn.SetReadLimit(readLimit)
+	return conn, nil
+}
+
+// run reads from the connection until it drops, then reconnects (backing off while the broker is not there) and asks
+// for what we asked for before. It stops when ctx is done
+func (c *Client) run(ctx context.Context, conn *websocket.Conn) {
+	defer func() {
+		close(c.locations)
+		close(c.done)
+	}()
+
+	first := true
 	for {
-		ctx := context.Background()
-		msg := ws_protocol.WsResponse{}
-		err := wsjson.Read(ctx, c.conn, &msg)
-		if nil != err {
-			log.Debug().Err(err).Msg("Failed to understand WS message")
+		for _, f := range c.handlerSnapshot().connect {
+			f()
+		}
+		if !first {
+			go c.resubscribe(ctx)
+		}
+		first = false
+
+		err := c.read(ctx, conn)
+		c.disconnected(err)
+		if nil != ctx.Err() || !c.reconnect {
 			return
 		}
-		switch msg.Type {
-		case ws_protocol.ResponseTypePlaneLocation:
-			c.locationChan <- msg.Location
-		case ws_protocol.ResponseTypeAckSub:
-			c.ackSubChan <- msg.Tiles
-		case ws_protocol.ResponseTypeAckUnsub:
-			c.ackUnsubChan <- msg.Tiles
-		case ws_protocol.ResponseTypeError:
-			log.Error().Str("Response", msg.Message)
-		case ws_protocol.ResponseTypeSubTiles:
-			c.gridTilesChan <- msg.Tiles
+
+		backoff := time.Second
+		for {
+			c.logger.Info().Err(err).Dur("backoff", backoff).Msg("Reconnecting to the broker")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if conn, err = c.dial(ctx); nil == err {
+				break
+			}
+			backoff = min(2*backoff+time.Duration(rand.Int63n(int64(time.Second))), c.maxBackoff)
 		}
+		c.mu.Lock()
+		c.conn = conn
+		c.mu.Unlock()
+		c.logger.Info().Msg("Reconnected to the broker")
 	}
 }
 
-func (c *Client) LocationUpdates() chan *export.PlaneLocation {
-	return c.locationChan
+// read hands what the broker sends to the handlers, until the connection drops or ctx is done
+func (c *Client) read(ctx context.Context, conn *websocket.Conn) error {
+	for {
+		mType, msg, err := conn.Read(ctx)
+		if nil != err {
+			if nil != ctx.Err() {
+				_ = conn.Close(websocket.StatusNormalClosure, "Going away")
+			}
+			return err
+		}
+		if websocket.MessageText != mType {
+			c.logger.Debug().Msg("Ignoring binary message")
+			continue
+		}
+		rs := &ws_protocol.WsResponse{}
+		if err = json.Unmarshal(msg, rs); nil != err {
+			c.logger.Error().Err(err).Msg("Failed to understand the broker")
+			continue
+		}
+		c.dispatch(rs)
+	}
 }
 
-func (c *Client) Grid() (tile_grid.GridLocations, error) {
-	rqUrl := "http"
-	if c.secure {
-		rqUrl += "s"
+// disconnected forgets the connection, and fails the request waiting on it
+func (c *Client) disconnected(err error) {
+	c.mu.Lock()
+	c.conn = nil
+	if nil != c.pending {
+		close(c.pending.reply)
+		c.pending = nil
 	}
-	rqUrl += "://" + c.host + "/grid"
+	c.mu.Unlock()
+	// the broker starts again with keyframes
+	c.aircraft = make(map[string]*deltaAircraft)
 
-	rs, err := http.Get(rqUrl)
-	if nil != err {
-		log.Error().Err(err).Msg("Unable to fetch the grid array")
-		return nil, err
+	c.logger.Debug().Err(err).Msg("Disconnected from the broker")
+	for _, f := range c.handlerSnapshot().disconnect {
+		f(err)
 	}
-	body, err := io.ReadAll(rs.Body)
-	if nil != err {
-		return nil, err
+}
+
+func (c *Client) handlerSnapshot() handlers {
+	c.handlersMu.RLock()
+	defer c.handlersMu.RUnlock()
+	return c.handlers
+}
+
+// dispatch hands a message from the broker to the request waiting on it, or to the handlers
+func (c *Client) dispatch(rs *ws_protocol.WsResponse) {
+	h := c.handlerSnapshot()
+	for _, f := range h.response {
+		f(rs)
 	}
-	if err = rs.Body.Close(); err != nil {
-		return nil, err
+	if ws_protocol.ResponseTypeAckFollow == rs.Type && nil != rs.Location && ws_protocol.WsProtocolPlanesDelta == c.protocol {
+		// the deltas for the aircraft we follow are against what the ack gave us
+		c.aircraft[rs.Location.Icao] = &deltaAircraft{loc: *rs.Location, seen: time.Now()}
+	}
+	if c.reply(rs) {
+		return
 	}
 
-	grid := tile_grid.GridLocations{}
-	if err = json.Unmarshal(body, &grid); nil != err {
-		return nil, err
+	locations := rs.Locations
+	switch rs.Type {
+	case ws_protocol.ResponseTypePlaneLocation:
+		locations = []*export.PlaneLocation{rs.Location}
+	case ws_protocol.ResponseTypePlaneLocations:
+	case ws_protocol.ResponseTypePlaneDeltas:
+		locations = c.applyDeltas(rs)
+	case ws_protocol.ResponseTypeAircraftRemoved:
+		delete(c.aircraft, rs.Icao)
+		for _, f := range h.removed {
+			f(rs.Location)
+		}
+		return
+	case ws_protocol.ResponseTypeEmergency:
+		for _, f := range h.emergency {
+			f(rs.Emergency)
+		}
+		return
+	case ws_protocol.ResponseTypeGeofence:
+		for _, f := range h.geofence {
+			f(rs.Geofence)
+		}
+		return
+	case ws_protocol.ResponseTypeReplayEnd:
+		for _, f := range h.replay {
+			f(rs.Replay, nil)
+		}
+		return
+	case ws_protocol.ResponseTypeError:
+		c.logger.Warn().Str("message", rs.Message).Msg("Broker error")
+		for _, f := range h.error {
+			f(rs.Message)
+		}
+		return
+	default:
+		return
 	}
 
-	return grid, nil
+	if nil != rs.Replay {
+		for _, f := range h.replay {
+			f(rs.Replay, locations)
+		}
+		return
+	}
+	for _, loc := range locations {
+		if nil == loc {
+			continue
+		}
+		for _, f := range h.location {
+			f(loc)
+		}
+	}
 }
 
-func (c *Client) SubscribedTileList() ([]string, error) {
-	c.gridLock.Lock()
-	defer c.gridLock.Unlock()
-	rq := ws_protocol.WsRequest{
-		Type: ws_protocol.RequestTypeSubscribeList,
+// reply hands the message to the request waiting on it, if it is what the request was waiting for
+func (c *Client) reply(rs *ws_protocol.WsResponse) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if nil == c.pending {
+		return false
 	}
-	err := wsjson.Write(context.Background(), c.conn, &rq)
-	if nil != err {
-		return nil, err
+	if ws_protocol.ResponseTypeError != rs.Type && !contains(c.pending.want, rs.Type) {
+		return false
 	}
-
-	return <-c.ackSubChan, nil
+	c.pending.reply <- rs
+	c.pending = nil
+	return true
 }
-func (c *Client) Subscribe(tileName string) error {
-	c.subLock.Lock()
-	defer c.subLock.Unlock()
-	rq := ws_protocol.WsRequest{
-		Type:     ws_protocol.RequestTypeSubscribe,
-		GridTile: tileName,
+
+// applyDeltas turns the deltas into whole locations, from what we were sent before
+func (c *Client) applyDeltas(rs *ws_protocol.WsResponse) []*export.PlaneLocation {
+	now := time.Now()
+	if now.Sub(c.lastSweep) > time.Minute {
+		for k, a := range c.aircraft {
+			if now.Sub(a.seen) > deltasForgetAfter {
+				delete(c.aircraft, k)
+			}
+		}
+		c.lastSweep = now
 	}
-	err := wsjson.Write(context.Background(), c.conn, &rq)
-	if nil != err {
-		return err
+
+	// replays have their own view of the aircraft
+	prefix := ""
+	if nil != rs.Replay {
+		prefix = rs.Replay.Id + "/"
 	}
-	<-c.ackSubChan
-	return nil
+	locations := make([]*export.PlaneLocation, 0, len(rs.Deltas))
+	for _, d := range rs.Deltas {
+		a, ok := c.aircraft[prefix+d.Icao]
+		if !ok {
+			if !d.Full {
+				// we have not got what this is a change to, it will be in the next keyframe
+				c.logger.Debug().Str("icao", d.Icao).Msg("Delta without a keyframe")
+				continue
+			}
+			a = &deltaAircraft{}
+			c.aircraft[prefix+d.Icao] = a
+		}
+		if err := ws_protocol.ApplyDelta(&a.loc, d); nil != err {
+			c.logger.Error().Err(err).Str("icao", d.Icao).Msg("Failed to apply delta")
+			continue
+		}
+		a.seen = now
+		loc := a.loc
+		locations = append(locations, &loc)
+	}
+	return locations
 }
 
-func (c *Client) Unsubscribe(tileName string) error {
-	c.unsubLock.Lock()
-	defer c.unsubLock.Unlock()
-	rq := ws_protocol.WsRequest{
-		Type:     ws_protocol.RequestTypeUnsubscribe,
-		GridTile: tileName,
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
 	}
-	err := wsjson.Write(context.Background(), c.conn, &rq)
-	if nil != err {
-		return err
+	return false
+}
+
+// httpURL is the broker's http address, from its websocket url
+func (c *Client) httpURL(path string) string {
+	u := c.url
+	switch {
+	case strings.HasPrefix(u, "ws://"):
+		u = "http://" + strings.TrimPrefix(u, "ws://")
+	case strings.HasPrefix(u, "wss://"):
+		u = "https://" + strings.TrimPrefix(u, "wss://")
 	}
-	<-c.ackSubChan
-	return nil
+	return strings.TrimSuffix(strings.TrimSuffix(u, "/"), "/planes") + path
 }
@@ -0,0 +1,311 @@
+package ws_client
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"plane.watch/lib/auth"
+	"plane.watch/lib/export"
+	"plane.watch/lib/history"
+	"plane.watch/lib/tile_grid"
+	"plane.watch/lib/ws_protocol"
+)
+
+func testAircraft(icao, callSign, tile string, altitude int) *export.PlaneLocation {
+	return &export.PlaneLocation{
+		Icao:         icao,
+		CallSign:     &callSign,
+		TileLocation: tile,
+		Lat:          -31.95,
+		Lon:          115.86,
+		HasLocation:  true,
+		Altitude:     altitude,
+		HasAltitude:  true,
+		LastMsg:      time.Now(),
+	}
+}
+
+func connectTestClient(t *testing.T, ctx context.Context, fb *FakeBroker, opts ...Option) *Client {
+	t.Helper()
+	c := NewClient(fb.URL(), opts...)
+	if err := c.Connect(ctx); nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func nextLocation(t *testing.T, ch <-chan *export.PlaneLocation) *export.PlaneLocation {
+	t.Helper()
+	select {
+	case loc := <-ch:
+		return loc
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a location update")
+		return nil
+	}
+}
+
+func TestClient_Requests(t *testing.T) {
+	fb := NewFakeBroker()
+	defer fb.Close()
+	qfa9 := testAircraft("7C6CA3", "QFA9", "tile38", 36000)
+	fb.SetAircraft(qfa9, testAircraft("7C4924", "VOZ1", "tile40", 12000))
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	points := make([]history.Point, 100)
+	for i := range points {
+		points[i] = history.Point{Time: start.Add(time.Duration(i) * time.Second), Lon: float64(i) * 0.001}
+	}
+	fb.SetHistory("7C6CA3", points)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := connectTestClient(t, ctx, fb, WithApiKey("secret"))
+	if "secret" != fb.Headers()[0].Get(auth.HeaderApiKey) {
+		t.Errorf("expected to connect with our api key, got %v", fb.Headers()[0])
+	}
+
+	if err := c.Subscribe(ctx, "tile38_low"); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.Subscribe(ctx, "nope"); !errors.Is(err, ErrBroker) {
+		t.Errorf("expected a broker error for an unknown tile, got %v", err)
+	}
+	if err := c.Unsubscribe(ctx, "tile39_low"); !errors.Is(err, ErrBroker) {
+		t.Errorf("expected a broker error unsubscribing from a tile we are not subscribed to, got %v", err)
+	}
+	if tiles, err := c.SubscribedTileList(ctx); nil != err || 1 != len(tiles) || "tile38_low" != tiles[0] {
+		t.Errorf("expected to be subscribed to tile38_low, got %v %v", tiles, err)
+	}
+	if tiles, err := c.SubscribeBBox(ctx, tile_grid.GlobeIndexSpecialTile{North: -31, South: -33, West: 115, East: 117}, 8, "high"); nil != err || 0 == len(tiles) {
+		t.Errorf("expected the viewport cells, got %v %v", tiles, err)
+	}
+	if err := c.AdjustTick(ctx, 500*time.Millisecond); nil != err {
+		t.Error(err)
+	}
+
+	results, err := c.Search(ctx, "qfa")
+	if nil != err || 1 != len(results.Aircraft) || "7C6CA3" != results.Aircraft[0].Icao {
+		t.Errorf("expected to find QFA9, got %+v %v", results, err)
+	}
+
+	path, profile, err := c.History(ctx, "7c6ca3", "", &history.Options{From: start, MaxPoints: 10})
+	if nil != err || 10 != len(path) || 10 != len(profile) || !path[0].Time.Equal(start) {
+		t.Errorf("expected 10 points of history, got %d and %d %v", len(path), len(profile), err)
+	}
+	if _, _, err = c.History(ctx, "nope", "", nil); !errors.Is(err, ErrBroker) {
+		t.Errorf("expected a broker error for a bad icao, got %v", err)
+	}
+
+	if f, errFilter := c.Filter(ctx, &ws_protocol.Filter{CallSign: []string{"VOZ*"}}); nil != errFilter || nil == f {
+		t.Errorf("expected the filter to be acked, got %v", errFilter)
+	}
+	if _, err = c.Filter(ctx, nil); nil != err {
+		t.Error(err)
+	}
+
+	if loc, errFollow := c.Follow(ctx, "", "qfa9"); nil != errFollow || nil == loc || "7C6CA3" != loc.Icao {
+		t.Errorf("expected to follow QFA9, got %+v %v", loc, errFollow)
+	}
+	if err = c.Unfollow(ctx, "", "qfa9"); nil != err {
+		t.Error(err)
+	}
+	if err = c.Unfollow(ctx, "", "qfa9"); !errors.Is(err, ErrBroker) {
+		t.Errorf("expected a broker error unfollowing twice, got %v", err)
+	}
+
+	// the snapshot comes with the location updates
+	updates := c.LocationUpdates()
+	if err = c.GridPlanes(ctx, "tile40"); nil != err {
+		t.Fatal(err)
+	}
+	if loc := nextLocation(t, updates); "7C4924" != loc.Icao {
+		t.Errorf("expected the aircraft in tile40, got %s", loc.Icao)
+	}
+
+	grid, err := c.Grid(ctx)
+	if nil != err || 0 == len(grid) {
+		t.Errorf("expected the grid, got %d tiles %v", len(grid), err)
+	}
+}
+
+func TestClient_Handlers(t *testing.T) {
+	fb := NewFakeBroker()
+	defer fb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := NewClient(fb.URL())
+	errs := make(chan string, 1)
+	emergencies := make(chan *export.EmergencyEvent, 1)
+	c.OnError(func(msg string) { errs <- msg })
+	c.OnEmergency(func(e *export.EmergencyEvent) { emergencies <- e })
+	if err := c.Connect(ctx); nil != err {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	fb.Send(&ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeError, Message: "Too many requests, slow down"})
+	fb.Send(&ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeEmergency, Emergency: &export.EmergencyEvent{Icao: "7C6CA3"}})
+	select {
+	case msg := <-errs:
+		if "Too many requests, slow down" != msg {
+			t.Errorf("unexpected error %s", msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("expected the error to go to OnError")
+	}
+	select {
+	case e := <-emergencies:
+		if "7C6CA3" != e.Icao {
+			t.Errorf("unexpected emergency %+v", e)
+		}
+	case <-ctx.Done():
+		t.Fatal("expected the emergency to go to OnEmergency")
+	}
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	fb := NewFakeBroker()
+	defer fb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	c := NewClient(fb.URL(), WithMaxBackoff(time.Second))
+	var connects, disconnects atomic.Int32
+	c.OnConnect(func() { connects.Add(1) })
+	c.OnDisconnect(func(error) { disconnects.Add(1) })
+	updates := c.LocationUpdates()
+	if err := c.Connect(ctx); nil != err {
+		t.Fatal(err)
+	}
+	defer func() { _ = c.Close() }()
+
+	if err := c.Subscribe(ctx, "tile38_low"); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := c.Follow(ctx, "7C4924", ""); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.Subscribe(ctx, "tile39_low"); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.Unsubscribe(ctx, "tile39_low"); nil != err {
+		t.Fatal(err)
+	}
+
+	before := len(fb.Requests())
+	fb.DropConnections()
+	// we resubscribe to tile38_low and follow 7C4924, and that is all
+	for len(fb.Requests()) < before+2 {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected to resubscribe, got %+v", fb.Requests()[before:])
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	again := fb.Requests()[before:]
+	if ws_protocol.RequestTypeSubscribe != again[0].Type || "tile38_low" != again[0].GridTile ||
+		ws_protocol.RequestTypeFollow != again[1].Type || "7C4924" != again[1].Icao {
+		t.Errorf("expected to resubscribe, got %+v", again)
+	}
+	if 2 != connects.Load() || 1 != disconnects.Load() || !c.Connected() {
+		t.Errorf("expected to have reconnected, got %d connects and %d disconnects", connects.Load(), disconnects.Load())
+	}
+
+	// give the resubscribe a moment to be acked
+	time.Sleep(100 * time.Millisecond)
+	fb.SendLocations(testAircraft("7C6CA3", "QFA9", "tile38", 36000), testAircraft("7C4924", "VOZ1", "tile40", 12000))
+	if loc := nextLocation(t, updates); "7C6CA3" != loc.Icao {
+		t.Errorf("expected an update for our tile, got %s", loc.Icao)
+	}
+	if loc := nextLocation(t, updates); "7C4924" != loc.Icao {
+		t.Errorf("expected an update for the aircraft we follow, got %s", loc.Icao)
+	}
+}
+
+func TestClient_Deltas(t *testing.T) {
+	fb := NewFakeBroker()
+	defer fb.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c := connectTestClient(t, ctx, fb, WithDeltas())
+	updates := c.LocationUpdates()
+	if err := c.Subscribe(ctx, ws_protocol.GridTileAllLow); nil != err {
+		t.Fatal(err)
+	}
+
+	fb.SendLocations(testAircraft("7C6CA3", "QFA9", "tile38", 36000))
+	fb.SendLocations(testAircraft("7C6CA3", "QFA9", "tile38", 35000))
+	nextLocation(t, updates)
+	loc := nextLocation(t, updates)
+	if 35000 != loc.Altitude || nil == loc.CallSign || "QFA9" != *loc.CallSign {
+		t.Errorf("expected the whole aircraft with the new altitude, got %+v", loc)
+	}
+	if err := c.Resync(ctx, "7C6CA3"); nil != err {
+		t.Error(err)
+	}
+}
+
+func TestClient_Close(t *testing.T) {
+	fb := NewFakeBroker()
+	defer fb.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := NewClient(fb.URL())
+	updates := c.LocationUpdates()
+	if err := c.Connect(ctx); nil != err {
+		t.Fatal(err)
+	}
+	if err := c.Connect(ctx); !errors.Is(err, ErrAlreadyConnected) {
+		t.Errorf("expected to only connect once, got %v", err)
+	}
+	cancel()
+	select {
+	case _, ok := <-updates:
+		if ok {
+			t.Error("expected the location updates to be closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the client to stop when its context is done")
+	}
+	if err := c.Subscribe(context.Background(), "tile38_low"); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected to not be connected, got %v", err)
+	}
+	if err := c.Close(); nil != err {
+		t.Error(err)
+	}
+
+	if err := NewClient(fb.URL(), WithDeltas()).Connect(context.Background()); nil != err {
+		t.Error(err)
+	}
+	fb.server.Close()
+	if err := NewClient(fb.URL()).Connect(context.Background()); nil == err {
+		t.Error("expected to not be able to connect to a broker that is not there")
+	}
+}
+
+func TestClient_RequestTimeout(t *testing.T) {
+	fb := NewFakeBroker()
+	defer fb.Close()
+	c := connectTestClient(t, context.Background(), fb, WithRequestTimeout(200*time.Millisecond))
+
+	for _, tick := range []time.Duration{0, time.Microsecond, ws_protocol.MaxTick} {
+		if err := c.AdjustTick(context.Background(), tick); !errors.Is(err, ErrInvalidTick) {
+			t.Errorf("expected %s to be an invalid tick, got %v", tick, err)
+		}
+	}
+
+	// the broker does not answer a tick it cannot use, so we give up on it
+	_, err := c.Request(context.Background(), &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeTickAdjust, Tick: 60_000})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the request to time out, got %v", err)
+	}
+	if err = c.Subscribe(context.Background(), "tile38_low"); nil != err {
+		t.Errorf("expected to make requests after one timed out, got %v", err)
+	}
+}
@@ -1,11 +1,16 @@
 package ws_client
 
+import "context"
+
+// DefaultURL is plane.watch's websocket
+const DefaultURL = "https://plane.watch/planes"
+
 var DefaultClient *Client
 
 func init() {
-	DefaultClient = NewClient("https://plane.watch")
+	DefaultClient = NewClient(DefaultURL)
 }
 
-func Connect() error {
-	return DefaultClient.Connect()
+func Connect(ctx context.Context) error {
+	return DefaultClient.Connect(ctx)
 }
@@ -0,0 +1,468 @@
+package ws_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+	"plane.watch/lib/export"
+	"plane.watch/lib/history"
+	"plane.watch/lib/search"
+	"plane.watch/lib/tile_grid"
+	"plane.watch/lib/ws_protocol"
+)
+
+// fakeTileLevels are the cell levels the fake broker lets clients subscribe to, the broker's default
+var fakeTileLevels = []int{2, 4, 6, 8, 10}
+
+type (
+	// FakeBroker is an in-process pw_ws_broker to test clients against. It answers requests the way the broker does,
+	// from the aircraft and history it is given, and sends location updates when told to. There is no send tick,
+	// authentication or replays
+	FakeBroker struct {
+		server *httptest.Server
+
+		mu       sync.Mutex
+		conns    map[*fakeConn]bool
+		requests []ws_protocol.WsRequest
+		headers  []http.Header
+		aircraft map[string]*export.PlaneLocation
+		history  map[string][]history.Point
+	}
+
+	// fakeConn is a client connected to the fake broker
+	fakeConn struct {
+		conn     *websocket.Conn
+		protocol string
+		cancel   context.CancelFunc
+
+		mu      sync.Mutex
+		subs    map[string]bool
+		follows map[string]bool
+		filter  *ws_protocol.CompiledFilter
+		delta   *ws_protocol.DeltaEncoder
+	}
+)
+
+// NewFakeBroker starts a fake broker, Close it when done
+func NewFakeBroker() *FakeBroker {
+	fb := &FakeBroker{
+		conns:    make(map[*fakeConn]bool),
+		aircraft: make(map[string]*export.PlaneLocation),
+		history:  make(map[string][]history.Point),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/planes", fb.servePlanes)
+	mux.HandleFunc("/grid", func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := json.Marshal(tile_grid.GetGrid())
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(buf)
+	})
+	fb.server = httptest.NewServer(mux)
+	return fb
+}
+
+// URL is the fake broker's websocket
+func (fb *FakeBroker) URL() string {
+	return strings.Replace(fb.server.URL, "http://", "ws://", 1) + "/planes"
+}
+
+// Close disconnects every client and stops the fake broker
+func (fb *FakeBroker) Close() {
+	fb.DropConnections()
+	fb.server.Close()
+}
+
+// DropConnections disconnects every client, as if the broker went away
+func (fb *FakeBroker) DropConnections() {
+	fb.mu.Lock()
+	conns := fb.conns
+	fb.conns = make(map[*fakeConn]bool)
+	fb.mu.Unlock()
+	for fc := range conns {
+		_ = fc.conn.Close(websocket.StatusGoingAway, "Going away")
+		fc.cancel()
+	}
+}
+
+// Clients is how many clients are connected
+func (fb *FakeBroker) Clients() int {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return len(fb.conns)
+}
+
+// Requests is every request clients have made, in order
+func (fb *FakeBroker) Requests() []ws_protocol.WsRequest {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return append([]ws_protocol.WsRequest{}, fb.requests...)
+}
+
+// Headers are the http headers each client connected with, in order
+func (fb *FakeBroker) Headers() []http.Header {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return append([]http.Header{}, fb.headers...)
+}
+
+// SetAircraft is what the fake broker knows about right now, for search, follow and grid-planes
+func (fb *FakeBroker) SetAircraft(aircraft ...*export.PlaneLocation) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.aircraft = make(map[string]*export.PlaneLocation, len(aircraft))
+	for _, loc := range aircraft {
+		fb.aircraft[loc.Icao] = loc
+	}
+}
+
+// SetHistory is where an aircraft has been (oldest first), for plane-location-history
+func (fb *FakeBroker) SetHistory(icao string, points []history.Point) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.history[strings.ToUpper(icao)] = points
+}
+
+// SendLocations sends the updates to the clients subscribed to (or following) each aircraft, as the broker would
+// with no send tick
+func (fb *FakeBroker) SendLocations(locations ...*export.PlaneLocation) {
+	for _, fc := range fb.connections() {
+		for _, loc := range locations {
+			if fc.wants(loc) {
+				_ = fc.sendLocations(loc)
+			}
+		}
+	}
+}
+
+// Send sends rs to every client
+func (fb *FakeBroker) Send(rs *ws_protocol.WsResponse) {
+	for _, fc := range fb.connections() {
+		_ = fc.send(rs)
+	}
+}
+
+func (fb *FakeBroker) connections() []*fakeConn {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	conns := make([]*fakeConn, 0, len(fb.conns))
+	for fc := range fb.conns {
+		conns = append(conns, fc)
+	}
+	return conns
+}
+
+func (fb *FakeBroker) servePlanes(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		Subprotocols:    []string{ws_protocol.WsProtocolPlanes, ws_protocol.WsProtocolPlanesDelta},
+		CompressionMode: websocket.CompressionContextTakeover,
+	})
+	if nil != err {
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	fc := &fakeConn{
+		conn:     conn,
+		protocol: conn.Subprotocol(),
+		cancel:   cancel,
+		subs:     make(map[string]bool),
+		follows:  make(map[string]bool),
+	}
+	if ws_protocol.WsProtocolPlanesDelta == fc.protocol {
+		fc.delta = ws_protocol.NewDeltaEncoder(30 * time.Second)
+	}
+	fb.mu.Lock()
+	fb.conns[fc] = true
+	fb.headers = append(fb.headers, r.Header.Clone())
+	fb.mu.Unlock()
+	defer func() {
+		fb.mu.Lock()
+		delete(fb.conns, fc)
+		fb.mu.Unlock()
+		cancel()
+	}()
+
+	for {
+		_, msg, errRead := conn.Read(ctx)
+		if nil != errRead {
+			return
+		}
+		var rq ws_protocol.WsRequest
+		if errRead = json.Unmarshal(msg, &rq); nil != errRead {
+			_ = fc.sendError("Unknown request")
+			continue
+		}
+		fb.mu.Lock()
+		fb.requests = append(fb.requests, rq)
+		fb.mu.Unlock()
+		if errRead = fb.handle(fc, &rq); nil != errRead {
+			return
+		}
+	}
+}
+
+// handle answers a request, the way the broker does
+func (fb *FakeBroker) handle(fc *fakeConn, rq *ws_protocol.WsRequest) error {
+	switch rq.Type {
+	case ws_protocol.RequestTypeSubscribe:
+		if !strings.HasSuffix(rq.GridTile, ws_protocol.GridTileSuffixLow) && !strings.HasSuffix(rq.GridTile, ws_protocol.GridTileSuffixHigh) &&
+			!strings.HasPrefix(rq.GridTile, ws_protocol.GridTileGeofencePrefix) {
+			return fc.sendError("Unknown Tile: " + rq.GridTile)
+		}
+		fc.mu.Lock()
+		fc.subs[rq.GridTile] = true
+		fc.mu.Unlock()
+		return fc.send(&ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeAckSub, Tiles: []string{rq.GridTile}})
+	case ws_protocol.RequestTypeUnsubscribe:
+		fc.mu.Lock()
+		ok := fc.subs[rq.GridTile]
+		delete(fc.subs, rq.GridTile)
+		fc.mu.Unlock()
+		if !ok {
+			return fc.sendError("Not Subbed to: " + rq.GridTile)
+		}
+		return fc.send(&ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeAckUnsub, Tiles: []string{rq.GridTile}})
+	case ws_protocol.RequestTypeSubscribeList:
+		fc.mu.Lock()
+		tiles := make([]string, 0, len(fc.subs))
+		for tile := range fc.subs {
+			tiles = append(tiles, tile)
+		}
+		fc.mu.Unlock()
+		sort.Strings(tiles)
+		return fc.send(&ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeSubTiles, Tiles: tiles})
+	case ws_protocol.RequestTypeSubscribeBBox:
+		if nil == rq.Bounds {
+			return fc.sendError("Unable to subscribe to viewport: " + tile_grid.ErrInvalidBounds.Error())
+		}
+		cells, err := tile_grid.ViewportCells(*rq.Bounds, rq.Zoom, fakeTileLevels, 64)
+		if nil != err {
+			return fc.sendError("Unable to subscribe to viewport: " + err.Error())
+		}
+		suffix := ws_protocol.GridTileSuffixLow
+		if "high" == rq.Speed {
+			suffix = ws_protocol.GridTileSuffixHigh
+		}
+		tiles := make([]string, len(cells))
+		for i, cell := range cells {
+			tiles[i] = cell.String() + suffix
+		}
+		return fc.send(&ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeAckSub, Tiles: tiles})
+	case ws_protocol.RequestTypeUnsubscribeBBox:
+		return fc.send(&ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeAckUnsub})
+	case ws_protocol.RequestTypeGridPlanes:
+		matching := make([]*export.PlaneLocation, 0)
+		for _, loc := range fb.known() {
+			if rq.GridTile == loc.TileLocation {
+				matching = append(matching, loc)
+			}
+		}
+		if 0 == len(matching) {
+			return nil
+		}
+		return fc.sendLocations(matching...)
+	case ws_protocol.RequestTypePlaneLocHistory:
+		q := history.Query{Icao: rq.Icao, CallSign: rq.CallSign}
+		if nil != rq.History {
+			q.Options = *rq.History
+		}
+		if err := q.Check(0, time.Now()); nil != err {
+			return fc.sendError("Unable to get history: " + err.Error())
+		}
+		fb.mu.Lock()
+		points := make([]history.Point, 0)
+		for _, p := range fb.history[q.Icao] {
+			if !p.Time.Before(q.From) && p.Time.Before(q.To) {
+				points = append(points, p)
+			}
+		}
+		fb.mu.Unlock()
+		result := history.Build(q, points)
+		return fc.send(&ws_protocol.WsResponse{
+			Type:     ws_protocol.ResponseTypePlaneLocHistory,
+			History:  result.Path,
+			Profile:  result.Profile,
+			Icao:     q.Icao,
+			CallSign: q.CallSign,
+		})
+	case ws_protocol.RequestTypeTickAdjust:
+		if rq.Tick <= 0 || time.Duration(rq.Tick)*time.Millisecond >= ws_protocol.MaxTick {
+			// like the broker, which ignores ticks it cannot use
+			return nil
+		}
+		return fc.send(&ws_protocol.WsResponse{
+			Type:    ws_protocol.ResponseTypeMsg,
+			Message: fmt.Sprintf("Set Tick Rate To %s", time.Duration(rq.Tick)*time.Millisecond),
+		})
+	case ws_protocol.RequestTypeSearch:
+		// ranked like the broker does, without the airports, routes and operators it asks pw_atc_api for
+		idx := search.NewIndex(func(a, b *export.PlaneLocation) bool { return a.Icao < b.Icao })
+		for _, loc := range fb.known() {
+			idx.Set(loc.Icao, loc, loc.Icao, unPtr(loc.CallSign), unPtr(loc.Registration), unPtr(loc.TypeCode), unPtr(loc.Operator))
+		}
+		results := ws_protocol.SearchResult{
+			Query:    rq.Query,
+			Aircraft: ws_protocol.AircraftList{},
+			Airport:  []ws_protocol.AirportLocation{},
+			Route:    []string{},
+			Routes:   []export.Route{},
+			Operator: []export.Operator{},
+		}
+		for _, hit := range idx.Search(rq.Query, 10) {
+			results.Aircraft = append(results.Aircraft, hit.Item)
+		}
+		return fc.send(&ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeSearchResults, Results: &results})
+	case ws_protocol.RequestTypeFilter:
+		rs := &ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeAckFilter}
+		var filter *ws_protocol.CompiledFilter
+		if nil != rq.Filter {
+			var err error
+			if filter, err = rq.Filter.Compile(); nil != err {
+				return fc.sendError("Unable to use filter: " + err.Error())
+			}
+			rs.Filter = &filter.Filter
+		}
+		fc.mu.Lock()
+		fc.filter = filter
+		fc.mu.Unlock()
+		return fc.send(rs)
+	case ws_protocol.RequestTypeFollow:
+		if "" == rq.Icao && "" == rq.CallSign {
+			return fc.sendError("Unable to follow: which aircraft?")
+		}
+		fc.mu.Lock()
+		fc.follows[followKey(rq.Icao, rq.CallSign)] = true
+		fc.mu.Unlock()
+		rs := &ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeAckFollow, Icao: rq.Icao, CallSign: rq.CallSign}
+		for _, loc := range fb.known() {
+			if fakeFollows(rq.Icao, rq.CallSign, loc) {
+				rs.Location = loc
+			}
+		}
+		if nil != fc.delta {
+			fc.mu.Lock()
+			fc.delta.Sent(rs.Location, time.Now())
+			fc.mu.Unlock()
+		}
+		return fc.send(rs)
+	case ws_protocol.RequestTypeUnfollow:
+		key := followKey(rq.Icao, rq.CallSign)
+		fc.mu.Lock()
+		ok := fc.follows[key]
+		delete(fc.follows, key)
+		fc.mu.Unlock()
+		if !ok {
+			return fc.sendError("Not following: " + rq.Icao + rq.CallSign)
+		}
+		return fc.send(&ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeAckUnfollow, Icao: rq.Icao, CallSign: rq.CallSign})
+	case ws_protocol.RequestTypeResync:
+		if nil == fc.delta {
+			return fc.sendError("Unable to resync: not speaking " + ws_protocol.WsProtocolPlanesDelta)
+		}
+		fc.mu.Lock()
+		fc.delta.Reset(rq.Icao)
+		fc.mu.Unlock()
+		return fc.send(&ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeMsg, Message: "Resync " + rq.Icao})
+	case ws_protocol.RequestTypeReplay, ws_protocol.RequestTypeReplayPause, ws_protocol.RequestTypeReplayResume,
+		ws_protocol.RequestTypeReplaySeek, ws_protocol.RequestTypeReplaySpeed, ws_protocol.RequestTypeReplayStop:
+		return fc.sendError("Unable to replay: replays are not available")
+	default:
+		return fc.sendError("Unknown request type")
+	}
+}
+
+// known is every aircraft we know about, by icao
+func (fb *FakeBroker) known() []*export.PlaneLocation {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	list := make([]*export.PlaneLocation, 0, len(fb.aircraft))
+	for _, loc := range fb.aircraft {
+		list = append(list, loc)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Icao < list[j].Icao
+	})
+	return list
+}
+
+// fakeFollows tells us if the aircraft is the one being followed
+func fakeFollows(icao, callSign string, loc *export.PlaneLocation) bool {
+	if "" != icao {
+		return strings.EqualFold(icao, loc.Icao)
+	}
+	return nil != loc.CallSign && strings.EqualFold(strings.TrimSpace(callSign), strings.TrimSpace(*loc.CallSign))
+}
+
+// wants tells us if the client is subscribed to (or following) the aircraft, and it gets past the client's filter
+func (fc *fakeConn) wants(loc *export.PlaneLocation) bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if nil != fc.filter && !fc.filter.Matches(loc) {
+		return false
+	}
+	if fc.subs[ws_protocol.GridTileAllLow] || fc.subs[ws_protocol.GridTileAllHigh] ||
+		fc.subs[loc.TileLocation+ws_protocol.GridTileSuffixLow] || fc.subs[loc.TileLocation+ws_protocol.GridTileSuffixHigh] {
+		return true
+	}
+	for key := range fc.follows {
+		if strings.HasPrefix(key, "callsign:") {
+			if fakeFollows("", strings.TrimPrefix(key, "callsign:"), loc) {
+				return true
+			}
+		} else if fakeFollows(key, "", loc) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendLocations sends the locations as a plane-location-list, or plane-delta-list for planes-delta clients
+func (fc *fakeConn) sendLocations(locations ...*export.PlaneLocation) error {
+	if nil == fc.delta {
+		return fc.send(&ws_protocol.WsResponse{Type: ws_protocol.ResponseTypePlaneLocations, Locations: locations})
+	}
+	now := time.Now()
+	rs := &ws_protocol.WsResponse{Type: ws_protocol.ResponseTypePlaneDeltas}
+	fc.mu.Lock()
+	for _, loc := range locations {
+		d, err := fc.delta.Encode(loc, now)
+		if nil != err {
+			fc.mu.Unlock()
+			return err
+		}
+		rs.Deltas = append(rs.Deltas, d)
+	}
+	fc.mu.Unlock()
+	return fc.send(rs)
+}
+
+func (fc *fakeConn) sendError(msg string) error {
+	return fc.send(&ws_protocol.WsResponse{Type: ws_protocol.ResponseTypeError, Message: msg})
+}
+
+func (fc *fakeConn) send(rs *ws_protocol.WsResponse) error {
+	buf, err := json.Marshal(rs)
+	if nil != err {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = fc.conn.Write(ctx, websocket.MessageText, buf); nil != err && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+func unPtr(s *string) string {
+	if nil == s {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,348 @@
+package ws_client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"nhooyr.io/websocket"
+	"plane.watch/lib/export"
+	"plane.watch/lib/history"
+	"plane.watch/lib/tile_grid"
+	"plane.watch/lib/ws_protocol"
+)
+
+// resubscribeTimeout is how long we give each request we make again after reconnecting
+const resubscribeTimeout = 10 * time.Second
+
+var (
+	// replies are the response types the broker answers each request with (or an error), requests that are not here
+	// (like grid-planes) get no reply of their own
+	replies = map[string][]string{
+		ws_protocol.RequestTypeSubscribe:       {ws_protocol.ResponseTypeAckSub},
+		ws_protocol.RequestTypeUnsubscribe:     {ws_protocol.ResponseTypeAckUnsub},
+		ws_protocol.RequestTypeSubscribeList:   {ws_protocol.ResponseTypeSubTiles},
+		ws_protocol.RequestTypeSubscribeBBox:   {ws_protocol.ResponseTypeAckSub},
+		ws_protocol.RequestTypeUnsubscribeBBox: {ws_protocol.ResponseTypeAckUnsub},
+		ws_protocol.RequestTypePlaneLocHistory: {ws_protocol.ResponseTypePlaneLocHistory},
+		ws_protocol.RequestTypeTickAdjust:      {ws_protocol.ResponseTypeMsg},
+		ws_protocol.RequestTypeSearch:          {ws_protocol.ResponseTypeSearchResults},
+		ws_protocol.RequestTypeFilter:          {ws_protocol.ResponseTypeAckFilter},
+		ws_protocol.RequestTypeFollow:          {ws_protocol.ResponseTypeAckFollow},
+		ws_protocol.RequestTypeUnfollow:        {ws_protocol.ResponseTypeAckUnfollow},
+		ws_protocol.RequestTypeResync:          {ws_protocol.ResponseTypeMsg},
+		ws_protocol.RequestTypeReplay:          {ws_protocol.ResponseTypeAckReplay},
+		ws_protocol.RequestTypeReplayPause:     {ws_protocol.ResponseTypeAckReplay},
+		ws_protocol.RequestTypeReplayResume:    {ws_protocol.ResponseTypeAckReplay},
+		ws_protocol.RequestTypeReplaySeek:      {ws_protocol.ResponseTypeAckReplay},
+		ws_protocol.RequestTypeReplaySpeed:     {ws_protocol.ResponseTypeAckReplay},
+		ws_protocol.RequestTypeReplayStop:      {ws_protocol.ResponseTypeReplayEnd},
+	}
+)
+
+type (
+	// state is what we have asked the broker for, that we ask for again when we reconnect
+	state struct {
+		tick    int
+		filter  *ws_protocol.Filter
+		tiles   map[string]bool
+		bbox    *ws_protocol.WsRequest
+		follows map[string]ws_protocol.WsRequest
+	}
+)
+
+func newState() state {
+	return state{
+		tiles:   make(map[string]bool),
+		follows: make(map[string]ws_protocol.WsRequest),
+	}
+}
+
+// followKey is how we tell the aircraft we follow apart, by icao or callsign
+func followKey(icao, callSign string) string {
+	if "" != icao {
+		return strings.ToUpper(strings.TrimSpace(icao))
+	}
+	return "callsign:" + strings.ToUpper(strings.TrimSpace(callSign))
+}
+
+// remember keeps track of what the broker agreed to
+func (c *Client) remember(rq *ws_protocol.WsRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch rq.Type {
+	case ws_protocol.RequestTypeTickAdjust:
+		c.state.tick = rq.Tick
+	case ws_protocol.RequestTypeFilter:
+		c.state.filter = rq.Filter
+	case ws_protocol.RequestTypeSubscribe:
+		c.state.tiles[rq.GridTile] = true
+	case ws_protocol.RequestTypeUnsubscribe:
+		delete(c.state.tiles, rq.GridTile)
+	case ws_protocol.RequestTypeSubscribeBBox:
+		bbox := *rq
+		c.state.bbox = &bbox
+	case ws_protocol.RequestTypeUnsubscribeBBox:
+		c.state.bbox = nil
+	case ws_protocol.RequestTypeFollow:
+		c.state.follows[followKey(rq.Icao, rq.CallSign)] = *rq
+	case ws_protocol.RequestTypeUnfollow:
+		delete(c.state.follows, followKey(rq.Icao, rq.CallSign))
+	}
+}
+
+// resubscribe asks the broker (we just reconnected to) for what we asked for before. Replays are not restarted
+func (c *Client) resubscribe(ctx context.Context) {
+	c.mu.Lock()
+	requests := make([]ws_protocol.WsRequest, 0, len(c.state.tiles)+len(c.state.follows)+3)
+	if 0 != c.state.tick {
+		requests = append(requests, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeTickAdjust, Tick: c.state.tick})
+	}
+	if nil != c.state.filter {
+		requests = append(requests, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeFilter, Filter: c.state.filter})
+	}
+	tiles := make([]string, 0, len(c.state.tiles))
+	for tile := range c.state.tiles {
+		tiles = append(tiles, tile)
+	}
+	sort.Strings(tiles)
+	for _, tile := range tiles {
+		requests = append(requests, ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSubscribe, GridTile: tile})
+	}
+	if nil != c.state.bbox {
+		requests = append(requests, *c.state.bbox)
+	}
+	for _, rq := range c.state.follows {
+		requests = append(requests, rq)
+	}
+	c.mu.Unlock()
+
+	for i := range requests {
+		rqCtx, cancel := context.WithTimeout(ctx, resubscribeTimeout)
+		_, err := c.Request(rqCtx, &requests[i])
+		cancel()
+		if nil != err {
+			c.logger.Error().Err(err).Str("type", requests[i].Type).Msg("Failed to resubscribe")
+		}
+	}
+	c.logger.Debug().Int("requests", len(requests)).Msg("Resubscribed")
+}
+
+// Request sends rq to the broker and waits for its reply, a broker error is an ErrBroker. Requests that do not get a
+// reply of their own (grid-planes) return as soon as they are sent, with no response. When ctx has no deadline we
+// wait for the client's request timeout (see WithRequestTimeout), so a reply that never comes does not hold up the
+// requests after it.
+//
+// The broker does not say which request a reply is for, so requests are sent one at a time
+func (c *Client) Request(ctx context.Context, rq *ws_protocol.WsRequest) (*ws_protocol.WsResponse, error) {
+	if _, ok := ctx.Deadline(); !ok && c.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.requestTimeout)
+		defer cancel()
+	}
+	c.requestMu.Lock()
+	defer c.requestMu.Unlock()
+
+	var p *pendingRequest
+	if want, ok := replies[rq.Type]; ok {
+		p = &pendingRequest{want: want, reply: make(chan *ws_protocol.WsResponse, 1)}
+	}
+	c.mu.Lock()
+	conn := c.conn
+	if nil == conn {
+		c.mu.Unlock()
+		return nil, ErrNotConnected
+	}
+	c.pending = p
+	c.mu.Unlock()
+
+	buf, err := json.Marshal(rq)
+	if nil == err {
+		err = conn.Write(ctx, websocket.MessageText, buf)
+	}
+	if nil != err || nil == p {
+		c.clearPending(p)
+		return nil, err
+	}
+
+	select {
+	case rs, ok := <-p.reply:
+		if !ok {
+			return nil, ErrNotConnected
+		}
+		if ws_protocol.ResponseTypeError == rs.Type {
+			return rs, fmt.Errorf("%w: %s", ErrBroker, rs.Message)
+		}
+		c.remember(rq)
+		return rs, nil
+	case <-ctx.Done():
+		c.clearPending(p)
+		return nil, ctx.Err()
+	}
+}
+
+// clearPending stops waiting for the reply to p, if we still are
+func (c *Client) clearPending(p *pendingRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == p {
+		c.pending = nil
+	}
+}
+
+// Subscribe gets the location updates for a tile (or cell, or all_low/all_high), and keeps getting them after we
+// reconnect
+func (c *Client) Subscribe(ctx context.Context, tile string) error {
+	_, err := c.Request(ctx, &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSubscribe, GridTile: tile})
+	return err
+}
+
+// Unsubscribe stops the location updates for a tile
+func (c *Client) Unsubscribe(ctx context.Context, tile string) error {
+	_, err := c.Request(ctx, &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeUnsubscribe, GridTile: tile})
+	return err
+}
+
+// SubscribedTileList is the tiles (and viewport cells) the broker has us subscribed to
+func (c *Client) SubscribedTileList(ctx context.Context) ([]string, error) {
+	rs, err := c.Request(ctx, &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSubscribeList})
+	if nil != err {
+		return nil, err
+	}
+	return rs.Tiles, nil
+}
+
+// SubscribeBBox subscribes to the cells covering a map viewport (at speed "low" or "high"), replacing the viewport we
+// subscribed to before. It returns the cells
+func (c *Client) SubscribeBBox(ctx context.Context, bounds tile_grid.GlobeIndexSpecialTile, zoom int, speed string) ([]string, error) {
+	rs, err := c.Request(ctx, &ws_protocol.WsRequest{
+		Type:   ws_protocol.RequestTypeSubscribeBBox,
+		Bounds: &bounds,
+		Zoom:   zoom,
+		Speed:  speed,
+	})
+	if nil != err {
+		return nil, err
+	}
+	return rs.Tiles, nil
+}
+
+// UnsubscribeBBox drops the viewport subscription
+func (c *Client) UnsubscribeBBox(ctx context.Context) error {
+	_, err := c.Request(ctx, &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeUnsubscribeBBox})
+	return err
+}
+
+// GridPlanes asks for a snapshot of the aircraft in a tile, they come to OnLocation with the next batch of updates
+func (c *Client) GridPlanes(ctx context.Context, tile string) error {
+	_, err := c.Request(ctx, &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeGridPlanes, GridTile: tile})
+	return err
+}
+
+// AdjustTick asks for location updates to be batched up and sent every tick. The tick is at least a millisecond and
+// shorter than ws_protocol.MaxTick, the broker does not answer ticks outside of that
+func (c *Client) AdjustTick(ctx context.Context, tick time.Duration) error {
+	if tick < time.Millisecond || tick >= ws_protocol.MaxTick {
+		return fmt.Errorf("%w: %s needs to be at least 1ms and under %s", ErrInvalidTick, tick, ws_protocol.MaxTick)
+	}
+	_, err := c.Request(ctx, &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeTickAdjust, Tick: int(tick.Milliseconds())})
+	return err
+}
+
+// Search looks for aircraft, airports, routes and operators matching the query
+func (c *Client) Search(ctx context.Context, query string) (*ws_protocol.SearchResult, error) {
+	rs, err := c.Request(ctx, &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeSearch, Query: query})
+	if nil != err {
+		return nil, err
+	}
+	return rs.Results, nil
+}
+
+// History is where an aircraft (optionally only while flying as callSign) has been, and its altitude and speed
+// profile. opts can be nil for the broker's defaults
+func (c *Client) History(ctx context.Context, icao, callSign string, opts *history.Options) ([]ws_protocol.LocationHistory, []history.ProfilePoint, error) {
+	rs, err := c.Request(ctx, &ws_protocol.WsRequest{
+		Type:     ws_protocol.RequestTypePlaneLocHistory,
+		Icao:     icao,
+		CallSign: callSign,
+		History:  opts,
+	})
+	if nil != err {
+		return nil, nil, err
+	}
+	return rs.History, rs.Profile, nil
+}
+
+// Filter only sends us the aircraft matching f, nil clears the filter. It returns the filter the broker is using
+func (c *Client) Filter(ctx context.Context, f *ws_protocol.Filter) (*ws_protocol.Filter, error) {
+	rs, err := c.Request(ctx, &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeFilter, Filter: f})
+	if nil != err {
+		return nil, err
+	}
+	return rs.Filter, nil
+}
+
+// Follow gets every update for an aircraft (by icao or callsign) wherever it is. It returns what the broker knows of
+// the aircraft now, if anything
+func (c *Client) Follow(ctx context.Context, icao, callSign string) (*export.PlaneLocation, error) {
+	rs, err := c.Request(ctx, &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeFollow, Icao: icao, CallSign: callSign})
+	if nil != err {
+		return nil, err
+	}
+	return rs.Location, nil
+}
+
+// Unfollow stops following an aircraft
+func (c *Client) Unfollow(ctx context.Context, icao, callSign string) error {
+	_, err := c.Request(ctx, &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeUnfollow, Icao: icao, CallSign: callSign})
+	return err
+}
+
+// Resync asks for every field of an aircraft (or every aircraft, when icao is empty) next, when speaking planes-delta
+func (c *Client) Resync(ctx context.Context, icao string) error {
+	_, err := c.Request(ctx, &ws_protocol.WsRequest{Type: ws_protocol.RequestTypeResync, Icao: icao})
+	return err
+}
+
+// Replay starts (ws_protocol.RequestTypeReplay) or controls (pause, resume, seek, speed and stop) a replay. The
+// replayed locations go to OnReplay
+func (c *Client) Replay(ctx context.Context, action string, rq *ws_protocol.Replay) (*ws_protocol.ReplayState, error) {
+	rs, err := c.Request(ctx, &ws_protocol.WsRequest{Type: action, Replay: rq})
+	if nil != err {
+		return nil, err
+	}
+	return rs.Replay, nil
+}
+
+// Grid is the broker's tile grid
+func (c *Client) Grid(ctx context.Context) (tile_grid.GridLocations, error) {
+	rq, err := http.NewRequestWithContext(ctx, http.MethodGet, c.httpURL("/grid"), nil)
+	if nil != err {
+		return nil, err
+	}
+	for k, v := range c.header {
+		rq.Header[k] = v
+	}
+	rs, err := c.httpClient.Do(rq)
+	if nil != err {
+		return nil, fmt.Errorf("unable to fetch the grid: %w", err)
+	}
+	defer func() { _ = rs.Body.Close() }()
+	if http.StatusOK != rs.StatusCode {
+		return nil, fmt.Errorf("unable to fetch the grid: %s", rs.Status)
+	}
+	body, err := io.ReadAll(rs.Body)
+	if nil != err {
+		return nil, err
+	}
+
+	grid := tile_grid.GridLocations{}
+	if err = json.Unmarshal(body, &grid); nil != err {
+		return nil, err
+	}
+	return grid, nil
+}
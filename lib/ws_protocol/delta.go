@@ -0,0 +1,279 @@
+package ws_protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"plane.watch/lib/export"
+)
+
+// The planes-delta protocol is the planes protocol, except location updates (plane-location and plane-location-list)
+// are sent as plane-delta-list messages. Each Delta only has the fields of the aircraft that changed since the client
+// was last sent it, keyed by their field id (see DeltaFieldNames). A Full delta (a keyframe) has every field, and
+// replaces what the client had for the aircraft. Clients get a keyframe the first time they see an aircraft, every so
+// often after that, and after asking to resync.
+
+var ErrUnknownDeltaField = errors.New("unknown delta field")
+
+// deltaJson is jsoniter.ConfigFastest with sorted map keys, so the same SourceTags always encode the same way
+var deltaJson = jsoniter.Config{
+	EscapeHTML:                    false,
+	MarshalFloatWith6Digits:       true,
+	ObjectFieldMustBeSimpleString: true,
+	SortMapKeys:                   true,
+}.Froze()
+
+var nullJson = json.RawMessage("null")
+
+type (
+	// Delta is the fields of an aircraft that changed, by field id. A null value means the field is now empty
+	Delta struct {
+		Icao   string                     `json:"i"`
+		Full   bool                       `json:"k,omitempty"`
+		Fields map[string]json.RawMessage `json:"f,omitempty"`
+	}
+
+	deltaField struct {
+		id    int
+		key   string
+		name  string
+		index []int
+	}
+
+	// DeltaEncoder remembers what a client was last sent for each aircraft, so it can send only what changed.
+	// It is not safe for concurrent use
+	DeltaEncoder struct {
+		keyframe time.Duration
+		sent     map[string]*deltaSent
+		// lastSweep is when we last forgot the aircraft we have not sent in a while
+		lastSweep time.Time
+	}
+
+	deltaSent struct {
+		// hashes of the encoded value of each field we sent, by field id
+		hashes   [maxDeltaField + 1]uint64
+		lastFull time.Time
+		lastSent time.Time
+	}
+)
+
+// deltaFieldIds are the field ids of the PlaneLocation fields (Updates.* are the fields of Updates). Ids are part of
+// the protocol, never change or reuse one
+var deltaFieldIds = map[int]string{
+	1:  "Lat",
+	2:  "Lon",
+	3:  "Heading",
+	4:  "Velocity",
+	5:  "Altitude",
+	6:  "VerticalRate",
+	7:  "New",
+	8:  "Removed",
+	9:  "OnGround",
+	10: "HasAltitude",
+	11: "HasLocation",
+	12: "HasHeading",
+	13: "HasOnGround",
+	14: "HasFlightStatus",
+	15: "HasVerticalRate",
+	16: "HasVelocity",
+	17: "AltitudeUnits",
+	18: "FlightStatus",
+	19: "Airframe",
+	20: "AirframeType",
+	21: "SourceTag",
+	22: "Squawk",
+	23: "Special",
+	24: "TileLocation",
+	25: "Emergencies",
+	26: "SourceTags",
+	27: "TrackedSince",
+	28: "FlightId",
+	29: "Airport",
+	30: "SurfaceState",
+	31: "LastMsg",
+	32: "Updates.Location",
+	33: "Updates.Altitude",
+	34: "Updates.Velocity",
+	35: "Updates.Heading",
+	36: "Updates.OnGround",
+	37: "Updates.VerticalRate",
+	38: "Updates.FlightStatus",
+	39: "Updates.Special",
+	40: "Updates.Squawk",
+	41: "Updates.Emergency",
+	42: "PositionExtrapolated",
+	43: "PositionAge",
+	44: "SignalRssi",
+	45: "AircraftWidth",
+	46: "AircraftLength",
+	47: "IcaoCode",
+	48: "Registration",
+	49: "TypeCode",
+	50: "TypeCodeLong",
+	51: "Serial",
+	52: "RegisteredOwner",
+	53: "COFAOwner",
+	54: "EngineType",
+	55: "FlagCode",
+	56: "CallSign",
+	57: "Operator",
+	58: "RouteCode",
+	59: "Segments",
+}
+
+const maxDeltaField = 59
+
+var (
+	deltaFields    []deltaField
+	deltaFieldByID map[string]*deltaField
+)
+
+func init() {
+	t := reflect.TypeOf(export.PlaneLocation{})
+	deltaFieldByID = make(map[string]*deltaField, len(deltaFieldIds))
+	for id := 1; id <= maxDeltaField; id++ {
+		name, ok := deltaFieldIds[id]
+		if !ok {
+			continue
+		}
+		var index []int
+		ft := t
+		for _, part := range strings.Split(name, ".") {
+			sf, found := ft.FieldByName(part)
+			if !found {
+				panic("ws_protocol: PlaneLocation has no field " + name)
+			}
+			index = append(index, sf.Index...)
+			ft = sf.Type
+		}
+		deltaFields = append(deltaFields, deltaField{id: id, key: strconv.Itoa(id), name: name, index: index})
+	}
+	for i := range deltaFields {
+		deltaFieldByID[deltaFields[i].key] = &deltaFields[i]
+	}
+}
+
+// DeltaFieldNames is the PlaneLocation field each field id is for
+func DeltaFieldNames() map[int]string {
+	names := make(map[int]string, len(deltaFieldIds))
+	for id, name := range deltaFieldIds {
+		names[id] = name
+	}
+	return names
+}
+
+// NewDeltaEncoder makes an encoder that sends a keyframe for each aircraft at least every keyframe, 0 for only the
+// first time
+func NewDeltaEncoder(keyframe time.Duration) *DeltaEncoder {
+	return &DeltaEncoder{
+		keyframe: keyframe,
+		sent:     make(map[string]*deltaSent),
+	}
+}
+
+// Encode works out what to send the client for loc, and remembers that we sent it
+func (e *DeltaEncoder) Encode(loc *export.PlaneLocation, now time.Time) (Delta, error) {
+	e.sweep(now)
+	s, seen := e.sent[loc.Icao]
+	if !seen {
+		s = &deltaSent{}
+	}
+	d := Delta{
+		Icao:   loc.Icao,
+		Full:   !seen || (e.keyframe > 0 && now.Sub(s.lastFull) >= e.keyframe),
+		Fields: make(map[string]json.RawMessage),
+	}
+	v := reflect.ValueOf(loc).Elem()
+	h := fnv.New64a()
+	for i := range deltaFields {
+		f := &deltaFields[i]
+		buf, err := deltaJson.Marshal(v.FieldByIndex(f.index).Interface())
+		if nil != err {
+			return Delta{}, fmt.Errorf("unable to encode %s: %w", f.name, err)
+		}
+		h.Reset()
+		_, _ = h.Write(buf)
+		sum := h.Sum64()
+		if d.Full || sum != s.hashes[f.id] {
+			d.Fields[f.key] = buf
+		}
+		s.hashes[f.id] = sum
+	}
+	if d.Full {
+		s.lastFull = now
+	}
+	s.lastSent = now
+	if loc.Removed {
+		// if it comes back, it is new to the client again
+		delete(e.sent, loc.Icao)
+	} else {
+		e.sent[loc.Icao] = s
+	}
+	return d, nil
+}
+
+// Sent remembers that the client was sent all of loc some other way (e.g. with an ack-follow), so the next delta for
+// it is against loc
+func (e *DeltaEncoder) Sent(loc *export.PlaneLocation, now time.Time) {
+	if nil == loc {
+		return
+	}
+	delete(e.sent, loc.Icao)
+	_, _ = e.Encode(loc, now)
+}
+
+// Reset forgets what we sent for the aircraft, or every aircraft when icao is empty, so they all get a keyframe next
+func (e *DeltaEncoder) Reset(icao string) {
+	if "" == icao {
+		e.sent = make(map[string]*deltaSent)
+		return
+	}
+	delete(e.sent, strings.ToUpper(icao))
+}
+
+// sweep forgets the aircraft we have not sent for a while, the client will have forgotten them too
+func (e *DeltaEncoder) sweep(now time.Time) {
+	const forgetAfter = 10 * time.Minute
+	if now.Sub(e.lastSweep) < time.Minute {
+		return
+	}
+	e.lastSweep = now
+	for icao, s := range e.sent {
+		if now.Sub(s.lastSent) > forgetAfter {
+			delete(e.sent, icao)
+		}
+	}
+}
+
+// ApplyDelta updates loc with the delta, for clients speaking the planes-delta protocol
+func ApplyDelta(loc *export.PlaneLocation, d Delta) error {
+	if d.Full {
+		*loc = export.PlaneLocation{}
+	}
+	loc.Icao = d.Icao
+	v := reflect.ValueOf(loc).Elem()
+	for key, raw := range d.Fields {
+		f, ok := deltaFieldByID[key]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownDeltaField, key)
+		}
+		if 0 == len(raw) {
+			// jsoniter decodes a null json.RawMessage as nothing
+			raw = nullJson
+		}
+		fv := v.FieldByIndex(f.index)
+		nv := reflect.New(fv.Type())
+		if err := deltaJson.Unmarshal(raw, nv.Interface()); nil != err {
+			return fmt.Errorf("unable to decode %s: %w", f.name, err)
+		}
+		fv.Set(nv.Elem())
+	}
+	return nil
+}
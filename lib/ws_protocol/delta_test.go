@@ -0,0 +1,180 @@
+package ws_protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"plane.watch/lib/export"
+)
+
+func deltaTestLocation() *export.PlaneLocation {
+	now := time.Date(2023, 10, 1, 2, 3, 4, 0, time.UTC)
+	return &export.PlaneLocation{
+		Icao:         "7C6CA3",
+		Lat:          -31.952162,
+		Lon:          115.943482,
+		Altitude:     36000,
+		HasAltitude:  true,
+		HasLocation:  true,
+		Squawk:       "3012",
+		SourceTag:    "feeder-perth",
+		SourceTags:   map[string]uint32{"feeder-perth": 10, "feeder-sydney": 2, "ADS-C": 1},
+		TrackedSince: now.Add(-time.Hour),
+		LastMsg:      now,
+		Updates:      export.Updates{Location: now, Altitude: now},
+		CallSign:     ptr("QFA9"),
+		Registration: ptr("VH-ZNA"),
+		Operator:     ptr("Qantas"),
+		Segments:     []export.Segment{{Name: "Perth", ICAOCode: "YPPH"}, {Name: "London Heathrow", ICAOCode: "EGLL"}},
+	}
+}
+
+func sameLocation(t *testing.T, want, got *export.PlaneLocation) {
+	t.Helper()
+	json := jsoniter.ConfigCompatibleWithStandardLibrary
+	w, _ := json.Marshal(want)
+	g, _ := json.Marshal(got)
+	if string(w) != string(g) {
+		t.Errorf("client copy is out of sync\nwant %s\ngot  %s", w, g)
+	}
+}
+
+func TestDeltaFields_CoverPlaneLocation(t *testing.T) {
+	covered := map[string]bool{"Icao": true}
+	for _, name := range DeltaFieldNames() {
+		covered[name] = true
+	}
+	typ := reflect.TypeOf(export.PlaneLocation{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if !f.IsExported() || "-" == f.Tag.Get("json") {
+			continue
+		}
+		if "Updates" == f.Name {
+			for j := 0; j < f.Type.NumField(); j++ {
+				if !covered["Updates."+f.Type.Field(j).Name] {
+					t.Errorf("Updates.%s has no delta field id", f.Type.Field(j).Name)
+				}
+			}
+			continue
+		}
+		if !covered[f.Name] {
+			t.Errorf("%s has no delta field id", f.Name)
+		}
+	}
+}
+
+func TestDeltaEncoder(t *testing.T) {
+	e := NewDeltaEncoder(time.Minute)
+	loc := deltaTestLocation()
+	client := &export.PlaneLocation{}
+	now := loc.LastMsg
+
+	// first sight is a keyframe
+	d, err := e.Encode(loc, now)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !d.Full || len(d.Fields) != len(deltaFields) {
+		t.Errorf("expected a keyframe with every field, got %d fields", len(d.Fields))
+	}
+	if err = ApplyDelta(client, d); nil != err {
+		t.Fatal(err)
+	}
+	sameLocation(t, loc, client)
+
+	// nothing changed, nothing to send
+	if d, _ = e.Encode(loc, now); d.Full || 0 != len(d.Fields) {
+		t.Errorf("expected an empty delta, got %+v", d)
+	}
+
+	// only what changed is sent, and the client ends up with the same aircraft
+	moved := *loc
+	moved.Lat += 0.01
+	moved.LastMsg = now.Add(time.Second)
+	moved.Updates.Location = moved.LastMsg
+	moved.Registration = nil
+	moved.SourceTags = map[string]uint32{"ADS-C": 1, "feeder-sydney": 2, "feeder-perth": 10}
+	d, _ = e.Encode(&moved, now.Add(time.Second))
+	want := map[string]bool{"1": true, "31": true, "32": true, "48": true}
+	if d.Full || len(want) != len(d.Fields) {
+		t.Errorf("expected only lat, last msg, updates.location and registration, got %v", d.Fields)
+	}
+	for key := range d.Fields {
+		if !want[key] {
+			t.Errorf("did not expect field %s (%s) to be sent", key, deltaFieldByID[key].name)
+		}
+	}
+	if "null" != string(d.Fields["48"]) {
+		t.Errorf("expected the registration to be cleared, got %s", d.Fields["48"])
+	}
+	if err = ApplyDelta(client, d); nil != err {
+		t.Fatal(err)
+	}
+	sameLocation(t, &moved, client)
+
+	// a keyframe every minute
+	if d, _ = e.Encode(&moved, now.Add(time.Minute)); !d.Full {
+		t.Error("expected a keyframe after a minute")
+	}
+
+	// a resync gets a keyframe next
+	e.Reset("7c6ca3")
+	if d, _ = e.Encode(&moved, now.Add(61*time.Second)); !d.Full {
+		t.Error("expected a keyframe after a resync")
+	}
+
+	// once removed, it is new again
+	removed := moved
+	removed.Removed = true
+	_, _ = e.Encode(&removed, now.Add(62*time.Second))
+	if d, _ = e.Encode(&moved, now.Add(63*time.Second)); !d.Full {
+		t.Error("expected a keyframe for an aircraft that came back")
+	}
+}
+
+func TestDeltaEncoder_Sent(t *testing.T) {
+	e := NewDeltaEncoder(0)
+	loc := deltaTestLocation()
+	e.Sent(loc, loc.LastMsg)
+	if d, _ := e.Encode(loc, loc.LastMsg); d.Full || 0 != len(d.Fields) {
+		t.Errorf("expected nothing to send for an aircraft the client was sent in full, got %+v", d)
+	}
+}
+
+func TestApplyDelta_UnknownField(t *testing.T) {
+	err := ApplyDelta(&export.PlaneLocation{}, Delta{Icao: "7C6CA3", Fields: map[string]json.RawMessage{"999": []byte("1")}})
+	if !errors.Is(err, ErrUnknownDeltaField) {
+		t.Errorf("expected an unknown field, got %v", err)
+	}
+}
+
+func TestApplyDelta_EmptyIsNull(t *testing.T) {
+	loc := deltaTestLocation()
+	fields := map[string]json.RawMessage{}
+	for id, name := range DeltaFieldNames() {
+		if "CallSign" == name {
+			fields[strconv.Itoa(id)] = json.RawMessage{}
+		}
+	}
+	err := ApplyDelta(loc, Delta{Icao: loc.Icao, Fields: fields})
+	if nil != err || nil != loc.CallSign {
+		t.Errorf("expected an empty field to clear the call sign, got %v %v", loc.CallSign, err)
+	}
+}
+
+func BenchmarkDeltaEncoder_Encode(b *testing.B) {
+	e := NewDeltaEncoder(time.Minute)
+	loc := deltaTestLocation()
+	now := loc.LastMsg
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		loc.Lat += 0.0001
+		_, _ = e.Encode(loc, now)
+	}
+}
@@ -0,0 +1,152 @@
+package ws_protocol
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"plane.watch/lib/export"
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+type (
+	// Filter narrows down the aircraft a client is sent, on top of the tiles it subscribes to. Everything given
+	// must match, anything left out matches every aircraft. Patterns are case-insensitive and can use * and ?
+	Filter struct {
+		// MinAltitude and MaxAltitude are an altitude band in feet (inclusive), aircraft without an altitude do not match
+		MinAltitude *int `json:"minAltitude,omitempty"`
+		MaxAltitude *int `json:"maxAltitude,omitempty"`
+		// OnGround only sends aircraft on the ground (true) or in the air (false)
+		OnGround *bool `json:"onGround,omitempty"`
+		// Airframe matches the airframe category (e.g. "Heavy") or category type (e.g. "4/5")
+		Airframe []string `json:"airframe,omitempty"`
+		// CallSign, Registration and Operator are lists of patterns, one of which must match
+		CallSign     []string `json:"callSign,omitempty"`
+		Registration []string `json:"registration,omitempty"`
+		Operator     []string `json:"operator,omitempty"`
+		// Squawk is the set of squawk codes to send
+		Squawk []string `json:"squawk,omitempty"`
+		// EmergencyOnly only sends aircraft with an emergency in effect
+		EmergencyOnly bool `json:"emergencyOnly,omitempty"`
+		// Source is a list of patterns for where the update came from (e.g. ADS-C), matching the source tag of the
+		// update or any source that has seen the aircraft
+		Source []string `json:"source,omitempty"`
+	}
+
+	// CompiledFilter is a Filter that has been checked and is ready to match aircraft against
+	CompiledFilter struct {
+		Filter
+		squawks map[string]bool
+	}
+)
+
+// Compile checks the filter and gets it ready to match aircraft with
+func (f Filter) Compile() (*CompiledFilter, error) {
+	if nil != f.MinAltitude && nil != f.MaxAltitude && *f.MinAltitude > *f.MaxAltitude {
+		return nil, fmt.Errorf("%w: minAltitude %d is above maxAltitude %d", ErrInvalidFilter, *f.MinAltitude, *f.MaxAltitude)
+	}
+	cf := CompiledFilter{Filter: f}
+	var err error
+	for _, patterns := range []*[]string{&cf.CallSign, &cf.Registration, &cf.Operator, &cf.Source} {
+		if *patterns, err = compilePatterns(*patterns); nil != err {
+			return nil, err
+		}
+	}
+	if len(f.Squawk) > 0 {
+		cf.squawks = make(map[string]bool, len(f.Squawk))
+		for _, squawk := range f.Squawk {
+			cf.squawks[strings.TrimSpace(squawk)] = true
+		}
+	}
+	return &cf, nil
+}
+
+// compilePatterns upper cases the patterns (so we match case-insensitively) and makes sure they are valid
+func compilePatterns(patterns []string) ([]string, error) {
+	if 0 == len(patterns) {
+		return nil, nil
+	}
+	out := make([]string, len(patterns))
+	for i, p := range patterns {
+		out[i] = strings.ToUpper(strings.TrimSpace(p))
+		if _, err := path.Match(out[i], ""); nil != err {
+			return nil, fmt.Errorf("%w: bad pattern %q", ErrInvalidFilter, p)
+		}
+	}
+	return out, nil
+}
+
+// matchAny tells us if value matches any of the (compiled) patterns, no patterns matches everything
+func matchAny(patterns []string, value *string) bool {
+	if 0 == len(patterns) {
+		return true
+	}
+	if nil == value {
+		return false
+	}
+	v := strings.ToUpper(strings.TrimSpace(*value))
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches tells us if the filter lets the aircraft through
+func (cf *CompiledFilter) Matches(loc *export.PlaneLocation) bool {
+	if nil == loc {
+		return false
+	}
+	if nil != cf.MinAltitude && (!loc.HasAltitude || loc.Altitude < *cf.MinAltitude) {
+		return false
+	}
+	if nil != cf.MaxAltitude && (!loc.HasAltitude || loc.Altitude > *cf.MaxAltitude) {
+		return false
+	}
+	if nil != cf.OnGround && (!loc.HasOnGround || loc.OnGround != *cf.OnGround) {
+		return false
+	}
+	if len(cf.Airframe) > 0 && !containsFold(cf.Airframe, loc.Airframe) && !containsFold(cf.Airframe, loc.AirframeType) {
+		return false
+	}
+	if !matchAny(cf.CallSign, loc.CallSign) || !matchAny(cf.Registration, loc.Registration) || !matchAny(cf.Operator, loc.Operator) {
+		return false
+	}
+	if nil != cf.squawks && !cf.squawks[loc.Squawk] {
+		return false
+	}
+	if cf.EmergencyOnly && 0 == len(loc.Emergencies) {
+		return false
+	}
+	if len(cf.Source) > 0 && !cf.matchesSource(loc) {
+		return false
+	}
+	return true
+}
+
+func (cf *CompiledFilter) matchesSource(loc *export.PlaneLocation) bool {
+	if matchAny(cf.Source, &loc.SourceTag) {
+		return true
+	}
+	for tag := range loc.SourceTags {
+		if matchAny(cf.Source, &tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, value string) bool {
+	if "" == value {
+		return false
+	}
+	for _, s := range list {
+		if strings.EqualFold(s, value) {
+			return true
+		}
+	}
+	return false
+}
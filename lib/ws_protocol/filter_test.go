@@ -0,0 +1,93 @@
+package ws_protocol
+
+import (
+	"errors"
+	"testing"
+
+	"plane.watch/lib/export"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestFilter_Matches(t *testing.T) {
+	qantas := &export.PlaneLocation{
+		Icao:         "7C6CA3",
+		Altitude:     36000,
+		HasAltitude:  true,
+		OnGround:     false,
+		HasOnGround:  true,
+		Airframe:     "Heavy",
+		AirframeType: "4/5",
+		Squawk:       "3012",
+		SourceTag:    "feeder-perth",
+		SourceTags:   map[string]uint32{"feeder-perth": 10, "ADS-C": 1},
+		CallSign:     ptr("QFA9"),
+		Registration: ptr("VH-ZNA"),
+		Operator:     ptr("Qantas"),
+	}
+	emergency := &export.PlaneLocation{
+		Icao:        "7C0001",
+		Altitude:    4000,
+		HasAltitude: true,
+		Squawk:      "7700",
+		Emergencies: []string{"squawk-7700"},
+		SourceTag:   "feeder-sydney",
+	}
+	onGround := &export.PlaneLocation{
+		Icao:        "7C0002",
+		OnGround:    true,
+		HasOnGround: true,
+		Squawk:      "2000",
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []bool // qantas, emergency, onGround
+	}{
+		{"empty filter matches everything", Filter{}, []bool{true, true, true}},
+		{"altitude band", Filter{MinAltitude: ptr(10000), MaxAltitude: ptr(40000)}, []bool{true, false, false}},
+		{"below", Filter{MaxAltitude: ptr(5000)}, []bool{false, true, false}},
+		{"on the ground", Filter{OnGround: ptr(true)}, []bool{false, false, true}},
+		{"in the air", Filter{OnGround: ptr(false)}, []bool{true, false, false}},
+		{"airframe category", Filter{Airframe: []string{"heavy"}}, []bool{true, false, false}},
+		{"airframe category type", Filter{Airframe: []string{"4/5"}}, []bool{true, false, false}},
+		{"callsign pattern", Filter{CallSign: []string{"qfa*"}}, []bool{true, false, false}},
+		{"callsign pattern miss", Filter{CallSign: []string{"VOZ*", "JST?"}}, []bool{false, false, false}},
+		{"registration", Filter{Registration: []string{"VH-Z??"}}, []bool{true, false, false}},
+		{"operator", Filter{Operator: []string{"qantas"}}, []bool{true, false, false}},
+		{"squawk set", Filter{Squawk: []string{"7500", "7600", "7700"}}, []bool{false, true, false}},
+		{"emergencies", Filter{EmergencyOnly: true}, []bool{false, true, false}},
+		{"source tag", Filter{Source: []string{"feeder-*"}}, []bool{true, true, false}},
+		{"any source that has seen it", Filter{Source: []string{"ads-c"}}, []bool{true, false, false}},
+		{"everything must match", Filter{CallSign: []string{"QFA*"}, EmergencyOnly: true}, []bool{false, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cf, err := tt.filter.Compile()
+			if nil != err {
+				t.Fatal(err)
+			}
+			for i, loc := range []*export.PlaneLocation{qantas, emergency, onGround} {
+				if got := cf.Matches(loc); got != tt.want[i] {
+					t.Errorf("%s: Matches() = %v, want %v", loc.Icao, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFilter_Compile(t *testing.T) {
+	if _, err := (Filter{MinAltitude: ptr(10000), MaxAltitude: ptr(5000)}).Compile(); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("expected an inside out altitude band to be invalid, got %v", err)
+	}
+	if _, err := (Filter{CallSign: []string{"QFA["}}).Compile(); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("expected a bad pattern to be invalid, got %v", err)
+	}
+	f := Filter{CallSign: []string{"qfa*"}}
+	if _, err := f.Compile(); nil != err || "qfa*" != f.CallSign[0] {
+		t.Errorf("compiling should not change the filter it came from, %v %v", f.CallSign, err)
+	}
+}
@@ -1,12 +1,21 @@
 package ws_protocol
 
 import (
-	"github.com/paulmach/orb"
+	"time"
+
 	"plane.watch/lib/export"
+	"plane.watch/lib/history"
+	"plane.watch/lib/tile_grid"
 )
 
+// MaxTick is the longest tick a client can ask for with adjust-tick, the tick has to be shorter than this. The
+// broker ignores ticks it cannot use, without replying
+const MaxTick = 10 * time.Second
+
 const (
 	WsProtocolPlanes = "planes"
+	// WsProtocolPlanesDelta is the planes protocol with location updates sent as deltas, see Delta
+	WsProtocolPlanesDelta = "planes-delta"
 
 	RequestTypeSubscribe       = "sub"
 	RequestTypeSubscribeList   = "sub-list"
@@ -15,21 +24,50 @@ const (
 	RequestTypePlaneLocHistory = "plane-location-history" // returns the requested planes path
 	RequestTypeTickAdjust      = "adjust-tick"            // adjusts how often we send updates
 	RequestTypeSearch          = "search"                 // adjusts how often we send updates
+	RequestTypeSubscribeBBox   = "sub-bbox"               // subscribes to the cells covering a map viewport
+	RequestTypeUnsubscribeBBox = "unsub-bbox"             // drops the viewport subscription
+	RequestTypeFilter          = "filter"                 // only sends aircraft matching the filter, no filter clears it
+	RequestTypeFollow          = "follow"                 // sends every update for an aircraft (by icao or callSign), wherever it is
+	RequestTypeUnfollow        = "unfollow"               // stops following an aircraft
+	RequestTypeResync          = "resync"                 // planes-delta: send a keyframe next for the aircraft (icao), or every aircraft
+	RequestTypeReplay          = "replay"                 // plays back what we recorded for an area, see Replay
+	RequestTypeReplayPause     = "replay-pause"           // pauses the replay (Replay.Id)
+	RequestTypeReplayResume    = "replay-resume"          // carries on from where the replay was paused
+	RequestTypeReplaySeek      = "replay-seek"            // jumps the replay to Replay.At
+	RequestTypeReplaySpeed     = "replay-speed"           // changes the replay to Replay.Speed
+	RequestTypeReplayStop      = "replay-stop"            // stops the replay early, with a replay-end
 
 	ResponseTypeError           = "error"
 	ResponseTypeMsg             = "info"
 	ResponseTypeAckSub          = "ack-sub"
 	ResponseTypeAckUnsub        = "ack-unsub"
+	ResponseTypeAckFilter       = "ack-filter"
+	ResponseTypeAckFollow       = "ack-follow" // comes with what we currently know about the aircraft, if anything
+	ResponseTypeAckUnfollow     = "ack-unfollow"
+	ResponseTypeAircraftRemoved = "aircraft-removed" // a followed aircraft is no longer being tracked
 	ResponseTypeSubTiles        = "sub-list"
 	ResponseTypePlaneLocation   = "plane-location"
 	ResponseTypePlaneLocations  = "plane-location-list"
+	ResponseTypePlaneDeltas     = "plane-delta-list" // planes-delta: instead of plane-location and plane-location-list
 	ResponseTypePlaneLocHistory = "plane-location-history"
 	ResponseTypeSearchResults   = "search-results"
+	ResponseTypeEmergency       = "emergency"  // sent to every client, regardless of subscriptions
+	ResponseTypeGeofence        = "geofence"   // sent to clients subscribed to geofence.<id>
+	ResponseTypeAckReplay       = "ack-replay" // acks replay and the replay controls, with where the replay is up to
+	ResponseTypeReplayEnd       = "replay-end" // the replay got to its end, or was stopped
 
 	GridTileAllLow  = "all_low"
 	GridTileAllHigh = "all_high"
+	// GridTileSuffixLow and GridTileSuffixHigh follow a tile (legacy or cell) name to pick the update speed
+	GridTileSuffixLow  = "_low"
+	GridTileSuffixHigh = "_high"
+	// GridTileGeofencePrefix followed by a geofence id subscribes to that geofences enter/inside/exit events
+	GridTileGeofencePrefix = export.NatsGeofencePrefix
 )
 
+// LocationHistory is where an aircraft was, sent with ResponseTypePlaneLocHistory
+type LocationHistory = history.Point
+
 type (
 	WsRequest struct {
 		Type     string `json:"type"`
@@ -38,19 +76,31 @@ type (
 		CallSign string `json:"callSign,omitempty"`
 		Tick     int    `json:"tick,omitempty"`  // in Milliseconds
 		Query    string `json:"query,omitempty"` // in Milliseconds
-	}
-	LocationHistory struct {
-		Lat, Lon          float64
-		LatLon            orb.Point `json:"-"`
-		Heading, Velocity float64
-		Altitude          *int32
+
+		// Bounds and Zoom are the map viewport for RequestTypeSubscribeBBox, Speed is "low" (the default) or "high"
+		Bounds *tile_grid.GlobeIndexSpecialTile `json:"bounds,omitempty"`
+		Zoom   int                              `json:"zoom,omitempty"`
+		Speed  string                           `json:"speed,omitempty"`
+
+		// Filter is the filter for RequestTypeFilter
+		Filter *Filter `json:"filter,omitempty"`
+
+		// Replay is the replay to start (RequestTypeReplay), or the replay to control
+		Replay *Replay `json:"replay,omitempty"`
+
+		// History is how much of the aircraft's history we want for RequestTypePlaneLocHistory, and how to simplify it
+		History *history.Options `json:"history,omitempty"`
 	}
 	AircraftList []*export.PlaneLocation
+	// SearchResult is what matched a search, grouped by kind. Each kind is ranked, exact matches first
 	SearchResult struct {
 		Query    string
 		Aircraft AircraftList
 		Airport  []AirportLocation
+		// Route is the callsigns of Routes, kept for clients that only know the callsigns
 		Route    []string
+		Routes   []export.Route
+		Operator []export.Operator
 	}
 	AirportLocation struct {
 		Name     string
@@ -64,11 +114,24 @@ type (
 		Tiles     []string                `json:"tiles,omitempty"`
 		Location  *export.PlaneLocation   `json:"location,omitempty"`
 		Locations []*export.PlaneLocation `json:"locations,omitempty"`
+		Deltas    []Delta                 `json:"deltas,omitempty"`
 
 		Icao     string            `json:"icao,omitempty"`
 		CallSign string            `json:"callSign,omitempty"`
 		History  []LocationHistory `json:"history,omitempty"`
 		Results  *SearchResult     `json:"results,omitempty"`
+
+		// Profile is the altitude and speed of the aircraft over its history, sent with ResponseTypePlaneLocHistory
+		Profile []history.ProfilePoint `json:"profile,omitempty"`
+
+		Emergency *export.EmergencyEvent `json:"emergency,omitempty"`
+		Geofence  *export.GeofenceEvent  `json:"geofence,omitempty"`
+
+		// Filter is the filter now in use, sent with ResponseTypeAckFilter
+		Filter *Filter `json:"filter,omitempty"`
+
+		// Replay is set on the replay acks and on location updates being replayed, live updates do not have it
+		Replay *ReplayState `json:"replay,omitempty"`
 	}
 )
 
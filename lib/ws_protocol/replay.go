@@ -0,0 +1,107 @@
+package ws_protocol
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"plane.watch/lib/tile_grid"
+)
+
+// MaxReplaySpeed is the fastest a replay can be played back, in times real time
+const MaxReplaySpeed = 100
+
+var ErrInvalidReplay = errors.New("invalid replay")
+
+type (
+	// Replay asks for the updates we recorded for an area between Start and End to be played back, as if they were
+	// live, at Speed times real time. It is also what the replay controls (pause, resume, seek, speed, stop) carry
+	Replay struct {
+		// Id names the replay in its controls and in the updates it sends, we make one up when it is left out
+		Id    string    `json:"id,omitempty"`
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+		// Speed is how many times faster than real time to play back, 1 when left out
+		Speed float64 `json:"speed,omitempty"`
+
+		// GridTile (a legacy tile or cell, with its speed suffix) or Bounds is the area to replay. _high (or Detail
+		// "high" with Bounds) replays every update, _low (the default) only the significant ones
+		GridTile string                           `json:"gridTile,omitempty"`
+		Bounds   *tile_grid.GlobeIndexSpecialTile `json:"bounds,omitempty"`
+		Detail   string                           `json:"detail,omitempty"`
+
+		// At is where to jump to, for RequestTypeReplaySeek
+		At time.Time `json:"at,omitempty"`
+	}
+
+	// ReplayState is where a replay is up to, sent with its acks and with every batch of updates it sends
+	ReplayState struct {
+		Id     string    `json:"id"`
+		Start  time.Time `json:"start"`
+		End    time.Time `json:"end"`
+		At     time.Time `json:"at"`
+		Speed  float64   `json:"speed"`
+		Paused bool      `json:"paused,omitempty"`
+	}
+)
+
+// Check makes sure the replay is one we can play, spanning no more than maxSpan, and fills in the default speed
+func (r *Replay) Check(maxSpan time.Duration, now time.Time) error {
+	if 0 == r.Speed {
+		r.Speed = 1
+	}
+	if err := CheckReplaySpeed(r.Speed); nil != err {
+		return err
+	}
+	if r.Start.IsZero() || r.End.IsZero() || !r.Start.Before(r.End) {
+		return fmt.Errorf("%w: start must be before end", ErrInvalidReplay)
+	}
+	if r.Start.After(now) {
+		return fmt.Errorf("%w: start is in the future", ErrInvalidReplay)
+	}
+	if r.End.Sub(r.Start) > maxSpan {
+		return fmt.Errorf("%w: can replay at most %s at a time", ErrInvalidReplay, maxSpan)
+	}
+	_, _, err := r.Area()
+	return err
+}
+
+// CheckReplaySpeed makes sure we can play back at speed
+func CheckReplaySpeed(speed float64) error {
+	if speed <= 0 || speed > MaxReplaySpeed {
+		return fmt.Errorf("%w: speed must be more than 0 and at most %d", ErrInvalidReplay, MaxReplaySpeed)
+	}
+	return nil
+}
+
+// Area is the bounds of the area to replay, and whether to replay every update (high) or only the significant ones
+func (r *Replay) Area() (tile_grid.GlobeIndexSpecialTile, bool, error) {
+	if ("" == r.GridTile) == (nil == r.Bounds) {
+		return tile_grid.GlobeIndexSpecialTile{}, false, fmt.Errorf("%w: needs either a gridTile or bounds", ErrInvalidReplay)
+	}
+	if nil != r.Bounds {
+		b := *r.Bounds
+		if b.North <= b.South || b.North > 90 || b.South < -90 || b.West < -180 || b.West > 180 || b.East < -180 || b.East > 180 || b.West == b.East {
+			return b, false, fmt.Errorf("%w: %w", ErrInvalidReplay, tile_grid.ErrInvalidBounds)
+		}
+		return b, "high" == r.Detail, nil
+	}
+
+	name, high := r.GridTile, false
+	switch {
+	case strings.HasSuffix(name, GridTileSuffixHigh):
+		name, high = strings.TrimSuffix(name, GridTileSuffixHigh), true
+	case strings.HasSuffix(name, GridTileSuffixLow):
+		name = strings.TrimSuffix(name, GridTileSuffixLow)
+	default:
+		return tile_grid.GlobeIndexSpecialTile{}, false, fmt.Errorf("%w: gridTile %s needs a %s or %s suffix", ErrInvalidReplay, r.GridTile, GridTileSuffixLow, GridTileSuffixHigh)
+	}
+	if cell, err := tile_grid.ParseCell(name); nil == err {
+		return cell.Bounds(), high, nil
+	}
+	if b, ok := tile_grid.GetGrid()[name]; ok {
+		return b, high, nil
+	}
+	return tile_grid.GlobeIndexSpecialTile{}, false, fmt.Errorf("%w: unknown gridTile %s", ErrInvalidReplay, r.GridTile)
+}
@@ -0,0 +1,67 @@
+package ws_protocol
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"plane.watch/lib/tile_grid"
+)
+
+func TestReplay_Check(t *testing.T) {
+	now := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	perth := &tile_grid.GlobeIndexSpecialTile{North: -31.5, East: 116.5, South: -32.5, West: 115.5}
+	tests := []struct {
+		name    string
+		replay  Replay
+		wantErr bool
+	}{
+		{"an hour of a tile", Replay{Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour), GridTile: "tile38_low"}, false},
+		{"a cell", Replay{Start: now.Add(-time.Hour), End: now, GridTile: "z6-52-37_high", Speed: 10}, false},
+		{"bounds", Replay{Start: now.Add(-time.Hour), End: now, Bounds: perth}, false},
+		{"no area", Replay{Start: now.Add(-time.Hour), End: now}, true},
+		{"two areas", Replay{Start: now.Add(-time.Hour), End: now, GridTile: "tile38_low", Bounds: perth}, true},
+		{"no speed suffix", Replay{Start: now.Add(-time.Hour), End: now, GridTile: "tile38"}, true},
+		{"unknown tile", Replay{Start: now.Add(-time.Hour), End: now, GridTile: "tile99_low"}, true},
+		{"inside out bounds", Replay{Start: now.Add(-time.Hour), End: now, Bounds: &tile_grid.GlobeIndexSpecialTile{North: -32.5, South: -31.5, East: 116.5, West: 115.5}}, true},
+		{"backwards", Replay{Start: now, End: now.Add(-time.Hour), GridTile: "tile38_low"}, true},
+		{"too long", Replay{Start: now.Add(-7 * time.Hour), End: now, GridTile: "tile38_low"}, true},
+		{"the future", Replay{Start: now.Add(time.Hour), End: now.Add(2 * time.Hour), GridTile: "tile38_low"}, true},
+		{"too fast", Replay{Start: now.Add(-time.Hour), End: now, GridTile: "tile38_low", Speed: MaxReplaySpeed + 1}, true},
+		{"backwards speed", Replay{Start: now.Add(-time.Hour), End: now, GridTile: "tile38_low", Speed: -1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.replay.Check(6*time.Hour, now)
+			if tt.wantErr != (nil != err) {
+				t.Fatalf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if nil != err && !errors.Is(err, ErrInvalidReplay) {
+				t.Errorf("expected an ErrInvalidReplay, got %v", err)
+			}
+			if nil == err && tt.replay.Speed <= 0 {
+				t.Errorf("expected a speed to be filled in, got %f", tt.replay.Speed)
+			}
+		})
+	}
+}
+
+func TestReplay_Area(t *testing.T) {
+	r := Replay{GridTile: "z6-52-37_high"}
+	b, high, err := r.Area()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if !high {
+		t.Error("expected _high to replay every update")
+	}
+	cell := tile_grid.Cell{Z: 6, X: 52, Y: 37}
+	if b != cell.Bounds() {
+		t.Errorf("expected the bounds of the cell, got %+v", b)
+	}
+
+	r = Replay{Bounds: &tile_grid.GlobeIndexSpecialTile{North: 10, East: -170, South: -10, West: 170}}
+	if _, high, err = r.Area(); nil != err || high {
+		t.Errorf("expected bounds across the antimeridian to be low detail by default, got %v %v", high, err)
+	}
+}